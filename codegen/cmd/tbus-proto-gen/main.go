@@ -17,6 +17,7 @@ var (
 	protoDir string
 
 	internal   bool
+	grpc       bool
 	protoFiles []string
 )
 
@@ -29,6 +30,7 @@ func init() {
 	flag.StringVar(&incDirs, "I", "", "include directories, comma-separated")
 	flag.StringVar(&outDir, "out", "", "output directory")
 	flag.StringVar(&protoDir, "from", "", "proto directory")
+	flag.BoolVar(&grpc, "grpc", false, "generate gRPC bridges (go only)")
 }
 
 func protoSuffixSubst(fn, suffix string) string {
@@ -58,6 +60,9 @@ func goProtoc() error {
 	if internal {
 		internalParam = ",internal"
 	}
+	if grpc {
+		internalParam += ",grpc"
+	}
 	return protoc("--tbus_out=go" + internalParam)
 }
 
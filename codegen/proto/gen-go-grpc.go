@@ -0,0 +1,219 @@
+package proto
+
+import (
+	"io"
+	"text/template"
+)
+
+const (
+	goGRPCFileSuffix = "_grpc_bridge.pb.go"
+
+	goGRPCSource = `// Code generated by protoc-gen-tbus. DO NOT EDIT.
+// source: {{.Source}}
+
+package {{.Package}}
+
+import (
+	context "context"
+	time "time"
+
+	empty "github.com/golang/protobuf/ptypes/empty"
+{{- range .Imports}}
+	{{with .Alias}}{{.}} {{end}}"{{.Pkg}}"
+{{- end}}
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = context.Background
+var _ = time.Now
+var _ = (*empty.Empty)(nil)
+var _ = codes.OK
+var _ = status.Code
+{{- $tbus := .PkgPfx}}
+{{- $pkg := .ProtoPkg}}
+{{- $source := .Source}}
+{{range .Classes}}
+{{- $class := .ClassName}}
+// {{$class}}GRPCBridge serves gRPC service {{$pkg}}.{{$class}} by forwarding
+// rpcs to the device through {{$class}}Ctl, and streams to event subscriptions
+type {{$class}}GRPCBridge struct {
+	Ctl *{{$class}}Ctl
+	// EventQueue is the number of events queued for each stream
+	EventQueue int
+}
+
+// New{{$class}}GRPCBridge creates a {{$class}}GRPCBridge
+func New{{$class}}GRPCBridge(ctl *{{$class}}Ctl) *{{$class}}GRPCBridge {
+	return &{{$class}}GRPCBridge{Ctl: ctl, EventQueue: 16}
+}
+
+// Register{{$class}}GRPCBridge registers the bridge as gRPC service {{$pkg}}.{{$class}}
+func Register{{$class}}GRPCBridge(s grpc.ServiceRegistrar, b *{{$class}}GRPCBridge) {
+	s.RegisterService(&{{$class}}GRPCServiceDesc, b)
+}
+
+// {{$class}}GRPCServiceDesc is the descriptor of gRPC service {{$pkg}}.{{$class}}
+var {{$class}}GRPCServiceDesc = grpc.ServiceDesc{
+	ServiceName: "{{$pkg}}.{{$class}}",
+	HandlerType: (*interface{})(nil),
+	Metadata:    "{{$source}}",
+{{- if .Methods}}
+	Methods: []grpc.MethodDesc{
+{{- range .Methods}}
+		{MethodName: "{{.Name}}", Handler: _{{$class}}GRPC{{.Symbol}}Handler},
+{{- end}}
+	},
+{{- end}}
+{{- if .Events}}
+	Streams: []grpc.StreamDesc{
+{{- range .Events}}
+		{StreamName: "{{.Name}}", Handler: _{{$class}}GRPC{{.Symbol}}Handler, ServerStreams: true},
+{{- end}}
+	},
+{{- end}}
+}
+{{range .Methods}}
+// {{.Symbol}} forwards rpc {{$class}}.{{.Name}} to the device
+func (b *{{$class}}GRPCBridge) {{.Symbol}}(ctx context.Context, in *{{or .ParamType "empty.Empty"}}) (*{{or .ReturnType "empty.Empty"}}, error) {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		// a timeout of 0 waits forever, so an expired deadline fails here
+		if timeout = deadline.Sub(time.Now()); timeout <= 0 {
+			return nil, status.Error(codes.DeadlineExceeded, context.DeadlineExceeded.Error())
+		}
+	}
+	invoke := b.Ctl.{{.Symbol}}({{if .ParamType}}in{{end}})
+	if timeout > 0 {
+		invoke.Timeout(timeout)
+	}
+	{{if .ReturnType}}reply, err := invoke.Wait(){{else}}err := invoke.Wait(){{end}}
+	if err != nil {
+		return nil, status.Error(codes.Code({{$tbus}}GRPCCode(err)), err.Error())
+	}
+	return {{if .ReturnType}}reply{{else}}&empty.Empty{}{{end}}, nil
+}
+
+func _{{$class}}GRPC{{.Symbol}}Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &{{or .ParamType "empty.Empty"}}{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	b := srv.(*{{$class}}GRPCBridge)
+	if interceptor == nil {
+		return b.{{.Symbol}}(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/{{$pkg}}.{{$class}}/{{.Name}}"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return b.{{.Symbol}}(ctx, req.(*{{or .ParamType "empty.Empty"}}))
+	})
+}
+{{end}}
+{{- range .Events}}
+// {{.Symbol}} streams events of {{$class}}.{{.Name}} until the client cancels,
+// events are dropped if the client is slower than the queue
+func (b *{{$class}}GRPCBridge) {{.Symbol}}(_ *empty.Empty, stream grpc.ServerStream) error {
+	queue := {{$tbus}}NewEventQueue(b.EventQueue)
+	sub := b.Ctl.Subscribe(Chn{{$class}}{{.Symbol}}ID, queue)
+	defer sub.Close()
+	for {
+		select {
+		case evt := <-queue.C:
+			val := &{{.EventType}}{}
+			if evt.Decode(val) != nil {
+				continue
+			}
+			if err := stream.SendMsg(val); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func _{{$class}}GRPC{{.Symbol}}Handler(srv interface{}, stream grpc.ServerStream) error {
+	in := &empty.Empty{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(*{{$class}}GRPCBridge).{{.Symbol}}(in, stream)
+}
+{{end}}
+{{- if not .Router}}
+// {{$class}}GRPCLogic implements {{$class}}Logic by calling gRPC service
+// {{$pkg}}.{{$class}}, it exposes a gRPC service implementation as a device
+type {{$class}}GRPCLogic struct {
+	{{$tbus}}LogicBase
+	Conn grpc.ClientConnInterface
+}
+
+// New{{$class}}GRPCLogic creates a {{$class}}GRPCLogic, use New{{$class}}Dev to create the device
+func New{{$class}}GRPCLogic(conn grpc.ClientConnInterface) *{{$class}}GRPCLogic {
+	return &{{$class}}GRPCLogic{Conn: conn}
+}
+{{range .Methods}}
+// {{.Symbol}} implements {{$class}}Logic
+func (l *{{$class}}GRPCLogic) {{.Symbol}}({{with .ParamType}}params *{{.}}{{end}}) {{if .ReturnType}}(*{{.ReturnType}}, error){{else}}error{{end}} {
+	return l.{{.Symbol}}Context(context.Background(){{if .ParamType}}, params{{end}})
+}
+
+// {{.Symbol}}Context implements {{$class}}ContextLogic
+func (l *{{$class}}GRPCLogic) {{.Symbol}}Context(ctx context.Context{{with .ParamType}}, params *{{.}}{{end}}) {{if .ReturnType}}(*{{.ReturnType}}, error){{else}}error{{end}} {
+	{{- if not .ParamType}}
+	params := &empty.Empty{}
+	{{- end}}
+	reply := &{{or .ReturnType "empty.Empty"}}{}
+	if err := l.Conn.Invoke(ctx, "/{{$pkg}}.{{$class}}/{{.Name}}", params, reply); err != nil {
+		return {{if .ReturnType}}nil, {{end}}{{$tbus}}GRPCError(uint32(status.Code(err)), status.Convert(err).Message())
+	}
+	return {{if .ReturnType}}reply, {{end}}nil
+}
+{{end}}
+{{- if .Events}}
+// StreamEvents emits events from the gRPC server streams until ctx is done
+// or a stream fails
+func (l *{{$class}}GRPCLogic) StreamEvents(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, {{len .Events}})
+{{- range .Events}}
+	go func() { errCh <- l.stream{{.Symbol}}(ctx) }()
+{{- end}}
+	err := <-errCh
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+{{range $index, $event := .Events}}
+func (l *{{$class}}GRPCLogic) stream{{.Symbol}}(ctx context.Context) error {
+	stream, err := l.Conn.NewStream(ctx, &{{$class}}GRPCServiceDesc.Streams[{{$index}}], "/{{$pkg}}.{{$class}}/{{.Name}}")
+	if err == nil {
+		err = stream.SendMsg(&empty.Empty{})
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	for err == nil {
+		val := &{{.EventType}}{}
+		if err = stream.RecvMsg(val); err == nil {
+			l.EmitEvent(Chn{{$class}}{{.Symbol}}ID, val)
+		}
+	}
+	return err
+}
+{{end}}
+{{- end}}
+{{- end}}{{end -}}
+`
+)
+
+var goGRPCTemplate = template.Must(template.New("grpc").Parse(goGRPCSource))
+
+// generateGRPC generates gRPC bridges of classes in a separate file
+func (g *goGenerator) generateGRPC(ctx *goFile, w io.Writer) error {
+	return goGRPCTemplate.Execute(w, ctx)
+}
@@ -0,0 +1,69 @@
+package proto
+
+import (
+	"bytes"
+	"flag"
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func testGRPCDefFile() *DefFile {
+	return &DefFile{
+		Name:    "demo/lamp.proto",
+		Package: "demo",
+		Options: FileOptions{GoPackage: "github.com/example/demo"},
+		Devices: []*Device{
+			{
+				Name:    "Lamp",
+				ClassID: 0x0100,
+				Methods: []*Method{
+					{Index: 1, Name: "set_power", RequestType: ".demo.Power"},
+					{Index: 2, Name: "get_state", ResponseType: ".demo.LampState"},
+					{Index: 3, Name: "Toggle"},
+				},
+				EventChns: []*EventChannel{
+					{Index: 1, Name: "state", EventType: ".demo.LampState"},
+				},
+			},
+			{
+				Name:    "Switch",
+				ClassID: 0x0101,
+				Methods: []*Method{
+					{Index: 1, Name: "Flip", RequestType: ".demo.Power", ResponseType: ".demo.Power"},
+				},
+			},
+		},
+	}
+}
+
+func TestGenerateGRPC(t *testing.T) {
+	g := &goGenerator{grpc: true}
+	var out bytes.Buffer
+	if err := g.generateGRPC(g.newFile(testGRPCDefFile()), &out); err != nil {
+		t.Fatal(err)
+	}
+	formatted, err := format.Source(out.Bytes())
+	if err != nil {
+		t.Fatalf("generated code doesn't parse: %v\n%s", err, out.String())
+	}
+	if !bytes.Equal(formatted, out.Bytes()) {
+		t.Errorf("generated code isn't gofmt-ed")
+	}
+	golden := filepath.Join("testdata", "lamp_grpc_bridge.pb.go.golden")
+	if *updateGolden {
+		if err = ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, out.Bytes()) {
+		t.Errorf("generated code differs from %s, run with -update if expected:\n%s", golden, out.String())
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 type goGenerator struct {
 	internal bool
+	grpc     bool
 }
 
 func (g *goGenerator) Generate(def *Definition, out Output) error {
@@ -41,8 +42,15 @@ func (g *goGenerator) Generate(def *Definition, out Output) error {
 		if err != nil {
 			return err
 		}
-		err = g.generate(f, gf, w)
+		ctx := g.newFile(f)
+		err = g.generate(ctx, gf, w)
 		w.Close()
+		if err == nil && g.grpc && len(ctx.Classes) > 0 {
+			if w, err = out.GenerateFile(SuffixFileName(f.Name, goGRPCFileSuffix)); err == nil {
+				err = g.generateGRPC(ctx, w)
+				w.Close()
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -54,11 +62,11 @@ const (
 	goGenFileSuffix = ".pb.go"
 	goBadImport     = "\nimport _ \"tbus/common\"\n"
 
-	goDecls = `import "time"
-{{- range .Imports}}
-import {{with .Alias}}{{.}} {{end}}"{{.Pkg}}"
-{{- end}}
-`
+	goDecls = `{{if .HasMethods}}import "context"
+import "time"
+{{end}}{{if .HasEvents}}import "sync"
+{{end}}{{range .Imports}}import {{with .Alias}}{{.}} {{end}}"{{.Pkg}}"
+{{end}}`
 	goSource = `
 //
 // GENERTED FROM {{.Source}}, DO NOT EDIT
@@ -68,6 +76,26 @@ import {{with .Alias}}{{.}} {{end}}"{{.Pkg}}"
 // {{.ClassName}}ClassID is the class ID of {{.ClassName}}
 const {{.ClassName}}ClassID uint32 = {{.ClassID}}
 
+// {{.ClassName}}Class is the registered descriptor of {{.ClassName}}
+var {{.ClassName}}Class = {{$tbus}}RegisterClass(&{{$tbus}}ClassDesc{
+    Name:    "{{.ClassName}}",
+    ClassID: {{.ClassName}}ClassID,
+{{- if .Methods}}
+    Methods: []{{$tbus}}MethodDesc{
+{{- range .Methods}}
+        {Index: {{.Index}}, Name: "{{.Name}}"{{with .ParamMsg}}, ParamType: "{{.}}"{{end}}{{with .ReturnMsg}}, ReplyType: "{{.}}"{{end}}},
+{{- end}}
+    },
+{{- end}}
+{{- if .Events}}
+    Events: []{{$tbus}}EventDesc{
+{{- range .Events}}
+        {Index: {{.Index}}, Name: "{{.Name}}", EventType: "{{.EventMsg}}"},
+{{- end}}
+    },
+{{- end}}
+})
+
 // {{.ClassName}}Logic defines the logic interface
 type {{.ClassName}}Logic interface {
     {{$tbus}}DeviceLogic
@@ -79,6 +107,17 @@ type {{.ClassName}}Logic interface {
 {{- end}}
 }
 
+{{- if .Methods}}
+
+// {{.ClassName}}ContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type {{.ClassName}}ContextLogic interface {
+{{- range .Methods}}
+    {{.Symbol}}Context(context.Context{{with .ParamType}}, *{{.}}{{end}}) {{if .ReturnType}}(*{{.ReturnType}}, error){{else}}error{{end}}
+{{- end}}
+}
+{{- end}}
+
 // {{.ClassName}}Dev is the device
 type {{.ClassName}}Dev struct {
     {{$tbus}}DeviceBase
@@ -102,29 +141,65 @@ func (d *{{.ClassName}}Dev) DispatchMsg(msg *{{$tbus}}Msg) (err error) {
         return d.Reply(msg.Head.MsgID, nil, {{$tbus}}ErrRouteNotSupport)
 {{- end}}
     }
-    var reply proto.Message
+    call := &{{$tbus}}DeviceCall{Device: d, Class: {{.ClassName}}Class, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
     case 0:
-        devInfo := d.DeviceInfo()
-        reply = &devInfo
 {{- range .Methods}}
     case {{.Index}}: // {{.Name}}
         {{- if .ParamType}}
-        params := &{{.ParamType}}{}
-        err = msg.Body.Decode(params)
-        if err == nil {
-            {{if .ReturnType}}reply, {{end}}err = d.Logic.{{.Symbol}}(params)
-        }
-        {{- else}}
-        {{if .ReturnType}}reply, {{end}}err = d.Logic.{{.Symbol}}()
+        call.Params = &{{.ParamType}}{}
         {{- end}}
+{{- end}}
+    default:
+        return d.Reply(msg.Head.MsgID, nil, {{$tbus}}ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *{{.ClassName}}Dev) invoke(call *{{$tbus}}DeviceCall) (err error) {
+{{- if .Methods}}
+    if logic, ok := d.Logic.({{.ClassName}}ContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+{{- end}}
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+{{- range .Methods}}
+    case {{.Index}}: // {{.Name}}
+        {{if .ReturnType}}call.Reply, {{end}}err = d.Logic.{{.Symbol}}({{if .ParamType}}call.Params.(*{{.ParamType}}){{end}})
 {{- end}}
     default:
         err = {{$tbus}}ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
 }
 
+{{- if .Methods}}
+
+func (d *{{.ClassName}}Dev) invokeContext(logic {{.ClassName}}ContextLogic, call *{{$tbus}}DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+{{- range .Methods}}
+    case {{.Index}}: // {{.Name}}
+        {{if .ReturnType}}call.Reply, {{end}}err = logic.{{.Symbol}}Context(call.Context{{if .ParamType}}, call.Params.(*{{.ParamType}}){{end}})
+{{- end}}
+    default:
+        err = {{$tbus}}ErrInvalidMethod
+    }
+    return
+}
+{{- end}}
+
 // SetDeviceID sets device id
 func (d *{{.ClassName}}Dev) SetDeviceID(id uint32) *{{.ClassName}}Dev {
     d.Info.DeviceId = id
@@ -140,6 +215,7 @@ type {{.ClassName}}Ctl struct {
 func New{{.ClassName}}Ctl(master {{$tbus}}Master) *{{.ClassName}}Ctl {
     c := &{{.ClassName}}Ctl{}
     c.Master = master
+    c.Class = {{.ClassName}}Class
     return c
 }
 
@@ -189,25 +265,56 @@ type Chn{{$class.ClassName}}{{.Symbol}} struct {
 	C chan *{{.EventType}}
 
 	subscription {{$tbus}}EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
 }
 
 // HandleEvent implements EventHandler
 func (c *Chn{{$class.ClassName}}{{.Symbol}}) HandleEvent(evt {{$tbus}}Event, _ {{$tbus}}EventSubscription) {
 	val := &{{.EventType}}{}
-	if evt.Decode(val) == nil {
-		c.C <- val
+	if evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.C <- val:
+	case <-c.done:
 	}
 }
 
-// Close implement EventSubscription
+// HandleClose implements EventCloseHandler
+func (c *Chn{{$class.ClassName}}{{.Symbol}}) HandleClose({{$tbus}}EventSubscription) {
+	c.close()
+}
+
+// Close implement EventSubscription, C is closed after events being
+// delivered are dropped
 func (c *Chn{{$class.ClassName}}{{.Symbol}}) Close() error {
-	close(c.C)
-	return c.subscription.Close()
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *Chn{{$class.ClassName}}{{.Symbol}}) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
 }
 
 // {{.Symbol}} wraps class {{$class.ClassName}}
 func (c *{{$class.ClassName}}Ctl) {{.Symbol}}() *Chn{{$class.ClassName}}{{.Symbol}} {
-	chn := &Chn{{$class.ClassName}}{{.Symbol}}{C: make(chan *{{.EventType}})}
+	chn := &Chn{{$class.ClassName}}{{.Symbol}}{C: make(chan *{{.EventType}}), done: make(chan struct{})}
 	chn.subscription = c.Subscribe({{.Index}}, chn)
 	return chn
 }
@@ -243,6 +350,8 @@ type goMethod struct {
 	Symbol     string
 	ParamType  string
 	ReturnType string
+	ParamMsg   string
+	ReturnMsg  string
 }
 
 type goEvent struct {
@@ -250,6 +359,7 @@ type goEvent struct {
 	Name      string
 	Symbol    string
 	EventType string
+	EventMsg  string
 }
 
 type goImport struct {
@@ -258,15 +368,20 @@ type goImport struct {
 }
 
 type goFile struct {
-	Source  string
-	Package string
-	PkgPfx  string
-	Imports []goImport
-	Classes []goClass
+	Source   string
+	Package  string
+	ProtoPkg string
+	PkgPfx   string
+	Imports  []goImport
+	Classes  []goClass
+	// HasMethods imports context and time for invocations
+	HasMethods bool
+	// HasEvents imports sync for event channels
+	HasEvents bool
 }
 
-func (g *goGenerator) generate(f *DefFile, gf *GeneratedFile, w io.Writer) error {
-	ctx := goFile{Source: f.Name, Package: f.Package}
+func (g *goGenerator) newFile(f *DefFile) *goFile {
+	ctx := &goFile{Source: f.Name, Package: f.Package, ProtoPkg: f.Package}
 	if f.Options.GoPackage != "" {
 		ctx.Package = filepath.Base(f.Options.GoPackage)
 	}
@@ -291,6 +406,8 @@ func (g *goGenerator) generate(f *DefFile, gf *GeneratedFile, w io.Writer) error
 				Symbol:     gen.CamelCase(m.Name),
 				ParamType:  m.RequestType,
 				ReturnType: m.ResponseType,
+				ParamMsg:   strings.TrimPrefix(m.RequestType, "."),
+				ReturnMsg:  strings.TrimPrefix(m.ResponseType, "."),
 			}
 			mtd.ParamType = g.fixTypeName(f.Package, mtd.ParamType)
 			mtd.ReturnType = g.fixTypeName(f.Package, mtd.ReturnType)
@@ -302,19 +419,29 @@ func (g *goGenerator) generate(f *DefFile, gf *GeneratedFile, w io.Writer) error
 				Name:      c.Name,
 				Symbol:    gen.CamelCase(c.Name),
 				EventType: g.fixTypeName(f.Package, c.EventType),
+				EventMsg:  strings.TrimPrefix(c.EventType, "."),
 			}
 			cls.Events = append(cls.Events, chn)
 		}
+		if len(cls.Methods) > 0 {
+			ctx.HasMethods = true
+		}
+		if len(cls.Events) > 0 {
+			ctx.HasEvents = true
+		}
 		ctx.Classes = append(ctx.Classes, cls)
 	}
+	return ctx
+}
 
+func (g *goGenerator) generate(ctx *goFile, gf *GeneratedFile, w io.Writer) error {
 	content := *gf.Content
 	firstImport := strings.Index(content, "\nimport ")
 	if firstImport > 0 {
 		if _, err := io.WriteString(w, content[0:firstImport+1]); err != nil {
 			return err
 		}
-		if err := goDeclsTemplate.Execute(w, &ctx); err != nil {
+		if err := goDeclsTemplate.Execute(w, ctx); err != nil {
 			return err
 		}
 		if _, err := io.WriteString(w, content[firstImport+1:]); err != nil {
@@ -324,7 +451,7 @@ func (g *goGenerator) generate(f *DefFile, gf *GeneratedFile, w io.Writer) error
 		return err
 	}
 
-	return goSourceTemplate.Execute(w, &ctx)
+	return goSourceTemplate.Execute(w, ctx)
 }
 
 func (g *goGenerator) fixTypeName(pkgName, typeName string) string {
@@ -340,8 +467,11 @@ func (g *goGenerator) fixTypeName(pkgName, typeName string) string {
 func NewGoGenerator(args []string) (Generator, error) {
 	g := &goGenerator{}
 	for _, arg := range args {
-		if arg == "internal" {
+		switch arg {
+		case "internal":
 			g.internal = true
+		case "grpc":
+			g.grpc = true
 		}
 	}
 	return g, nil
@@ -0,0 +1,74 @@
+package proto
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// unusedImports returns imports not referenced by the source
+func unusedImports(t *testing.T, src []byte) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		t.Fatalf("generated code doesn't parse: %v\n%s", err, src)
+	}
+	used := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+		}
+		return true
+	})
+	var unused []string
+	for _, spec := range file.Imports {
+		pkg, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(pkg)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name != "_" && !used[name] {
+			unused = append(unused, pkg)
+		}
+	}
+	return unused
+}
+
+func TestGenerateImports(t *testing.T) {
+	head := "package demo\n\nimport proto \"github.com/golang/protobuf/proto\"\n\nvar _ = proto.Marshal\n"
+	devices := map[string]*Device{
+		"events only": {
+			Name:    "Sensor",
+			ClassID: 0x0102,
+			EventChns: []*EventChannel{
+				{Index: 1, Name: "reading", EventType: ".demo.Reading"},
+			},
+		},
+		"methods only": {
+			Name:    "Lamp",
+			ClassID: 0x0100,
+			Methods: []*Method{
+				{Index: 1, Name: "set_power", RequestType: ".demo.Power"},
+			},
+		},
+	}
+	for name, dev := range devices {
+		for _, internal := range []bool{true, false} {
+			g := &goGenerator{internal: internal}
+			f := &DefFile{Name: "demo/demo.proto", Package: "demo", Devices: []*Device{dev}}
+			content := head
+			var out bytes.Buffer
+			if err := g.generate(g.newFile(f), &GeneratedFile{Content: &content}, &out); err != nil {
+				t.Fatal(err)
+			}
+			if unused := unusedImports(t, out.Bytes()); len(unused) > 0 {
+				t.Errorf("%s (internal %v): unused imports %v\n%s", name, internal, unused, out.String())
+			}
+		}
+	}
+}
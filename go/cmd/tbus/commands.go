@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	tbus "github.com/robotalks/tbus/go/tbus"
+)
+
+func parseAddr(args []string, index int) (tbus.RouteAddr, error) {
+	if index >= len(args) {
+		return nil, nil
+	}
+	return tbus.ParseRouteAddr(args[index])
+}
+
+func splitMember(str string) (class *tbus.ClassDesc, member string, err error) {
+	pos := strings.LastIndex(str, ".")
+	if pos <= 0 || pos == len(str)-1 {
+		return nil, "", fmt.Errorf("invalid %s, expect Class.Member", str)
+	}
+	if class = tbus.ClassByName(str[:pos]); class == nil {
+		return nil, "", fmt.Errorf("%v %s", tbus.ErrUnknownClass, str[:pos])
+	}
+	return class, str[pos+1:], nil
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	strs := make([]string, len(keys))
+	for n, k := range keys {
+		strs[n] = k + "=" + labels[k]
+	}
+	return strings.Join(strs, ",")
+}
+
+func printDevice(addrs tbus.RouteAddr, info *tbus.DeviceInfo, depth int) {
+	fmt.Printf("%s%-12s %-10s id=%d",
+		strings.Repeat("  ", depth),
+		addrs.String(),
+		tbus.ClassName(info.ClassId),
+		info.DeviceId)
+	if len(info.Labels) > 0 {
+		fmt.Printf(" %s", formatLabels(info.Labels))
+	}
+	fmt.Println()
+}
+
+func printTree(master tbus.Master, addrs tbus.RouteAddr, depth int) error {
+	enum, err := tbus.NewBusCtl(master).SetAddress(addrs).Enumerate().Wait()
+	if err != nil {
+		return err
+	}
+	for _, info := range enum.Devices {
+		devAddrs := append(append(tbus.RouteAddr{}, addrs...), uint8(info.Address))
+		printDevice(devAddrs, info, depth)
+		if info.ClassId == tbus.BusClassID {
+			if err = printTree(master, devAddrs, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func runTree(master *tbus.LocalMaster, args []string) error {
+	addrs, err := parseAddr(args, 0)
+	if err != nil {
+		return err
+	}
+	info, err := tbus.NewBusCtl(master).SetAddress(addrs).DeviceInfo()
+	if err != nil {
+		return err
+	}
+	printDevice(addrs, &info, 0)
+	if info.ClassId != tbus.BusClassID {
+		return nil
+	}
+	return printTree(master, addrs, 1)
+}
+
+func runCall(master *tbus.LocalMaster, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: call ADDR Class.Method [JSON]")
+	}
+	addrs, err := parseAddr(args, 0)
+	if err != nil {
+		return err
+	}
+	class, method, err := splitMember(args[1])
+	if err != nil {
+		return err
+	}
+	var params []byte
+	if len(args) > 2 {
+		params = []byte(args[2])
+	}
+	start := time.Now()
+	reply, err := tbus.NewDynamicCtl(master, addrs, class).CallJSON(method, params).WaitJSON()
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(reply))
+	fmt.Fprintf(os.Stderr, "latency %v\n", elapsed)
+	return nil
+}
+
+func runWatch(master *tbus.LocalMaster, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: watch ADDR Class.Channel")
+	}
+	addrs, err := parseAddr(args, 0)
+	if err != nil {
+		return err
+	}
+	class, channel, err := splitMember(args[1])
+	if err != nil {
+		return err
+	}
+	chn, err := tbus.NewDynamicCtl(master, addrs, class).Watch(channel)
+	if err != nil {
+		return err
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	for {
+		select {
+		case evt, ok := <-chn.C:
+			if !ok {
+				// closed with the master
+				return tbus.ErrMasterClosed
+			}
+			encoded, err := evt.JSON()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s %s\n", time.Now().Format(time.RFC3339Nano), evt.Address, encoded)
+		case <-sigCh:
+			return nil
+		}
+	}
+}
+
+func runPing(master *tbus.LocalMaster, args []string) error {
+	flags := flag.NewFlagSet("ping", flag.ContinueOnError)
+	count := flags.Int("n", 4, "number of invocations")
+	interval := flags.Duration("i", time.Second, "interval between invocations")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	addrs, err := parseAddr(flags.Args(), 0)
+	if err != nil {
+		return err
+	}
+	ctl := tbus.NewDynamicCtl(master, addrs, nil)
+	var total, min, max time.Duration
+	succeeded := 0
+	for n := 0; n < *count; n++ {
+		if n > 0 {
+			time.Sleep(*interval)
+		}
+		start := time.Now()
+		_, err := ctl.DeviceInfo()
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Printf("%s seq=%d error: %v\n", addrs, n, err)
+			continue
+		}
+		fmt.Printf("%s seq=%d time=%v\n", addrs, n, elapsed)
+		if succeeded == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+		total += elapsed
+		succeeded++
+	}
+	fmt.Printf("%d invoked, %d succeeded", *count, succeeded)
+	if succeeded > 0 {
+		fmt.Printf(", min/avg/max = %v/%v/%v", min, total/time.Duration(succeeded), max)
+	}
+	fmt.Println()
+	return nil
+}
+
+func runGateway(master *tbus.LocalMaster, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: gateway HOST:PORT")
+	}
+	gateway := tbus.NewGateway(master)
+	gateway.Timeout = timeout
+	fmt.Fprintf(os.Stderr, "serving http://%s/devices\n", args[0])
+	return http.ListenAndServe(args[0], gateway)
+}
+
+func runMQTT(master *tbus.LocalMaster, args []string) error {
+	flags := flag.NewFlagSet("mqtt", flag.ContinueOnError)
+	prefix := flags.String("prefix", tbus.DefaultMQTTPrefix, "first level of topics")
+	clientID := flags.String("client-id", "tbus", "MQTT client id")
+	username := flags.String("user", "", "MQTT username")
+	password := flags.String("password", "", "MQTT password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: mqtt [OPTIONS] HOST:PORT")
+	}
+	client, err := tbus.DialMQTT(flags.Arg(0), tbus.MQTTOptions{
+		ClientID: *clientID,
+		Username: *username,
+		Password: *password,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	bridge := tbus.NewMQTTBridge(master, client)
+	bridge.Prefix = *prefix
+	bridge.Timeout = timeout
+	if err = bridge.Start(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "bridging to mqtt://%s/%s\n", flags.Arg(0), *prefix)
+	<-bridge.Done()
+	return client.Err()
+}
+
+func runClasses(_ *tbus.LocalMaster, _ []string) error {
+	for _, class := range tbus.Classes() {
+		fmt.Printf("0x%04x %s\n", class.ClassID, class.Name)
+		for _, m := range class.Methods {
+			fmt.Printf("  %d %s(%s) %s\n", m.Index, m.Name, m.ParamType, m.ReplyType)
+		}
+		for _, e := range class.Events {
+			fmt.Printf("  %d %s -> %s\n", e.Index, e.Name, e.EventType)
+		}
+	}
+	return nil
+}
+
+func runDecode(_ *tbus.LocalMaster, args []string) error {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	route := flags.String("route", "", "only messages to/from the address or its subtree")
+	member := flags.String("member", "", "only messages of method or event, as Class.Name or Name")
+	kind := flags.String("kind", "", "only messages of kind: attach, request, reply, event")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: decode [OPTIONS] FILE")
+	}
+	var routeFilter tbus.RouteAddr
+	if *route != "" {
+		var err error
+		if routeFilter, err = tbus.ParseRouteAddr(*route); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := tbus.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+	annotator := tbus.NewAnnotator()
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ann := annotator.Annotate(rec)
+		if *route != "" && !bytes.HasPrefix(ann.Route, routeFilter) {
+			continue
+		}
+		if *member != "" && ann.Member() != *member && ann.Name != *member {
+			continue
+		}
+		if *kind != "" && ann.Kind != *kind {
+			continue
+		}
+		fmt.Println(ann.String())
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	tbus "github.com/robotalks/tbus/go/tbus"
+)
+
+// endpoint is parsed from URL like tcp://host:port, tls://host:port,
+// ws://host:port/path, udp://host:port, unix:///path, serial:///dev/tty
+type endpoint struct {
+	scheme  string
+	address string
+}
+
+func parseEndpoint(str string) (*endpoint, error) {
+	pos := strings.Index(str, "://")
+	if pos <= 0 {
+		// default to TCP
+		return &endpoint{scheme: "tcp", address: str}, nil
+	}
+	ep := &endpoint{scheme: str[:pos], address: str[pos+3:]}
+	switch ep.scheme {
+	case "tcp", "tls", "ws", "wss", "udp", "unix", "serial":
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", ep.scheme)
+	}
+	if ep.address == "" {
+		return nil, fmt.Errorf("missing address in %s", str)
+	}
+	return ep, nil
+}
+
+func (e *endpoint) dial() (io.ReadWriteCloser, error) {
+	switch e.scheme {
+	case "serial":
+		cfg, err := tbus.ParseSerialConfig(serialLine)
+		if err != nil {
+			return nil, err
+		}
+		return (&tbus.SerialDialer{Device: e.address, Config: cfg}).Dial()
+	case "tls":
+		config, err := tlsConfig(false)
+		if err != nil {
+			return nil, err
+		}
+		return tbus.TLSDialer("tcp", e.address, config).Dial()
+	case "ws", "wss":
+		dialer := &tbus.WSDialer{URL: e.scheme + "://" + e.address}
+		if e.scheme == "wss" {
+			config, err := tlsConfig(false)
+			if err != nil {
+				return nil, err
+			}
+			dialer.TLSConfig = config
+		}
+		return dialer.Dial()
+	case "udp":
+		return (&tbus.PacketDialer{Address: e.address, Options: packetOptions()}).Dial()
+	}
+	return net.Dial(e.scheme, e.address)
+}
+
+func (e *endpoint) listen() (tbus.Listener, error) {
+	if e.scheme == "serial" {
+		// waits for the device to appear
+		cfg, err := tbus.ParseSerialConfig(serialLine)
+		if err != nil {
+			return nil, err
+		}
+		return tbus.NewSerialListener(e.address, cfg), nil
+	}
+	if e.scheme == "tls" {
+		config, err := tlsConfig(true)
+		if err != nil {
+			return nil, err
+		}
+		return tbus.ListenTLS("tcp", e.address, config)
+	}
+	if e.scheme == "ws" || e.scheme == "wss" {
+		return e.listenWS()
+	}
+	if e.scheme == "udp" {
+		return tbus.ListenPacket("udp", e.address, packetOptions())
+	}
+	listener, err := net.Listen(e.scheme, e.address)
+	if err != nil {
+		return nil, err
+	}
+	return tbus.NetListener(listener), nil
+}
+
+// listenWS serves WebSocket on the path of address, like host:port/path
+func (e *endpoint) listenWS() (tbus.Listener, error) {
+	hostPort, path := e.address, "/"
+	if pos := strings.Index(hostPort, "/"); pos >= 0 {
+		hostPort, path = hostPort[:pos], hostPort[pos:]
+	}
+	var listener net.Listener
+	var err error
+	if e.scheme == "wss" {
+		var config *tls.Config
+		if config, err = tlsConfig(true); err != nil {
+			return nil, err
+		}
+		listener, err = tls.Listen("tcp", hostPort, config)
+	} else {
+		listener, err = net.Listen("tcp", hostPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws := tbus.NewWSListener()
+	mux := http.NewServeMux()
+	mux.Handle(path, ws)
+	go http.Serve(listener, mux)
+	return &wsListener{WSListener: ws, listener: listener}, nil
+}
+
+// wsListener closes the http listener together with WSListener
+type wsListener struct {
+	*tbus.WSListener
+	listener net.Listener
+}
+
+func (l *wsListener) Close() error {
+	l.WSListener.Close()
+	return l.listener.Close()
+}
+
+// packetOptions builds udp options, the CLI is the master side
+func packetOptions() tbus.PacketOptions {
+	return tbus.PacketOptions{Retransmit: retransmit}
+}
+
+// tlsConfig builds TLS config from -tls-* flags, with -tls-ca the peer
+// is verified against it, for server it enables mutual TLS
+func tlsConfig(server bool) (*tls.Config, error) {
+	var cert *tls.Certificate
+	if tlsCertFile != "" {
+		loaded, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert = &loaded
+	}
+	var err error
+	var pool *x509.CertPool
+	if tlsCAFile != "" {
+		if pool, err = tbus.LoadCertPool(tlsCAFile); err != nil {
+			return nil, err
+		}
+	}
+	if server {
+		if cert == nil {
+			return nil, fmt.Errorf("-tls-cert is required to listen on tls")
+		}
+		return tbus.ServerTLSConfig(*cert, pool), nil
+	}
+	return tbus.ClientTLSConfig(cert, pool, ""), nil
+}
+
+// connectDevice connects to the bus and returns the remote device,
+// traffic is tapped if tapper is not nil
+func connectDevice(tapper tbus.Tapper) (tbus.RemoteDevice, error) {
+	if listenAddr != "" {
+		ep, err := parseEndpoint(listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		listener, err := ep.listen()
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+		if tapper != nil {
+			listener = &tbus.TapListener{Listener: listener, ReadDir: tbus.CaptureUp, Tapper: tapper}
+		}
+		host := tbus.NewRemoteDeviceHost(listener)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- host.Run()
+		}()
+		select {
+		case dev := <-host.AcceptChan():
+			return dev, nil
+		case err = <-errCh:
+			if err == nil {
+				err = fmt.Errorf("listener closed")
+			}
+			return nil, err
+		}
+	}
+	ep, err := parseEndpoint(connectAddr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer tbus.Dialer = tbus.DialerFunc(ep.dial)
+	if tapper != nil {
+		dialer = &tbus.TapDialer{Dialer: dialer, ReadDir: tbus.CaptureUp, Tapper: tapper}
+	}
+	return tbus.DialRemoteDevice(dialer)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// textLogger writes logs as key=value lines
+type textLogger struct {
+	w     io.Writer
+	level int
+	lock  sync.Mutex
+}
+
+func newTextLogger(w io.Writer, level string) (*textLogger, error) {
+	for n, name := range logLevels {
+		if strings.EqualFold(name, level) {
+			return &textLogger{w: w, level: n}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid log level %s", level)
+}
+
+func (l *textLogger) Debug(msg string, args ...interface{}) { l.log(0, msg, args) }
+func (l *textLogger) Info(msg string, args ...interface{})  { l.log(1, msg, args) }
+func (l *textLogger) Warn(msg string, args ...interface{})  { l.log(2, msg, args) }
+func (l *textLogger) Error(msg string, args ...interface{}) { l.log(3, msg, args) }
+
+func (l *textLogger) log(level int, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%s level=%s msg=%q",
+		time.Now().Format(time.RFC3339Nano), strings.ToUpper(logLevels[level]), msg)
+	for n := 0; n < len(args); n += 2 {
+		var val interface{} = "!MISSING"
+		if n+1 < len(args) {
+			val = args[n+1]
+		}
+		str := fmt.Sprint(val)
+		if strings.ContainsAny(str, " \"=") {
+			str = fmt.Sprintf("%q", str)
+		}
+		fmt.Fprintf(&buf, " %v=%s", args[n], str)
+	}
+	buf.WriteByte('\n')
+	l.lock.Lock()
+	buf.WriteTo(l.w)
+	l.lock.Unlock()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	tbus "github.com/robotalks/tbus/go/tbus"
+)
+
+var (
+	connectAddr string
+	listenAddr  string
+	captureFile string
+	metricsAddr string
+	traceSpans  bool
+	logLevel    string
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsCAFile   string
+	retransmit  time.Duration
+	serialLine  string
+	timeout     time.Duration
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(master *tbus.LocalMaster, args []string) error
+	// offline commands don't connect to bus
+	offline bool
+}
+
+var commands = []*command{
+	{name: "tree", usage: "tree [ADDR]", run: runTree},
+	{name: "call", usage: "call ADDR Class.Method [JSON]", run: runCall},
+	{name: "watch", usage: "watch ADDR Class.Channel", run: runWatch},
+	{name: "ping", usage: "ping [-n COUNT] [ADDR]", run: runPing},
+	{name: "gateway", usage: "gateway HOST:PORT", run: runGateway},
+	{name: "mqtt", usage: "mqtt [-prefix PREFIX] [-client-id ID] [-user USER -password PASS] HOST:PORT", run: runMQTT},
+	{name: "classes", usage: "classes", run: runClasses, offline: true},
+	{name: "decode", usage: "decode [-route ADDR] [-member Class.Name] [-kind KIND] FILE", run: runDecode, offline: true},
+}
+
+func init() {
+	flag.StringVar(&connectAddr, "connect", "", "connect to bus: tcp://host:port, tls://host:port, ws://host:port/path, udp://host:port, unix:///path, serial:///dev/tty")
+	flag.StringVar(&listenAddr, "listen", "", "wait for bus to connect: tcp://host:port, tls://host:port, ws://host:port/path, udp://host:port, unix:///path, serial:///dev/tty")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate for tls")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key of -tls-cert")
+	flag.StringVar(&tlsCAFile, "tls-ca", "", "PEM CA certificates to verify tls peer, enables mutual TLS when listening")
+	flag.DurationVar(&retransmit, "retransmit", 0, "retransmit unreplied invocations over udp after the duration")
+	flag.StringVar(&serialLine, "serial", "115200,8N1", "serial line config: baud,8N1[,rtscts|xonxoff][,framed]")
+	flag.StringVar(&captureFile, "capture", "", "capture bus traffic into file")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve metrics in Prometheus text format on host:port")
+	flag.BoolVar(&traceSpans, "trace", false, "trace invocations and print spans to stderr")
+	flag.StringVar(&logLevel, "log", "", "log to stderr at level: debug, info, warn, error")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "invocation timeout")
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] COMMAND [ARGS]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func run() error {
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd := findCommand(flag.Arg(0))
+	if cmd == nil {
+		return fmt.Errorf("unknown command %s", flag.Arg(0))
+	}
+	if cmd.offline {
+		return cmd.run(nil, flag.Args()[1:])
+	}
+	if connectAddr == "" && listenAddr == "" {
+		return fmt.Errorf("either -connect or -listen is required")
+	}
+
+	if metricsAddr != "" {
+		registry := tbus.NewMetricsRegistry()
+		tbus.SetMetrics(registry)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}()
+	}
+
+	if logLevel != "" {
+		logger, err := newTextLogger(os.Stderr, logLevel)
+		if err != nil {
+			return err
+		}
+		tbus.SetLogger(logger)
+	}
+
+	if traceSpans {
+		tbus.SetTracer(tbus.NewTracer(tbus.NewWriterExporter(os.Stderr)))
+	}
+
+	var tapper tbus.Tapper
+	if captureFile != "" {
+		f, err := os.Create(captureFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w, err := tbus.NewCaptureWriter(f)
+		if err != nil {
+			return err
+		}
+		tapper = w
+	}
+
+	dev, err := connectDevice(tapper)
+	if err != nil {
+		return err
+	}
+	defer dev.Close(context.Background())
+	master := tbus.NewLocalMaster(dev)
+	master.InvocationTimeout = timeout
+	go dev.Run()
+
+	return cmd.run(master, flag.Args()[1:])
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
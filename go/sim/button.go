@@ -0,0 +1,67 @@
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// Button simulates a push button, state changes are emitted as events
+// when the device is attached to a bus
+type Button struct {
+	tbus.LogicBase
+	// Clock is used by Click, nil uses system time
+	Clock tbus.Clock
+
+	pressed bool
+	lock    sync.Mutex
+}
+
+// NewButton creates a simulated button
+func NewButton() *Button {
+	return &Button{}
+}
+
+// GetState implements ButtonLogic
+func (b *Button) GetState() (*tbus.ButtonState, error) {
+	return &tbus.ButtonState{Pressed: b.Pressed()}, nil
+}
+
+// Pressed returns current state
+func (b *Button) Pressed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.pressed
+}
+
+// SetPressed changes the state and emits the event if state changes
+func (b *Button) SetPressed(pressed bool) error {
+	b.lock.Lock()
+	changed := b.pressed != pressed
+	b.pressed = pressed
+	b.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	return emitEvent(&b.LogicBase, tbus.ChnButtonStateID, &tbus.ButtonState{Pressed: pressed})
+}
+
+// Press presses the button
+func (b *Button) Press() error {
+	return b.SetPressed(true)
+}
+
+// Release releases the button
+func (b *Button) Release() error {
+	return b.SetPressed(false)
+}
+
+// Click presses and releases the button after duration
+func (b *Button) Click(duration time.Duration) error {
+	if err := b.Press(); err != nil {
+		return err
+	}
+	tbus.ClockOrSystem(b.Clock).Sleep(duration)
+	return b.Release()
+}
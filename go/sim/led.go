@@ -0,0 +1,84 @@
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// LEDChange is a recorded LED state change
+type LEDChange struct {
+	Time time.Time
+	On   bool
+}
+
+// LED simulates an LED and records the history of states
+type LED struct {
+	tbus.LogicBase
+	// Clock is used to timestamp history, nil uses system time
+	Clock tbus.Clock
+
+	on      bool
+	history []LEDChange
+	changes notifier
+	lock    sync.Mutex
+}
+
+// NewLED creates a simulated LED
+func NewLED() *LED {
+	return &LED{}
+}
+
+// SetPowerState implements LEDLogic, every request is recorded
+// even if the state doesn't change
+func (l *LED) SetPowerState(state *tbus.LEDPowerState) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.on = state.On
+	l.history = append(l.history, LEDChange{Time: tbus.ClockOrSystem(l.Clock).Now(), On: state.On})
+	l.changes.notify()
+	return nil
+}
+
+// IsOn returns current state
+func (l *LED) IsOn() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.on
+}
+
+// History returns recorded state changes
+func (l *LED) History() []LEDChange {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]LEDChange(nil), l.history...)
+}
+
+// Toggles returns the number of times the state actually changed
+func (l *LED) Toggles() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count, on := 0, false
+	for _, c := range l.history {
+		if c.On != on {
+			count++
+			on = c.On
+		}
+	}
+	return count
+}
+
+// Reset clears the history
+func (l *LED) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.history = nil
+}
+
+// WaitOn waits until the LED is in the specified state
+func (l *LED) WaitOn(on bool, timeout time.Duration) bool {
+	return waitUntil(l.Clock, timeout, &l.changes, func() bool {
+		return l.IsOn() == on
+	})
+}
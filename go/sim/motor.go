@@ -0,0 +1,134 @@
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// Motor defaults
+const (
+	DefaultMotorMaxSpeed          = 100
+	DefaultMotorAcceleration      = 500
+	DefaultMotorDeceleration      = 250
+	DefaultMotorBrakeDeceleration = 2000
+)
+
+// Motor simulates a DC motor, speed ramps towards the commanded speed
+// instead of changing immediately. Speed is signed, negative is reverse.
+type Motor struct {
+	tbus.LogicBase
+	// Clock drives the simulation, nil uses system time
+	Clock tbus.Clock
+	// MaxSpeed clamps commanded speed
+	MaxSpeed uint32
+	// Acceleration is the speed change per second when started
+	Acceleration float64
+	// Deceleration is the speed change per second when coasting to stop
+	Deceleration float64
+	// BrakeDeceleration is the speed change per second when braking
+	BrakeDeceleration float64
+
+	speed   ramp
+	braking bool
+	changes notifier
+	lock    sync.Mutex
+}
+
+// NewMotor creates a simulated motor with default parameters
+func NewMotor() *Motor {
+	return &Motor{
+		MaxSpeed:          DefaultMotorMaxSpeed,
+		Acceleration:      DefaultMotorAcceleration,
+		Deceleration:      DefaultMotorDeceleration,
+		BrakeDeceleration: DefaultMotorBrakeDeceleration,
+	}
+}
+
+// Start implements MotorLogic, it also releases the brake
+func (m *Motor) Start(state *tbus.MotorDriveState) error {
+	speed := state.Speed
+	if m.MaxSpeed > 0 && speed > m.MaxSpeed {
+		speed = m.MaxSpeed
+	}
+	target := float64(speed)
+	if state.Direction == tbus.MotorDriveState_Rev {
+		target = -target
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.braking = false
+	m.speed.set(m.now(), target, m.Acceleration)
+	m.changes.notify()
+	return nil
+}
+
+// Stop implements MotorLogic, the motor coasts to stop
+func (m *Motor) Stop() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rate := m.Deceleration
+	if m.braking {
+		rate = m.BrakeDeceleration
+	}
+	m.speed.set(m.now(), 0, rate)
+	m.changes.notify()
+	return nil
+}
+
+// Brake implements MotorLogic
+func (m *Motor) Brake(state *tbus.MotorBrakeState) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.braking = state.On
+	if m.braking {
+		m.speed.set(m.now(), 0, m.BrakeDeceleration)
+	} else if m.speed.target == 0 {
+		m.speed.set(m.now(), 0, m.Deceleration)
+	}
+	m.changes.notify()
+	return nil
+}
+
+func (m *Motor) now() time.Time {
+	return tbus.ClockOrSystem(m.Clock).Now()
+}
+
+// Speed returns current signed speed
+func (m *Motor) Speed() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.speed.at(m.now())
+}
+
+func (m *Motor) speedAt(t time.Time) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.speed.at(t)
+}
+
+// Target returns the signed speed the motor is ramping to
+func (m *Motor) Target() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.speed.target
+}
+
+// Braking returns true if brake is on
+func (m *Motor) Braking() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.braking
+}
+
+// Stopped returns true if the motor is not moving
+func (m *Motor) Stopped() bool {
+	return m.Speed() == 0
+}
+
+// WaitSpeed waits until the motor reaches or passes the signed speed,
+// it returns false on timeout
+func (m *Motor) WaitSpeed(speed float64, timeout time.Duration) bool {
+	return waitValue(m.Clock, timeout, &m.changes, speed, m.Speed)
+}
@@ -0,0 +1,278 @@
+package sim
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// Names of robot devices, set as label "name" in device info
+const (
+	RobotLeftMotor    = "left-motor"
+	RobotRightMotor   = "right-motor"
+	RobotLeftEncoder  = "left-encoder"
+	RobotRightEncoder = "right-encoder"
+	RobotIMU          = "imu"
+	RobotBumper       = "bumper"
+	RobotPoseSensor   = "pose"
+)
+
+// Arena is a rectangle area bounded by walls
+type Arena struct {
+	MinX, MinY float64
+	MaxX, MaxY float64
+}
+
+// RobotConfig defines the robot
+type RobotConfig struct {
+	// WheelBase is the distance between wheels in meters
+	WheelBase float64
+	// SpeedScale converts motor speed to wheel velocity in m/s
+	SpeedScale float64
+	// TicksPerMeter is the encoder resolution
+	TicksPerMeter float64
+	// StepInterval is the integration interval
+	StepInterval time.Duration
+	// Optional devices
+	Encoders   bool
+	IMU        bool
+	Bumper     bool
+	PoseSensor bool
+	// Arena bounds the robot, bumper is pressed when hitting a wall,
+	// nil for unbounded
+	Arena *Arena
+	// Clock drives the simulation, nil uses system time
+	Clock tbus.Clock
+}
+
+// DefaultRobotConfig returns a config with all devices
+func DefaultRobotConfig() RobotConfig {
+	return RobotConfig{
+		WheelBase:     0.15,
+		SpeedScale:    0.005,
+		TicksPerMeter: 1000,
+		StepInterval:  10 * time.Millisecond,
+		Encoders:      true,
+		IMU:           true,
+		Bumper:        true,
+		PoseSensor:    true,
+	}
+}
+
+// Robot simulates a differential-drive robot on a LocalBus,
+// the pose is integrated from motor speeds when stepped
+type Robot struct {
+	Config RobotConfig
+	Bus    *tbus.LocalBus
+
+	Left, Right               *Motor
+	LeftEncoder, RightEncoder *Encoder
+	IMU                       *IMU
+	Bumper                    *Button
+	PoseSensor                *PoseSensor
+
+	devices  map[string]tbus.Device
+	pose     tbus.Pose2D
+	velocity float64
+	last     time.Time
+	lock     sync.Mutex
+}
+
+// NewRobot creates a robot with devices plugged into a new bus
+func NewRobot(config RobotConfig) *Robot {
+	r := &Robot{
+		Config:  config,
+		Bus:     tbus.NewLocalBus(),
+		devices: make(map[string]tbus.Device),
+	}
+	r.Left, r.Right = NewMotor(), NewMotor()
+	r.Left.Clock, r.Right.Clock = config.Clock, config.Clock
+	left, right := tbus.NewMotorDev(r.Left), tbus.NewMotorDev(r.Right)
+	r.plug(RobotLeftMotor, left, &left.Info)
+	r.plug(RobotRightMotor, right, &right.Info)
+	if config.Encoders {
+		r.LeftEncoder, r.RightEncoder = NewEncoder(), NewEncoder()
+		left, right := tbus.NewEncoderDev(r.LeftEncoder), tbus.NewEncoderDev(r.RightEncoder)
+		r.plug(RobotLeftEncoder, left, &left.Info)
+		r.plug(RobotRightEncoder, right, &right.Info)
+	}
+	if config.IMU {
+		r.IMU = NewIMU()
+		dev := tbus.NewIMUDev(r.IMU)
+		r.plug(RobotIMU, dev, &dev.Info)
+	}
+	if config.Bumper {
+		r.Bumper = NewButton()
+		dev := tbus.NewButtonDev(r.Bumper)
+		r.plug(RobotBumper, dev, &dev.Info)
+	}
+	if config.PoseSensor {
+		r.PoseSensor = NewPoseSensor()
+		dev := tbus.NewPoseSensorDev(r.PoseSensor)
+		r.plug(RobotPoseSensor, dev, &dev.Info)
+	}
+	r.last = tbus.ClockOrSystem(config.Clock).Now()
+	return r
+}
+
+func (r *Robot) plug(name string, dev tbus.Device, info *tbus.DeviceInfo) {
+	info.AddLabel("name", name)
+	r.Bus.Plug(dev)
+	r.devices[name] = dev
+}
+
+// Device returns the device by name
+func (r *Robot) Device(name string) tbus.Device {
+	return r.devices[name]
+}
+
+// Address returns the address of device by name on the robot bus
+func (r *Robot) Address(name string) tbus.RouteAddr {
+	if dev := r.devices[name]; dev != nil {
+		return tbus.DeviceAddress(dev)
+	}
+	return nil
+}
+
+// Pose returns current pose
+func (r *Robot) Pose() tbus.Pose2D {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pose
+}
+
+// SetPose places the robot
+func (r *Robot) SetPose(pose tbus.Pose2D) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pose = pose
+}
+
+// Step integrates the pose up to current time and updates sensors
+func (r *Robot) Step() error {
+	r.lock.Lock()
+	now := tbus.ClockOrSystem(r.Config.Clock).Now()
+	elapsed := now.Sub(r.last)
+	if elapsed <= 0 {
+		r.lock.Unlock()
+		return nil
+	}
+	interval := r.Config.StepInterval
+	if interval <= 0 {
+		interval = elapsed
+	}
+	var distLeft, distRight, vl, vr, w float64
+	hit, touching := false, false
+	for r.last.Before(now) {
+		dt := now.Sub(r.last)
+		if dt > interval {
+			dt = interval
+		}
+		// motor speeds ramp linearly, sampling at the middle is exact
+		// as long as ramp changes fall on step boundaries
+		mid := r.last.Add(dt / 2)
+		vl = r.Left.speedAt(mid) * r.Config.SpeedScale
+		vr = r.Right.speedAt(mid) * r.Config.SpeedScale
+		secs := dt.Seconds()
+		v := (vl + vr) / 2
+		w = (vr - vl) / r.Config.WheelBase
+		theta := r.pose.Theta + w*secs/2
+		r.pose.X += v * math.Cos(theta) * secs
+		r.pose.Y += v * math.Sin(theta) * secs
+		r.pose.Theta = normalizeAngle(r.pose.Theta + w*secs)
+		touching = r.clampToArena()
+		hit = hit || touching
+		distLeft += vl * secs
+		distRight += vr * secs
+		r.last = r.last.Add(dt)
+	}
+	v := (vl + vr) / 2
+	accel := (v - r.velocity) / elapsed.Seconds()
+	r.velocity = v
+	pose := r.pose
+	r.lock.Unlock()
+
+	var errs []error
+	if r.LeftEncoder != nil {
+		errs = append(errs,
+			r.LeftEncoder.Advance(distLeft*r.Config.TicksPerMeter, vl*r.Config.TicksPerMeter),
+			r.RightEncoder.Advance(distRight*r.Config.TicksPerMeter, vr*r.Config.TicksPerMeter))
+	}
+	if r.IMU != nil {
+		errs = append(errs, r.IMU.Update(tbus.IMUState{
+			Heading:         pose.Theta,
+			AngularVelocity: w,
+			AccelX:          accel,
+			AccelY:          v * w,
+		}))
+	}
+	if r.PoseSensor != nil {
+		errs = append(errs, r.PoseSensor.Update(pose))
+	}
+	if r.Bumper != nil {
+		// a bump during the step is reported even if no longer touching
+		if hit {
+			errs = append(errs, r.Bumper.Press())
+		}
+		if !touching {
+			errs = append(errs, r.Bumper.Release())
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run steps the robot at StepInterval on the clock until stop is closed
+func (r *Robot) Run(stop <-chan struct{}) error {
+	interval := r.Config.StepInterval
+	if interval <= 0 {
+		interval = 10 * time.Millisecond
+	}
+	clock := tbus.ClockOrSystem(r.Config.Clock)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-clock.After(interval):
+			if err := r.Step(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Robot) clampToArena() bool {
+	a := r.Config.Arena
+	if a == nil {
+		return false
+	}
+	hit := false
+	if r.pose.X <= a.MinX {
+		r.pose.X, hit = a.MinX, true
+	} else if r.pose.X >= a.MaxX {
+		r.pose.X, hit = a.MaxX, true
+	}
+	if r.pose.Y <= a.MinY {
+		r.pose.Y, hit = a.MinY, true
+	} else if r.pose.Y >= a.MaxY {
+		r.pose.Y, hit = a.MaxY, true
+	}
+	return hit
+}
+
+// normalizeAngle normalizes angle into (-π, π]
+func normalizeAngle(a float64) float64 {
+	a = math.Mod(a, 2*math.Pi)
+	if a > math.Pi {
+		a -= 2 * math.Pi
+	} else if a <= -math.Pi {
+		a += 2 * math.Pi
+	}
+	return a
+}
@@ -0,0 +1,119 @@
+package sim
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testRobot struct {
+	*Robot
+	clock       *tbus.FakeClock
+	master      *tbus.LocalMaster
+	left, right *tbus.MotorCtl
+}
+
+func newTestRobot(config RobotConfig) *testRobot {
+	r := &testRobot{clock: tbus.NewFakeClock(time.Unix(1000, 0))}
+	config.Clock = r.clock
+	r.Robot = NewRobot(config)
+	r.master = tbus.NewLocalMaster(tbus.NewBusDev(r.Bus))
+	r.left = tbus.NewMotorCtl(r.master).SetAddress(r.Address(RobotLeftMotor))
+	r.right = tbus.NewMotorCtl(r.master).SetAddress(r.Address(RobotRightMotor))
+	return r
+}
+
+func (r *testRobot) drive(left, right int, d time.Duration) {
+	So(r.left.SetSpeed(left).Wait(), ShouldBeNil)
+	So(r.right.SetSpeed(right).Wait(), ShouldBeNil)
+	r.clock.Advance(d)
+	So(r.Step(), ShouldBeNil)
+}
+
+func TestRobot(t *testing.T) {
+	Convey("Robot", t, func() {
+		// wheels reach 0.25m/s after 0.1s
+		const distance = 0.005 * (50*0.1/2 + 50*0.9)
+
+		Convey("devices", func() {
+			r := newTestRobot(DefaultRobotConfig())
+			enum, err := tbus.NewBusCtl(r.master).Enumerate().Wait()
+			So(err, ShouldBeNil)
+			So(enum.Devices, ShouldHaveLength, 7)
+			So(r.Address(RobotIMU), ShouldNotBeEmpty)
+			So(r.Address("none"), ShouldBeNil)
+
+			config := DefaultRobotConfig()
+			config.Encoders, config.IMU = false, false
+			r = newTestRobot(config)
+			So(r.LeftEncoder, ShouldBeNil)
+			So(r.Device(RobotIMU), ShouldBeNil)
+		})
+
+		Convey("forward", func() {
+			r := newTestRobot(DefaultRobotConfig())
+			poses := tbus.NewPoseSensorCtl(r.master).SetAddress(r.Address(RobotPoseSensor)).Pose()
+			r.drive(50, 50, time.Second)
+			pose := <-poses.C
+			So(pose.X, ShouldAlmostEqual, distance, 1e-9)
+			So(pose.Y, ShouldAlmostEqual, 0, 1e-9)
+			So(pose.Theta, ShouldEqual, 0)
+
+			enc, err := tbus.NewEncoderCtl(r.master).SetAddress(r.Address(RobotLeftEncoder)).GetState().Wait()
+			So(err, ShouldBeNil)
+			So(enc.Ticks, ShouldEqual, 237)
+			So(enc.Velocity, ShouldAlmostEqual, 250, 1e-9)
+		})
+
+		Convey("spin", func() {
+			r := newTestRobot(DefaultRobotConfig())
+			r.drive(-50, 50, time.Second)
+			pose := r.Pose()
+			So(pose.X, ShouldAlmostEqual, 0, 1e-9)
+			So(pose.Y, ShouldAlmostEqual, 0, 1e-9)
+			So(pose.Theta, ShouldAlmostEqual, normalizeAngle(distance*2/0.15), 1e-9)
+			imu, err := tbus.NewIMUCtl(r.master).SetAddress(r.Address(RobotIMU)).GetState().Wait()
+			So(err, ShouldBeNil)
+			So(imu.Heading, ShouldEqual, pose.Theta)
+			So(imu.AngularVelocity, ShouldAlmostEqual, 0.5/0.15, 1e-9)
+		})
+
+		Convey("arc", func() {
+			r := newTestRobot(DefaultRobotConfig())
+			r.drive(40, 60, 2*time.Second)
+			pose := r.Pose()
+			So(pose.X, ShouldBeGreaterThan, 0)
+			So(pose.Y, ShouldBeGreaterThan, 0)
+			So(pose.Theta, ShouldBeGreaterThan, 0)
+			So(math.Hypot(pose.X, pose.Y), ShouldBeLessThan, 0.25*2)
+		})
+
+		Convey("bumper", func() {
+			config := DefaultRobotConfig()
+			config.Arena = &Arena{MinX: -1, MinY: -1, MaxX: 0.1, MaxY: 1}
+			r := newTestRobot(config)
+			bumps := tbus.NewButtonCtl(r.master).SetAddress(r.Address(RobotBumper)).State()
+			r.drive(50, 50, time.Second)
+			state := <-bumps.C
+			So(state.Pressed, ShouldBeTrue)
+			So(r.Pose().X, ShouldEqual, 0.1)
+			r.drive(-50, -50, time.Second)
+			state = <-bumps.C
+			So(state.Pressed, ShouldBeFalse)
+		})
+
+		Convey("deterministic", func() {
+			run := func() tbus.Pose2D {
+				r := newTestRobot(DefaultRobotConfig())
+				r.drive(30, 70, 1500*time.Millisecond)
+				r.drive(-20, 50, 700*time.Millisecond)
+				r.drive(0, 0, time.Second)
+				return r.Pose()
+			}
+			So(run(), ShouldResemble, run())
+		})
+	})
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"math"
+	"sync"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// Encoder simulates a wheel encoder, it's fed by the simulation
+type Encoder struct {
+	tbus.LogicBase
+
+	ticks    float64
+	velocity float64
+	lock     sync.Mutex
+}
+
+// NewEncoder creates a simulated encoder
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+func (e *Encoder) state() *tbus.EncoderState {
+	return &tbus.EncoderState{Ticks: int64(math.Floor(e.ticks)), Velocity: e.velocity}
+}
+
+// GetState implements EncoderLogic
+func (e *Encoder) GetState() (*tbus.EncoderState, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.state(), nil
+}
+
+// Reset implements EncoderLogic
+func (e *Encoder) Reset() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.ticks = 0
+	return nil
+}
+
+// Ticks returns current tick count
+func (e *Encoder) Ticks() int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.state().Ticks
+}
+
+// Advance adds ticks and updates velocity in ticks per second,
+// an event is emitted if the tick count or velocity changes
+func (e *Encoder) Advance(ticks, velocity float64) error {
+	e.lock.Lock()
+	prev := e.state()
+	e.ticks += ticks
+	e.velocity = velocity
+	state := e.state()
+	e.lock.Unlock()
+	if state.Ticks == prev.Ticks && state.Velocity == prev.Velocity {
+		return nil
+	}
+	return emitEvent(&e.LogicBase, tbus.ChnEncoderStateID, state)
+}
+
+// IMU simulates an inertial measurement unit, it's fed by the simulation
+type IMU struct {
+	tbus.LogicBase
+
+	state tbus.IMUState
+	lock  sync.Mutex
+}
+
+// NewIMU creates a simulated IMU
+func NewIMU() *IMU {
+	return &IMU{}
+}
+
+// GetState implements IMULogic
+func (u *IMU) GetState() (*tbus.IMUState, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	state := u.state
+	return &state, nil
+}
+
+// Update sets the measurements and emits an event if changed
+func (u *IMU) Update(state tbus.IMUState) error {
+	u.lock.Lock()
+	changed := u.state != state
+	u.state = state
+	u.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	return emitEvent(&u.LogicBase, tbus.ChnIMUStateID, &state)
+}
+
+// PoseSensor reports ground truth pose, like a motion capture system
+type PoseSensor struct {
+	tbus.LogicBase
+
+	pose tbus.Pose2D
+	lock sync.Mutex
+}
+
+// NewPoseSensor creates a simulated pose sensor
+func NewPoseSensor() *PoseSensor {
+	return &PoseSensor{}
+}
+
+// GetPose implements PoseSensorLogic
+func (p *PoseSensor) GetPose() (*tbus.Pose2D, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pose := p.pose
+	return &pose, nil
+}
+
+// Update sets the pose and emits an event if changed
+func (p *PoseSensor) Update(pose tbus.Pose2D) error {
+	p.lock.Lock()
+	changed := p.pose != pose
+	p.pose = pose
+	p.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	return emitEvent(&p.LogicBase, tbus.ChnPoseSensorPoseID, &pose)
+}
@@ -0,0 +1,109 @@
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// Servo defaults
+const (
+	DefaultServoMinAngle = 0
+	DefaultServoMaxAngle = 180
+	// DefaultServoVelocity is about 0.1s/60°
+	DefaultServoVelocity = 600
+)
+
+// Servo simulates a servo moving at limited angular velocity
+type Servo struct {
+	tbus.LogicBase
+	// Clock drives the simulation, nil uses system time
+	Clock tbus.Clock
+	// MinAngle and MaxAngle clamp commanded positions
+	MinAngle uint32
+	MaxAngle uint32
+	// Velocity is the max angular velocity in degrees per second
+	Velocity float64
+
+	angle   ramp
+	changes notifier
+	lock    sync.Mutex
+}
+
+// NewServo creates a simulated servo with default parameters
+func NewServo() *Servo {
+	return &Servo{
+		MinAngle: DefaultServoMinAngle,
+		MaxAngle: DefaultServoMaxAngle,
+		Velocity: DefaultServoVelocity,
+	}
+}
+
+// SetInitialAngle places the servo at an angle immediately
+func (s *Servo) SetInitialAngle(angle uint32) *Servo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.angle = ramp{from: float64(s.clamp(angle)), target: float64(s.clamp(angle))}
+	s.changes.notify()
+	return s
+}
+
+func (s *Servo) clamp(angle uint32) uint32 {
+	if angle < s.MinAngle {
+		return s.MinAngle
+	}
+	if angle > s.MaxAngle {
+		return s.MaxAngle
+	}
+	return angle
+}
+
+// SetPosition implements ServoLogic, the angle is clamped to range
+func (s *Servo) SetPosition(pos *tbus.ServoPosition) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.angle.set(s.now(), float64(s.clamp(pos.Angle)), s.Velocity)
+	s.changes.notify()
+	return nil
+}
+
+// Stop implements ServoLogic, the servo holds current angle
+func (s *Servo) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.angle.hold(s.now())
+	s.changes.notify()
+	return nil
+}
+
+func (s *Servo) now() time.Time {
+	return tbus.ClockOrSystem(s.Clock).Now()
+}
+
+// Angle returns current angle
+func (s *Servo) Angle() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.angle.at(s.now())
+}
+
+// Target returns the angle the servo is moving to
+func (s *Servo) Target() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.angle.target
+}
+
+// Moving returns true if the servo hasn't reached the target
+func (s *Servo) Moving() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.angle.at(s.now()) != s.angle.target
+}
+
+// WaitAngle waits until the servo reaches the angle, it returns
+// false on timeout
+func (s *Servo) WaitAngle(angle float64, timeout time.Duration) bool {
+	return waitValue(s.Clock, timeout, &s.changes, angle, s.Angle)
+}
@@ -0,0 +1,126 @@
+// Package sim provides simulated device logics for testing controllers
+// without hardware. Devices are created with the generated constructors,
+// e.g. tbus.NewMotorDev(sim.NewMotor()), and inspected directly from tests.
+package sim
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/robotalks/tbus/go/tbus"
+)
+
+// pollInterval is the interval of sampling ramping values when waiting
+const pollInterval = time.Millisecond
+
+// ramp moves a value towards a target at a constant rate,
+// the value is computed from elapsed time so no goroutine is needed
+type ramp struct {
+	from   float64
+	target float64
+	rate   float64
+	start  time.Time
+}
+
+// at returns the value at specified time
+func (r *ramp) at(t time.Time) float64 {
+	delta := r.target - r.from
+	if r.rate <= 0 {
+		return r.target
+	}
+	step := r.rate * t.Sub(r.start).Seconds()
+	if step < 0 {
+		step = 0
+	}
+	if math.Abs(delta) <= step {
+		return r.target
+	}
+	if delta < 0 {
+		return r.from - step
+	}
+	return r.from + step
+}
+
+// set starts ramping from current value to a new target
+func (r *ramp) set(t time.Time, target, rate float64) {
+	r.from, r.target, r.rate, r.start = r.at(t), target, rate, t
+}
+
+// hold stops ramping at current value
+func (r *ramp) hold(t time.Time) {
+	r.set(t, r.at(t), 0)
+}
+
+// notifier wakes up waiters when simulated state changes,
+// the zero value is ready to use
+type notifier struct {
+	ch   chan struct{}
+	lock sync.Mutex
+}
+
+// changed returns a channel closed by the next notify
+func (n *notifier) changed() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// notify wakes up all waiters
+func (n *notifier) notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// waitUntil checks cond when state changes or clock moves by pollInterval
+// until it's true or timeout elapses on clock, with a FakeClock the
+// timeout only elapses when the clock is advanced
+func waitUntil(clock tbus.Clock, timeout time.Duration, n *notifier, cond func() bool) bool {
+	clock = tbus.ClockOrSystem(clock)
+	deadline := clock.Now().Add(timeout)
+	for {
+		changed := n.changed()
+		if cond() {
+			return true
+		}
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return false
+		}
+		if remaining > pollInterval {
+			remaining = pollInterval
+		}
+		select {
+		case <-changed:
+		case <-clock.After(remaining):
+		}
+	}
+}
+
+// waitValue waits until sampled value reaches or crosses v, it doesn't
+// miss a value passed between two samples
+func waitValue(clock tbus.Clock, timeout time.Duration, n *notifier, v float64, sample func() float64) bool {
+	prev := sample()
+	return waitUntil(clock, timeout, n, func() bool {
+		cur := sample()
+		crossed := (prev-v)*(cur-v) <= 0
+		prev = cur
+		return crossed
+	})
+}
+
+// emitEvent emits the event only if the device is attached to a bus
+func emitEvent(logic *tbus.LogicBase, channel uint8, event proto.Message) error {
+	if logic.Device == nil || logic.Device.BusPort() == nil {
+		return nil
+	}
+	return logic.EmitEvent(channel, event)
+}
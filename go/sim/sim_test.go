@@ -0,0 +1,162 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robotalks/tbus/go/tbus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSim(t *testing.T) {
+	Convey("Sim", t, func() {
+		bus := tbus.NewLocalBus()
+		master := tbus.NewLocalMaster(tbus.NewBusDev(bus))
+
+		Convey("motor", func() {
+			motor := NewMotor()
+			dev := tbus.NewMotorDev(motor)
+			bus.Plug(dev)
+			ctl := tbus.NewMotorCtl(master).SetAddress(tbus.DeviceAddress(dev))
+
+			So(ctl.Forward(50).Wait(), ShouldBeNil)
+			So(motor.Speed(), ShouldBeLessThan, 50)
+			So(motor.WaitSpeed(50, 200*time.Millisecond), ShouldBeTrue)
+			So(motor.Speed(), ShouldEqual, 50)
+
+			So(ctl.Forward(1000).Wait(), ShouldBeNil)
+			So(motor.Target(), ShouldEqual, DefaultMotorMaxSpeed)
+
+			So(ctl.Reverse(20).Wait(), ShouldBeNil)
+			So(motor.WaitSpeed(0, 500*time.Millisecond), ShouldBeTrue)
+			So(motor.WaitSpeed(-20, 200*time.Millisecond), ShouldBeTrue)
+
+			So(ctl.SetBrake(true).Wait(), ShouldBeNil)
+			So(motor.Braking(), ShouldBeTrue)
+			So(motor.WaitSpeed(0, 50*time.Millisecond), ShouldBeTrue)
+			So(motor.Stopped(), ShouldBeTrue)
+			So(motor.WaitSpeed(10, 10*time.Millisecond), ShouldBeFalse)
+		})
+
+		Convey("motor with fake clock", func() {
+			clock := tbus.NewFakeClock(time.Unix(0, 0))
+			motor := NewMotor()
+			motor.Clock = clock
+			dev := tbus.NewMotorDev(motor)
+			bus.Plug(dev)
+			So(tbus.NewMotorCtl(master).SetAddress(tbus.DeviceAddress(dev)).Forward(50).Wait(), ShouldBeNil)
+
+			reached := make(chan bool, 1)
+			go func() {
+				reached <- motor.WaitSpeed(50, time.Hour)
+			}()
+			select {
+			case <-reached:
+				So("reached without advancing clock", ShouldBeNil)
+			case <-time.After(10 * time.Millisecond):
+			}
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+			So(<-reached, ShouldBeTrue)
+
+			// the timeout elapses on the fake clock, not in real time
+			go func() {
+				reached <- motor.WaitSpeed(60, time.Minute)
+			}()
+			var result []bool
+			for n := 0; n < 100 && len(result) == 0; n++ {
+				clock.Advance(time.Minute)
+				select {
+				case ok := <-reached:
+					result = append(result, ok)
+				case <-time.After(5 * time.Millisecond):
+				}
+			}
+			So(result, ShouldResemble, []bool{false})
+		})
+
+		Convey("servo", func() {
+			servo := NewServo().SetInitialAngle(90)
+			dev := tbus.NewServoDev(servo)
+			bus.Plug(dev)
+			ctl := tbus.NewServoCtl(master).SetAddress(tbus.DeviceAddress(dev))
+
+			So(servo.Angle(), ShouldEqual, 90)
+			So(ctl.MoveTo(300).Wait(), ShouldBeNil)
+			So(servo.Target(), ShouldEqual, 180)
+			So(servo.Moving(), ShouldBeTrue)
+			So(servo.WaitAngle(180, 500*time.Millisecond), ShouldBeTrue)
+			So(servo.Moving(), ShouldBeFalse)
+
+			servo.Velocity = 60
+			So(ctl.MoveTo(0).Wait(), ShouldBeNil)
+			time.Sleep(50 * time.Millisecond)
+			So(ctl.Stop().Wait(), ShouldBeNil)
+			angle := servo.Angle()
+			So(angle, ShouldBeLessThan, 180)
+			So(angle, ShouldBeGreaterThan, 170)
+			So(servo.Moving(), ShouldBeFalse)
+		})
+
+		Convey("led", func() {
+			led := NewLED()
+			dev := tbus.NewLEDDev(led)
+			bus.Plug(dev)
+			ctl := tbus.NewLEDCtl(master).SetAddress(tbus.DeviceAddress(dev))
+
+			So(ctl.On().Wait(), ShouldBeNil)
+			So(ctl.On().Wait(), ShouldBeNil)
+			So(ctl.Off().Wait(), ShouldBeNil)
+			So(led.IsOn(), ShouldBeFalse)
+			So(led.History(), ShouldHaveLength, 3)
+			So(led.History()[0].On, ShouldBeTrue)
+			So(led.Toggles(), ShouldEqual, 2)
+			led.Reset()
+			So(led.History(), ShouldBeEmpty)
+		})
+
+		Convey("led with fake clock", func() {
+			clock := tbus.NewFakeClock(time.Unix(0, 0))
+			led := NewLED()
+			led.Clock = clock
+			dev := tbus.NewLEDDev(led)
+			bus.Plug(dev)
+
+			// state changes wake up the waiter without advancing clock
+			reached := make(chan bool, 1)
+			go func() {
+				reached <- led.WaitOn(true, time.Hour)
+			}()
+			clock.BlockUntil(1)
+			So(tbus.NewLEDCtl(master).SetAddress(tbus.DeviceAddress(dev)).On().Wait(), ShouldBeNil)
+			So(<-reached, ShouldBeTrue)
+
+			go func() {
+				reached <- led.WaitOn(false, time.Second)
+			}()
+			// the poll timer of the first wait is still pending
+			clock.BlockUntil(2)
+			clock.Advance(time.Second)
+			So(<-reached, ShouldBeFalse)
+		})
+
+		Convey("button", func() {
+			btn := NewButton()
+			dev := tbus.NewButtonDev(btn)
+			bus.Plug(dev)
+			ctl := tbus.NewButtonCtl(master).SetAddress(tbus.DeviceAddress(dev))
+			chn := ctl.State()
+			defer chn.Close()
+
+			So(btn.Press(), ShouldBeNil)
+			state := <-chn.C
+			So(state.Pressed, ShouldBeTrue)
+			st, err := ctl.GetState().Wait()
+			So(err, ShouldBeNil)
+			So(st.Pressed, ShouldBeTrue)
+			So(btn.Release(), ShouldBeNil)
+			state = <-chn.C
+			So(state.Pressed, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,248 @@
+package tbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+// Access effects
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// ErrorCodePermissionDenied is the code of Error replied for denied calls
+const ErrorCodePermissionDenied = "permission_denied"
+
+// PermissionError is returned when a call is denied by AccessPolicy
+type PermissionError struct {
+	Identity string
+	Address  RouteAddr
+	Call     string
+}
+
+// Error implements error
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: %q calling %s at %s", e.Identity, e.Call, e.Address)
+}
+
+// ErrorCode implements error with code
+func (e *PermissionError) ErrorCode() string {
+	return ErrorCodePermissionDenied
+}
+
+// IsPermissionDenied determines if err is a denied call, locally or replied
+func IsPermissionDenied(err error) bool {
+	if e, ok := err.(interface {
+		ErrorCode() string
+	}); ok {
+		return e.ErrorCode() == ErrorCodePermissionDenied
+	}
+	return false
+}
+
+// AccessRule matches calls, empty fields match anything
+type AccessRule struct {
+	// Effect is AccessAllow or AccessDeny
+	Effect string `json:"effect"`
+	// Identity is a glob pattern (path.Match) of caller identity name
+	Identity string `json:"identity,omitempty"`
+	// Address matches the device at or under the address, like /1
+	Address string `json:"address,omitempty"`
+	// Class is the class name or ID, like Motor or 0x0020
+	Class string `json:"class,omitempty"`
+	// Method is the method name or index, * matches any
+	Method string `json:"method,omitempty"`
+
+	addrs   RouteAddr
+	classID *uint32
+	method  *uint8
+}
+
+// AccessRequest describes a call to check against AccessPolicy
+type AccessRequest struct {
+	// Identity is nil for local callers
+	Identity *AuthIdentity
+	// Address is the device address relative to the caller
+	Address RouteAddr
+	ClassID uint32
+	Method  uint8
+}
+
+// IdentityName returns the name of identity, empty for local callers
+func (r *AccessRequest) IdentityName() string {
+	if r.Identity != nil {
+		return r.Identity.Name
+	}
+	return ""
+}
+
+// CallName returns Class.Method of the call
+func (r *AccessRequest) CallName() string {
+	class := ClassByID(r.ClassID)
+	if class == nil {
+		return fmt.Sprintf("0x%04x.#%d", r.ClassID, r.Method)
+	}
+	if m := class.MethodByIndex(r.Method); m != nil {
+		return class.Name + "." + m.Name
+	}
+	return fmt.Sprintf("%s.#%d", class.Name, r.Method)
+}
+
+// AccessPolicy evaluates rules in order, the first matched rule decides,
+// Default decides if none matched and is AccessDeny if empty
+type AccessPolicy struct {
+	Default string       `json:"default,omitempty"`
+	Rules   []AccessRule `json:"rules"`
+}
+
+// ParseAccessPolicy parses and compiles policy in JSON
+func ParseAccessPolicy(data []byte) (*AccessPolicy, error) {
+	p := &AccessPolicy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, p.Compile()
+}
+
+// LoadAccessPolicy loads policy from a JSON file
+func LoadAccessPolicy(file string) (*AccessPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParseAccessPolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return p, nil
+}
+
+// Compile validates and prepares the rules, it must be called after
+// rules are modified
+func (p *AccessPolicy) Compile() error {
+	if err := checkEffect(p.Default, true); err != nil {
+		return err
+	}
+	for n := range p.Rules {
+		if err := p.Rules[n].compile(); err != nil {
+			return fmt.Errorf("rule %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// Check returns PermissionError if the call is denied
+func (p *AccessPolicy) Check(req *AccessRequest) error {
+	effect := p.Default
+	for n := range p.Rules {
+		if p.Rules[n].match(req) {
+			effect = p.Rules[n].Effect
+			break
+		}
+	}
+	if effect == AccessAllow {
+		return nil
+	}
+	return &PermissionError{Identity: req.IdentityName(), Address: req.Address, Call: req.CallName()}
+}
+
+// Interceptor creates a DeviceInterceptor enforcing the policy on device
+// calls, the address is relative to where the msg is received
+func (p *AccessPolicy) Interceptor() DeviceInterceptor {
+	return func(call *DeviceCall, next DeviceHandler) error {
+		req := &AccessRequest{Method: call.Method}
+		if call.Class != nil {
+			req.ClassID = call.Class.ClassID
+		} else {
+			req.ClassID = call.Device.DeviceInfo().ClassId
+		}
+		if call.Msg != nil {
+			req.Identity, req.Address = call.Msg.Caller, call.Msg.Routed
+		}
+		if err := p.Check(req); err != nil {
+			CurrentLogger().Warn("call denied", "identity", req.IdentityName(),
+				LogKeyAddr, req.Address.String(), LogKeyMethod, req.CallName())
+			return err
+		}
+		return next(call)
+	}
+}
+
+func checkEffect(effect string, allowEmpty bool) error {
+	switch effect {
+	case AccessAllow, AccessDeny:
+		return nil
+	case "":
+		if allowEmpty {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid effect %q", effect)
+}
+
+func (r *AccessRule) compile() (err error) {
+	if err = checkEffect(r.Effect, false); err != nil {
+		return
+	}
+	if _, err = path.Match(r.Identity, ""); err != nil {
+		return fmt.Errorf("invalid identity %q: %v", r.Identity, err)
+	}
+	r.addrs, r.classID, r.method = nil, nil, nil
+	if r.Address != "" {
+		if r.addrs, err = ParseRouteAddr(r.Address); err != nil {
+			return
+		}
+	}
+	var class *ClassDesc
+	if r.Class != "" {
+		if class = ClassByName(r.Class); class == nil {
+			id, err := strconv.ParseUint(r.Class, 0, 32)
+			if err != nil {
+				return fmt.Errorf("unknown class %s", r.Class)
+			}
+			classID := uint32(id)
+			r.classID, class = &classID, ClassByID(classID)
+		} else {
+			r.classID = &class.ClassID
+		}
+	}
+	if r.Method != "" && r.Method != "*" {
+		var index uint8
+		if val, err := strconv.ParseUint(r.Method, 10, 7); err == nil {
+			index = uint8(val)
+		} else if class == nil {
+			return fmt.Errorf("method %s requires a known class", r.Method)
+		} else if m := class.MethodByName(r.Method); m != nil {
+			index = m.Index
+		} else {
+			return fmt.Errorf("unknown method %s.%s", class.Name, r.Method)
+		}
+		r.method = &index
+	}
+	return nil
+}
+
+func (r *AccessRule) match(req *AccessRequest) bool {
+	if r.Identity != "" {
+		if ok, _ := path.Match(r.Identity, req.IdentityName()); !ok {
+			return false
+		}
+	}
+	if r.addrs != nil {
+		if !bytes.HasPrefix(req.Address, r.addrs) {
+			return false
+		}
+	}
+	if r.classID != nil && *r.classID != req.ClassID {
+		return false
+	}
+	if r.method != nil && *r.method != req.Method {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package tbus
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testMotor struct {
+	LogicBase
+}
+
+func (m *testMotor) Start(*MotorDriveState) error { return nil }
+func (m *testMotor) Stop() error                  { return nil }
+func (m *testMotor) Brake(*MotorBrakeState) error { return nil }
+
+const testAccessPolicy = `{
+	"default": "deny",
+	"rules": [
+		{"effect": "deny", "identity": "dashboard", "class": "Motor", "method": "Start"},
+		{"effect": "allow", "identity": "dashboard"},
+		{"effect": "allow", "identity": "op-*", "address": "/2"}
+	]
+}`
+
+func TestAccessPolicy(t *testing.T) {
+	Convey("AccessPolicy", t, func() {
+		policy, err := ParseAccessPolicy([]byte(testAccessPolicy))
+		So(err, ShouldBeNil)
+
+		Convey("check", func() {
+			dashboard := &AuthIdentity{Name: "dashboard"}
+			operator := &AuthIdentity{Name: "op-1"}
+			So(policy.Check(&AccessRequest{Identity: dashboard, ClassID: BusClassID, Method: 1}), ShouldBeNil)
+			So(policy.Check(&AccessRequest{Identity: dashboard, ClassID: MotorClassID, Method: 2}), ShouldBeNil)
+			err := policy.Check(&AccessRequest{Identity: dashboard, Address: RouteWith(2), ClassID: MotorClassID, Method: 1})
+			So(IsPermissionDenied(err), ShouldBeTrue)
+			So(err.Error(), ShouldEqual, `permission denied: "dashboard" calling Motor.Start at /2`)
+			So(policy.Check(&AccessRequest{Identity: operator, Address: RouteWith(2, 1), ClassID: MotorClassID, Method: 1}), ShouldBeNil)
+			So(IsPermissionDenied(policy.Check(&AccessRequest{Identity: operator, Address: RouteWith(1), ClassID: LEDClassID, Method: 1})), ShouldBeTrue)
+			So(IsPermissionDenied(policy.Check(&AccessRequest{ClassID: LEDClassID, Method: 1})), ShouldBeTrue)
+		})
+
+		Convey("invalid", func() {
+			_, err := ParseAccessPolicy([]byte(`{"rules": [{"effect": "maybe"}]}`))
+			So(err, ShouldNotBeNil)
+			_, err = ParseAccessPolicy([]byte(`{"rules": [{"effect": "allow", "class": "Motor", "method": "Fly"}]}`))
+			So(err.Error(), ShouldEqual, "rule 0: unknown method Motor.Fly")
+			_, err = ParseAccessPolicy([]byte(`{"rules": [{"effect": "allow", "method": "Start"}]}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("remote caller", func() {
+			UseDeviceInterceptors(policy.Interceptor())
+			defer ResetDeviceInterceptors()
+
+			bus := NewLocalBus()
+			led := NewLEDDev(&testLED{})
+			motor := NewMotorDev(&testMotor{})
+			bus.Plug(led)
+			bus.Plug(motor)
+			hostConn, portConn := net.Pipe()
+			port := NewRemoteBusPort(NewBusDev(bus), DialerFunc(func() (io.ReadWriteCloser, error) {
+				return portConn, nil
+			}))
+			port.Caller = &AuthIdentity{Name: "dashboard"}
+			go port.Run()
+			dev, err := AcceptRemoteDevice(hostConn)
+			So(err, ShouldBeNil)
+			master := NewLocalMaster(dev)
+			go dev.Run()
+			defer dev.Close(context.Background())
+
+			_, err = NewBusCtl(master).Enumerate().Wait()
+			So(err, ShouldBeNil)
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(led)).On().Wait(), ShouldBeNil)
+			So(NewMotorCtl(master).SetAddress(DeviceAddress(motor)).Stop().Wait(), ShouldBeNil)
+			err = NewMotorCtl(master).SetAddress(DeviceAddress(motor)).Start(&MotorDriveState{}).Wait()
+			So(IsPermissionDenied(err), ShouldBeTrue)
+
+			// local callers have no identity
+			So(IsPermissionDenied(NewLEDCtl(NewLocalMaster(NewLEDDev(&testLED{}))).On().Wait()), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,272 @@
+package tbus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Authentication methods
+const (
+	AuthMethodPSK   = "psk"
+	AuthMethodToken = "token"
+)
+
+// AuthBodyFlag is the body flag of authentication frames exchanged
+// before the attachment DeviceInfo, which uses body flag 0
+const AuthBodyFlag uint8 = 0x7f
+
+var (
+	// ErrAuthRequired indicates the host requires authentication
+	ErrAuthRequired = fmt.Errorf("authentication required")
+	// ErrAuthNotSupported indicates the host doesn't authenticate
+	ErrAuthNotSupported = fmt.Errorf("authentication not supported")
+	// ErrAuthMethod indicates the authentication method is not accepted
+	ErrAuthMethod = fmt.Errorf("authentication method not accepted")
+	// ErrAuthFailed indicates the credentials are rejected
+	ErrAuthFailed = fmt.Errorf("authentication failed")
+)
+
+// AuthIdentity is the authenticated identity of a remote device
+type AuthIdentity struct {
+	// Method is empty if the host doesn't authenticate, or AuthMethodTLS
+	// if only authenticated by client certificate
+	Method string
+	Name   string
+	// Peer is the remote address of the connection if available
+	Peer string
+	// Certificate is the verified client certificate on a TLS connection
+	Certificate *x509.Certificate
+}
+
+// Credentials authenticates a RemoteBusPort to the host
+type Credentials interface {
+	Method() string
+	Identity() string
+	// Respond computes the proof for the challenge from host
+	Respond(challenge []byte) ([]byte, error)
+}
+
+// Authenticator verifies credentials on the host
+type Authenticator interface {
+	Method() string
+	// Challenge generates the challenge for the identity, can be nil
+	Challenge(identity string) ([]byte, error)
+	// Verify verifies the proof against the challenge
+	Verify(identity string, challenge, proof []byte) error
+}
+
+// Authorizer is called with the authenticated identity and the device info
+// before the device is accepted, it may modify info (e.g. labels) or return
+// an error to reject the device
+type Authorizer func(identity *AuthIdentity, info *DeviceInfo) error
+
+// PSKCredentials authenticates using HMAC-SHA256 of the challenge with a
+// pre-shared key
+type PSKCredentials struct {
+	Name string
+	Key  []byte
+}
+
+// Method implements Credentials
+func (c *PSKCredentials) Method() string {
+	return AuthMethodPSK
+}
+
+// Identity implements Credentials
+func (c *PSKCredentials) Identity() string {
+	return c.Name
+}
+
+// Respond implements Credentials
+func (c *PSKCredentials) Respond(challenge []byte) ([]byte, error) {
+	return pskProof(c.Key, c.Name, challenge), nil
+}
+
+// PSKAuthenticator verifies PSKCredentials using keys by identity
+type PSKAuthenticator struct {
+	Keys map[string][]byte
+}
+
+// Method implements Authenticator
+func (a *PSKAuthenticator) Method() string {
+	return AuthMethodPSK
+}
+
+// Challenge implements Authenticator
+func (a *PSKAuthenticator) Challenge(identity string) ([]byte, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Verify implements Authenticator
+func (a *PSKAuthenticator) Verify(identity string, challenge, proof []byte) error {
+	key, ok := a.Keys[identity]
+	if !ok || len(challenge) == 0 || !hmac.Equal(pskProof(key, identity, challenge), proof) {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func pskProof(key []byte, identity string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	mac.Write([]byte(identity))
+	return mac.Sum(nil)
+}
+
+// TokenCredentials authenticates using a bearer token
+type TokenCredentials struct {
+	Name  string
+	Token string
+}
+
+// Method implements Credentials
+func (c *TokenCredentials) Method() string {
+	return AuthMethodToken
+}
+
+// Identity implements Credentials
+func (c *TokenCredentials) Identity() string {
+	return c.Name
+}
+
+// Respond implements Credentials
+func (c *TokenCredentials) Respond([]byte) ([]byte, error) {
+	return []byte(c.Token), nil
+}
+
+// TokenAuthenticator verifies TokenCredentials using tokens by identity
+type TokenAuthenticator struct {
+	Tokens map[string]string
+}
+
+// Method implements Authenticator
+func (a *TokenAuthenticator) Method() string {
+	return AuthMethodToken
+}
+
+// Challenge implements Authenticator
+func (a *TokenAuthenticator) Challenge(string) ([]byte, error) {
+	return nil, nil
+}
+
+// Verify implements Authenticator
+func (a *TokenAuthenticator) Verify(identity string, _, proof []byte) error {
+	token, ok := a.Tokens[identity]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), proof) != 1 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// Authenticators accepts any of the authentication methods
+type Authenticators []Authenticator
+
+// Find returns the Authenticator of the method, nil if not accepted
+func (a Authenticators) Find(method string) Authenticator {
+	for _, auth := range a {
+		if auth.Method() == method {
+			return auth
+		}
+	}
+	return nil
+}
+
+// Authenticate performs device side authentication handshake on the connection
+func Authenticate(conn io.ReadWriter, cred Credentials) error {
+	err := sendAuthFrame(conn, &AuthHello{Method: cred.Method(), Identity: cred.Identity()})
+	if err != nil {
+		return err
+	}
+	challenge := &AuthChallenge{}
+	if err = recvAuthFrame(conn, challenge); err != nil {
+		return err
+	}
+	proof, err := cred.Respond(challenge.Nonce)
+	if err != nil {
+		return err
+	}
+	if err = sendAuthFrame(conn, &AuthProof{Proof: proof}); err != nil {
+		return err
+	}
+	return recvAuthFrame(conn, nil)
+}
+
+// acceptAuth performs host side authentication handshake, the first
+// message has been decoded as msg. It returns the next message when done.
+func acceptAuth(conn io.ReadWriter, msg Msg, auths Authenticators) (*AuthIdentity, Msg, error) {
+	identity := &AuthIdentity{Peer: streamName(conn)}
+	isAuth := msg.Body.Flag == AuthBodyFlag && !msg.Body.IsError()
+	if len(auths) == 0 {
+		if isAuth {
+			return identity, msg, rejectAuth(conn, ErrAuthNotSupported)
+		}
+		return identity, msg, nil
+	}
+	if !isAuth {
+		return identity, msg, rejectAuth(conn, ErrAuthRequired)
+	}
+
+	hello := &AuthHello{}
+	if err := msg.Body.Decode(hello); err != nil {
+		return identity, msg, err
+	}
+	identity.Method, identity.Name = hello.Method, hello.Identity
+	auth := auths.Find(hello.Method)
+	if auth == nil {
+		return identity, msg, rejectAuth(conn, ErrAuthMethod)
+	}
+	nonce, err := auth.Challenge(hello.Identity)
+	if err != nil {
+		return identity, msg, rejectAuth(conn, err)
+	}
+	if err = sendAuthFrame(conn, &AuthChallenge{Nonce: nonce}); err != nil {
+		return identity, msg, err
+	}
+	proof := &AuthProof{}
+	if err = recvAuthFrame(conn, proof); err != nil {
+		return identity, msg, err
+	}
+	if err = auth.Verify(hello.Identity, nonce, proof.Proof); err != nil {
+		return identity, msg, rejectAuth(conn, err)
+	}
+	if err = sendAuthFrame(conn, nil); err != nil {
+		return identity, msg, err
+	}
+	msg, err = Decode(conn)
+	return identity, msg, err
+}
+
+func sendAuthFrame(w io.Writer, val proto.Message) error {
+	return BuildMsg().EncodeBody(AuthBodyFlag, val).Build().EncodeTo(w)
+}
+
+func recvAuthFrame(r io.Reader, val proto.Message) error {
+	msg, err := Decode(r)
+	if err != nil {
+		return err
+	}
+	if msg.Body.IsError() {
+		return msg.Body.Decode(nil)
+	}
+	if msg.Body.Flag != AuthBodyFlag {
+		return ErrAuthNotSupported
+	}
+	return msg.Body.Decode(val)
+}
+
+// rejectAuth sends err to the remote and returns it
+func rejectAuth(w io.Writer, err error) error {
+	BuildMsg().EncodeBody(AuthBodyFlag|BodyError, &Error{Message: err.Error()}).Build().EncodeTo(w)
+	return err
+}
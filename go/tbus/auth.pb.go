@@ -0,0 +1,66 @@
+// Code generated by protoc-gen-go.
+// source: tbus/auth.proto
+// DO NOT EDIT!
+
+package tbus
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// AuthHello starts authentication before device attachment
+type AuthHello struct {
+	Method   string `protobuf:"bytes,1,opt,name=method" json:"method,omitempty"`
+	Identity string `protobuf:"bytes,2,opt,name=identity" json:"identity,omitempty"`
+}
+
+func (m *AuthHello) Reset()                    { *m = AuthHello{} }
+func (m *AuthHello) String() string            { return proto.CompactTextString(m) }
+func (*AuthHello) ProtoMessage()               {}
+func (*AuthHello) Descriptor() ([]byte, []int) { return fileDescriptor9, []int{0} }
+
+// AuthChallenge is sent by host, nonce is empty if not required by method
+type AuthChallenge struct {
+	Nonce []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+}
+
+func (m *AuthChallenge) Reset()                    { *m = AuthChallenge{} }
+func (m *AuthChallenge) String() string            { return proto.CompactTextString(m) }
+func (*AuthChallenge) ProtoMessage()               {}
+func (*AuthChallenge) Descriptor() ([]byte, []int) { return fileDescriptor9, []int{1} }
+
+// AuthProof responds to the challenge
+type AuthProof struct {
+	Proof []byte `protobuf:"bytes,1,opt,name=proof,proto3" json:"proof,omitempty"`
+}
+
+func (m *AuthProof) Reset()                    { *m = AuthProof{} }
+func (m *AuthProof) String() string            { return proto.CompactTextString(m) }
+func (*AuthProof) ProtoMessage()               {}
+func (*AuthProof) Descriptor() ([]byte, []int) { return fileDescriptor9, []int{2} }
+
+func init() {
+	proto.RegisterType((*AuthHello)(nil), "tbus.AuthHello")
+	proto.RegisterType((*AuthChallenge)(nil), "tbus.AuthChallenge")
+	proto.RegisterType((*AuthProof)(nil), "tbus.AuthProof")
+}
+
+func init() { proto.RegisterFile("tbus/auth.proto", fileDescriptor9) }
+
+var fileDescriptor9 = []byte{
+	// 144 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2f, 0x49, 0x2a, 0x2d,
+	0xd6, 0x4f, 0x2c, 0x2d, 0xc9, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x01, 0x09, 0x28,
+	0xd9, 0x73, 0x71, 0x3a, 0x96, 0x96, 0x64, 0x78, 0xa4, 0xe6, 0xe4, 0xe4, 0x0b, 0x89, 0x71, 0xb1,
+	0xe5, 0xa6, 0x96, 0x64, 0xe4, 0xa7, 0x48, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0x41, 0x79, 0x42,
+	0x52, 0x5c, 0x1c, 0x99, 0x29, 0xa9, 0x79, 0x25, 0x99, 0x25, 0x95, 0x12, 0x4c, 0x60, 0x19, 0x38,
+	0x5f, 0x49, 0x95, 0x8b, 0x17, 0x64, 0x80, 0x73, 0x46, 0x62, 0x4e, 0x4e, 0x6a, 0x5e, 0x7a, 0xaa,
+	0x90, 0x08, 0x17, 0x6b, 0x5e, 0x7e, 0x5e, 0x72, 0x2a, 0xd8, 0x0c, 0x9e, 0x20, 0x08, 0x47, 0x49,
+	0x11, 0x62, 0x4f, 0x40, 0x51, 0x7e, 0x7e, 0x1a, 0x48, 0x49, 0x01, 0x88, 0x01, 0x53, 0x02, 0xe6,
+	0x24, 0xb1, 0x81, 0xdd, 0x65, 0x0c, 0x18, 0x00, 0x92, 0xb3, 0x1c, 0x1a, 0xaa, 0x00, 0x00, 0x00,
+}
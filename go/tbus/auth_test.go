@@ -0,0 +1,141 @@
+package tbus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// authAttach runs the attachment handshake between a RemoteBusPort with cred
+// and host, it returns the accepted device and the error from RemoteBusPort
+// if the handshake fails
+func authAttach(cred Credentials, host *RemoteDeviceHost, logic LEDLogic) (RemoteDevice, error, error) {
+	hostConn, portConn := net.Pipe()
+	port := NewRemoteBusPort(NewLEDDev(logic), DialerFunc(func() (io.ReadWriteCloser, error) {
+		return portConn, nil
+	}))
+	port.Credentials = cred
+	portErr := make(chan error, 1)
+	go func() {
+		portErr <- port.Run()
+	}()
+	dev, err := host.Accept(hostConn)
+	if err != nil {
+		return nil, err, <-portErr
+	}
+	return dev, nil, nil
+}
+
+func TestAuth(t *testing.T) {
+	Convey("Auth", t, func() {
+		psk := &PSKAuthenticator{Keys: map[string][]byte{"arm": []byte("secret")}}
+		token := &TokenAuthenticator{Tokens: map[string]string{"cam": "t0ken"}}
+		host := &RemoteDeviceHost{Authenticators: Authenticators{psk, token}}
+
+		Convey("psk", func() {
+			logic := &testLED{}
+			dev, err, _ := authAttach(&PSKCredentials{Name: "arm", Key: []byte("secret")}, host, logic)
+			So(err, ShouldBeNil)
+			defer dev.Close(context.Background())
+			bus := NewLocalBus()
+			So(bus.Plug(dev), ShouldBeNil)
+			go dev.Run()
+			master := NewLocalMaster(NewBusDev(bus))
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(dev)).On().Wait(), ShouldBeNil)
+			So(logic.on, ShouldBeTrue)
+
+			_, err, portErr := authAttach(&PSKCredentials{Name: "arm", Key: []byte("wrong")}, host, &testLED{})
+			So(err, ShouldEqual, ErrAuthFailed)
+			So(portErr, ShouldNotBeNil)
+			So(portErr.Error(), ShouldEqual, ErrAuthFailed.Error())
+		})
+
+		Convey("token", func() {
+			dev, err, _ := authAttach(&TokenCredentials{Name: "cam", Token: "t0ken"}, host, &testLED{})
+			So(err, ShouldBeNil)
+			dev.Close(context.Background())
+
+			_, err, _ = authAttach(&TokenCredentials{Name: "arm", Token: "t0ken"}, host, &testLED{})
+			So(err, ShouldEqual, ErrAuthFailed)
+		})
+
+		Convey("method mismatch", func() {
+			_, err, portErr := authAttach(nil, host, &testLED{})
+			So(err, ShouldEqual, ErrAuthRequired)
+			So(portErr.Error(), ShouldEqual, ErrAuthRequired.Error())
+
+			_, err, _ = authAttach(&PSKCredentials{Name: "arm", Key: []byte("secret")},
+				&RemoteDeviceHost{Authenticators: Authenticators{token}}, &testLED{})
+			So(err, ShouldEqual, ErrAuthMethod)
+
+			_, err, portErr = authAttach(&TokenCredentials{Name: "cam", Token: "t0ken"}, &RemoteDeviceHost{}, &testLED{})
+			So(err, ShouldEqual, ErrAuthNotSupported)
+			So(portErr.Error(), ShouldEqual, ErrAuthNotSupported.Error())
+		})
+
+		Convey("authorizer", func() {
+			host.Authorizer = func(identity *AuthIdentity, info *DeviceInfo) error {
+				if identity.Name != "arm" {
+					return fmt.Errorf("%s not allowed", identity.Name)
+				}
+				info.AddLabel("identity", identity.Name)
+				return nil
+			}
+			dev, err, _ := authAttach(&PSKCredentials{Name: "arm", Key: []byte("secret")}, host, &testLED{})
+			So(err, ShouldBeNil)
+			So(dev.DeviceInfo().Labels["identity"], ShouldEqual, "arm")
+			So(dev.DeviceInfo().ClassId, ShouldEqual, LEDClassID)
+			dev.Close(context.Background())
+
+			_, err, portErr := authAttach(&TokenCredentials{Name: "cam", Token: "t0ken"}, host, &testLED{})
+			So(err, ShouldNotBeNil)
+			So(portErr.Error(), ShouldEqual, "cam not allowed")
+		})
+
+		Convey("handshake", func() {
+			listener := NewPipeListener("host", PipeOptions{Buffer: 1024})
+			host := NewRemoteDeviceHost(listener)
+			host.Authenticators = Authenticators{token}
+			host.HandshakeTimeout = time.Second
+			clock := NewFakeClock(time.Now())
+			host.Clock = clock
+			So(host.Start(), ShouldBeNil)
+			defer host.Close(context.Background())
+
+			// a silent connection doesn't block the others and is dropped
+			silent, err := listener.Dial()
+			So(err, ShouldBeNil)
+			rejected := NewRemoteBusPort(NewLEDDev(&testLED{}), listener)
+			rejected.Credentials = &TokenCredentials{Name: "cam", Token: "wrong"}
+			So(rejected.Start(), ShouldBeNil)
+			defer rejected.Close(context.Background())
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), listener)
+			port.Credentials = &TokenCredentials{Name: "cam", Token: "t0ken"}
+			So(port.Start(), ShouldBeNil)
+			defer port.Close(context.Background())
+
+			// the clock doesn't move, so the silent connection is pending
+			var dev RemoteDevice
+			select {
+			case dev = <-host.AcceptChan():
+			case <-time.After(5 * time.Second):
+			}
+			So(dev == nil, ShouldBeFalse)
+			So(dev.DeviceInfo().ClassId, ShouldEqual, LEDClassID)
+			select {
+			case <-host.AcceptChan():
+				So("unauthenticated device accepted", ShouldBeNil)
+			case <-time.After(100 * time.Millisecond):
+			}
+			clock.BlockUntil(3)
+			clock.Advance(host.HandshakeTimeout)
+			_, err = silent.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+	})
+}
@@ -12,6 +12,10 @@ It is generated from these files:
 	tbus/led.proto
 	tbus/motor.proto
 	tbus/servo.proto
+	tbus/encoder.proto
+	tbus/imu.proto
+	tbus/pose.proto
+	tbus/auth.proto
 
 It has these top-level messages:
 	DeviceInfo
@@ -22,9 +26,16 @@ It has these top-level messages:
 	MotorDriveState
 	MotorBrakeState
 	ServoPosition
+	EncoderState
+	IMUState
+	Pose2D
+	AuthHello
+	AuthChallenge
+	AuthProof
 */
 package tbus
 
+import "context"
 import "time"
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
@@ -114,6 +125,15 @@ var fileDescriptor0 = []byte{
 // BusClassID is the class ID of Bus
 const BusClassID uint32 = 0x0001
 
+// BusClass is the registered descriptor of Bus
+var BusClass = RegisterClass(&ClassDesc{
+    Name:    "Bus",
+    ClassID: BusClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "Enumerate", ReplyType: "tbus.BusEnumeration"},
+    },
+})
+
 // BusLogic defines the logic interface
 type BusLogic interface {
     DeviceLogic
@@ -121,6 +141,12 @@ type BusLogic interface {
     Enumerate() (*BusEnumeration, error)
 }
 
+// BusContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type BusContextLogic interface {
+    EnumerateContext(context.Context) (*BusEnumeration, error)
+}
+
 // BusDev is the device
 type BusDev struct {
     DeviceBase
@@ -140,17 +166,49 @@ func (d *BusDev) DispatchMsg(msg *Msg) (err error) {
     if msg.Head.NeedRoute() {
         return d.Logic.(MsgRouter).RouteMsg(msg)
     }
-    var reply proto.Message
+    call := &DeviceCall{Device: d, Class: BusClass, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
+    case 0:
+    case 1: // Enumerate
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *BusDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(BusContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // Enumerate
+        call.Reply, err = d.Logic.Enumerate()
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *BusDev) invokeContext(logic BusContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
     case 0:
         devInfo := d.DeviceInfo()
-        reply = &devInfo
+        call.Reply = &devInfo
     case 1: // Enumerate
-        reply, err = d.Logic.Enumerate()
+        call.Reply, err = logic.EnumerateContext(call.Context)
     default:
         err = ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
 }
 
 // SetDeviceID sets device id
@@ -168,6 +226,7 @@ type BusCtl struct {
 func NewBusCtl(master Master) *BusCtl {
     c := &BusCtl{}
     c.Master = master
+    c.Class = BusClass
     return c
 }
 
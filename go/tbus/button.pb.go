@@ -4,7 +4,9 @@
 
 package tbus
 
+import "context"
 import "time"
+import "sync"
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
@@ -53,12 +55,30 @@ var fileDescriptor1 = []byte{
 // ButtonClassID is the class ID of Button
 const ButtonClassID uint32 = 0x0401
 
+// ButtonClass is the registered descriptor of Button
+var ButtonClass = RegisterClass(&ClassDesc{
+    Name:    "Button",
+    ClassID: ButtonClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "GetState", ReplyType: "tbus.ButtonState"},
+    },
+    Events: []EventDesc{
+        {Index: 1, Name: "State", EventType: "tbus.ButtonState"},
+    },
+})
+
 // ButtonLogic defines the logic interface
 type ButtonLogic interface {
     DeviceLogic
     GetState() (*ButtonState, error)
 }
 
+// ButtonContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type ButtonContextLogic interface {
+    GetStateContext(context.Context) (*ButtonState, error)
+}
+
 // ButtonDev is the device
 type ButtonDev struct {
     DeviceBase
@@ -78,17 +98,49 @@ func (d *ButtonDev) DispatchMsg(msg *Msg) (err error) {
     if msg.Head.NeedRoute() {
         return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
     }
-    var reply proto.Message
+    call := &DeviceCall{Device: d, Class: ButtonClass, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
+    case 0:
+    case 1: // GetState
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *ButtonDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(ButtonContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetState
+        call.Reply, err = d.Logic.GetState()
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *ButtonDev) invokeContext(logic ButtonContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
     case 0:
         devInfo := d.DeviceInfo()
-        reply = &devInfo
+        call.Reply = &devInfo
     case 1: // GetState
-        reply, err = d.Logic.GetState()
+        call.Reply, err = logic.GetStateContext(call.Context)
     default:
         err = ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
 }
 
 // SetDeviceID sets device id
@@ -106,6 +158,7 @@ type ButtonCtl struct {
 func NewButtonCtl(master Master) *ButtonCtl {
     c := &ButtonCtl{}
     c.Master = master
+    c.Class = ButtonClass
     return c
 }
 
@@ -148,25 +201,56 @@ type ChnButtonState struct {
 	C chan *ButtonState
 
 	subscription EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
 }
 
 // HandleEvent implements EventHandler
 func (c *ChnButtonState) HandleEvent(evt Event, _ EventSubscription) {
 	val := &ButtonState{}
-	if evt.Decode(val) == nil {
-		c.C <- val
+	if evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
 	}
+	select {
+	case c.C <- val:
+	case <-c.done:
+	}
+}
+
+// HandleClose implements EventCloseHandler
+func (c *ChnButtonState) HandleClose(EventSubscription) {
+	c.close()
 }
 
-// Close implement EventSubscription
+// Close implement EventSubscription, C is closed after events being
+// delivered are dropped
 func (c *ChnButtonState) Close() error {
-	close(c.C)
-	return c.subscription.Close()
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *ChnButtonState) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
 }
 
 // State wraps class Button
 func (c *ButtonCtl) State() *ChnButtonState {
-	chn := &ChnButtonState{C: make(chan *ButtonState)}
+	chn := &ChnButtonState{C: make(chan *ButtonState), done: make(chan struct{})}
 	chn.subscription = c.Subscribe(1, chn)
 	return chn
 }
@@ -0,0 +1,360 @@
+package tbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// CaptureDir is the direction of a captured message
+type CaptureDir uint8
+
+// Capture directions
+const (
+	CaptureDown CaptureDir = 1 // master to device
+	CaptureUp   CaptureDir = 2 // device to master
+)
+
+// String implements fmt.Stringer
+func (d CaptureDir) String() string {
+	switch d {
+	case CaptureDown:
+		return ">"
+	case CaptureUp:
+		return "<"
+	}
+	return "?"
+}
+
+// Reverse returns the opposite direction
+func (d CaptureDir) Reverse() CaptureDir {
+	if d == CaptureDown {
+		return CaptureUp
+	}
+	return CaptureDown
+}
+
+// CaptureRecord is a captured message
+type CaptureRecord struct {
+	Time time.Time
+	Dir  CaptureDir
+	Msg  Msg
+}
+
+// Tapper receives tapped messages
+type Tapper interface {
+	Tap(*CaptureRecord)
+}
+
+// TapperFunc is func form of Tapper
+type TapperFunc func(*CaptureRecord)
+
+// Tap implements Tapper
+func (f TapperFunc) Tap(rec *CaptureRecord) {
+	f(rec)
+}
+
+// CaptureMagic is the header of capture file
+var CaptureMagic = []byte("TBUSCAP\x01")
+
+// CaptureWriter writes captured messages into a capture file.
+// The capture file starts with CaptureMagic followed by records, each record
+// is 7-bit encoded record size, 8-byte big-endian timestamp in nanoseconds
+// since Unix epoch, 1-byte direction and the encoded message.
+type CaptureWriter struct {
+	Writer io.Writer
+
+	err  error
+	lock sync.Mutex
+}
+
+// NewCaptureWriter creates a CaptureWriter and writes the header
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(CaptureMagic); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{Writer: w}, nil
+}
+
+// Write writes a record
+func (w *CaptureWriter) Write(rec *CaptureRecord) error {
+	var buf bytes.Buffer
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(rec.Time.UnixNano()))
+	buf.Write(ts[:])
+	buf.WriteByte(byte(rec.Dir))
+	msg := rec.Msg
+	if err := msg.EncodeTo(&buf); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	out := bufio.NewWriter(w.Writer)
+	_, err := encode7bit(out, uint32(buf.Len()))
+	if err == nil {
+		_, err = out.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	return err
+}
+
+// Tap implements Tapper
+func (w *CaptureWriter) Tap(rec *CaptureRecord) {
+	if err := w.Write(rec); err != nil {
+		w.lock.Lock()
+		if w.err == nil {
+			w.err = err
+		}
+		w.lock.Unlock()
+	}
+}
+
+// Err returns the first error encountered when used as Tapper
+func (w *CaptureWriter) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// CaptureReader reads records from a capture file
+type CaptureReader struct {
+	Reader io.Reader
+}
+
+// NewCaptureReader creates a CaptureReader and validates the header
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	magic := make([]byte, len(CaptureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, CaptureMagic) {
+		return nil, fmt.Errorf("invalid capture file")
+	}
+	return &CaptureReader{Reader: bufio.NewReader(r)}, nil
+}
+
+// Next reads next record, returns io.EOF at the end
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	size, err := decode7bit32(r.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if size < 9 {
+		return nil, fmt.Errorf("invalid capture record size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r.Reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rec := &CaptureRecord{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(data))),
+		Dir:  CaptureDir(data[8]),
+	}
+	if rec.Msg, err = Decode(bytes.NewReader(data[9:])); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ReadAll reads all remaining records
+func (r *CaptureReader) ReadAll() (recs []*CaptureRecord, err error) {
+	for {
+		var rec *CaptureRecord
+		if rec, err = r.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// MsgAnnotation is the decoded information of a captured message
+type MsgAnnotation struct {
+	Record *CaptureRecord
+	// Kind is one of attach, request, reply, event
+	Kind  string
+	Route RouteAddr
+	MsgID MsgID
+	Class *ClassDesc
+	// Index is method or event channel index
+	Index uint8
+	// Name is method or event channel name
+	Name string
+	// Body is the decoded body, nil if unable to decode
+	Body proto.Message
+	Err  error
+}
+
+// Member returns Class.Name or index based name if not resolved
+func (a *MsgAnnotation) Member() string {
+	className := "?"
+	if a.Class != nil {
+		className = a.Class.Name
+	}
+	name := a.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", a.Index)
+	}
+	return className + "." + name
+}
+
+// String implements fmt.Stringer
+func (a *MsgAnnotation) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %-7s %s",
+		a.Record.Time.Format("15:04:05.000000"), a.Record.Dir, a.Kind, a.Route)
+	if len(a.MsgID) > 0 {
+		fmt.Fprintf(&buf, " id=%x", []byte(a.MsgID))
+	}
+	if a.Kind != "attach" {
+		fmt.Fprintf(&buf, " %s", a.Member())
+	}
+	switch {
+	case a.Err != nil:
+		fmt.Fprintf(&buf, " error: %v", a.Err)
+	case a.Body != nil:
+		if encoded, err := MarshalJSON(a.Body); err == nil {
+			fmt.Fprintf(&buf, " %s", encoded)
+		}
+	case len(a.Record.Msg.Body.Data) > 0:
+		fmt.Fprintf(&buf, " [% x]", a.Record.Msg.Body.Data)
+	}
+	return buf.String()
+}
+
+type pendingRequest struct {
+	index  uint8
+	route  RouteAddr
+	class  *ClassDesc
+	method *MethodDesc
+}
+
+// Annotator decodes captured messages and learns device classes from
+// attachments, DeviceInfo and Bus.Enumerate replies it has seen
+type Annotator struct {
+	classes map[string]*ClassDesc
+	pending map[string]*pendingRequest
+	lock    sync.Mutex
+}
+
+// NewAnnotator creates an Annotator
+func NewAnnotator() *Annotator {
+	return &Annotator{
+		classes: make(map[string]*ClassDesc),
+		pending: make(map[string]*pendingRequest),
+	}
+}
+
+// SetClass associates a route with a class
+func (a *Annotator) SetClass(route RouteAddr, classID uint32) {
+	a.lock.Lock()
+	a.setClass(route, classID)
+	a.lock.Unlock()
+}
+
+func (a *Annotator) setClass(route RouteAddr, classID uint32) {
+	if class := ClassByID(classID); class != nil {
+		a.classes[string(route)] = class
+	}
+}
+
+// Annotate decodes a captured message
+func (a *Annotator) Annotate(rec *CaptureRecord) *MsgAnnotation {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	msg := &rec.Msg
+	ann := &MsgAnnotation{Record: rec, Route: msg.Head.Addrs, MsgID: msg.Head.MsgID}
+	switch {
+	case msg.Head.IsEvent():
+		ann.Kind = "event"
+		ann.Index = msg.Body.Flag
+		ann.Class = a.classes[string(ann.Route)]
+		if ann.Class != nil {
+			if e := ann.Class.EventByIndex(msg.Body.Flag); e != nil {
+				ann.Name = e.Name
+				ann.Body, ann.Err = a.decode(msg, e.EventType)
+			}
+		}
+	case len(msg.Head.MsgID) == 0:
+		// messages without ID are for attachment handshake
+		ann.Kind = "attach"
+		info := &DeviceInfo{}
+		if ann.Err = msg.Body.Decode(info); ann.Err == nil {
+			ann.Body = info
+			if rec.Dir == CaptureUp {
+				a.setClass(nil, info.ClassId)
+			}
+		}
+	case rec.Dir == CaptureDown:
+		ann.Kind = "request"
+		ann.Index = msg.Body.Flag
+		ann.Class = a.classes[string(ann.Route)]
+		req := &pendingRequest{index: ann.Index, route: ann.Route, class: ann.Class}
+		if ann.Class != nil {
+			req.method = ann.Class.MethodByIndex(msg.Body.Flag)
+		} else if msg.Body.Flag == 0 {
+			req.method = &deviceInfoMethod
+		}
+		if req.method != nil {
+			ann.Name = req.method.Name
+			ann.Body, ann.Err = a.decode(msg, req.method.ParamType)
+		}
+		a.pending[string(msg.Head.MsgID)] = req
+	default:
+		ann.Kind = "reply"
+		req := a.pending[string(msg.Head.MsgID)]
+		if req == nil {
+			break
+		}
+		delete(a.pending, string(msg.Head.MsgID))
+		ann.Index, ann.Route, ann.Class = req.index, req.route, req.class
+		if req.method == nil {
+			break
+		}
+		ann.Name = req.method.Name
+		if msg.Body.IsError() {
+			ann.Err = msg.Body.Decode(nil)
+			break
+		}
+		ann.Body, ann.Err = a.decode(msg, req.method.ReplyType)
+		a.learn(req, ann.Body)
+	}
+	return ann
+}
+
+func (a *Annotator) decode(msg *Msg, typeName string) (proto.Message, error) {
+	val, err := NewMessage(typeName)
+	if err == nil && val != nil {
+		err = msg.Body.Decode(val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (a *Annotator) learn(req *pendingRequest, reply proto.Message) {
+	switch r := reply.(type) {
+	case *DeviceInfo:
+		a.setClass(req.route, r.ClassId)
+	case *BusEnumeration:
+		for _, info := range r.Devices {
+			route := append(append(RouteAddr{}, req.route...), uint8(info.Address))
+			a.setClass(route, info.ClassId)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package tbus
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func TestCapture(t *testing.T) {
+	Convey("Capture", t, func() {
+		Convey("file format", func() {
+			var buf bytes.Buffer
+			w, err := NewCaptureWriter(&buf)
+			So(err, ShouldBeNil)
+			ts := time.Unix(100, 200)
+			msg := BuildMsg().RouteTo(RouteWith(1, 2)).MsgIDVarInt(3).
+				EncodeBody(1, &LEDPowerState{On: true}).Build()
+			So(w.Write(&CaptureRecord{Time: ts, Dir: CaptureDown, Msg: *msg}), ShouldBeNil)
+			evt := BuildMsg().EncodeEvent(2, 1, &ButtonState{Pressed: true}).Build()
+			So(w.Write(&CaptureRecord{Time: ts, Dir: CaptureUp, Msg: *evt}), ShouldBeNil)
+
+			r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			recs, err := r.ReadAll()
+			So(err, ShouldBeNil)
+			So(recs, ShouldHaveLength, 2)
+			So(recs[0].Time.Equal(ts), ShouldBeTrue)
+			So(recs[0].Dir, ShouldEqual, CaptureDown)
+			So(recs[0].Msg.Head.Addrs, ShouldResemble, RouteWith(1, 2))
+			So(recs[1].Msg.Head.IsEvent(), ShouldBeTrue)
+
+			_, err = NewCaptureReader(bytes.NewReader([]byte("TBUSCAP\x02")))
+			So(err, ShouldNotBeNil)
+			r, err = NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+			So(err, ShouldBeNil)
+			_, err = r.Next()
+			So(err, ShouldBeNil)
+			_, err = r.Next()
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+
+		Convey("tapper error", func() {
+			r, pw := io.Pipe()
+			r.Close()
+			w := &CaptureWriter{Writer: pw}
+			msg := BuildMsg().EncodeBody(1, nil).Build()
+			var wg sync.WaitGroup
+			for n := 0; n < 4; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w.Tap(&CaptureRecord{Time: time.Now(), Dir: CaptureDown, Msg: *msg})
+				}()
+			}
+			wg.Wait()
+			So(w.Err(), ShouldEqual, io.ErrClosedPipe)
+		})
+
+		Convey("annotate", func() {
+			a := NewAnnotator()
+			attach := BuildMsg().EncodeBody(0, &DeviceInfo{ClassId: BusClassID}).Build()
+			ann := a.Annotate(&CaptureRecord{Dir: CaptureUp, Msg: *attach})
+			So(ann.Kind, ShouldEqual, "attach")
+
+			enum := BuildMsg().MsgIDVarInt(1).EncodeBody(1, nil).Build()
+			ann = a.Annotate(&CaptureRecord{Dir: CaptureDown, Msg: *enum})
+			So(ann.Kind, ShouldEqual, "request")
+			So(ann.Member(), ShouldEqual, "Bus.Enumerate")
+			reply := BuildMsg().MsgIDVarInt(1).EncodeBody(0, &BusEnumeration{
+				Devices: []*DeviceInfo{{Address: 2, ClassId: LEDClassID}},
+			}).Build()
+			ann = a.Annotate(&CaptureRecord{Dir: CaptureUp, Msg: *reply})
+			So(ann.Kind, ShouldEqual, "reply")
+			So(ann.Member(), ShouldEqual, "Bus.Enumerate")
+			So(ann.Body, ShouldHaveSameTypeAs, &BusEnumeration{})
+
+			req := BuildMsg().RouteTo(RouteWith(2)).MsgIDVarInt(1).
+				EncodeBody(1, &LEDPowerState{On: true}).Build()
+			ann = a.Annotate(&CaptureRecord{Dir: CaptureDown, Msg: *req})
+			So(ann.Member(), ShouldEqual, "LED.SetPowerState")
+			So(ann.Body.(*LEDPowerState).On, ShouldBeTrue)
+			var errReply *Msg
+			SendReply(MsgDispatcherFunc(func(msg *Msg) error {
+				errReply = msg
+				return nil
+			}), MsgIDVarInt(1), nil, ErrInvalidAddr)
+			ann = a.Annotate(&CaptureRecord{Dir: CaptureUp, Msg: *errReply})
+			So(ann.Route, ShouldResemble, RouteWith(2))
+			So(ann.Err, ShouldNotBeNil)
+			So(ann.String(), ShouldContainSubstring, "LED.SetPowerState error: invalid address")
+
+			unknown := BuildMsg().RouteTo(RouteWith(9)).MsgIDVarInt(2).EncodeBody(5, nil).Build()
+			ann = a.Annotate(&CaptureRecord{Dir: CaptureDown, Msg: *unknown})
+			So(ann.Member(), ShouldEqual, "?.#5")
+		})
+
+		Convey("tap connection", func() {
+			var recs []*CaptureRecord
+			conn := &bufferConn{}
+			tap := NewTapConn(conn, CaptureUp, TapperFunc(func(rec *CaptureRecord) {
+				recs = append(recs, rec)
+			}))
+			msg := BuildMsg().RouteTo(RouteWith(1)).MsgIDVarInt(1).EncodeBody(1, nil).Build()
+			So(msg.EncodeTo(tap), ShouldBeNil)
+			So(recs, ShouldHaveLength, 1)
+			So(recs[0].Dir, ShouldEqual, CaptureDown)
+
+			// feed byte by byte
+			data := conn.Bytes()
+			reader := &bufferConn{}
+			reader.Write(data)
+			tap = NewTapConn(reader, CaptureUp, TapperFunc(func(rec *CaptureRecord) {
+				recs = append(recs, rec)
+			}))
+			b := make([]byte, 1)
+			for n := 0; n < len(data); n++ {
+				_, err := tap.Read(b)
+				So(err, ShouldBeNil)
+			}
+			So(recs, ShouldHaveLength, 2)
+			So(recs[1].Dir, ShouldEqual, CaptureUp)
+			So(recs[1].Msg.Head.Addrs, ShouldResemble, RouteWith(1))
+		})
+	})
+}
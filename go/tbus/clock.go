@@ -0,0 +1,130 @@
+package tbus
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts time for timeouts and timers
+type Clock interface {
+	// Now returns current time
+	Now() time.Time
+	// After waits for the duration to elapse and then sends
+	// current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+	// Sleep pauses for the duration
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the Clock using system time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// ClockOrSystem returns clock if not nil, otherwise SystemClock
+func ClockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// FakeClock is a Clock only moves when advanced manually,
+// timeouts and timers fire deterministically in tests.
+// The zero value is a FakeClock starting at zero time.
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeClockWaiter
+	lock    sync.Mutex
+	cond    *sync.Cond
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock creates a FakeClock starting at specified time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// condition must be called with lock held
+func (c *FakeClock) condition() *sync.Cond {
+	if c.cond == nil {
+		c.cond = sync.NewCond(&c.lock)
+	}
+	return c.cond
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After implements Clock
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &fakeClockWaiter{at: c.now.Add(d), ch: ch})
+	c.condition().Broadcast()
+	return ch
+}
+
+// Sleep implements Clock, it blocks until the clock is advanced
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the clock forward and fires expired timers
+func (c *FakeClock) Advance(d time.Duration) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+	return c.now
+}
+
+// Waiters returns the number of pending timers
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n timers are pending,
+// it's used to make sure a timer is set before advancing the clock
+func (c *FakeClock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.waiters) < n {
+		c.condition().Wait()
+	}
+}
@@ -0,0 +1,66 @@
+package tbus
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type silentDevice struct {
+	DeviceBase
+}
+
+func (d *silentDevice) DispatchMsg(msg *Msg) error {
+	return nil
+}
+
+func TestClock(t *testing.T) {
+	Convey("FakeClock", t, func() {
+		start := time.Unix(100, 0)
+		clock := NewFakeClock(start)
+		So(clock.Now(), ShouldResemble, start)
+
+		ch := clock.After(time.Second)
+		So(clock.Waiters(), ShouldEqual, 1)
+		clock.Advance(500 * time.Millisecond)
+		select {
+		case <-ch:
+			So("fired early", ShouldBeEmpty)
+		default:
+		}
+		clock.Advance(500 * time.Millisecond)
+		So(<-ch, ShouldResemble, start.Add(time.Second))
+		So(clock.Waiters(), ShouldEqual, 0)
+		So(<-clock.After(0), ShouldResemble, start.Add(time.Second))
+
+		done := make(chan struct{})
+		go func() {
+			clock.Sleep(time.Minute)
+			close(done)
+		}()
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		<-done
+
+		Convey("zero value", func() {
+			var zero FakeClock
+			ch := zero.After(time.Second)
+			zero.BlockUntil(1)
+			zero.Advance(time.Second)
+			So(<-ch, ShouldResemble, time.Time{}.Add(time.Second))
+		})
+
+		Convey("invocation timeout", func() {
+			master := NewLocalMaster(&silentDevice{})
+			master.Clock = clock
+			go func() {
+				clock.BlockUntil(1)
+				clock.Advance(DefaultInvocationTimeout)
+			}()
+			begin := time.Now()
+			So(NewLEDCtl(master).On().Wait(), ShouldEqual, ErrRecvTimeout)
+			So(time.Since(begin), ShouldBeLessThan, time.Second)
+		})
+	})
+}
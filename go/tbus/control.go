@@ -9,10 +9,15 @@ type Controller struct {
 	LogicBase
 	Master  Master
 	Address RouteAddr
+	// Class is the class of target device, nil if unknown
+	Class *ClassDesc
 }
 
 // Invoke invokes a method on a device
 func (c *Controller) Invoke(methodIndex uint8, params proto.Message) Invocation {
+	if invoker, ok := c.Master.(ClassInvoker); ok && c.Class != nil {
+		return invoker.InvokeClass(c.Class, methodIndex, params, c.Address)
+	}
 	return c.Master.Invoke(methodIndex, params, c.Address)
 }
 
@@ -52,3 +57,22 @@ func (i *MethodInvocation) Result(reply proto.Message) error {
 func (i *MethodInvocation) Ignore() {
 	i.Invocation.Ignore()
 }
+
+// EventQueue is an EventHandler queueing received events, events are
+// dropped if the queue is full so a slow consumer never blocks the master
+type EventQueue struct {
+	C chan Event
+}
+
+// NewEventQueue creates an EventQueue holding up to size events
+func NewEventQueue(size int) *EventQueue {
+	return &EventQueue{C: make(chan Event, size)}
+}
+
+// HandleEvent implements EventHandler
+func (q *EventQueue) HandleEvent(evt Event, _ EventSubscription) {
+	select {
+	case q.C <- evt:
+	default:
+	}
+}
@@ -1,6 +1,8 @@
 package tbus
 
 import (
+	"sync"
+
 	proto "github.com/golang/protobuf/proto"
 )
 
@@ -8,7 +10,9 @@ import (
 type DeviceBase struct {
 	Info DeviceInfo
 
-	busPort BusPort
+	busPort          BusPort
+	interceptors     []DeviceInterceptor
+	interceptorsLock sync.RWMutex
 }
 
 // DeviceInfo returns device information
@@ -40,7 +44,13 @@ func SendReply(dispatcher MsgDispatcher, msgID MsgID, reply proto.Message, err e
 	flag := uint8(0)
 	if err != nil {
 		flag |= BodyError
-		reply = &Error{Message: err.Error()}
+		replyErr := &Error{Message: err.Error()}
+		if coded, ok := err.(interface {
+			ErrorCode() string
+		}); ok {
+			replyErr.Code = coded.ErrorCode()
+		}
+		reply = replyErr
 	}
 
 	return BuildMsg().
@@ -62,6 +72,7 @@ func (l *LogicBase) SetDevice(dev Device) {
 
 // EmitEvent emits event to specified channel
 func (l *LogicBase) EmitEvent(channelID uint8, event proto.Message) error {
+	CurrentMetrics().Counter(MetricEventsEmitted, "class", ClassName(l.Device.DeviceInfo().ClassId)).Add(1)
 	return BuildMsg().
 		EncodeEvent(
 			uint8(l.Device.DeviceInfo().Address),
@@ -0,0 +1,306 @@
+package tbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	proto "github.com/golang/protobuf/proto"
+)
+
+var (
+	jsonMarshaler   = &jsonpb.Marshaler{OrigName: true, EmitDefaults: true}
+	jsonUnmarshaler = &jsonpb.Unmarshaler{}
+)
+
+// MarshalJSON encodes a protobuf message as JSON, nil message is encoded as null
+func MarshalJSON(msg proto.Message) ([]byte, error) {
+	if msg == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	if err := jsonMarshaler.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes JSON into a protobuf message and rejects unknown fields
+func UnmarshalJSON(data []byte, msg proto.Message) error {
+	return jsonUnmarshaler.Unmarshal(bytes.NewReader(data), msg)
+}
+
+// FailedInvocation is an Invocation failed before sending the request
+type FailedInvocation struct {
+	Err error
+}
+
+// Recv implements Invocation
+func (i *FailedInvocation) Recv() (MsgReceiver, error) {
+	return nil, i.Err
+}
+
+// MsgID implements Invocation
+func (i *FailedInvocation) MsgID() MsgID {
+	return nil
+}
+
+// Timeout implements Invocation
+func (i *FailedInvocation) Timeout(time.Duration) Invocation {
+	return i
+}
+
+// Result implements Invocation
+func (i *FailedInvocation) Result(proto.Message) error {
+	return i.Err
+}
+
+// Ignore implements Invocation
+func (i *FailedInvocation) Ignore() {
+}
+
+// DynamicCtl is a controller invoking methods and subscribing
+// events by name according to a class descriptor
+type DynamicCtl struct {
+	Controller
+}
+
+// NewDynamicCtl creates a DynamicCtl, methods and events are not
+// resolved and fail with ErrUnknownClass if class is nil
+func NewDynamicCtl(master Master, addrs RouteAddr, class *ClassDesc) *DynamicCtl {
+	c := &DynamicCtl{}
+	c.Master = master
+	c.Class = class
+	c.Address = addrs
+	return c
+}
+
+// DiscoverDynamicCtl queries device info from the device and creates
+// DynamicCtl using the class from registry. The device only reports its
+// class ID, descriptors are not fetched from the device, so the class must
+// be compiled in and registered locally, otherwise ErrUnknownClass is
+// returned.
+func DiscoverDynamicCtl(master Master, addrs RouteAddr) (*DynamicCtl, error) {
+	c := NewDynamicCtl(master, addrs, nil)
+	info, err := c.DeviceInfo()
+	if err != nil {
+		return nil, err
+	}
+	if c.Class = ClassByID(info.ClassId); c.Class == nil {
+		return nil, fmt.Errorf("%v 0x%04x", ErrUnknownClass, info.ClassId)
+	}
+	return c, nil
+}
+
+// Method finds method by name
+func (c *DynamicCtl) Method(name string) (*MethodDesc, error) {
+	if c.Class == nil {
+		return nil, ErrUnknownClass
+	}
+	if m := c.Class.MethodByName(name); m != nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("%v %s.%s", ErrUnknownMethod, c.Class.Name, name)
+}
+
+// Event finds event channel by name
+func (c *DynamicCtl) Event(name string) (*EventDesc, error) {
+	if c.Class == nil {
+		return nil, ErrUnknownClass
+	}
+	if e := c.Class.EventByName(name); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("%v %s.%s", ErrUnknownEvent, c.Class.Name, name)
+}
+
+// ParseParams validates JSON params against the method and decodes it
+func (c *DynamicCtl) ParseParams(method *MethodDesc, params []byte) (proto.Message, error) {
+	msg, err := method.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(params)
+	if msg == nil {
+		if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) ||
+			bytes.Equal(trimmed, []byte("{}")) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s.%s accepts no params", c.Class.Name, method.Name)
+	}
+	if len(trimmed) > 0 {
+		if err = UnmarshalJSON(trimmed, msg); err != nil {
+			return nil, fmt.Errorf("%s.%s invalid params: %v", c.Class.Name, method.Name, err)
+		}
+	}
+	return msg, nil
+}
+
+// Call invokes a method by name with params already decoded
+func (c *DynamicCtl) Call(method string, params proto.Message) *DynamicInvocation {
+	invoke := &DynamicInvocation{}
+	m, err := c.Method(method)
+	if err != nil {
+		invoke.Invocation = &FailedInvocation{Err: err}
+		return invoke
+	}
+	invoke.Method = m
+	invoke.Invocation = c.Invoke(m.Index, params)
+	return invoke
+}
+
+// CallJSON invokes a method by name with JSON encoded params
+func (c *DynamicCtl) CallJSON(method string, params []byte) *DynamicInvocation {
+	invoke := &DynamicInvocation{}
+	m, err := c.Method(method)
+	var msg proto.Message
+	if err == nil {
+		msg, err = c.ParseParams(m, params)
+	}
+	if err != nil {
+		invoke.Invocation = &FailedInvocation{Err: err}
+		return invoke
+	}
+	invoke.Method = m
+	invoke.Invocation = c.Invoke(m.Index, msg)
+	return invoke
+}
+
+// CallMap invokes a method by name with params in a map
+func (c *DynamicCtl) CallMap(method string, params map[string]interface{}) *DynamicInvocation {
+	var encoded []byte
+	if params != nil {
+		var err error
+		if encoded, err = json.Marshal(params); err != nil {
+			return &DynamicInvocation{
+				MethodInvocation: MethodInvocation{Invocation: &FailedInvocation{Err: err}},
+			}
+		}
+	}
+	return c.CallJSON(method, encoded)
+}
+
+// Watch subscribes an event channel by name
+func (c *DynamicCtl) Watch(channel string) (*DynamicChn, error) {
+	e, err := c.Event(channel)
+	if err != nil {
+		return nil, err
+	}
+	chn := &DynamicChn{Event: e, C: make(chan *DynamicEvent), done: make(chan struct{})}
+	chn.subscription = c.Subscribe(e.Index, chn)
+	return chn, nil
+}
+
+// DynamicInvocation is the invocation created by DynamicCtl
+type DynamicInvocation struct {
+	MethodInvocation
+	Method *MethodDesc
+}
+
+// Timeout implements Invocation
+func (i *DynamicInvocation) Timeout(dur time.Duration) *DynamicInvocation {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+// Wait waits and retrieves the result, nil if method replies nothing
+func (i *DynamicInvocation) Wait() (proto.Message, error) {
+	if i.Method == nil {
+		return nil, i.Result(nil)
+	}
+	reply, err := i.Method.NewReply()
+	if err == nil {
+		err = i.Result(reply)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// WaitJSON waits and retrieves the result encoded in JSON
+func (i *DynamicInvocation) WaitJSON() ([]byte, error) {
+	reply, err := i.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return MarshalJSON(reply)
+}
+
+// WaitMap waits and retrieves the result as a map, nil if method replies nothing
+func (i *DynamicInvocation) WaitMap() (map[string]interface{}, error) {
+	encoded, err := i.WaitJSON()
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	err = json.Unmarshal(encoded, &result)
+	return result, err
+}
+
+// DynamicEvent is an event received from DynamicChn
+type DynamicEvent struct {
+	Address RouteAddr
+	Message proto.Message
+}
+
+// JSON encodes event message in JSON
+func (e *DynamicEvent) JSON() ([]byte, error) {
+	return MarshalJSON(e.Message)
+}
+
+// DynamicChn is the subscribed event channel from DynamicCtl
+type DynamicChn struct {
+	Event *EventDesc
+	C     chan *DynamicEvent
+
+	subscription EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
+}
+
+// HandleEvent implements EventHandler
+func (c *DynamicChn) HandleEvent(evt Event, _ EventSubscription) {
+	val, err := c.Event.NewEvent()
+	if err != nil || val == nil || evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.C <- &DynamicEvent{Address: evt.Address(), Message: val}:
+	case <-c.done:
+	}
+}
+
+// HandleClose implements EventCloseHandler
+func (c *DynamicChn) HandleClose(EventSubscription) {
+	c.close()
+}
+
+// Close implements EventSubscription, C is closed after events being
+// delivered are dropped
+func (c *DynamicChn) Close() error {
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *DynamicChn) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
+}
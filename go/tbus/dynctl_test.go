@@ -0,0 +1,104 @@
+package tbus
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDynamicCtl(t *testing.T) {
+	Convey("DynamicCtl", t, func() {
+		bus := NewLocalBus()
+		master := NewLocalMaster(NewBusDev(bus))
+		ledLogic := &testLED{}
+		led := NewLEDDev(ledLogic)
+		bus.Plug(led)
+		btnLogic := &testButton{}
+		btn := NewButtonDev(btnLogic)
+		bus.Plug(btn)
+
+		Convey("registry", func() {
+			So(ClassByID(LEDClassID), ShouldEqual, LEDClass)
+			So(ClassByName("Motor"), ShouldEqual, MotorClass)
+			So(MotorClass.MethodByName("Start").Index, ShouldEqual, 1)
+			So(MotorClass.MethodByIndex(0).Name, ShouldEqual, DeviceInfoMethodName)
+			So(ButtonClass.EventByName("State").Index, ShouldEqual, ChnButtonStateID)
+			So(ClassName(0xffff), ShouldEqual, "0xffff")
+		})
+
+		Convey("discover", func() {
+			ctl, err := DiscoverDynamicCtl(master, DeviceAddress(led))
+			So(err, ShouldBeNil)
+			So(ctl.Class, ShouldEqual, LEDClass)
+		})
+
+		Convey("invoke with JSON", func() {
+			ctl := NewDynamicCtl(master, DeviceAddress(led), LEDClass)
+			_, err := ctl.CallJSON("SetPowerState", []byte(`{"on":true}`)).Wait()
+			So(err, ShouldBeNil)
+			So(ledLogic.on, ShouldBeTrue)
+			_, err = ctl.CallMap("SetPowerState", map[string]interface{}{"on": false}).Wait()
+			So(err, ShouldBeNil)
+			So(ledLogic.on, ShouldBeFalse)
+		})
+
+		Convey("reply in JSON", func() {
+			ctl := NewDynamicCtl(master, DeviceAddress(btn), ButtonClass)
+			btnLogic.pressed = true
+			reply, err := ctl.CallJSON("GetState", nil).WaitMap()
+			So(err, ShouldBeNil)
+			So(reply["pressed"], ShouldEqual, true)
+			encoded, err := ctl.CallJSON(DeviceInfoMethodName, nil).WaitJSON()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldContainSubstring, `"class_id":1025`)
+		})
+
+		Convey("validation", func() {
+			ctl := NewDynamicCtl(master, DeviceAddress(led), LEDClass)
+			_, err := ctl.CallJSON("Blink", nil).Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, ErrUnknownMethod.Error())
+			_, err = ctl.CallJSON("SetPowerState", []byte(`{"brightness":1}`)).Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid params")
+			btnCtl := NewDynamicCtl(master, DeviceAddress(btn), ButtonClass)
+			_, err = btnCtl.CallJSON("GetState", []byte(`{"pressed":true}`)).Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "accepts no params")
+
+			noClass := NewDynamicCtl(master, DeviceAddress(led), nil)
+			_, err = noClass.CallJSON("SetPowerState", nil).Wait()
+			So(err, ShouldEqual, ErrUnknownClass)
+			_, err = noClass.Watch("State")
+			So(err, ShouldEqual, ErrUnknownClass)
+		})
+
+		Convey("events", func() {
+			ctl := NewDynamicCtl(master, DeviceAddress(btn), ButtonClass)
+			_, err := ctl.Watch("Pressed")
+			So(err, ShouldNotBeNil)
+			chn, err := ctl.Watch("State")
+			So(err, ShouldBeNil)
+			go btnLogic.simulatePressed(true)
+			evt := <-chn.C
+			So(evt.Message.(*ButtonState).Pressed, ShouldBeTrue)
+			encoded, err := evt.JSON()
+			So(err, ShouldBeNil)
+			So(string(encoded), ShouldEqual, `{"pressed":true}`)
+		})
+
+		Convey("close with event in flight", func() {
+			ctl := NewDynamicCtl(master, DeviceAddress(btn), ButtonClass)
+			chn, err := ctl.Watch("State")
+			So(err, ShouldBeNil)
+			btnLogic.simulatePressed(true)
+			// let the handler block on sending
+			time.Sleep(10 * time.Millisecond)
+			So(chn.Close(), ShouldBeNil)
+			_, ok := <-chn.C
+			So(ok, ShouldBeFalse)
+			So(chn.Close(), ShouldBeNil)
+		})
+	})
+}
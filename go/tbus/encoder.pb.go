@@ -0,0 +1,292 @@
+// Code generated by protoc-gen-go.
+// source: tbus/encoder.proto
+// DO NOT EDIT!
+
+package tbus
+
+import "context"
+import "time"
+import "sync"
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import _ "github.com/golang/protobuf/ptypes/empty"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type EncoderState struct {
+	Ticks int64 `protobuf:"varint,1,opt,name=ticks" json:"ticks,omitempty"`
+	// velocity in ticks per second
+	Velocity float64 `protobuf:"fixed64,2,opt,name=velocity" json:"velocity,omitempty"`
+}
+
+func (m *EncoderState) Reset()                    { *m = EncoderState{} }
+func (m *EncoderState) String() string            { return proto.CompactTextString(m) }
+func (*EncoderState) ProtoMessage()               {}
+func (*EncoderState) Descriptor() ([]byte, []int) { return fileDescriptor6, []int{0} }
+
+func init() {
+	proto.RegisterType((*EncoderState)(nil), "tbus.EncoderState")
+}
+
+func init() { proto.RegisterFile("tbus/encoder.proto", fileDescriptor6) }
+
+var fileDescriptor6 = []byte{
+	// 217 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2a, 0x49, 0x2a, 0x2d,
+	0xd6, 0x4f, 0xcd, 0x4b, 0xce, 0x4f, 0x49, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62,
+	0x01, 0x89, 0x49, 0x49, 0xa7, 0xe7, 0xe7, 0xa7, 0xe7, 0xa4, 0xea, 0x83, 0xc5, 0x92, 0x4a, 0xd3,
+	0xf4, 0x53, 0x73, 0x0b, 0x4a, 0x2a, 0x21, 0x4a, 0xa4, 0x24, 0xc1, 0xda, 0x92, 0xf3, 0x73, 0x73,
+	0xf3, 0xf3, 0xf4, 0xf3, 0x0b, 0x4a, 0x32, 0xf3, 0xf3, 0x8a, 0x21, 0x52, 0x4a, 0x0e, 0x5c, 0x3c,
+	0xae, 0x10, 0xe3, 0x82, 0x4b, 0x12, 0x4b, 0x52, 0x85, 0x44, 0xb8, 0x58, 0x4b, 0x32, 0x93, 0xb3,
+	0x8b, 0x25, 0x18, 0x15, 0x18, 0x35, 0x98, 0x83, 0x20, 0x1c, 0x21, 0x29, 0x2e, 0x8e, 0xb2, 0xd4,
+	0x9c, 0xfc, 0xe4, 0xcc, 0x92, 0x4a, 0x09, 0x26, 0x05, 0x46, 0x0d, 0xc6, 0x20, 0x38, 0xdf, 0xe8,
+	0x14, 0x23, 0x17, 0x3b, 0xd4, 0x08, 0x21, 0x1b, 0x2e, 0x0e, 0xf7, 0xd4, 0x12, 0x88, 0x49, 0x62,
+	0x7a, 0x10, 0x27, 0xe9, 0xc1, 0x9c, 0xa4, 0xe7, 0x0a, 0x72, 0x92, 0x94, 0x90, 0x1e, 0xc8, 0x35,
+	0x7a, 0xc8, 0xb6, 0x2a, 0xb1, 0x34, 0x6c, 0x95, 0x60, 0x14, 0xb2, 0xe5, 0x62, 0x0d, 0x4a, 0x2d,
+	0x4e, 0x2d, 0xc1, 0xa9, 0x15, 0x87, 0x38, 0x58, 0x3b, 0x93, 0x90, 0x35, 0x17, 0x2b, 0x99, 0x36,
+	0x1b, 0x30, 0x4a, 0xb1, 0x36, 0x6c, 0x95, 0x68, 0xe2, 0x48, 0x62, 0x03, 0x6b, 0x31, 0x06, 0x0c,
+	0x00, 0x1c, 0xe1, 0x1c, 0x34, 0x69, 0x01, 0x00, 0x00,
+}
+
+//
+// GENERTED FROM tbus/encoder.proto, DO NOT EDIT
+//
+
+// EncoderClassID is the class ID of Encoder
+const EncoderClassID uint32 = 0x0402
+
+// EncoderClass is the registered descriptor of Encoder
+var EncoderClass = RegisterClass(&ClassDesc{
+    Name:    "Encoder",
+    ClassID: EncoderClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "GetState", ReplyType: "tbus.EncoderState"},
+        {Index: 2, Name: "Reset"},
+    },
+    Events: []EventDesc{
+        {Index: 1, Name: "State", EventType: "tbus.EncoderState"},
+    },
+})
+
+// EncoderLogic defines the logic interface
+type EncoderLogic interface {
+    DeviceLogic
+    GetState() (*EncoderState, error)
+    Reset() error
+}
+
+// EncoderContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type EncoderContextLogic interface {
+    GetStateContext(context.Context) (*EncoderState, error)
+    ResetContext(context.Context) error
+}
+
+// EncoderDev is the device
+type EncoderDev struct {
+    DeviceBase
+    Logic EncoderLogic
+}
+
+// NewEncoderDev creates a new device
+func NewEncoderDev(logic EncoderLogic) *EncoderDev {
+    d := &EncoderDev{Logic: logic}
+    d.Info.ClassId = EncoderClassID
+    logic.SetDevice(d)
+    return d
+}
+
+// DispatchMsg implements Device
+func (d *EncoderDev) DispatchMsg(msg *Msg) (err error) {
+    if msg.Head.NeedRoute() {
+        return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
+    }
+    call := &DeviceCall{Device: d, Class: EncoderClass, Method: msg.Body.Flag, Msg: msg}
+    switch msg.Body.Flag {
+    case 0:
+    case 1: // GetState
+    case 2: // Reset
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *EncoderDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(EncoderContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetState
+        call.Reply, err = d.Logic.GetState()
+    case 2: // Reset
+        err = d.Logic.Reset()
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *EncoderDev) invokeContext(logic EncoderContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetState
+        call.Reply, err = logic.GetStateContext(call.Context)
+    case 2: // Reset
+        err = logic.ResetContext(call.Context)
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+// SetDeviceID sets device id
+func (d *EncoderDev) SetDeviceID(id uint32) *EncoderDev {
+    d.Info.DeviceId = id
+    return d
+}
+
+// EncoderCtl is the device controller
+type EncoderCtl struct {
+    Controller
+}
+
+// NewEncoderCtl creates controller for Encoder
+func NewEncoderCtl(master Master) *EncoderCtl {
+    c := &EncoderCtl{}
+    c.Master = master
+    c.Class = EncoderClass
+    return c
+}
+
+// SetAddress sets routing address for target device
+func (c *EncoderCtl) SetAddress(addrs RouteAddr) *EncoderCtl {
+    c.Address = addrs
+    return c
+}
+
+// InvokeEncoderGetState represents the invocation of Encoder.GetState
+type InvokeEncoderGetState struct {
+	MethodInvocation
+}
+
+// Timeout implements Invocation
+func (i *InvokeEncoderGetState) Timeout(dur time.Duration) *InvokeEncoderGetState {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+// Wait waits and retrieves the result
+func (i *InvokeEncoderGetState) Wait() (*EncoderState, error) {
+	reply := &EncoderState{}
+	err := i.Result(reply)
+	return reply, err
+}
+
+// GetState wraps class Encoder
+func (c *EncoderCtl) GetState() *InvokeEncoderGetState {
+	invoke := &InvokeEncoderGetState{}
+	invoke.Invocation = c.Invoke(1, nil)
+	return invoke
+}
+
+// InvokeEncoderReset represents the invocation of Encoder.Reset
+type InvokeEncoderReset struct {
+	MethodInvocation
+}
+
+// Timeout implements Invocation
+func (i *InvokeEncoderReset) Timeout(dur time.Duration) *InvokeEncoderReset {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+// Wait waits and retrieves the result
+func (i *InvokeEncoderReset) Wait() error {
+	return i.Result(nil)
+}
+
+// Reset wraps class Encoder
+func (c *EncoderCtl) Reset() *InvokeEncoderReset {
+	invoke := &InvokeEncoderReset{}
+	invoke.Invocation = c.Invoke(2, nil)
+	return invoke
+}
+
+// ChnEncoderStateID is the channel index
+const ChnEncoderStateID uint8 = 1
+
+// ChnEncoderState is the subscribed event channel for Encoder.State
+type ChnEncoderState struct {
+	C chan *EncoderState
+
+	subscription EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
+}
+
+// HandleEvent implements EventHandler
+func (c *ChnEncoderState) HandleEvent(evt Event, _ EventSubscription) {
+	val := &EncoderState{}
+	if evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.C <- val:
+	case <-c.done:
+	}
+}
+
+// HandleClose implements EventCloseHandler
+func (c *ChnEncoderState) HandleClose(EventSubscription) {
+	c.close()
+}
+
+// Close implement EventSubscription, C is closed after events being
+// delivered are dropped
+func (c *ChnEncoderState) Close() error {
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *ChnEncoderState) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
+}
+
+// State wraps class Encoder
+func (c *EncoderCtl) State() *ChnEncoderState {
+	chn := &ChnEncoderState{C: make(chan *EncoderState), done: make(chan struct{})}
+	chn.subscription = c.Subscribe(1, chn)
+	return chn
+}
+
@@ -4,3 +4,8 @@ package tbus
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// ErrorCode returns the code of the error
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
@@ -15,6 +15,8 @@ var _ = math.Inf
 
 type Error struct {
 	Message string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	// code identifies the kind of error, e.g. permission_denied
+	Code string `protobuf:"bytes,3,opt,name=code" json:"code,omitempty"`
 }
 
 func (m *Error) Reset()                    { *m = Error{} }
@@ -29,10 +31,11 @@ func init() {
 func init() { proto.RegisterFile("tbus/error.proto", fileDescriptor2) }
 
 var fileDescriptor2 = []byte{
-	// 78 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0x12, 0x28, 0x49, 0x2a, 0x2d,
+	// 88 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x28, 0x49, 0x2a, 0x2d,
 	0xd6, 0x4f, 0x2d, 0x2a, 0xca, 0x2f, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x01, 0x89,
-	0x28, 0x29, 0x72, 0xb1, 0xba, 0x82, 0x04, 0x85, 0x24, 0xb8, 0xd8, 0x73, 0x53, 0x8b, 0x8b, 0x13,
-	0xd3, 0x53, 0x25, 0x98, 0x14, 0x18, 0x35, 0x38, 0x83, 0x60, 0xdc, 0x24, 0x36, 0xb0, 0x7a, 0x63,
-	0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x10, 0x9a, 0x47, 0x74, 0x43, 0x00, 0x00, 0x00,
+	0x28, 0x99, 0x72, 0xb1, 0xba, 0x82, 0x04, 0x85, 0x24, 0xb8, 0xd8, 0x73, 0x53, 0x8b, 0x8b, 0x13,
+	0xd3, 0x53, 0x25, 0x98, 0x14, 0x18, 0x35, 0x38, 0x83, 0x60, 0x5c, 0x21, 0x21, 0x2e, 0x96, 0xe4,
+	0xfc, 0x94, 0x54, 0x09, 0x66, 0xb0, 0x30, 0x98, 0x9d, 0xc4, 0x06, 0x36, 0xc3, 0x18, 0x30, 0x00,
+	0x4f, 0x47, 0xbd, 0xed, 0x57, 0x00, 0x00, 0x00,
 }
@@ -0,0 +1,332 @@
+package tbus
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultAction is the fault applied to a frame
+type FaultAction int
+
+// Fault actions
+const (
+	FaultPass FaultAction = iota
+	FaultDrop
+	FaultDuplicate
+	FaultDelay
+	FaultReorder
+	FaultCorrupt
+	FaultTruncate
+)
+
+var faultActionNames = []string{"pass", "drop", "duplicate", "delay", "reorder", "corrupt", "truncate"}
+
+// String implements fmt.Stringer
+func (a FaultAction) String() string {
+	if int(a) < len(faultActionNames) {
+		return faultActionNames[a]
+	}
+	return "unknown"
+}
+
+// FaultRule applies an action to selected frames
+type FaultRule struct {
+	Action FaultAction
+	// Frames selects frames by sequence number starting from 0,
+	// empty selects all frames
+	Frames []int
+	// Match selects frames by message content, nil selects all frames
+	Match func(*Msg) bool
+	// Probability applies the action randomly to selected frames,
+	// 0 always applies
+	Probability float64
+	// Limit is the max number of frames the rule applies to, 0 is unlimited
+	Limit int
+	// Delay is the duration for FaultDelay
+	Delay time.Duration
+}
+
+func (r *FaultRule) selects(seq int, msg *Msg) bool {
+	if len(r.Frames) > 0 {
+		found := false
+		for _, n := range r.Frames {
+			if n == seq {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.Match == nil || r.Match(msg)
+}
+
+// FaultPolicy defines faults injected in each direction of a connection.
+// Rules are evaluated in order and the first applied rule wins.
+// Randomness is derived from Seed, so the same traffic always
+// results in the same faults.
+type FaultPolicy struct {
+	Seed int64
+	// Write rules apply to frames written to the connection
+	Write []FaultRule
+	// Read rules apply to frames read from the connection
+	Read []FaultRule
+	// ByteErrorRate is the probability of corrupting each byte
+	// in both directions regardless of framing
+	ByteErrorRate float64
+	// Clock is used for FaultDelay, nil uses SystemClock
+	Clock Clock
+}
+
+// FaultStats counts applied faults
+type FaultStats map[FaultAction]int
+
+// FaultConn injects faults into a connection
+type FaultConn struct {
+	Conn   io.ReadWriteCloser
+	Policy *FaultPolicy
+
+	writer *faultStream
+	reader *faultStream
+
+	readBuf  bytes.Buffer
+	readLock sync.Mutex
+}
+
+// NewFaultConn creates a FaultConn
+func NewFaultConn(conn io.ReadWriteCloser, policy *FaultPolicy) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		Policy: policy,
+		writer: newFaultStream(policy, policy.Write, policy.Seed),
+		reader: newFaultStream(policy, policy.Read, policy.Seed+1),
+	}
+}
+
+// Write implements io.Writer, dropped data is reported as written
+func (c *FaultConn) Write(p []byte) (int, error) {
+	c.writer.lock.Lock()
+	defer c.writer.lock.Unlock()
+	if err := c.writer.process(p, c.Conn); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read implements io.Reader
+func (c *FaultConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	buf := make([]byte, len(p))
+	for c.readBuf.Len() == 0 {
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			c.reader.lock.Lock()
+			c.reader.process(buf[:n], &c.readBuf)
+			c.reader.lock.Unlock()
+		}
+		if err != nil {
+			c.reader.lock.Lock()
+			c.reader.flush(&c.readBuf)
+			c.reader.lock.Unlock()
+			if c.readBuf.Len() > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	return c.readBuf.Read(p)
+}
+
+// Close implements io.Closer, a frame held for reordering is written first
+func (c *FaultConn) Close() error {
+	c.writer.lock.Lock()
+	err := c.writer.flush(c.Conn)
+	c.writer.lock.Unlock()
+	if closeErr := c.Conn.Close(); closeErr != nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteStats returns faults applied to written frames
+func (c *FaultConn) WriteStats() FaultStats {
+	return c.writer.snapshot()
+}
+
+// ReadStats returns faults applied to read frames
+func (c *FaultConn) ReadStats() FaultStats {
+	return c.reader.snapshot()
+}
+
+// FaultDialer injects faults into dialed connections
+type FaultDialer struct {
+	Dialer Dialer
+	Policy *FaultPolicy
+}
+
+// Dial implements Dialer
+func (d *FaultDialer) Dial() (io.ReadWriteCloser, error) {
+	conn, err := d.Dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewFaultConn(conn, d.Policy), nil
+}
+
+// FaultListener injects faults into accepted connections
+type FaultListener struct {
+	Listener Listener
+	Policy   *FaultPolicy
+}
+
+// Accept implements Listener
+func (l *FaultListener) Accept() (io.ReadWriteCloser, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewFaultConn(conn, l.Policy), nil
+}
+
+// Close implements Listener
+func (l *FaultListener) Close() error {
+	return l.Listener.Close()
+}
+
+// faultStream splits a byte stream into frames and applies rules
+type faultStream struct {
+	rules    []FaultRule
+	applied  []int
+	rnd      *rand.Rand
+	byteRate float64
+	clock    Clock
+	seq      int
+	buf      []byte
+	held     []byte
+	stats    FaultStats
+	lock     sync.Mutex
+}
+
+func newFaultStream(policy *FaultPolicy, rules []FaultRule, seed int64) *faultStream {
+	return &faultStream{
+		rules:    rules,
+		applied:  make([]int, len(rules)),
+		rnd:      rand.New(rand.NewSource(seed)),
+		byteRate: policy.ByteErrorRate,
+		clock:    ClockOrSystem(policy.Clock),
+		stats:    make(FaultStats),
+	}
+}
+
+func (s *faultStream) snapshot() FaultStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := make(FaultStats)
+	for k, v := range s.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+func (s *faultStream) process(data []byte, out io.Writer) error {
+	s.buf = append(s.buf, data...)
+	for len(s.buf) > 0 {
+		reader := bytes.NewReader(s.buf)
+		msg, err := Decode(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		var frame []byte
+		if err != nil {
+			// not a frame, pass the byte through
+			frame, s.buf = s.buf[:1], s.buf[1:]
+			if err = s.emit(frame, out); err != nil {
+				return err
+			}
+			continue
+		}
+		size := len(s.buf) - reader.Len()
+		frame = append([]byte(nil), s.buf[:size]...)
+		s.buf = s.buf[size:]
+		if err = s.apply(&msg, frame, out); err != nil {
+			return err
+		}
+		s.seq++
+	}
+	return nil
+}
+
+func (s *faultStream) apply(msg *Msg, frame []byte, out io.Writer) error {
+	action := FaultPass
+	var rule *FaultRule
+	for n := range s.rules {
+		r := &s.rules[n]
+		if !r.selects(s.seq, msg) || (r.Limit > 0 && s.applied[n] >= r.Limit) {
+			continue
+		}
+		if r.Probability > 0 && s.rnd.Float64() >= r.Probability {
+			continue
+		}
+		s.applied[n]++
+		action, rule = r.Action, r
+		break
+	}
+	s.stats[action]++
+
+	switch action {
+	case FaultDrop:
+		return nil
+	case FaultDuplicate:
+		if err := s.emit(frame, out); err != nil {
+			return err
+		}
+	case FaultDelay:
+		s.clock.Sleep(rule.Delay)
+	case FaultReorder:
+		if s.held == nil {
+			s.held = frame
+			return nil
+		}
+	case FaultCorrupt:
+		frame = append([]byte(nil), frame...)
+		frame[s.rnd.Intn(len(frame))] ^= uint8(1 + s.rnd.Intn(0xff))
+	case FaultTruncate:
+		frame = frame[:s.rnd.Intn(len(frame))]
+	}
+	if err := s.emit(frame, out); err != nil {
+		return err
+	}
+	return s.flush(out)
+}
+
+// flush emits the frame held for reordering
+func (s *faultStream) flush(out io.Writer) error {
+	if held := s.held; held != nil {
+		s.held = nil
+		return s.emit(held, out)
+	}
+	return nil
+}
+
+// emit writes data with byte errors applied to a copy,
+// so a duplicated frame is corrupted independently
+func (s *faultStream) emit(data []byte, out io.Writer) error {
+	if s.byteRate > 0 {
+		data = append([]byte(nil), data...)
+		for n := range data {
+			if s.rnd.Float64() < s.byteRate {
+				data[n] ^= uint8(1 + s.rnd.Intn(0xff))
+			}
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := out.Write(data)
+	return err
+}
@@ -0,0 +1,196 @@
+package tbus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func faultFrames(policy *FaultPolicy, msgs ...*Msg) []Msg {
+	out := &bufferConn{}
+	conn := NewFaultConn(out, policy)
+	for _, msg := range msgs {
+		So(msg.EncodeTo(conn), ShouldBeNil)
+	}
+	var decoded []Msg
+	reader := bytes.NewReader(out.Bytes())
+	for {
+		msg, err := Decode(reader)
+		if err != nil {
+			break
+		}
+		decoded = append(decoded, msg)
+	}
+	return decoded
+}
+
+func faultTestMsgs(count int) []*Msg {
+	msgs := make([]*Msg, count)
+	for n := range msgs {
+		msgs[n] = BuildMsg().MsgIDVarInt(uint32(n)).EncodeBody(1, &LEDPowerState{On: true}).Build()
+	}
+	return msgs
+}
+
+func msgIDs(msgs []Msg) []uint32 {
+	ids := make([]uint32, len(msgs))
+	for n, msg := range msgs {
+		ids[n], _ = msg.Head.MsgID.VarInt()
+	}
+	return ids
+}
+
+func TestFaultConn(t *testing.T) {
+	Convey("FaultConn", t, func() {
+		Convey("drop and duplicate", func() {
+			msgs := faultFrames(&FaultPolicy{Write: []FaultRule{
+				{Action: FaultDrop, Frames: []int{1}},
+				{Action: FaultDuplicate, Frames: []int{2}},
+			}}, faultTestMsgs(4)...)
+			So(msgIDs(msgs), ShouldResemble, []uint32{0, 2, 2, 3})
+		})
+
+		Convey("reorder", func() {
+			msgs := faultFrames(&FaultPolicy{Write: []FaultRule{
+				{Action: FaultReorder, Frames: []int{0}},
+			}}, faultTestMsgs(3)...)
+			So(msgIDs(msgs), ShouldResemble, []uint32{1, 0, 2})
+
+			// the held frame is written on Close
+			out := &bufferConn{}
+			conn := NewFaultConn(out, &FaultPolicy{Write: []FaultRule{
+				{Action: FaultReorder, Frames: []int{1}},
+			}})
+			for _, msg := range faultTestMsgs(2) {
+				So(msg.EncodeTo(conn), ShouldBeNil)
+			}
+			var encoded bytes.Buffer
+			faultTestMsgs(1)[0].EncodeTo(&encoded)
+			So(out.Len(), ShouldEqual, encoded.Len())
+			So(conn.Close(), ShouldBeNil)
+			So(out.Len(), ShouldEqual, 2*encoded.Len())
+
+			// the held frame is read on EOF
+			in := &bufferConn{}
+			for _, msg := range faultTestMsgs(2) {
+				msg.EncodeTo(in)
+			}
+			conn = NewFaultConn(in, &FaultPolicy{Read: []FaultRule{
+				{Action: FaultReorder, Frames: []int{1}},
+			}})
+			var ids []uint32
+			for {
+				msg, err := Decode(conn)
+				if err != nil {
+					So(err, ShouldEqual, io.EOF)
+					break
+				}
+				id, _ := msg.Head.MsgID.VarInt()
+				ids = append(ids, id)
+			}
+			So(ids, ShouldResemble, []uint32{0, 1})
+		})
+
+		Convey("match and limit", func() {
+			msgs := faultFrames(&FaultPolicy{Write: []FaultRule{
+				{Action: FaultDrop, Limit: 2, Match: func(msg *Msg) bool {
+					id, _ := msg.Head.MsgID.VarInt()
+					return id%2 == 1
+				}},
+			}}, faultTestMsgs(6)...)
+			So(msgIDs(msgs), ShouldResemble, []uint32{0, 2, 4, 5})
+		})
+
+		Convey("seeded randomness", func() {
+			policy := &FaultPolicy{Seed: 42, Write: []FaultRule{
+				{Action: FaultDrop, Probability: 0.5},
+			}}
+			first := msgIDs(faultFrames(policy, faultTestMsgs(20)...))
+			So(len(first), ShouldBeLessThan, 20)
+			So(msgIDs(faultFrames(policy, faultTestMsgs(20)...)), ShouldResemble, first)
+		})
+
+		Convey("truncate and corrupt", func() {
+			out := &bufferConn{}
+			conn := NewFaultConn(out, &FaultPolicy{Write: []FaultRule{
+				{Action: FaultTruncate, Frames: []int{0}},
+			}})
+			var encoded bytes.Buffer
+			msg := faultTestMsgs(1)[0]
+			msg.EncodeTo(&encoded)
+			msg.EncodeTo(conn)
+			So(out.Len(), ShouldBeLessThan, encoded.Len())
+			So(conn.WriteStats()[FaultTruncate], ShouldEqual, 1)
+
+			out = &bufferConn{}
+			conn = NewFaultConn(out, &FaultPolicy{Write: []FaultRule{
+				{Action: FaultCorrupt},
+			}})
+			msg.EncodeTo(conn)
+			So(out.Len(), ShouldEqual, encoded.Len())
+			So(out.Bytes(), ShouldNotResemble, encoded.Bytes())
+
+			// byte errors don't modify the frame before it's duplicated
+			out = &bufferConn{}
+			conn = NewFaultConn(out, &FaultPolicy{Write: []FaultRule{
+				{Action: FaultDuplicate},
+			}, ByteErrorRate: 1})
+			data := encoded.Bytes()
+			conn.Write(data)
+			written := out.Bytes()
+			So(written, ShouldHaveLength, 2*len(data))
+			for n := range data {
+				So(written[n], ShouldNotEqual, data[n])
+				So(written[len(data)+n], ShouldNotEqual, data[n])
+			}
+		})
+
+		Convey("read side", func() {
+			in := &bufferConn{}
+			for _, msg := range faultTestMsgs(3) {
+				msg.EncodeTo(in)
+			}
+			conn := NewFaultConn(in, &FaultPolicy{Read: []FaultRule{
+				{Action: FaultDrop, Frames: []int{0, 2}},
+			}})
+			msg, err := Decode(conn)
+			So(err, ShouldBeNil)
+			id, _ := msg.Head.MsgID.VarInt()
+			So(id, ShouldEqual, 1)
+			_, err = Decode(conn)
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("invocation timeout", func() {
+			bus := NewLocalBus()
+			bus.Plug(NewLEDDev(&testLED{}))
+			hostConn, portConn := net.Pipe()
+			port := NewRemoteBusPort(NewBusDev(bus), &FaultDialer{
+				Dialer: DialerFunc(func() (io.ReadWriteCloser, error) {
+					return portConn, nil
+				}),
+				Policy: &FaultPolicy{Write: []FaultRule{
+					// frame 0 is the attachment
+					{Action: FaultDrop, Frames: []int{2}},
+				}},
+			})
+			go port.Run()
+			dev, err := AcceptRemoteDevice(hostConn)
+			So(err, ShouldBeNil)
+			master := NewLocalMaster(dev)
+			master.InvocationTimeout = 100 * time.Millisecond
+			go dev.Run()
+
+			ctl := NewLEDCtl(master).SetAddress(RouteWith(1))
+			So(ctl.On().Wait(), ShouldBeNil)
+			So(ctl.On().Wait(), ShouldEqual, ErrRecvTimeout)
+			So(ctl.Off().Wait(), ShouldBeNil)
+			dev.Close(context.Background())
+		})
+	})
+}
@@ -0,0 +1,181 @@
+package tbus
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Prefix and suffix bytes of checksummed frames
+const (
+	FramePrefix uint8 = 0xa5
+	FrameSuffix uint8 = 0x5a
+
+	// DefaultMaxFrameSize limits the message size accepted by FramedConn
+	DefaultMaxFrameSize = 4096
+)
+
+// Checksum16 is the Fletcher-16 checksum of the message in a frame
+func Checksum16(data []byte) uint16 {
+	var sum1, sum2 uint16
+	for _, b := range data {
+		sum1 = (sum1 + uint16(b)) % 255
+		sum2 = (sum2 + sum1) % 255
+	}
+	return sum2<<8 | sum1
+}
+
+// FramedConn wraps each message with prefix and checksum suffix for
+// error detection on unreliable links like serial ports. Corrupted
+// frames are dropped and the reader resynchronizes on the next prefix.
+type FramedConn struct {
+	Conn io.ReadWriteCloser
+	// MaxFrameSize limits the message size, DefaultMaxFrameSize if 0
+	MaxFrameSize int
+	// Logger logs dropped frames, the default Logger is used if nil
+	Logger Logger
+
+	rbuf    []byte
+	reading []byte
+	wbuf    []byte
+	wlock   sync.Mutex
+	dropped int64
+}
+
+// Framed wraps conn with checksummed framing
+func Framed(conn io.ReadWriteCloser) *FramedConn {
+	return &FramedConn{Conn: conn}
+}
+
+// Dropped returns the number of corrupted frames dropped
+func (c *FramedConn) Dropped() int {
+	return int(atomic.LoadInt64(&c.dropped))
+}
+
+// RemoteAddr returns the remote address of underlying connection if available
+func (c *FramedConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// Read implements io.Reader, it returns verified messages
+func (c *FramedConn) Read(p []byte) (int, error) {
+	for len(c.reading) == 0 {
+		msg, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.reading = msg
+	}
+	n := copy(p, c.reading)
+	c.reading = c.reading[n:]
+	return n, nil
+}
+
+// Write implements io.Writer, complete messages are framed and sent,
+// an incomplete message is kept until the rest is written
+func (c *FramedConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	var out []byte
+	for {
+		size, _, err := frameSize(c.wbuf)
+		if err != nil {
+			c.wbuf = nil
+			return 0, err
+		}
+		if size == 0 {
+			break
+		}
+		sum := Checksum16(c.wbuf[:size])
+		out = append(out, FramePrefix)
+		out = append(out, c.wbuf[:size]...)
+		out = append(out, uint8(sum), uint8(sum>>8), FrameSuffix)
+		c.wbuf = c.wbuf[size:]
+	}
+	if len(c.wbuf) == 0 {
+		c.wbuf = nil
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer
+func (c *FramedConn) Close() error {
+	return c.Conn.Close()
+}
+
+func (c *FramedConn) maxFrameSize() int {
+	if c.MaxFrameSize > 0 {
+		return c.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+// claimedFrameSize returns the size of the frame in buf claimed by its head,
+// 0 if the head is incomplete
+func claimedFrameSize(buf []byte) (int, error) {
+	reader := bytes.NewReader(buf)
+	head, err := DecodeHead(reader)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return len(buf) - reader.Len() + int(head.BodyBytes), nil
+}
+
+func (c *FramedConn) readFrame() ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		// skip garbage before prefix
+		start := 0
+		for start < len(c.rbuf) && c.rbuf[start] != FramePrefix {
+			start++
+		}
+		c.rbuf = c.rbuf[start:]
+		if len(c.rbuf) > 0 {
+			// the size claimed by the head is checked before the body
+			// arrives, so a corrupted length doesn't stall the stream
+			size, err := claimedFrameSize(c.rbuf[1:])
+			switch {
+			case err != nil || size > c.maxFrameSize():
+				c.drop()
+				continue
+			case size > 0 && len(c.rbuf) >= size+4:
+				msg := c.rbuf[1 : size+1]
+				sum := Checksum16(msg)
+				suffix := c.rbuf[size+1:]
+				if suffix[0] != uint8(sum) || suffix[1] != uint8(sum>>8) || suffix[2] != FrameSuffix {
+					c.drop()
+					continue
+				}
+				c.rbuf = c.rbuf[size+4:]
+				return append([]byte(nil), msg...), nil
+			}
+		}
+		n, err := c.Conn.Read(buf)
+		c.rbuf = append(c.rbuf, buf[:n]...)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+	}
+}
+
+// drop discards the prefix at the beginning to resynchronize
+func (c *FramedConn) drop() {
+	c.rbuf = c.rbuf[1:]
+	atomic.AddInt64(&c.dropped, 1)
+	LoggerOrDefault(c.Logger).Warn("corrupted frame dropped", LogKeyPeer, streamName(c.Conn))
+}
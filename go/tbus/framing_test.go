@@ -0,0 +1,93 @@
+package tbus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestFraming(t *testing.T) {
+	Convey("Framing", t, func() {
+		So(Checksum16([]byte("abcde")), ShouldEqual, 0xc8f0)
+
+		var msgs bytes.Buffer
+		So(BuildMsg().MsgIDVarInt(1).EncodeBody(1, &LEDPowerState{On: true}).Build().EncodeTo(&msgs), ShouldBeNil)
+		So(BuildMsg().MsgIDVarInt(2).EncodeBody(1, &LEDPowerState{}).Build().EncodeTo(&msgs), ShouldBeNil)
+		data := msgs.Bytes()
+
+		Convey("write", func() {
+			var out bytes.Buffer
+			conn := Framed(nopCloser{&out})
+			// a partial message is held until completed
+			_, err := conn.Write(data[:3])
+			So(err, ShouldBeNil)
+			So(out.Len(), ShouldEqual, 0)
+			_, err = conn.Write(data[3:])
+			So(err, ShouldBeNil)
+			framed := out.Bytes()
+			So(len(framed), ShouldEqual, len(data)+8)
+			So(framed[0], ShouldEqual, FramePrefix)
+			So(framed[len(framed)-1], ShouldEqual, FrameSuffix)
+
+			read, err := ioutil.ReadAll(Framed(nopCloser{bytes.NewBuffer(framed)}))
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, data)
+		})
+
+		Convey("resync", func() {
+			var out bytes.Buffer
+			Framed(nopCloser{&out}).Write(data)
+			framed := out.Bytes()
+			size, _, _ := frameSize(data)
+			first := size + 4
+			// garbage, a corrupted frame and a good one
+			corrupted := append([]byte{0x00, FramePrefix, 0xff}, framed[:first]...)
+			corrupted[5] ^= 0x01
+			corrupted = append(corrupted, framed[first:]...)
+			conn := Framed(nopCloser{bytes.NewBuffer(corrupted)})
+			msg, err := Decode(conn)
+			So(err, ShouldBeNil)
+			So(msg.Head.MsgID, ShouldResemble, MsgIDVarInt(2))
+			So(conn.Dropped(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("corrupted length", func() {
+			var out bytes.Buffer
+			Framed(nopCloser{&out}).Write(data)
+			size, _, _ := frameSize(data)
+			// garbage, a head claiming a 1MB body and a good frame
+			corrupted := []byte{0x00, 0x01, FramePrefix, 0x10, 0x00, 0x80, 0x80, 0x40}
+			corrupted = append(corrupted, out.Bytes()[:size+4]...)
+			conn := Framed(nopCloser{bytes.NewBuffer(corrupted)})
+			msg, err := Decode(conn)
+			So(err, ShouldBeNil)
+			So(msg.Head.MsgID, ShouldResemble, MsgIDVarInt(1))
+			So(conn.Dropped(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("remote device", func() {
+			hostConn, portConn := net.Pipe()
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), DialerFunc(func() (io.ReadWriteCloser, error) {
+				return Framed(portConn), nil
+			}))
+			go port.Run()
+			dev, err := AcceptRemoteDevice(Framed(hostConn))
+			So(err, ShouldBeNil)
+			defer dev.Close(context.Background())
+			master := NewLocalMaster(dev)
+			go dev.Run()
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+		})
+	})
+}
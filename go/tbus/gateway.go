@@ -0,0 +1,363 @@
+package tbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGatewayKeepAlive is the interval of keep-alive comments in event streams
+	DefaultGatewayKeepAlive = 15 * time.Second
+	// DefaultGatewayMaxBody limits the size of invocation params
+	DefaultGatewayMaxBody = 1 << 20
+
+	gatewayPrefix     = "/devices"
+	gatewayEventsPath = "events"
+	gatewayEventQueue = 64
+)
+
+// Gateway is an http.Handler exposing devices as REST and Server-Sent Events:
+//
+//	GET  /devices[/{route}]                  enumerates the device tree
+//	POST /devices[/{route}]/{Method}         invokes the method with JSON params
+//	GET  /devices[/{route}]/events/{Channel} streams events of the channel
+//
+// Route is the device address like /1/2, methods, channels and messages are
+// resolved by the class registry.
+type Gateway struct {
+	Master Master
+	// Timeout overrides the invocation timeout of Master if not 0
+	Timeout time.Duration
+	// KeepAlive is the interval of keep-alive comments in event streams,
+	// DefaultGatewayKeepAlive if 0
+	KeepAlive time.Duration
+	// Logger logs failed requests, the default Logger is used if nil
+	Logger Logger
+	// Clock drives keep-alive comments, SystemClock if nil
+	Clock Clock
+
+	classes map[string]*ClassDesc
+	lock    sync.Mutex
+}
+
+// NewGateway creates a Gateway
+func NewGateway(master Master) *Gateway {
+	return &Gateway{Master: master}
+}
+
+// GatewayDevice is a node of the device tree replied by Gateway
+type GatewayDevice struct {
+	Address  string            `json:"address"`
+	Class    string            `json:"class"`
+	ClassID  uint32            `json:"class_id"`
+	DeviceID uint32            `json:"device_id"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Devices  []*GatewayDevice  `json:"devices,omitempty"`
+}
+
+// GatewayEvent is the data of an event in the event stream
+type GatewayEvent struct {
+	Address string          `json:"address"`
+	Event   json.RawMessage `json:"event"`
+}
+
+// gatewayError is the reply of a failed request
+type gatewayError struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// ServeHTTP implements http.Handler
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path != gatewayPrefix && !strings.HasPrefix(path, gatewayPrefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	addrs, names, err := parseGatewayPath(path[len(gatewayPrefix):])
+	if err != nil {
+		g.replyError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case len(names) == 0:
+		if r.Method != http.MethodGet {
+			g.methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		g.serveTree(w, r, addrs)
+	case len(names) == 1:
+		if r.Method != http.MethodPost {
+			g.methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		g.serveInvoke(w, r, addrs, names[0])
+	case len(names) == 2 && names[0] == gatewayEventsPath:
+		if r.Method != http.MethodGet {
+			g.methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		g.serveEvents(w, r, addrs, names[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// parseGatewayPath splits path into the numeric route and the names after it
+func parseGatewayPath(path string) (addrs RouteAddr, names []string, err error) {
+	for _, token := range strings.Split(path, "/") {
+		if token == "" {
+			continue
+		}
+		if names == nil {
+			if addr, e := strconv.ParseUint(token, 10, 8); e == nil {
+				addrs = append(addrs, uint8(addr))
+				continue
+			}
+		}
+		names = append(names, token)
+	}
+	if len(addrs) > RoutingAddrsMax {
+		return nil, nil, fmt.Errorf("%v %s: too many addrs", ErrInvalidAddr, path)
+	}
+	return
+}
+
+func (g *Gateway) serveTree(w http.ResponseWriter, r *http.Request, addrs RouteAddr) {
+	info, err := (&Controller{Master: g.Master, Address: addrs}).DeviceInfo()
+	if err != nil {
+		g.replyError(w, r, 0, err)
+		return
+	}
+	root := newGatewayDevice(addrs, &info)
+	if info.ClassId == BusClassID {
+		if err = g.enumerate(root, addrs); err != nil {
+			g.replyError(w, r, 0, err)
+			return
+		}
+	}
+	g.replyJSON(w, http.StatusOK, root)
+}
+
+func (g *Gateway) enumerate(node *GatewayDevice, addrs RouteAddr) error {
+	enum, err := NewBusCtl(g.Master).SetAddress(addrs).Enumerate().Wait()
+	if err != nil {
+		return err
+	}
+	for _, info := range enum.Devices {
+		devAddrs := append(append(RouteAddr{}, addrs...), uint8(info.Address))
+		dev := newGatewayDevice(devAddrs, info)
+		if info.ClassId == BusClassID {
+			if err = g.enumerate(dev, devAddrs); err != nil {
+				return err
+			}
+		}
+		node.Devices = append(node.Devices, dev)
+	}
+	return nil
+}
+
+func newGatewayDevice(addrs RouteAddr, info *DeviceInfo) *GatewayDevice {
+	return &GatewayDevice{
+		Address:  addrs.String(),
+		Class:    ClassName(info.ClassId),
+		ClassID:  info.ClassId,
+		DeviceID: info.DeviceId,
+		Labels:   info.Labels,
+	}
+}
+
+// discover resolves the class of the device, the class is cached per route
+// so only the first request queries the device
+func (g *Gateway) discover(addrs RouteAddr) (*DynamicCtl, error) {
+	key := addrs.String()
+	g.lock.Lock()
+	class := g.classes[key]
+	g.lock.Unlock()
+	if class != nil {
+		return NewDynamicCtl(g.Master, addrs, class), nil
+	}
+	invocation := (&Controller{Master: g.Master, Address: addrs}).Invoke(0, nil)
+	if g.Timeout > 0 {
+		invocation.Timeout(g.Timeout)
+	}
+	var info DeviceInfo
+	if err := invocation.Result(&info); err != nil {
+		return nil, err
+	}
+	if class = ClassByID(info.ClassId); class == nil {
+		return nil, fmt.Errorf("%v 0x%04x", ErrUnknownClass, info.ClassId)
+	}
+	g.lock.Lock()
+	if g.classes == nil {
+		g.classes = make(map[string]*ClassDesc)
+	}
+	g.classes[key] = class
+	g.lock.Unlock()
+	return NewDynamicCtl(g.Master, addrs, class), nil
+}
+
+// forget drops the cached class of the route as the device may be replaced
+func (g *Gateway) forget(addrs RouteAddr) {
+	g.lock.Lock()
+	delete(g.classes, addrs.String())
+	g.lock.Unlock()
+}
+
+func (g *Gateway) serveInvoke(w http.ResponseWriter, r *http.Request, addrs RouteAddr, name string) {
+	ctl, err := g.discover(addrs)
+	if err != nil {
+		g.replyError(w, r, 0, err)
+		return
+	}
+	method, err := ctl.Method(name)
+	if err != nil {
+		g.forget(addrs)
+		g.replyError(w, r, http.StatusNotFound, err)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, DefaultGatewayMaxBody))
+	if err != nil {
+		g.replyError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	params, err := ctl.ParseParams(method, body)
+	if err != nil {
+		g.replyError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	invocation := ctl.Call(name, params)
+	if g.Timeout > 0 {
+		invocation.Timeout(g.Timeout)
+	}
+	reply, err := invocation.WaitJSON()
+	if err != nil {
+		g.forget(addrs)
+		g.replyError(w, r, 0, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply)
+}
+
+func (g *Gateway) serveEvents(w http.ResponseWriter, r *http.Request, addrs RouteAddr, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		g.replyError(w, r, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	ctl, err := g.discover(addrs)
+	if err != nil {
+		g.replyError(w, r, 0, err)
+		return
+	}
+	channel, err := ctl.Event(name)
+	if err != nil {
+		g.forget(addrs)
+		g.replyError(w, r, http.StatusNotFound, err)
+		return
+	}
+	queue := NewEventQueue(gatewayEventQueue)
+	sub := ctl.Subscribe(channel.Index, queue)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := g.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultGatewayKeepAlive
+	}
+	clock := ClockOrSystem(g.Clock)
+	tick := clock.After(keepAlive)
+	for {
+		select {
+		case evt := <-queue.C:
+			data, err := encodeGatewayEvent(channel, evt)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", channel.Name, data); err != nil {
+				return
+			}
+		case <-tick:
+			if _, err = io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			tick = clock.After(keepAlive)
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func encodeGatewayEvent(channel *EventDesc, evt Event) ([]byte, error) {
+	val, err := channel.Decode(evt)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := MarshalJSON(val)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&GatewayEvent{Address: evt.Address().String(), Event: encoded})
+}
+
+func (g *Gateway) methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	g.replyJSON(w, http.StatusMethodNotAllowed, &gatewayError{Error: "method not allowed"})
+}
+
+// replyError replies err, status is derived from err if 0
+func (g *Gateway) replyError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	reply := &gatewayError{Error: err.Error()}
+	if e, ok := err.(interface {
+		ErrorCode() string
+	}); ok {
+		reply.Code = e.ErrorCode()
+	}
+	if status == 0 {
+		status = gatewayErrorStatus(err)
+	}
+	LoggerOrDefault(g.Logger).Warn("gateway request failed", "method", r.Method,
+		"path", r.URL.Path, "status", status, LogKeyError, err)
+	g.replyJSON(w, status, reply)
+}
+
+func gatewayErrorStatus(err error) int {
+	switch {
+	case err == ErrRecvTimeout:
+		return http.StatusGatewayTimeout
+	case err == ErrMasterClosed:
+		return http.StatusServiceUnavailable
+	case IsPermissionDenied(err):
+		return http.StatusForbidden
+	case err.Error() == ErrInvalidAddr.Error():
+		return http.StatusNotFound
+	case strings.HasPrefix(err.Error(), ErrUnknownClass.Error()):
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+func (g *Gateway) replyJSON(w http.ResponseWriter, status int, val interface{}) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,150 @@
+package tbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGateway(t *testing.T) {
+	Convey("Gateway", t, func() {
+		bus := NewLocalBus()
+		led := NewLEDDev(&testLED{})
+		bus.Plug(led)
+		btnLogic := &testButton{}
+		btn := NewButtonDev(btnLogic)
+		btn.SetDeviceID(3).Info.AddLabel("name", "button")
+		bus.Plug(btn)
+		server := httptest.NewServer(NewGateway(NewLocalMaster(NewBusDev(bus))))
+		defer server.Close()
+
+		post := func(path, body string) (int, map[string]interface{}) {
+			resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			var reply map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&reply)
+			return resp.StatusCode, reply
+		}
+
+		Convey("tree", func() {
+			resp, err := http.Get(server.URL + "/devices")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			var root GatewayDevice
+			So(json.NewDecoder(resp.Body).Decode(&root), ShouldBeNil)
+			So(root.Address, ShouldEqual, "/")
+			So(root.Class, ShouldEqual, "Bus")
+			So(root.Devices, ShouldHaveLength, 2)
+			So(root.Devices[1].Address, ShouldEqual, DeviceAddress(btn).String())
+			So(root.Devices[1].Class, ShouldEqual, "Button")
+			So(root.Devices[1].DeviceID, ShouldEqual, 3)
+			So(root.Devices[1].Labels["name"], ShouldEqual, "button")
+		})
+
+		Convey("invoke", func() {
+			ledPath := "/devices" + DeviceAddress(led).String()
+			status, _ := post(ledPath+"/SetPowerState", `{"on":true}`)
+			So(status, ShouldEqual, http.StatusOK)
+
+			btnLogic.pressed = true
+			status, reply := post("/devices"+DeviceAddress(btn).String()+"/GetState", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(reply["pressed"], ShouldEqual, true)
+
+			status, reply = post(ledPath+"/Fly", "")
+			So(status, ShouldEqual, http.StatusNotFound)
+			So(reply["error"], ShouldContainSubstring, "LED.Fly")
+			status, _ = post(ledPath+"/SetPowerState", `{"color":1}`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			status, _ = post("/devices/99/On", "")
+			So(status, ShouldEqual, http.StatusNotFound)
+
+			resp, err := http.Get(server.URL + ledPath + "/On")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("discovery", func() {
+			discovered := 0
+			master := NewInterceptedMaster(NewLocalMaster(NewBusDev(bus)), func(call *Call, next Invoker) Invocation {
+				if call.Method == 0 {
+					discovered++
+				}
+				return next(call)
+			})
+			gateway := NewGateway(master)
+			serve := func(g *Gateway, path string) int {
+				rec := httptest.NewRecorder()
+				g.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(`{"on":true}`)))
+				return rec.Code
+			}
+			ledPath := "/devices" + DeviceAddress(led).String()
+			So(serve(gateway, ledPath+"/SetPowerState"), ShouldEqual, http.StatusOK)
+			So(serve(gateway, ledPath+"/SetPowerState"), ShouldEqual, http.StatusOK)
+			So(discovered, ShouldEqual, 1)
+			// the class is discovered again after a failure
+			So(serve(gateway, ledPath+"/Fly"), ShouldEqual, http.StatusNotFound)
+			So(serve(gateway, ledPath+"/SetPowerState"), ShouldEqual, http.StatusOK)
+			So(discovered, ShouldEqual, 2)
+
+			silent := NewGateway(NewLocalMaster(&silentDevice{}))
+			silent.Timeout = 10 * time.Millisecond
+			start := time.Now()
+			So(serve(silent, "/devices/SetPowerState"), ShouldEqual, http.StatusGatewayTimeout)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("events", func() {
+			resp, err := http.Get(server.URL + "/devices" + DeviceAddress(btn).String() + "/events/State")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+			btnLogic.simulatePressed(true)
+			reader := bufio.NewReader(resp.Body)
+			line, err := reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "event: State\n")
+			line, err = reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, fmt.Sprintf("data: {\"address\":%q,\"event\":{\"pressed\":true}}\n", DeviceAddress(btn).String()))
+
+			resp, err = http.Get(server.URL + "/devices" + DeviceAddress(btn).String() + "/events/Click")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("keep-alive", func() {
+			clock := NewFakeClock(time.Now())
+			gateway := NewGateway(NewLocalMaster(NewBusDev(bus)))
+			gateway.Clock = clock
+			server := httptest.NewServer(gateway)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/devices" + DeviceAddress(btn).String() + "/events/State")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			reader := bufio.NewReader(resp.Body)
+			for n := 0; n < 2; n++ {
+				clock.BlockUntil(1)
+				clock.Advance(DefaultGatewayKeepAlive)
+				line, err := reader.ReadString('\n')
+				So(err, ShouldBeNil)
+				So(line, ShouldEqual, ": keep-alive\n")
+				_, err = reader.ReadString('\n')
+				So(err, ShouldBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package tbus
+
+import "strings"
+
+// gRPC status codes used by generated gRPC bridges, the values are
+// defined by gRPC, so this package doesn't depend on gRPC
+const (
+	GRPCCodeUnknown          uint32 = 2
+	GRPCCodeInvalidArgument  uint32 = 3
+	GRPCCodeDeadlineExceeded uint32 = 4
+	GRPCCodeNotFound         uint32 = 5
+	GRPCCodePermissionDenied uint32 = 7
+	GRPCCodeUnimplemented    uint32 = 12
+	GRPCCodeUnavailable      uint32 = 14
+)
+
+// GRPCCode maps an invocation error to gRPC status code
+func GRPCCode(err error) uint32 {
+	switch {
+	case err == ErrRecvTimeout:
+		return GRPCCodeDeadlineExceeded
+	case err == ErrRecvAborted, err == ErrMasterClosed:
+		return GRPCCodeUnavailable
+	case IsPermissionDenied(err):
+		return GRPCCodePermissionDenied
+	case err.Error() == ErrInvalidAddr.Error():
+		return GRPCCodeNotFound
+	case err.Error() == ErrInvalidMethod.Error(),
+		strings.HasPrefix(err.Error(), ErrUnknownClass.Error()),
+		strings.HasPrefix(err.Error(), ErrUnknownMethod.Error()):
+		return GRPCCodeUnimplemented
+	}
+	return GRPCCodeUnknown
+}
+
+// GRPCError converts gRPC status code and message to the error replied by
+// a device, permission denied is preserved for access control
+func GRPCError(code uint32, msg string) error {
+	err := &Error{Message: msg}
+	if code == GRPCCodePermissionDenied {
+		err.Code = ErrorCodePermissionDenied
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package tbus
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGRPC(t *testing.T) {
+	Convey("GRPC", t, func() {
+		Convey("code", func() {
+			So(GRPCCode(ErrRecvTimeout), ShouldEqual, GRPCCodeDeadlineExceeded)
+			So(GRPCCode(ErrRecvAborted), ShouldEqual, GRPCCodeUnavailable)
+			So(GRPCCode(ErrMasterClosed), ShouldEqual, GRPCCodeUnavailable)
+			So(GRPCCode(&Error{Message: ErrInvalidAddr.Error()}), ShouldEqual, GRPCCodeNotFound)
+			So(GRPCCode(fmt.Errorf("%v 0x1234", ErrUnknownClass)), ShouldEqual, GRPCCodeUnimplemented)
+			So(GRPCCode(GRPCError(GRPCCodePermissionDenied, "denied")), ShouldEqual, GRPCCodePermissionDenied)
+			So(GRPCCode(fmt.Errorf("failure")), ShouldEqual, GRPCCodeUnknown)
+		})
+
+		Convey("event queue", func() {
+			bus := NewLocalBus()
+			btnLogic := &testButton{}
+			btn := NewButtonDev(btnLogic)
+			bus.Plug(btn)
+			queue := NewEventQueue(1)
+			sub := NewButtonCtl(NewLocalMaster(NewBusDev(bus))).
+				SetAddress(DeviceAddress(btn)).
+				Subscribe(ChnButtonStateID, queue)
+			defer sub.Close()
+			btnLogic.simulatePressed(true)
+			evt := <-queue.C
+			state := &ButtonState{}
+			So(evt.Decode(state), ShouldBeNil)
+			So(state.Pressed, ShouldBeTrue)
+			// dropped without blocking when full
+			queue.HandleEvent(evt, sub)
+			queue.HandleEvent(evt, sub)
+			So(queue.C, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,157 @@
+package tbus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultHarnessTeardown limits waiting for ports and devices to stop
+const DefaultHarnessTeardown = 5 * time.Second
+
+// ErrHarnessTeardown indicates ports or devices didn't stop in time
+var ErrHarnessTeardown = fmt.Errorf("harness teardown timeout")
+
+// Harness wires a master, bus trees and remote devices connected over
+// in-memory pipes for end-to-end tests, e.g.
+//
+//	bus := NewLocalBus()
+//	h, err := NewRemoteHarness(NewBusDev(bus), PipeOptions{})
+//	defer h.Close()
+//	h.PlugRemote(bus, NewLEDDev(logic))
+//	NewBusCtl(h.Master).Enumerate()
+//
+// Close closes Master, tears down all connections and waits for all ports
+// and devices.
+type Harness struct {
+	// Master is attached to Root
+	Master *LocalMaster
+	// Root is the device Master is attached to, it's the RemoteDevice
+	// if the root is connected over a pipe
+	Root Device
+	// Options configures pipes created by PlugRemote
+	Options PipeOptions
+	// Logger is used by ports and devices, the default Logger is used if nil
+	Logger Logger
+	// Teardown limits waiting in Close, DefaultHarnessTeardown if 0
+	Teardown time.Duration
+
+	lock    sync.Mutex
+	remotes []RemoteDevice
+	err     error
+	wg      sync.WaitGroup
+	closed  bool
+}
+
+// NewHarness creates a Harness with Master attached to root directly
+func NewHarness(root Device) *Harness {
+	return &Harness{Master: NewLocalMaster(root), Root: root}
+}
+
+// NewRemoteHarness creates a Harness with Master attached to root over a pipe
+func NewRemoteHarness(root Device, opts PipeOptions) (*Harness, error) {
+	h := &Harness{Options: opts}
+	remote, err := h.connect(root)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.Root = remote
+	h.Master = NewLocalMaster(remote)
+	h.run(remote.Run)
+	return h, nil
+}
+
+// PlugRemote exposes dev over a pipe and plugs the remote device into bus
+func (h *Harness) PlugRemote(bus *LocalBus, dev Device) (RemoteDevice, error) {
+	remote, err := h.connect(dev)
+	if err != nil {
+		return nil, err
+	}
+	if err = bus.Plug(remote); err != nil {
+		return nil, err
+	}
+	h.run(remote.Run)
+	return remote, nil
+}
+
+// connect exposes dev with a RemoteBusPort over a pipe and returns the
+// remote device on host side which is not running yet
+func (h *Harness) connect(dev Device) (RemoteDevice, error) {
+	listener := NewPipeListener(fmt.Sprintf("harness-%s", ClassName(dev.DeviceInfo().ClassId)), h.Options)
+	defer listener.Close()
+	port := NewRemoteBusPort(dev, listener)
+	port.Logger = h.Logger
+	h.run(port.Run)
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := (&RemoteDeviceHost{Logger: h.Logger}).Accept(conn)
+	if err != nil {
+		return nil, err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		remote.Close(context.Background())
+		return nil, io.ErrClosedPipe
+	}
+	h.remotes = append(h.remotes, remote)
+	return remote, nil
+}
+
+func (h *Harness) run(fn func() error) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := fn(); err != nil {
+			h.lock.Lock()
+			if h.err == nil {
+				h.err = err
+			}
+			h.lock.Unlock()
+		}
+	}()
+}
+
+// Close closes Master and all remote devices and waits for ports and
+// devices to stop, it returns the first error from them
+func (h *Harness) Close() error {
+	teardown := h.Teardown
+	if teardown == 0 {
+		teardown = DefaultHarnessTeardown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), teardown)
+	defer cancel()
+	if h.Master != nil && h.Master.Close(ctx) != nil {
+		return ErrHarnessTeardown
+	}
+
+	h.lock.Lock()
+	h.closed = true
+	remotes := h.remotes
+	h.remotes = nil
+	h.lock.Unlock()
+	for n := len(remotes) - 1; n >= 0; n-- {
+		if remotes[n].Close(ctx) != nil {
+			return ErrHarnessTeardown
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ErrHarnessTeardown
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.err
+}
@@ -0,0 +1,266 @@
+// Code generated by protoc-gen-go.
+// source: tbus/imu.proto
+// DO NOT EDIT!
+
+package tbus
+
+import "context"
+import "time"
+import "sync"
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import _ "github.com/golang/protobuf/ptypes/empty"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type IMUState struct {
+	// heading in radians, counter-clockwise
+	Heading float64 `protobuf:"fixed64,1,opt,name=heading" json:"heading,omitempty"`
+	// angular velocity in radians per second
+	AngularVelocity float64 `protobuf:"fixed64,2,opt,name=angular_velocity,json=angularVelocity" json:"angular_velocity,omitempty"`
+	// linear acceleration in m/s^2 along x (forward) and y (left)
+	AccelX float64 `protobuf:"fixed64,3,opt,name=accel_x,json=accelX" json:"accel_x,omitempty"`
+	AccelY float64 `protobuf:"fixed64,4,opt,name=accel_y,json=accelY" json:"accel_y,omitempty"`
+}
+
+func (m *IMUState) Reset()                    { *m = IMUState{} }
+func (m *IMUState) String() string            { return proto.CompactTextString(m) }
+func (*IMUState) ProtoMessage()               {}
+func (*IMUState) Descriptor() ([]byte, []int) { return fileDescriptor7, []int{0} }
+
+func init() {
+	proto.RegisterType((*IMUState)(nil), "tbus.IMUState")
+}
+
+func init() { proto.RegisterFile("tbus/imu.proto", fileDescriptor7) }
+
+var fileDescriptor7 = []byte{
+	// 235 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2b, 0x49, 0x2a, 0x2d,
+	0xd6, 0xcf, 0xcc, 0x2d, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x01, 0xf1, 0xa5, 0xa4,
+	0xd3, 0xf3, 0xf3, 0xd3, 0x73, 0x52, 0xf5, 0xc1, 0x62, 0x49, 0xa5, 0x69, 0xfa, 0xa9, 0xb9, 0x05,
+	0x25, 0x95, 0x10, 0x25, 0x52, 0x92, 0x60, 0x2d, 0xc9, 0xf9, 0xb9, 0xb9, 0xf9, 0x79, 0xfa, 0xf9,
+	0x05, 0x25, 0x99, 0xf9, 0x79, 0xc5, 0x10, 0x29, 0xa5, 0x46, 0x46, 0x2e, 0x0e, 0x4f, 0xdf, 0xd0,
+	0xe0, 0x92, 0xc4, 0x92, 0x54, 0x21, 0x09, 0x2e, 0xf6, 0x8c, 0xd4, 0xc4, 0x94, 0xcc, 0xbc, 0x74,
+	0x09, 0x46, 0x05, 0x46, 0x0d, 0xc6, 0x20, 0x18, 0x57, 0x48, 0x93, 0x4b, 0x20, 0x31, 0x2f, 0xbd,
+	0x34, 0x27, 0xb1, 0x28, 0xbe, 0x2c, 0x35, 0x27, 0x3f, 0x39, 0xb3, 0xa4, 0x52, 0x82, 0x09, 0xac,
+	0x84, 0x1f, 0x2a, 0x1e, 0x06, 0x15, 0x16, 0x12, 0xe7, 0x62, 0x4f, 0x4c, 0x4e, 0x4e, 0xcd, 0x89,
+	0xaf, 0x90, 0x60, 0x06, 0xab, 0x60, 0x03, 0x73, 0x23, 0x10, 0x12, 0x95, 0x12, 0x2c, 0x48, 0x12,
+	0x91, 0x46, 0xf5, 0x5c, 0xcc, 0x9e, 0xbe, 0xa1, 0x42, 0x16, 0x5c, 0x1c, 0xee, 0xa9, 0x25, 0x10,
+	0x97, 0x88, 0xe9, 0x41, 0xfc, 0xa3, 0x07, 0xf3, 0x8f, 0x9e, 0x2b, 0xc8, 0x3f, 0x52, 0x7c, 0x7a,
+	0x20, 0xaf, 0xe8, 0xc1, 0x5c, 0xac, 0xc4, 0xd2, 0xb0, 0x55, 0x82, 0x51, 0xc8, 0x9c, 0x8b, 0x95,
+	0x0c, 0x6d, 0x06, 0x8c, 0x52, 0xac, 0x0d, 0x5b, 0x25, 0x5a, 0x38, 0x92, 0xd8, 0xc0, 0xca, 0x8d,
+	0x01, 0x03, 0x00, 0x67, 0x58, 0x2e, 0x71, 0x5b, 0x01, 0x00, 0x00,
+}
+
+//
+// GENERTED FROM tbus/imu.proto, DO NOT EDIT
+//
+
+// IMUClassID is the class ID of IMU
+const IMUClassID uint32 = 0x0404
+
+// IMUClass is the registered descriptor of IMU
+var IMUClass = RegisterClass(&ClassDesc{
+    Name:    "IMU",
+    ClassID: IMUClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "GetState", ReplyType: "tbus.IMUState"},
+    },
+    Events: []EventDesc{
+        {Index: 1, Name: "State", EventType: "tbus.IMUState"},
+    },
+})
+
+// IMULogic defines the logic interface
+type IMULogic interface {
+    DeviceLogic
+    GetState() (*IMUState, error)
+}
+
+// IMUContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type IMUContextLogic interface {
+    GetStateContext(context.Context) (*IMUState, error)
+}
+
+// IMUDev is the device
+type IMUDev struct {
+    DeviceBase
+    Logic IMULogic
+}
+
+// NewIMUDev creates a new device
+func NewIMUDev(logic IMULogic) *IMUDev {
+    d := &IMUDev{Logic: logic}
+    d.Info.ClassId = IMUClassID
+    logic.SetDevice(d)
+    return d
+}
+
+// DispatchMsg implements Device
+func (d *IMUDev) DispatchMsg(msg *Msg) (err error) {
+    if msg.Head.NeedRoute() {
+        return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
+    }
+    call := &DeviceCall{Device: d, Class: IMUClass, Method: msg.Body.Flag, Msg: msg}
+    switch msg.Body.Flag {
+    case 0:
+    case 1: // GetState
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *IMUDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(IMUContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetState
+        call.Reply, err = d.Logic.GetState()
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *IMUDev) invokeContext(logic IMUContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetState
+        call.Reply, err = logic.GetStateContext(call.Context)
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+// SetDeviceID sets device id
+func (d *IMUDev) SetDeviceID(id uint32) *IMUDev {
+    d.Info.DeviceId = id
+    return d
+}
+
+// IMUCtl is the device controller
+type IMUCtl struct {
+    Controller
+}
+
+// NewIMUCtl creates controller for IMU
+func NewIMUCtl(master Master) *IMUCtl {
+    c := &IMUCtl{}
+    c.Master = master
+    c.Class = IMUClass
+    return c
+}
+
+// SetAddress sets routing address for target device
+func (c *IMUCtl) SetAddress(addrs RouteAddr) *IMUCtl {
+    c.Address = addrs
+    return c
+}
+
+// InvokeIMUGetState represents the invocation of IMU.GetState
+type InvokeIMUGetState struct {
+	MethodInvocation
+}
+
+// Timeout implements Invocation
+func (i *InvokeIMUGetState) Timeout(dur time.Duration) *InvokeIMUGetState {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+// Wait waits and retrieves the result
+func (i *InvokeIMUGetState) Wait() (*IMUState, error) {
+	reply := &IMUState{}
+	err := i.Result(reply)
+	return reply, err
+}
+
+// GetState wraps class IMU
+func (c *IMUCtl) GetState() *InvokeIMUGetState {
+	invoke := &InvokeIMUGetState{}
+	invoke.Invocation = c.Invoke(1, nil)
+	return invoke
+}
+
+// ChnIMUStateID is the channel index
+const ChnIMUStateID uint8 = 1
+
+// ChnIMUState is the subscribed event channel for IMU.State
+type ChnIMUState struct {
+	C chan *IMUState
+
+	subscription EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
+}
+
+// HandleEvent implements EventHandler
+func (c *ChnIMUState) HandleEvent(evt Event, _ EventSubscription) {
+	val := &IMUState{}
+	if evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.C <- val:
+	case <-c.done:
+	}
+}
+
+// HandleClose implements EventCloseHandler
+func (c *ChnIMUState) HandleClose(EventSubscription) {
+	c.close()
+}
+
+// Close implement EventSubscription, C is closed after events being
+// delivered are dropped
+func (c *ChnIMUState) Close() error {
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *ChnIMUState) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
+}
+
+// State wraps class IMU
+func (c *IMUCtl) State() *ChnIMUState {
+	chn := &ChnIMUState{C: make(chan *IMUState), done: make(chan struct{})}
+	chn.subscription = c.Subscribe(1, chn)
+	return chn
+}
+
@@ -0,0 +1,260 @@
+package tbus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// ClassInvoker is a Master able to invoke with class information,
+// Controller uses it when Class is known
+type ClassInvoker interface {
+	InvokeClass(class *ClassDesc, method uint8, params proto.Message, addrs RouteAddr) Invocation
+}
+
+// Call describes an invocation passing through interceptors,
+// interceptors may modify the fields before calling next
+type Call struct {
+	// Class is nil if unknown
+	Class  *ClassDesc
+	Method uint8
+	Addrs  RouteAddr
+	Params proto.Message
+	// Timeout overrides the timeout of master if not 0
+	Timeout time.Duration
+	// Start is the time the call started
+	Start time.Time
+}
+
+// MethodName returns the name of method, or #index if unknown
+func (c *Call) MethodName() string {
+	if c.Class != nil {
+		if m := c.Class.MethodByIndex(c.Method); m != nil {
+			return c.Class.Name + "." + m.Name
+		}
+		return fmt.Sprintf("%s.#%d", c.Class.Name, c.Method)
+	}
+	if c.Method == 0 {
+		return DeviceInfoMethodName
+	}
+	return fmt.Sprintf("#%d", c.Method)
+}
+
+// Invoker dispatches a call
+type Invoker func(*Call) Invocation
+
+// Interceptor intercepts a call when it's invoked, it calls next to
+// dispatch the call, or returns an Invocation without calling next to
+// short-circuit the call, e.g. FailedInvocation or ReplyInvocation.
+// The result is observed by wrapping the Invocation returned by next.
+type Interceptor func(call *Call, next Invoker) Invocation
+
+// ChainInterceptors combines interceptors into one,
+// the first one is the outermost
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	return func(call *Call, next Invoker) Invocation {
+		invoker := next
+		for n := len(interceptors) - 1; n >= 0; n-- {
+			interceptor, inner := interceptors[n], invoker
+			invoker = func(call *Call) Invocation {
+				return interceptor(call, inner)
+			}
+		}
+		return invoker(call)
+	}
+}
+
+// InterceptedMaster wraps a Master with interceptors, the chain runs and
+// the call is dispatched in Invoke.
+type InterceptedMaster struct {
+	Master Master
+	// Clock is used for Call.Start, nil uses SystemClock
+	Clock Clock
+
+	interceptors []Interceptor
+	lock         sync.RWMutex
+}
+
+// NewInterceptedMaster creates an InterceptedMaster
+func NewInterceptedMaster(master Master, interceptors ...Interceptor) *InterceptedMaster {
+	return &InterceptedMaster{Master: master, interceptors: interceptors}
+}
+
+// Use appends interceptors to the chain
+func (m *InterceptedMaster) Use(interceptors ...Interceptor) *InterceptedMaster {
+	m.lock.Lock()
+	m.interceptors = append(m.interceptors, interceptors...)
+	m.lock.Unlock()
+	return m
+}
+
+// Invoke implements Master
+func (m *InterceptedMaster) Invoke(method uint8, params proto.Message, addrs RouteAddr) Invocation {
+	return m.InvokeClass(nil, method, params, addrs)
+}
+
+// InvokeClass implements ClassInvoker
+func (m *InterceptedMaster) InvokeClass(class *ClassDesc, method uint8, params proto.Message, addrs RouteAddr) Invocation {
+	m.lock.RLock()
+	chain := ChainInterceptors(m.interceptors...)
+	m.lock.RUnlock()
+	call := &Call{Class: class, Method: method, Addrs: addrs, Params: params,
+		Start: ClockOrSystem(m.Clock).Now()}
+	return chain(call, m.dispatch)
+}
+
+// Subscribe implements Master
+func (m *InterceptedMaster) Subscribe(channel uint8, addrs RouteAddr, handler EventHandler) EventSubscription {
+	return m.Master.Subscribe(channel, addrs, handler)
+}
+
+func (m *InterceptedMaster) dispatch(call *Call) Invocation {
+	var inv Invocation
+	if invoker, ok := m.Master.(ClassInvoker); ok && call.Class != nil {
+		inv = invoker.InvokeClass(call.Class, call.Method, call.Params, call.Addrs)
+	} else {
+		inv = m.Master.Invoke(call.Method, call.Params, call.Addrs)
+	}
+	if call.Timeout != 0 {
+		inv.Timeout(call.Timeout)
+	}
+	return inv
+}
+
+// ReplyInvocation is a completed Invocation with the reply, it's used by
+// interceptors to short-circuit calls
+func ReplyInvocation(reply proto.Message) Invocation {
+	msg := BuildMsg().EncodeBody(0, reply).Build()
+	return &replyInvocation{msg: *msg}
+}
+
+type replyInvocation struct {
+	msg Msg
+}
+
+func (i *replyInvocation) Recv() (MsgReceiver, error) {
+	return i, nil
+}
+
+func (i *replyInvocation) MsgChan() <-chan Msg {
+	ch := make(chan Msg, 1)
+	ch <- i.msg
+	return ch
+}
+
+func (i *replyInvocation) MsgID() MsgID {
+	return nil
+}
+
+func (i *replyInvocation) Timeout(time.Duration) Invocation {
+	return i
+}
+
+func (i *replyInvocation) Result(reply proto.Message) error {
+	return i.msg.Body.Decode(reply)
+}
+
+func (i *replyInvocation) Ignore() {
+}
+
+// ObserveInterceptor calls fn when the result of each call is received
+// or the call is ignored, with the error and the latency since the call
+// is invoked measured by clock, nil clock uses SystemClock
+func ObserveInterceptor(clock Clock, fn func(call *Call, err error, latency time.Duration)) Interceptor {
+	clock = ClockOrSystem(clock)
+	return func(call *Call, next Invoker) Invocation {
+		start := clock.Now()
+		return &observedInvocation{Invocation: next(call), call: call, fn: fn, clock: clock, start: start}
+	}
+}
+
+type observedInvocation struct {
+	Invocation
+	call  *Call
+	fn    func(*Call, error, time.Duration)
+	clock Clock
+	start time.Time
+}
+
+func (i *observedInvocation) Timeout(dur time.Duration) Invocation {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+func (i *observedInvocation) Result(reply proto.Message) error {
+	err := i.Invocation.Result(reply)
+	i.fn(i.call, err, i.clock.Now().Sub(i.start))
+	return err
+}
+
+func (i *observedInvocation) Ignore() {
+	i.Invocation.Ignore()
+	i.fn(i.call, nil, i.clock.Now().Sub(i.start))
+}
+
+// RetryInterceptor retries failed calls up to attempts times in total when
+// the result is received, retryable decides which errors are retried, nil
+// retries timeouts only
+func RetryInterceptor(attempts int, retryable func(error) bool) Interceptor {
+	if retryable == nil {
+		retryable = func(err error) bool { return err == ErrRecvTimeout }
+	}
+	return func(call *Call, next Invoker) Invocation {
+		return &retriedInvocation{inv: next(call), call: call, next: next,
+			attempts: attempts, retryable: retryable}
+	}
+}
+
+type retriedInvocation struct {
+	inv       Invocation
+	call      *Call
+	next      Invoker
+	attempts  int
+	retryable func(error) bool
+	timeout   time.Duration
+	lock      sync.Mutex
+}
+
+func (i *retriedInvocation) current() Invocation {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.inv
+}
+
+func (i *retriedInvocation) Recv() (MsgReceiver, error) {
+	return i.current().Recv()
+}
+
+func (i *retriedInvocation) MsgID() MsgID {
+	return i.current().MsgID()
+}
+
+func (i *retriedInvocation) Timeout(dur time.Duration) Invocation {
+	i.lock.Lock()
+	i.timeout = dur
+	i.lock.Unlock()
+	i.current().Timeout(dur)
+	return i
+}
+
+func (i *retriedInvocation) Result(reply proto.Message) error {
+	for n := 1; ; n++ {
+		err := i.current().Result(reply)
+		if err == nil || n >= i.attempts || !i.retryable(err) {
+			return err
+		}
+		inv := i.next(i.call)
+		i.lock.Lock()
+		if i.timeout != 0 {
+			inv.Timeout(i.timeout)
+		}
+		i.inv = inv
+		i.lock.Unlock()
+	}
+}
+
+func (i *retriedInvocation) Ignore() {
+	i.current().Ignore()
+}
@@ -0,0 +1,124 @@
+package tbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInterceptor(t *testing.T) {
+	Convey("Interceptor", t, func() {
+		bus := NewLocalBus()
+		ledLogic := &testLED{}
+		led := NewLEDDev(ledLogic)
+		bus.Plug(led)
+		master := NewInterceptedMaster(NewLocalMaster(NewBusDev(bus)))
+		ledctl := NewLEDCtl(master).SetAddress(DeviceAddress(led))
+
+		Convey("order and observation", func() {
+			var trace []string
+			var observed *Call
+			var latency time.Duration
+			trace1 := func(call *Call, next Invoker) Invocation {
+				trace = append(trace, "1:"+call.MethodName())
+				return next(call)
+			}
+			trace2 := func(call *Call, next Invoker) Invocation {
+				trace = append(trace, "2:"+call.Addrs.String())
+				return next(call)
+			}
+			master.Use(trace1, trace2, ObserveInterceptor(nil, func(call *Call, err error, d time.Duration) {
+				observed, latency = call, d
+			}))
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(ledLogic.on, ShouldBeTrue)
+			So(trace, ShouldResemble, []string{"1:LED.SetPowerState", "2:/1"})
+			So(observed.Class, ShouldEqual, LEDClass)
+			So(observed.Params.(*LEDPowerState).On, ShouldBeTrue)
+			So(latency, ShouldBeGreaterThan, 0)
+
+			info, err := NewBusCtl(master).SetAddress(DeviceAddress(led)).DeviceInfo()
+			So(err, ShouldBeNil)
+			So(info.ClassId, ShouldEqual, LEDClassID)
+			So(trace[2], ShouldEqual, "1:Bus.DeviceInfo")
+
+			So(master.Invoke(0, nil, DeviceAddress(led)).Result(&info), ShouldBeNil)
+			So(trace[4], ShouldEqual, "1:DeviceInfo")
+		})
+
+		Convey("modify and short-circuit", func() {
+			master.Use(func(call *Call, next Invoker) Invocation {
+				if call.Method == 1 {
+					call.Params = &LEDPowerState{On: !call.Params.(*LEDPowerState).On}
+				}
+				return next(call)
+			}, func(call *Call, next Invoker) Invocation {
+				if call.Method == 0 {
+					return ReplyInvocation(&DeviceInfo{DeviceId: 99})
+				}
+				return next(call)
+			})
+			So(ledctl.Off().Wait(), ShouldBeNil)
+			So(ledLogic.on, ShouldBeTrue)
+			info, err := ledctl.DeviceInfo()
+			So(err, ShouldBeNil)
+			So(info.DeviceId, ShouldEqual, 99)
+			inv := master.Invoke(0, nil, DeviceAddress(led))
+			So(inv.MsgID(), ShouldBeNil)
+			recv, err := inv.Recv()
+			So(err, ShouldBeNil)
+			msg := <-recv.MsgChan()
+			So(msg.Body.Decode(&info), ShouldBeNil)
+			So(info.DeviceId, ShouldEqual, 99)
+		})
+
+		Convey("dispatch in Invoke", func() {
+			dispatched := 0
+			master.Use(func(call *Call, next Invoker) Invocation {
+				dispatched++
+				return next(call)
+			})
+			// fire-and-forget is sent without waiting
+			ledLogic.on = true
+			ledctl.Off()
+			So(dispatched, ShouldEqual, 1)
+			So(ledLogic.on, ShouldBeFalse)
+
+			inv := ledctl.On()
+			So(inv.MsgID(), ShouldNotBeNil)
+			recv, err := inv.Recv()
+			So(err, ShouldBeNil)
+			So(recv, ShouldNotBeNil)
+			So(inv.Result(nil), ShouldBeNil)
+			So(inv.Timeout(time.Millisecond).Result(nil), ShouldEqual, ErrRecvTimeout)
+			So(dispatched, ShouldEqual, 2)
+		})
+
+		Convey("retry", func() {
+			failures := 2
+			attempts := 0
+			master.Use(RetryInterceptor(3, nil), func(call *Call, next Invoker) Invocation {
+				attempts++
+				if failures > 0 {
+					failures--
+					return &FailedInvocation{Err: ErrRecvTimeout}
+				}
+				return next(call)
+			})
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(attempts, ShouldEqual, 3)
+
+			errFatal := fmt.Errorf("fatal")
+			master = NewInterceptedMaster(master.Master, RetryInterceptor(3, nil),
+				func(call *Call, next Invoker) Invocation {
+					attempts++
+					return &FailedInvocation{Err: errFatal}
+				})
+			attempts = 0
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(led)).On().Wait(), ShouldEqual, errFatal)
+			So(attempts, ShouldEqual, 1)
+		})
+	})
+}
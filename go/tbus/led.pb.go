@@ -4,6 +4,7 @@
 
 package tbus
 
+import "context"
 import "time"
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
@@ -52,12 +53,27 @@ var fileDescriptor3 = []byte{
 // LEDClassID is the class ID of LED
 const LEDClassID uint32 = 0x0010
 
+// LEDClass is the registered descriptor of LED
+var LEDClass = RegisterClass(&ClassDesc{
+    Name:    "LED",
+    ClassID: LEDClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "SetPowerState", ParamType: "tbus.LEDPowerState"},
+    },
+})
+
 // LEDLogic defines the logic interface
 type LEDLogic interface {
     DeviceLogic
     SetPowerState(*LEDPowerState) error
 }
 
+// LEDContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type LEDContextLogic interface {
+    SetPowerStateContext(context.Context, *LEDPowerState) error
+}
+
 // LEDDev is the device
 type LEDDev struct {
     DeviceBase
@@ -77,21 +93,50 @@ func (d *LEDDev) DispatchMsg(msg *Msg) (err error) {
     if msg.Head.NeedRoute() {
         return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
     }
-    var reply proto.Message
+    call := &DeviceCall{Device: d, Class: LEDClass, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
     case 0:
-        devInfo := d.DeviceInfo()
-        reply = &devInfo
     case 1: // SetPowerState
-        params := &LEDPowerState{}
-        err = msg.Body.Decode(params)
-        if err == nil {
-            err = d.Logic.SetPowerState(params)
+        call.Params = &LEDPowerState{}
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
         }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *LEDDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(LEDContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // SetPowerState
+        err = d.Logic.SetPowerState(call.Params.(*LEDPowerState))
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *LEDDev) invokeContext(logic LEDContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // SetPowerState
+        err = logic.SetPowerStateContext(call.Context, call.Params.(*LEDPowerState))
     default:
         err = ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
 }
 
 // SetDeviceID sets device id
@@ -109,6 +154,7 @@ type LEDCtl struct {
 func NewLEDCtl(master Master) *LEDCtl {
     c := &LEDCtl{}
     c.Master = master
+    c.Class = LEDClass
     return c
 }
 
@@ -0,0 +1,117 @@
+package tbus
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Service is a runnable component with a Start/Close lifecycle
+type Service interface {
+	// Start runs the component in background
+	Start() error
+	// Close stops the component and waits until it's stopped or ctx is done
+	Close(ctx context.Context) error
+	// Done is closed when the component stops
+	Done() <-chan struct{}
+	// Err returns the error the component stopped with
+	Err() error
+}
+
+// runState tracks a component running either by a blocking Run or
+// in background by Start
+type runState struct {
+	lock     sync.Mutex
+	running  bool
+	finished bool
+	done     chan struct{}
+	err      error
+}
+
+// begin marks the component running
+func (s *runState) begin() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running {
+		return ErrAlreadyRunning
+	}
+	s.running = true
+	if s.done == nil || s.finished {
+		s.done = make(chan struct{})
+	}
+	s.finished, s.err = false, nil
+	return nil
+}
+
+// end marks the component stopped with err
+func (s *runState) end(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running, s.finished, s.err = false, true, err
+	close(s.done)
+}
+
+// run runs fn in current goroutine
+func (s *runState) run(fn func() error) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	err := fn()
+	s.end(err)
+	return err
+}
+
+// start runs fn in background
+func (s *runState) start(fn func() error) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	go func() {
+		s.end(fn())
+	}()
+	return nil
+}
+
+// wait waits until the current run stops or ctx is done, it returns
+// immediately if not running
+func (s *runState) wait(ctx context.Context) error {
+	s.lock.Lock()
+	running, done := s.running, s.done
+	s.lock.Unlock()
+	if !running {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopped is closed when the current or last run stops
+func (s *runState) stopped() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// result returns the error the last run stopped with
+func (s *runState) result() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// closeStream closes reader and writer if they are closable
+func closeStream(r io.Reader, w io.Writer) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := w.(io.Closer); ok && interface{}(w) != interface{}(r) {
+		c.Close()
+	}
+}
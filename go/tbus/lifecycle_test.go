@@ -0,0 +1,144 @@
+package tbus
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLifecycle(t *testing.T) {
+	Convey("Lifecycle", t, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		Convey("master", func() {
+			// nobody replies on the other side
+			conn, _ := Pipe(PipeOptions{Buffer: 1024})
+			master := NewLocalMaster(NewStreamDevice(LEDClassID, conn))
+			master.InvocationTimeout = 0
+			pending := func() int {
+				master.lock.Lock()
+				defer master.lock.Unlock()
+				return len(master.invocations)
+			}
+			chn := NewButtonCtl(master).State()
+			result := make(chan error, 1)
+			go func() {
+				result <- NewLEDCtl(master).On().Wait()
+			}()
+			for pending() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(master.Close(ctx), ShouldBeNil)
+			So(<-result, ShouldEqual, ErrMasterClosed)
+			So(pending(), ShouldEqual, 0)
+			<-master.Done()
+			So(master.Close(ctx), ShouldBeNil)
+
+			So(NewLEDCtl(master).Off().Wait(), ShouldEqual, ErrMasterClosed)
+			So(BuildMsg().EncodeEvent(0, 1, &ButtonState{Pressed: true}).Build().Dispatch(master), ShouldBeNil)
+			_, ok := <-chn.C
+			So(ok, ShouldBeFalse)
+			So(chn.Close(), ShouldBeNil)
+			So(NewButtonCtl(master).State().Close(), ShouldBeNil)
+		})
+
+		Convey("subscriptions", func() {
+			bus := NewLocalBus()
+			btnLogic := &testButton{}
+			btn := NewButtonDev(btnLogic)
+			bus.Plug(btn)
+			master := NewLocalMaster(NewBusDev(bus))
+			chn := NewButtonCtl(master).SetAddress(DeviceAddress(btn)).State()
+			received := make(chan bool, 1)
+			exited := make(chan struct{})
+			go func() {
+				defer close(exited)
+				for state := range chn.C {
+					select {
+					case received <- state.Pressed:
+					default:
+					}
+				}
+			}()
+			// nobody receives from dynChn, so its handler blocks on sending
+			dynChn, err := NewDynamicCtl(master, DeviceAddress(btn), ButtonClass).Watch("State")
+			So(err, ShouldBeNil)
+			btnLogic.simulatePressed(true)
+			So(<-received, ShouldBeTrue)
+
+			So(master.Close(ctx), ShouldBeNil)
+			select {
+			case <-exited:
+			case <-ctx.Done():
+				So("consumer not exited after closing", ShouldBeNil)
+			}
+			for range dynChn.C {
+			}
+			So(chn.Close(), ShouldBeNil)
+			So(dynChn.Close(), ShouldBeNil)
+
+			late := NewButtonCtl(master).State()
+			_, ok := <-late.C
+			So(ok, ShouldBeFalse)
+			So(late.Close(), ShouldBeNil)
+		})
+
+		Convey("host", func() {
+			listener := NewPipeListener("host", PipeOptions{Buffer: 1024})
+			host := NewRemoteDeviceHost(listener)
+			So(host.Start(), ShouldBeNil)
+			So(host.Start(), ShouldEqual, ErrAlreadyRunning)
+
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), listener)
+			So(port.Start(), ShouldBeNil)
+			var dev RemoteDevice
+			select {
+			case dev = <-host.AcceptChan():
+			case <-ctx.Done():
+			}
+			So(dev == nil, ShouldBeFalse)
+			master := NewLocalMaster(dev)
+			So(dev.Start(), ShouldBeNil)
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+
+			// accepted but not taken from AcceptChan
+			pending := NewRemoteBusPort(NewLEDDev(&testLED{}), listener)
+			So(pending.Start(), ShouldBeNil)
+
+			So(host.Close(ctx), ShouldBeNil)
+			<-host.Done()
+			So(host.Err(), ShouldBeNil)
+			<-dev.Done()
+			So(dev.Err(), ShouldBeNil)
+			So(dev.Close(ctx), ShouldBeNil)
+			So(port.Close(ctx), ShouldBeNil)
+			So(port.Err(), ShouldBeNil)
+			So(pending.Close(ctx), ShouldBeNil)
+			So(pending.Err(), ShouldBeNil)
+			So(master.Close(ctx), ShouldBeNil)
+		})
+
+		Convey("timeout", func() {
+			conns := make(chan io.ReadWriteCloser)
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), DialerFunc(func() (io.ReadWriteCloser, error) {
+				return <-conns, nil
+			}))
+			So(port.Start(), ShouldBeNil)
+			expired, stop := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer stop()
+			So(port.Close(expired) == context.DeadlineExceeded, ShouldBeTrue)
+
+			// the connection dialed after Close is closed
+			c1, c2 := Pipe(PipeOptions{})
+			conns <- c1
+			So(port.Close(ctx), ShouldBeNil)
+			_, err := c2.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+	})
+}
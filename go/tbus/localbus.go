@@ -10,6 +10,10 @@ import (
 // LocalBus implements BusLogic and manages local devices
 type LocalBus struct {
 	LogicBase
+	// Logger logs plugging and routing failures,
+	// the default Logger is used if nil
+	Logger Logger
+
 	port    localBusPort
 	addrs   *bitset.BitSet
 	devices map[uint8]Device
@@ -41,7 +45,10 @@ func (b *LocalBus) Plug(dev Device) error {
 		b.addrs.SetTo(index, false)
 		b.devices[addr] = dev
 		dev.AttachTo(&b.port, addr)
+		CurrentMetrics().Gauge(MetricDevices).Add(1)
+		b.logger().Debug("device plugged", LogKeyAddr, addr, LogKeyClass, ClassName(dev.DeviceInfo().ClassId))
 	} else {
+		b.logger().Warn("no address available for device", LogKeyClass, ClassName(dev.DeviceInfo().ClassId))
 		return ErrAddrNotAvail
 	}
 	return nil
@@ -53,9 +60,14 @@ func (b *LocalBus) Unplug(dev Device) error {
 	if addr != 0 {
 		b.lock.Lock()
 		defer b.lock.Unlock()
+		if b.devices[addr] != dev {
+			return nil
+		}
 		dev.AttachTo(nil, 0)
 		delete(b.devices, addr)
 		b.addrs.SetTo(uint(addr), true)
+		CurrentMetrics().Gauge(MetricDevices).Add(-1)
+		b.logger().Debug("device unplugged", LogKeyAddr, addr, LogKeyClass, ClassName(dev.DeviceInfo().ClassId))
 	}
 	return nil
 }
@@ -67,9 +79,12 @@ func (b *LocalBus) RouteMsg(msg *Msg) error {
 	device := b.devices[addr]
 	b.lock.RUnlock()
 	if device == nil {
+		CurrentMetrics().Counter(MetricRouteErrors).Add(1)
+		b.logger().Warn("route to invalid address", LogKeyAddr, addr, LogKeyMsgID, logMsgID(msg.Head.MsgID))
 		return SendReply(b.Device.BusPort(), msg.Head.MsgID, nil, ErrInvalidAddr)
 	}
 	msg.Head.Addrs = msg.Head.Addrs[1:]
+	msg.Routed = append(append(RouteAddr(nil), msg.Routed...), addr)
 	return device.DispatchMsg(msg)
 }
 
@@ -94,6 +109,10 @@ func (b *LocalBus) Enumerate() (*BusEnumeration, error) {
 	return enum, nil
 }
 
+func (b *LocalBus) logger() Logger {
+	return LoggerOrDefault(b.Logger)
+}
+
 func (b *LocalBus) sendToHost(msg *Msg) error {
 	if b.Device == nil {
 		return ErrNoAssocDevice
@@ -0,0 +1,75 @@
+package tbus
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// Logger is a structured logger, args are alternating keys and values.
+// *slog.Logger implements it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Keys of structured log fields
+const (
+	LogKeyAddr   = "addr"
+	LogKeyMsgID  = "msg_id"
+	LogKeyClass  = "class"
+	LogKeyMethod = "method"
+	LogKeyPeer   = "peer"
+	LogKeyError  = "err"
+)
+
+// NopLogger discards all logs
+type NopLogger struct{}
+
+// Debug implements Logger
+func (NopLogger) Debug(string, ...interface{}) {}
+
+// Info implements Logger
+func (NopLogger) Info(string, ...interface{}) {}
+
+// Warn implements Logger
+func (NopLogger) Warn(string, ...interface{}) {}
+
+// Error implements Logger
+func (NopLogger) Error(string, ...interface{}) {}
+
+var (
+	logger     Logger = NopLogger{}
+	loggerLock sync.RWMutex
+)
+
+// SetLogger sets the default Logger used when a component has no Logger,
+// nil disables logging
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	loggerLock.Lock()
+	logger = l
+	loggerLock.Unlock()
+}
+
+// CurrentLogger returns the default Logger
+func CurrentLogger() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// LoggerOrDefault returns l if not nil, otherwise the default Logger
+func LoggerOrDefault(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	return CurrentLogger()
+}
+
+func logMsgID(id MsgID) string {
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,24 @@
+//go:build go1.21
+// +build go1.21
+
+package tbus
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSlogLogger(t *testing.T) {
+	Convey("slog compatible", t, func() {
+		var buf bytes.Buffer
+		var logger Logger = slog.New(slog.NewTextHandler(&buf, nil))
+		bus := NewLocalBus()
+		bus.Logger = logger
+		master := NewLocalMaster(NewBusDev(bus))
+		So(NewLEDCtl(master).SetAddress(RouteWith(3)).On().Wait(), ShouldNotBeNil)
+		So(buf.String(), ShouldContainSubstring, "level=WARN msg=\"route to invalid address\" addr=3 msg_id=")
+	})
+}
@@ -0,0 +1,84 @@
+package tbus
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type logRecord struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordLogger struct {
+	records []logRecord
+	lock    sync.Mutex
+}
+
+func (l *recordLogger) log(level, msg string, args []interface{}) {
+	rec := logRecord{level: level, msg: msg, fields: make(map[string]interface{})}
+	for n := 0; n+1 < len(args); n += 2 {
+		rec.fields[fmt.Sprint(args[n])] = args[n+1]
+	}
+	l.lock.Lock()
+	l.records = append(l.records, rec)
+	l.lock.Unlock()
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *recordLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+func (l *recordLogger) find(msg string) *logRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for n := range l.records {
+		if l.records[n].msg == msg {
+			return &l.records[n]
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Logger", t, func() {
+		Convey("master", func() {
+			logger := &recordLogger{}
+			master := NewLocalMaster(NewLEDDev(&testLED{}))
+			master.Logger = logger
+			master.recvReply(*BuildMsg().MsgID(MsgID{0x80}).EncodeBody(0, nil).Build())
+			rec := logger.find("discard reply with invalid msg ID")
+			So(rec, ShouldNotBeNil)
+			So(rec.level, ShouldEqual, "warn")
+			So(rec.fields[LogKeyMsgID], ShouldEqual, "80")
+
+			master.recvReply(*BuildMsg().MsgIDVarInt(9).EncodeBody(0, nil).Build())
+			So(logger.find("discard reply of unknown invocation"), ShouldNotBeNil)
+		})
+
+		Convey("default logger", func() {
+			logger := &recordLogger{}
+			SetLogger(logger)
+			defer SetLogger(nil)
+			So(LoggerOrDefault(nil), ShouldEqual, logger)
+
+			hostConn, devConn := net.Pipe()
+			go func() {
+				devConn.Write([]byte{0x00})
+				devConn.Close()
+			}()
+			_, err := AcceptRemoteDevice(hostConn)
+			So(err, ShouldNotBeNil)
+			rec := logger.find("device handshake failed")
+			So(rec, ShouldNotBeNil)
+			So(rec.fields, ShouldContainKey, LogKeyPeer)
+			So(rec.fields[LogKeyError], ShouldEqual, err)
+		})
+	})
+}
@@ -2,6 +2,8 @@ package tbus
 
 import (
 	"container/list"
+	"context"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,13 +19,21 @@ const (
 type LocalMaster struct {
 	Device            Device
 	InvocationTimeout time.Duration
+	// Clock is used for invocation timeouts
+	Clock Clock
+	// Logger logs discarded messages and failed invocations,
+	// the default Logger is used if nil
+	Logger Logger
 
 	idPool      MinIDGen
 	invocations map[uint32]*localMasterInvocation
+	closed      bool
+	done        chan struct{}
 	lock        sync.Mutex
 
 	subs     map[uint8]*pfxMap
 	subsLock sync.RWMutex
+	handlers sync.WaitGroup
 }
 
 // NewLocalMaster creates a LocalMaster
@@ -31,6 +41,7 @@ func NewLocalMaster(dev Device) *LocalMaster {
 	m := &LocalMaster{
 		Device:            dev,
 		InvocationTimeout: DefaultInvocationTimeout,
+		Clock:             SystemClock,
 
 		invocations: make(map[uint32]*localMasterInvocation),
 		subs:        make(map[uint8]*pfxMap),
@@ -41,25 +52,56 @@ func NewLocalMaster(dev Device) *LocalMaster {
 
 // Invoke implements Master
 func (m *LocalMaster) Invoke(method uint8, params proto.Message, addrs RouteAddr) Invocation {
-	inv := &localMasterInvocation{master: m, timeout: m.InvocationTimeout}
+	return m.InvokeClass(nil, method, params, addrs)
+}
+
+// InvokeClass implements ClassInvoker, class is only used for metrics
+func (m *LocalMaster) InvokeClass(class *ClassDesc, method uint8, params proto.Message, addrs RouteAddr) Invocation {
+	inv := &localMasterInvocation{
+		master:  m,
+		timeout: m.InvocationTimeout,
+		clock:   ClockOrSystem(m.Clock),
+		// the reply may arrive before Dispatch returns
+		replyCh: make(chan Msg, 1),
+		labels:  methodLabels(class, method),
+	}
+	inv.start = inv.clock.Now()
+	var trace TraceContext
+	if tracer := CurrentTracer(); tracer != nil {
+		inv.span = tracer.StartSpan(inv.labels[1]+"."+inv.labels[3], TraceContext{},
+			"side", "master", "address", addrs.String())
+		trace = inv.span.Trace
+	}
+	metrics := CurrentMetrics()
+	metrics.Counter(MetricInvocations, inv.labels...).Add(1)
 
 	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		inv.err = ErrMasterClosed
+		metrics.Counter(MetricErrors, append(inv.labels, "kind", "closed")...).Add(1)
+		inv.finishSpan(inv.err)
+		return inv
+	}
 	inv.msgID = m.idPool.Alloc()
 	if m.invocations == nil {
 		m.invocations = make(map[uint32]*localMasterInvocation)
 	}
 	m.invocations[inv.msgID] = inv
 	m.lock.Unlock()
+	metrics.Gauge(MetricPending).Add(1)
 
 	if inv.err = BuildMsg().
 		RouteTo(addrs).
 		MsgIDVarInt(inv.msgID).
+		Trace(trace).
 		EncodeBody(method, params).
 		Build().
 		Dispatch(m.Device); inv.err != nil {
+		metrics.Counter(MetricErrors, append(inv.labels, "kind", "dispatch")...).Add(1)
+		m.logger().Warn("dispatch invocation failed", inv.logArgs(LogKeyAddr, addrs.String(), LogKeyError, inv.err)...)
+		inv.finishSpan(inv.err)
 		inv.release()
-	} else {
-		inv.replyCh = make(chan Msg, 1)
 	}
 
 	return inv
@@ -68,6 +110,13 @@ func (m *LocalMaster) Invoke(method uint8, params proto.Message, addrs RouteAddr
 // Subscribe implements Master
 func (m *LocalMaster) Subscribe(channel uint8, addrs RouteAddr, handler EventHandler) EventSubscription {
 	m.subsLock.Lock()
+	if m.isClosed() {
+		m.subsLock.Unlock()
+		// never receives events
+		sub := &subscription{master: m, handler: handler}
+		sub.notifyClose()
+		return sub
+	}
 	defer m.subsLock.Unlock()
 	subsMap := m.subs[channel]
 	if subsMap == nil {
@@ -107,6 +156,93 @@ func (m *LocalMaster) Unsubscribe(sub EventSubscription) error {
 	return nil
 }
 
+// Close fails all pending invocations with ErrMasterClosed and closes all
+// subscriptions, then waits until events being delivered are handled or
+// ctx is done. Handlers implementing EventCloseHandler are notified of the
+// closed subscriptions. Invocations and subscriptions after Close are failed
+// or never receive events.
+func (m *LocalMaster) Close(ctx context.Context) error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return m.wait(ctx)
+	}
+	m.closed = true
+	invocations := m.invocations
+	m.invocations = make(map[uint32]*localMasterInvocation)
+	for msgID := range invocations {
+		m.idPool.Release(msgID)
+	}
+	done := m.doneChan()
+	m.lock.Unlock()
+
+	metrics := CurrentMetrics()
+	for _, inv := range invocations {
+		metrics.Gauge(MetricPending).Add(-1)
+		metrics.Counter(MetricErrors, append(inv.labels, "kind", "closed")...).Add(1)
+		inv.finishSpan(ErrMasterClosed)
+		// the invocation is removed, so no reply will be sent to it
+		close(inv.replyCh)
+	}
+	if len(invocations) > 0 {
+		m.logger().Info("master closed with pending invocations", "pending", len(invocations))
+	}
+
+	var closed []*subscription
+	m.subsLock.Lock()
+	for _, subsMap := range m.subs {
+		subsMap.each(func(val interface{}) {
+			subs := val.(*subscribers)
+			for elem := subs.subs.Front(); elem != nil; elem = subs.subs.Front() {
+				sub := elem.Value.(*subscription)
+				subs.remove(sub)
+				closed = append(closed, sub)
+			}
+		})
+	}
+	m.subs = make(map[uint8]*pfxMap)
+	m.subsLock.Unlock()
+	// notified without lock, so handlers are able to close subscriptions
+	for _, sub := range closed {
+		sub.notifyClose()
+	}
+	go func() {
+		m.handlers.Wait()
+		close(done)
+	}()
+	return m.wait(ctx)
+}
+
+// Done is closed when the master is closed and all delivered events are handled
+func (m *LocalMaster) Done() <-chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.doneChan()
+}
+
+// doneChan must be called with lock held
+func (m *LocalMaster) doneChan() chan struct{} {
+	if m.done == nil {
+		m.done = make(chan struct{})
+	}
+	return m.done
+}
+
+func (m *LocalMaster) wait(ctx context.Context) error {
+	select {
+	case <-m.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *LocalMaster) isClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
 // DispatchMsg implements BusPort
 func (m *LocalMaster) DispatchMsg(msg *Msg) error {
 	if msg.Head.IsEvent() {
@@ -119,15 +255,20 @@ func (m *LocalMaster) DispatchMsg(msg *Msg) error {
 func (m *LocalMaster) dispatchEvent(msg *Msg) error {
 	m.subsLock.RLock()
 	defer m.subsLock.RUnlock()
+	channel := strconv.Itoa(int(msg.Body.Flag))
 	subsMap := m.subs[msg.Body.Flag]
-	if subsMap == nil {
-		return nil
+	var val interface{}
+	if subsMap != nil {
+		val = subsMap.lookup(msg.Head.Addrs)
 	}
-	val := subsMap.lookup(msg.Head.Addrs)
 	if val == nil {
+		CurrentMetrics().Counter(MetricEventsDropped, "channel", channel).Add(1)
+		m.logger().Debug("drop event without subscribers", LogKeyAddr, msg.Head.Addrs.String(), "channel", channel)
 		return nil
 	}
-	val.(*subscribers).emit(msg)
+	subs := val.(*subscribers)
+	CurrentMetrics().Counter(MetricEventsDelivered, "channel", channel).Add(float64(subs.subs.Len()))
+	subs.emit(msg)
 	return nil
 }
 
@@ -135,6 +276,8 @@ func (m *LocalMaster) recvReply(msg Msg) {
 	msgID, err := msg.Head.MsgID.VarInt()
 	if err != nil {
 		// discard improper message
+		m.logger().Warn("discard reply with invalid msg ID",
+			LogKeyMsgID, logMsgID(msg.Head.MsgID), LogKeyError, err)
 		return
 	}
 	m.lock.Lock()
@@ -144,11 +287,28 @@ func (m *LocalMaster) recvReply(msg Msg) {
 		m.idPool.Release(msgID)
 	}
 	m.lock.Unlock()
-	if inv != nil && inv.replyCh != nil {
+	if inv == nil {
+		m.logger().Debug("discard reply of unknown invocation", LogKeyMsgID, logMsgID(msg.Head.MsgID))
+		return
+	}
+	metrics := CurrentMetrics()
+	metrics.Gauge(MetricPending).Add(-1)
+	metrics.Histogram(MetricReplyLatency, inv.labels...).Observe(inv.clock.Now().Sub(inv.start).Seconds())
+	if msg.Body.IsError() {
+		metrics.Counter(MetricErrors, append(inv.labels, "kind", "remote")...).Add(1)
+		inv.finishSpan(msg.Body.Decode(nil))
+	} else {
+		inv.finishSpan(nil)
+	}
+	if inv.replyCh != nil {
 		inv.replyCh <- msg
 	}
 }
 
+func (m *LocalMaster) logger() Logger {
+	return LoggerOrDefault(m.Logger)
+}
+
 type subscribers struct {
 	master  *LocalMaster
 	channel uint8
@@ -157,7 +317,7 @@ type subscribers struct {
 }
 
 func (s *subscribers) add(handler EventHandler) *subscription {
-	sub := &subscription{owner: s, handler: handler}
+	sub := &subscription{master: s.master, owner: s, handler: handler}
 	sub.elem = s.subs.PushBack(sub)
 	return sub
 }
@@ -184,6 +344,7 @@ func (s *subscribers) emit(msg *Msg) {
 }
 
 type subscription struct {
+	master  *LocalMaster
 	owner   *subscribers
 	handler EventHandler
 	elem    *list.Element
@@ -191,11 +352,22 @@ type subscription struct {
 
 func (s *subscription) emit(msg *Msg) {
 	evt := &subscribedEvent{msg: *msg}
-	go s.handler.HandleEvent(evt, s)
+	s.master.handlers.Add(1)
+	go func() {
+		defer s.master.handlers.Done()
+		s.handler.HandleEvent(evt, s)
+	}()
 }
 
 func (s *subscription) Close() error {
-	return s.owner.master.Unsubscribe(s)
+	return s.master.Unsubscribe(s)
+}
+
+// notifyClose tells the handler the subscription is closed by the master
+func (s *subscription) notifyClose() {
+	if h, ok := s.handler.(EventCloseHandler); ok {
+		h.HandleClose(s)
+	}
 }
 
 type subscribedEvent struct {
@@ -220,6 +392,10 @@ type localMasterInvocation struct {
 	msgID   uint32
 	replyCh chan Msg
 	timeout time.Duration
+	clock   Clock
+	start   time.Time
+	labels  []string
+	span    *Span
 }
 
 func (c *localMasterInvocation) Recv() (MsgReceiver, error) {
@@ -253,13 +429,22 @@ func (c *localMasterInvocation) Result(reply proto.Message) error {
 		msg, ok = <-recv.MsgChan()
 	} else {
 		select {
-		case <-time.After(c.timeout):
+		case <-c.clock.After(c.timeout):
+			metrics := CurrentMetrics()
+			metrics.Counter(MetricTimeouts, c.labels...).Add(1)
+			metrics.Counter(MetricErrors, append(c.labels, "kind", "timeout")...).Add(1)
+			c.finishSpan(ErrRecvTimeout)
+			c.master.logger().Warn("invocation timeout", c.logArgs()...)
+			c.release()
 			return ErrRecvTimeout
 		case msg, ok = <-recv.MsgChan():
 			break
 		}
 	}
 	if !ok {
+		if c.master != nil && c.master.isClosed() {
+			return ErrMasterClosed
+		}
 		return ErrRecvEnd
 	}
 
@@ -267,16 +452,35 @@ func (c *localMasterInvocation) Result(reply proto.Message) error {
 }
 
 func (c *localMasterInvocation) Ignore() {
+	c.finishSpan(nil)
 	c.release()
 }
 
+func (c *localMasterInvocation) logArgs(args ...interface{}) []interface{} {
+	fields := []interface{}{LogKeyMsgID, logMsgID(c.MsgID())}
+	for _, label := range c.labels {
+		fields = append(fields, label)
+	}
+	return append(fields, args...)
+}
+
+func (c *localMasterInvocation) finishSpan(err error) {
+	if c.span != nil {
+		c.span.Finish(err)
+	}
+}
+
 func (c *localMasterInvocation) release() {
 	if c.master != nil {
 		c.master.lock.Lock()
-		if c.master.invocations != nil {
+		_, pending := c.master.invocations[c.msgID]
+		if pending {
 			delete(c.master.invocations, c.msgID)
 			c.master.idPool.Release(c.msgID)
 		}
 		c.master.lock.Unlock()
+		if pending {
+			CurrentMetrics().Gauge(MetricPending).Add(-1)
+		}
 	}
 }
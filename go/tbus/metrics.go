@@ -0,0 +1,325 @@
+package tbus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Counter is a monotonically increasing metric
+type Counter interface {
+	Add(delta float64)
+}
+
+// Gauge is a metric which can go up and down
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram samples observations into buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Metrics creates metric instruments, labels are name/value pairs
+type Metrics interface {
+	Counter(name string, labels ...string) Counter
+	Gauge(name string, labels ...string) Gauge
+	Histogram(name string, labels ...string) Histogram
+}
+
+// Metric names used by instrumentation
+const (
+	MetricInvocations     = "tbus_master_invocations_total"
+	MetricReplyLatency    = "tbus_master_reply_latency_seconds"
+	MetricTimeouts        = "tbus_master_timeouts_total"
+	MetricErrors          = "tbus_master_errors_total"
+	MetricPending         = "tbus_master_pending_invocations"
+	MetricEventsDelivered = "tbus_master_events_delivered_total"
+	MetricEventsDropped   = "tbus_master_events_dropped_total"
+	MetricEventsEmitted   = "tbus_device_events_emitted_total"
+	MetricDevices         = "tbus_bus_devices"
+	MetricRouteErrors     = "tbus_bus_route_errors_total"
+	MetricFrames          = "tbus_stream_frames_total"
+	MetricBytes           = "tbus_stream_bytes_total"
+	MetricDecodeFailures  = "tbus_stream_decode_failures_total"
+)
+
+var metricHelps = map[string]string{
+	MetricInvocations:     "Invocations sent by master.",
+	MetricReplyLatency:    "Latency from invocation to reply.",
+	MetricTimeouts:        "Invocations timed out waiting for reply.",
+	MetricErrors:          "Failed invocations by kind.",
+	MetricPending:         "Invocations waiting for reply.",
+	MetricEventsDelivered: "Events delivered to subscribers.",
+	MetricEventsDropped:   "Events received without subscribers.",
+	MetricEventsEmitted:   "Events emitted by device logic.",
+	MetricDevices:         "Devices plugged into local buses.",
+	MetricRouteErrors:     "Messages routed to invalid addresses.",
+	MetricFrames:          "Frames transferred over streams.",
+	MetricBytes:           "Bytes transferred over streams.",
+	MetricDecodeFailures:  "Frames failed to decode from streams.",
+}
+
+// DefaultLatencyBuckets are histogram buckets in seconds
+var DefaultLatencyBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// NopMetrics discards all metrics
+type NopMetrics struct{}
+
+type nopMetric struct{}
+
+func (nopMetric) Add(float64)     {}
+func (nopMetric) Set(float64)     {}
+func (nopMetric) Observe(float64) {}
+
+// Counter implements Metrics
+func (NopMetrics) Counter(string, ...string) Counter { return nopMetric{} }
+
+// Gauge implements Metrics
+func (NopMetrics) Gauge(string, ...string) Gauge { return nopMetric{} }
+
+// Histogram implements Metrics
+func (NopMetrics) Histogram(string, ...string) Histogram { return nopMetric{} }
+
+var (
+	metrics     Metrics = NopMetrics{}
+	metricsLock sync.RWMutex
+)
+
+// SetMetrics sets the Metrics used by instrumentation, nil disables metrics
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = NopMetrics{}
+	}
+	metricsLock.Lock()
+	metrics = m
+	metricsLock.Unlock()
+}
+
+// CurrentMetrics returns the Metrics used by instrumentation
+func CurrentMetrics() Metrics {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+	return metrics
+}
+
+// MetricsRegistry is an in-memory Metrics which can be exposed in
+// Prometheus text format
+type MetricsRegistry struct {
+	// Buckets is used for new histograms, DefaultLatencyBuckets if nil
+	Buckets []float64
+
+	families map[string]*metricFamily
+	lock     sync.Mutex
+}
+
+type metricFamily struct {
+	name   string
+	kind   string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	lock    sync.Mutex
+}
+
+// NewMetricsRegistry creates a MetricsRegistry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+func (r *MetricsRegistry) series(kind, name string, labels []string) *metricSeries {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	family := r.families[name]
+	if family == nil {
+		family = &metricFamily{name: name, kind: kind, series: make(map[string]*metricSeries)}
+		r.families[name] = family
+	}
+	key := strings.Join(labels, "\x00")
+	s := family.series[key]
+	if s == nil {
+		s = &metricSeries{labels: append([]string(nil), labels...)}
+		if kind == "histogram" {
+			s.buckets = r.Buckets
+			if s.buckets == nil {
+				s.buckets = DefaultLatencyBuckets
+			}
+			s.counts = make([]uint64, len(s.buckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+// Counter implements Metrics
+func (r *MetricsRegistry) Counter(name string, labels ...string) Counter {
+	return r.series("counter", name, labels)
+}
+
+// Gauge implements Metrics
+func (r *MetricsRegistry) Gauge(name string, labels ...string) Gauge {
+	return r.series("gauge", name, labels)
+}
+
+// Histogram implements Metrics
+func (r *MetricsRegistry) Histogram(name string, labels ...string) Histogram {
+	return r.series("histogram", name, labels)
+}
+
+// Value returns the value of a counter or gauge, or the number of
+// observations of a histogram
+func (r *MetricsRegistry) Value(name string, labels ...string) float64 {
+	r.lock.Lock()
+	family := r.families[name]
+	var s *metricSeries
+	if family != nil {
+		s = family.series[strings.Join(labels, "\x00")]
+	}
+	r.lock.Unlock()
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counts != nil {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+func (s *metricSeries) Add(delta float64) {
+	s.lock.Lock()
+	s.value += delta
+	s.lock.Unlock()
+}
+
+func (s *metricSeries) Set(value float64) {
+	s.lock.Lock()
+	s.value = value
+	s.lock.Unlock()
+}
+
+func (s *metricSeries) Observe(value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for n, bound := range s.buckets {
+		if value <= bound {
+			s.counts[n]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// WriteText writes all metrics in Prometheus text exposition format
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*metricFamily, len(names))
+	for n, name := range names {
+		families[n] = r.families[name]
+	}
+	r.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, family := range families {
+		if help := metricHelps[family.name]; help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", family.name, help)
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", family.name, family.kind)
+		r.lock.Lock()
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		series := make([]*metricSeries, len(keys))
+		for n, key := range keys {
+			series[n] = family.series[key]
+		}
+		r.lock.Unlock()
+		for _, s := range series {
+			s.write(&buf, family.name)
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (s *metricSeries) write(buf *bytes.Buffer, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counts == nil {
+		fmt.Fprintf(buf, "%s%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+		return
+	}
+	for n, bound := range s.buckets {
+		labels := append(append([]string(nil), s.labels...), "le", formatValue(bound))
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(labels), s.counts[n])
+	}
+	labels := append(append([]string(nil), s.labels...), "le", "+Inf")
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(labels), s.count)
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, formatLabels(s.labels), s.count)
+}
+
+// ServeHTTP implements http.Handler
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for n := 0; n+1 < len(labels); n += 2 {
+		pairs = append(pairs, labels[n]+`="`+labelEscaper.Replace(labels[n+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values in the text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// methodLabels returns metric labels for a method
+func methodLabels(class *ClassDesc, method uint8) []string {
+	className, methodName := "unknown", fmt.Sprintf("#%d", method)
+	if class != nil {
+		className = class.Name
+		if m := class.MethodByIndex(method); m != nil {
+			methodName = m.Name
+		}
+	} else if method == 0 {
+		methodName = DeviceInfoMethodName
+	}
+	return []string{"class", className, "method", methodName}
+}
@@ -0,0 +1,125 @@
+package tbus
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("Metrics", t, func() {
+		registry := NewMetricsRegistry()
+		SetMetrics(registry)
+		defer SetMetrics(nil)
+
+		Convey("registry", func() {
+			registry.Counter("c", "a", "1").Add(2)
+			registry.Gauge("g").Set(5)
+			registry.Histogram("h").Observe(0.003)
+			So(registry.Value("c", "a", "1"), ShouldEqual, 2)
+			So(registry.Value("h"), ShouldEqual, 1)
+			var buf bytes.Buffer
+			So(registry.WriteText(&buf), ShouldBeNil)
+			text := buf.String()
+			So(text, ShouldContainSubstring, "# TYPE c counter\nc{a=\"1\"} 2\n")
+			So(text, ShouldContainSubstring, "g 5\n")
+			So(text, ShouldContainSubstring, "h_bucket{le=\"0.0025\"} 0\n")
+			So(text, ShouldContainSubstring, "h_bucket{le=\"0.005\"} 1\n")
+			So(text, ShouldContainSubstring, "h_bucket{le=\"+Inf\"} 1\n")
+			So(text, ShouldContainSubstring, "h_count 1\n")
+
+			rec := httptest.NewRecorder()
+			registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+			So(rec.Body.String(), ShouldEqual, text)
+		})
+
+		Convey("label escaping", func() {
+			registry.Counter("e", "v", "a\\b\"c\n\td").Add(1)
+			var buf bytes.Buffer
+			So(registry.WriteText(&buf), ShouldBeNil)
+			// only backslash, double quote and line feed are escaped
+			So(buf.String(), ShouldContainSubstring, `e{v="a\\b\"c\n`+"\td\"} 1\n")
+		})
+
+		Convey("master and bus", func() {
+			bus := NewLocalBus()
+			led := NewLEDDev(&testLED{})
+			bus.Plug(led)
+			bad := NewLEDDev(&errorLED{})
+			bus.Plug(bad)
+			btnLogic := &testButton{}
+			btn := NewButtonDev(btnLogic)
+			bus.Plug(btn)
+			So(registry.Value(MetricDevices), ShouldEqual, 3)
+			bus.Unplug(btn)
+			bus.Unplug(btn)
+			So(registry.Value(MetricDevices), ShouldEqual, 2)
+			bus.Plug(btn)
+
+			master := NewLocalMaster(NewBusDev(bus))
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(led)).On().Wait(), ShouldBeNil)
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(bad)).On().Wait(), ShouldNotBeNil)
+			ledLabels := []string{"class", "LED", "method", "SetPowerState"}
+			So(registry.Value(MetricInvocations, ledLabels...), ShouldEqual, 2)
+			So(registry.Value(MetricReplyLatency, ledLabels...), ShouldEqual, 2)
+			So(registry.Value(MetricErrors, append(ledLabels, "kind", "remote")...), ShouldEqual, 1)
+			So(registry.Value(MetricPending), ShouldEqual, 0)
+
+			So(master.Invoke(1, nil, RouteWith(9)).Result(nil), ShouldNotBeNil)
+			So(registry.Value(MetricRouteErrors), ShouldEqual, 1)
+			So(registry.Value(MetricInvocations, "class", "unknown", "method", "#1"), ShouldEqual, 1)
+
+			btnLogic.simulatePressed(true)
+			So(registry.Value(MetricEventsEmitted, "class", "Button"), ShouldEqual, 1)
+			So(registry.Value(MetricEventsDropped, "channel", "1"), ShouldEqual, 1)
+			chn := NewButtonCtl(master).SetAddress(DeviceAddress(btn)).State()
+			go btnLogic.simulatePressed(false)
+			<-chn.C
+			So(registry.Value(MetricEventsDelivered, "channel", "1"), ShouldEqual, 1)
+		})
+
+		Convey("timeout", func() {
+			clock := NewFakeClock(time.Unix(0, 0))
+			master := NewLocalMaster(&silentDevice{})
+			master.Clock = clock
+			go func() {
+				clock.BlockUntil(1)
+				clock.Advance(DefaultInvocationTimeout)
+			}()
+			So(NewLEDCtl(master).On().Wait(), ShouldEqual, ErrRecvTimeout)
+			labels := []string{"class", "LED", "method", "SetPowerState"}
+			So(registry.Value(MetricTimeouts, labels...), ShouldEqual, 1)
+			So(registry.Value(MetricErrors, append(labels, "kind", "timeout")...), ShouldEqual, 1)
+			// the timed out invocation is released
+			So(registry.Value(MetricPending), ShouldEqual, 0)
+			So(master.invocations, ShouldBeEmpty)
+		})
+
+		Convey("stream", func() {
+			local, remote := net.Pipe()
+			go func() {
+				NewMsgStreamer(remote).DispatchMsg(BuildMsg().EncodeBody(1, &LEDPowerState{On: true}).Build())
+				remote.Write([]byte{0x00, 0xff})
+				remote.Close()
+			}()
+			var msgs []*Msg
+			err := DecodeStream(local, MsgDispatcherFunc(func(msg *Msg) error {
+				msgs = append(msgs, msg)
+				return nil
+			}))
+			So(err, ShouldNotBeNil)
+			So(msgs, ShouldHaveLength, 1)
+			// labeled by network rather than the address of each connection
+			So(registry.Value(MetricFrames, "transport", "pipe", "dir", "out"), ShouldEqual, 1)
+			So(registry.Value(MetricFrames, "transport", "pipe", "dir", "in"), ShouldEqual, 1)
+			So(registry.Value(MetricBytes, "transport", "pipe", "dir", "in"),
+				ShouldBeGreaterThan, registry.Value(MetricBytes, "transport", "pipe", "dir", "out"))
+			So(registry.Value(MetricDecodeFailures, "transport", "pipe"), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package tbus
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// DeviceCall describes a method call dispatched to device logic
+type DeviceCall struct {
+	Device Device
+	Class  *ClassDesc
+	Method uint8
+	Msg    *Msg
+	// Params is decoded from Msg, nil if method accepts no params,
+	// interceptors may replace it with a value of the same type
+	Params proto.Message
+	// Reply is set by logic, nil if method replies nothing
+	Reply proto.Message
+	// Context carries the trace of the message, set by HandleCall if nil
+	Context context.Context
+}
+
+// MethodName returns the name of method
+func (c *DeviceCall) MethodName() string {
+	if c.Class != nil {
+		if m := c.Class.MethodByIndex(c.Method); m != nil {
+			return c.Class.Name + "." + m.Name
+		}
+		return fmt.Sprintf("%s.#%d", c.Class.Name, c.Method)
+	}
+	return fmt.Sprintf("#%d", c.Method)
+}
+
+// DeviceHandler handles a device call
+type DeviceHandler func(*DeviceCall) error
+
+// DeviceInterceptor intercepts a device call, it calls next to continue
+// the chain, or returns without calling next to reject the call
+type DeviceInterceptor func(call *DeviceCall, next DeviceHandler) error
+
+// PanicError is the error recovered from a panic in device logic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements error
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+var (
+	deviceInterceptors     []DeviceInterceptor
+	deviceInterceptorsLock sync.RWMutex
+)
+
+// UseDeviceInterceptors appends interceptors applied to all devices,
+// they run before interceptors of individual devices
+func UseDeviceInterceptors(interceptors ...DeviceInterceptor) {
+	deviceInterceptorsLock.Lock()
+	deviceInterceptors = append(deviceInterceptors, interceptors...)
+	deviceInterceptorsLock.Unlock()
+}
+
+// ResetDeviceInterceptors removes all global device interceptors
+func ResetDeviceInterceptors() {
+	deviceInterceptorsLock.Lock()
+	deviceInterceptors = nil
+	deviceInterceptorsLock.Unlock()
+}
+
+// Use appends interceptors to this device, it's safe to call while the
+// device is dispatching, calls in progress keep the previous chain
+func (d *DeviceBase) Use(interceptors ...DeviceInterceptor) {
+	d.interceptorsLock.Lock()
+	d.interceptors = append(d.interceptors, interceptors...)
+	d.interceptorsLock.Unlock()
+}
+
+// HandleCall runs the call through global and device interceptors
+// and then the handler. A panic in handler is recovered as PanicError.
+// For a traced message, the call is recorded as a child span.
+func (d *DeviceBase) HandleCall(call *DeviceCall, handler DeviceHandler) (err error) {
+	if call.Context == nil {
+		var span *Span
+		call.Context, span = startCallSpan(call)
+		if span != nil {
+			defer func() { span.Finish(err) }()
+		}
+	}
+
+	deviceInterceptorsLock.RLock()
+	chain := append([]DeviceInterceptor(nil), deviceInterceptors...)
+	deviceInterceptorsLock.RUnlock()
+	d.interceptorsLock.RLock()
+	chain = append(chain, d.interceptors...)
+	d.interceptorsLock.RUnlock()
+
+	invoke := recoverHandler(handler)
+	for n := len(chain) - 1; n >= 0; n-- {
+		interceptor, next := chain[n], invoke
+		invoke = func(call *DeviceCall) error {
+			return interceptor(call, next)
+		}
+	}
+	return invoke(call)
+}
+
+func recoverHandler(handler DeviceHandler) DeviceHandler {
+	return func(call *DeviceCall) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := make([]byte, 4096)
+				stack = stack[:runtime.Stack(stack, false)]
+				err = &PanicError{Value: r, Stack: stack}
+			}
+		}()
+		return handler(call)
+	}
+}
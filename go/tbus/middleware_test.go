@@ -0,0 +1,106 @@
+package tbus
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type panicLED struct {
+	LogicBase
+}
+
+func (d *panicLED) SetPowerState(param *LEDPowerState) error {
+	panic("burnt out")
+}
+
+func TestDeviceMiddleware(t *testing.T) {
+	Convey("DeviceMiddleware", t, func() {
+		bus := NewLocalBus()
+		ledLogic := &testLED{}
+		led := NewLEDDev(ledLogic)
+		bus.Plug(led)
+		master := NewLocalMaster(NewBusDev(bus))
+		ledctl := NewLEDCtl(master).SetAddress(DeviceAddress(led))
+
+		Convey("chain", func() {
+			var trace []string
+			UseDeviceInterceptors(func(call *DeviceCall, next DeviceHandler) error {
+				trace = append(trace, "global:"+call.MethodName())
+				return next(call)
+			})
+			defer ResetDeviceInterceptors()
+			led.Use(func(call *DeviceCall, next DeviceHandler) error {
+				if state, ok := call.Params.(*LEDPowerState); ok {
+					trace = append(trace, fmt.Sprintf("device:%v", state.On))
+				} else {
+					trace = append(trace, "device")
+				}
+				err := next(call)
+				trace = append(trace, fmt.Sprintf("reply:%v", call.Reply))
+				return err
+			})
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(trace, ShouldResemble, []string{
+				"global:LED.SetPowerState",
+				"device:true",
+				"reply:<nil>",
+			})
+			_, err := ledctl.DeviceInfo()
+			So(err, ShouldBeNil)
+			So(trace[3], ShouldEqual, "global:LED.DeviceInfo")
+			So(trace[5], ShouldContainSubstring, "class_id:16")
+		})
+
+		Convey("validate and modify", func() {
+			led.Use(func(call *DeviceCall, next DeviceHandler) error {
+				if state, ok := call.Params.(*LEDPowerState); ok {
+					if !state.On {
+						return fmt.Errorf("always on")
+					}
+					call.Params = &LEDPowerState{On: true}
+				}
+				return next(call)
+			})
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(ledLogic.on, ShouldBeTrue)
+			err := ledctl.Off().Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "always on")
+			So(ledLogic.on, ShouldBeTrue)
+		})
+
+		Convey("panic recovery", func() {
+			bad := NewLEDDev(&panicLED{})
+			bus.Plug(bad)
+			var recovered error
+			bad.Use(func(call *DeviceCall, next DeviceHandler) error {
+				recovered = next(call)
+				return recovered
+			})
+			err := NewLEDCtl(master).SetAddress(DeviceAddress(bad)).On().Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "panic: burnt out")
+			So(recovered, ShouldHaveSameTypeAs, &PanicError{})
+			So(string(recovered.(*PanicError).Stack), ShouldContainSubstring, "SetPowerState")
+			So(ledctl.On().Wait(), ShouldBeNil)
+		})
+
+		Convey("use while dispatching", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for n := 0; n < 20; n++ {
+					led.Use(func(call *DeviceCall, next DeviceHandler) error {
+						return next(call)
+					})
+				}
+			}()
+			for n := 0; n < 20; n++ {
+				So(ledctl.On().Wait(), ShouldBeNil)
+			}
+			<-done
+		})
+	})
+}
@@ -4,6 +4,7 @@
 
 package tbus
 
+import "context"
 import "time"
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
@@ -92,6 +93,17 @@ var fileDescriptor4 = []byte{
 // MotorClassID is the class ID of Motor
 const MotorClassID uint32 = 0x0020
 
+// MotorClass is the registered descriptor of Motor
+var MotorClass = RegisterClass(&ClassDesc{
+    Name:    "Motor",
+    ClassID: MotorClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "Start", ParamType: "tbus.MotorDriveState"},
+        {Index: 2, Name: "Stop"},
+        {Index: 3, Name: "Brake", ParamType: "tbus.MotorBrakeState"},
+    },
+})
+
 // MotorLogic defines the logic interface
 type MotorLogic interface {
     DeviceLogic
@@ -100,6 +112,14 @@ type MotorLogic interface {
     Brake(*MotorBrakeState) error
 }
 
+// MotorContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type MotorContextLogic interface {
+    StartContext(context.Context, *MotorDriveState) error
+    StopContext(context.Context) error
+    BrakeContext(context.Context, *MotorBrakeState) error
+}
+
 // MotorDev is the device
 type MotorDev struct {
     DeviceBase
@@ -119,29 +139,61 @@ func (d *MotorDev) DispatchMsg(msg *Msg) (err error) {
     if msg.Head.NeedRoute() {
         return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
     }
-    var reply proto.Message
+    call := &DeviceCall{Device: d, Class: MotorClass, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
     case 0:
-        devInfo := d.DeviceInfo()
-        reply = &devInfo
     case 1: // Start
-        params := &MotorDriveState{}
-        err = msg.Body.Decode(params)
-        if err == nil {
-            err = d.Logic.Start(params)
+        call.Params = &MotorDriveState{}
+    case 2: // Stop
+    case 3: // Brake
+        call.Params = &MotorBrakeState{}
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
         }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *MotorDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(MotorContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // Start
+        err = d.Logic.Start(call.Params.(*MotorDriveState))
     case 2: // Stop
         err = d.Logic.Stop()
     case 3: // Brake
-        params := &MotorBrakeState{}
-        err = msg.Body.Decode(params)
-        if err == nil {
-            err = d.Logic.Brake(params)
-        }
+        err = d.Logic.Brake(call.Params.(*MotorBrakeState))
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *MotorDev) invokeContext(logic MotorContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // Start
+        err = logic.StartContext(call.Context, call.Params.(*MotorDriveState))
+    case 2: // Stop
+        err = logic.StopContext(call.Context)
+    case 3: // Brake
+        err = logic.BrakeContext(call.Context, call.Params.(*MotorBrakeState))
     default:
         err = ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
 }
 
 // SetDeviceID sets device id
@@ -159,6 +211,7 @@ type MotorCtl struct {
 func NewMotorCtl(master Master) *MotorCtl {
     c := &MotorCtl{}
     c.Master = master
+    c.Class = MotorClass
     return c
 }
 
@@ -0,0 +1,692 @@
+package tbus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMQTTKeepAlive is the keep alive interval negotiated with the broker
+	DefaultMQTTKeepAlive = 30 * time.Second
+	// DefaultMQTTTimeout limits waiting for acknowledgements from the broker
+	DefaultMQTTTimeout = 10 * time.Second
+	// DefaultMQTTMaxPacketSize limits the size of received packets
+	DefaultMQTTMaxPacketSize = 1 << 20
+
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttUnsubAck    = 11
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+
+	mqttProtocolName  = "MQTT"
+	mqttProtocolLevel = 4
+	mqttCleanSession  = 0x02
+	mqttPasswordFlag  = 0x40
+	mqttUsernameFlag  = 0x80
+	mqttSubscribeFail = 0x80
+	mqttOutQueue      = 64
+)
+
+var (
+	// ErrMQTTProtocol indicates a malformed or unexpected MQTT packet
+	ErrMQTTProtocol = fmt.Errorf("mqtt protocol error")
+	// ErrMQTTRefused indicates the broker refused the connection or subscription
+	ErrMQTTRefused = fmt.Errorf("mqtt refused")
+	// ErrMQTTClosed indicates the connection is closed
+	ErrMQTTClosed = fmt.Errorf("mqtt connection closed")
+	// ErrMQTTPacketTooLarge indicates a received packet exceeds the size limit
+	ErrMQTTPacketTooLarge = fmt.Errorf("mqtt packet too large")
+)
+
+// mqttPacket is an MQTT control packet
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// readMQTTPacket reads a packet, the body is not allocated if it's larger
+// than maxSize
+func readMQTTPacket(r *bufio.Reader, maxSize int) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var length, shift uint
+	for n := 0; ; n++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= uint(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		if n == 3 {
+			return nil, ErrMQTTProtocol
+		}
+		shift += 7
+	}
+	if length > uint(maxSize) {
+		return nil, ErrMQTTPacketTooLarge
+	}
+	pkt := &mqttPacket{Type: header >> 4, Flags: header & 0x0f, Body: make([]byte, length)}
+	if _, err = io.ReadFull(r, pkt.Body); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (p *mqttPacket) encode() []byte {
+	buf := make([]byte, 0, len(p.Body)+5)
+	buf = append(buf, p.Type<<4|p.Flags)
+	for n := len(p.Body); ; {
+		c := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			c |= 0x80
+		}
+		buf = append(buf, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, p.Body...)
+}
+
+func appendMQTTUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendMQTTString(buf []byte, s string) []byte {
+	return append(appendMQTTUint16(buf, uint16(len(s))), s...)
+}
+
+// mqttDecoder decodes fields from the body of a packet
+type mqttDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *mqttDecoder) uint16() uint16 {
+	if len(d.buf) < 2 {
+		d.err = ErrMQTTProtocol
+		return 0
+	}
+	v := uint16(d.buf[0])<<8 | uint16(d.buf[1])
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *mqttDecoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.err = ErrMQTTProtocol
+		return 0
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *mqttDecoder) string() string {
+	size := int(d.uint16())
+	if len(d.buf) < size {
+		d.err = ErrMQTTProtocol
+		return ""
+	}
+	s := string(d.buf[:size])
+	d.buf = d.buf[size:]
+	return s
+}
+
+func newMQTTPublish(topic string, payload []byte) *mqttPacket {
+	body := appendMQTTString(make([]byte, 0, len(topic)+len(payload)+2), topic)
+	return &mqttPacket{Type: mqttPublish, Body: append(body, payload...)}
+}
+
+// parseMQTTPublish decodes a PUBLISH packet, packetID is only present with QoS > 0
+func parseMQTTPublish(p *mqttPacket) (topic string, payload []byte, qos byte, packetID uint16, err error) {
+	d := &mqttDecoder{buf: p.Body}
+	topic = d.string()
+	if qos = (p.Flags >> 1) & 3; qos > 0 {
+		packetID = d.uint16()
+	}
+	return topic, d.buf, qos, packetID, d.err
+}
+
+func newMQTTAck(typ byte, packetID uint16) *mqttPacket {
+	return &mqttPacket{Type: typ, Body: appendMQTTUint16(nil, packetID)}
+}
+
+// mqttTopicMatch matches a topic against a filter with wildcards + and #
+func mqttTopicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for n, level := range strings.Split(filter, "/") {
+		if level == "#" {
+			return true
+		}
+		if n >= len(levels) || (level != "+" && level != levels[n]) {
+			return false
+		}
+	}
+	return len(strings.Split(filter, "/")) == len(levels)
+}
+
+// MQTTOptions configures the connection of MQTTClient
+type MQTTOptions struct {
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive is the interval of pings, DefaultMQTTKeepAlive if 0
+	KeepAlive time.Duration
+	// Timeout limits waiting for acknowledgements, DefaultMQTTTimeout if 0
+	Timeout time.Duration
+	// MaxPacketSize limits received packets, DefaultMQTTMaxPacketSize if 0
+	MaxPacketSize int
+	// Clock drives pings and acknowledgement timeouts, SystemClock if nil
+	Clock Clock
+	// Logger logs dropped packets, the default Logger is used if nil
+	Logger Logger
+}
+
+// MQTTHandler handles a message received from a subscribed topic
+type MQTTHandler func(topic string, payload []byte)
+
+type mqttSubscription struct {
+	filter  string
+	handler MQTTHandler
+}
+
+// MQTTClient is a minimal MQTT 3.1.1 client, messages are published and
+// subscribed with QoS 0 using a clean session
+type MQTTClient struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+	opts   MQTTOptions
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	subs      []*mqttSubscription
+	acks      map[uint16]chan []byte
+	packetID  uint16
+	err       error
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewMQTTClient connects to the broker over conn
+func NewMQTTClient(conn io.ReadWriteCloser, opts MQTTOptions) (*MQTTClient, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultMQTTKeepAlive
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultMQTTTimeout
+	}
+	if opts.MaxPacketSize == 0 {
+		opts.MaxPacketSize = DefaultMQTTMaxPacketSize
+	}
+	c := &MQTTClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		opts:   opts,
+		acks:   make(map[uint16]chan []byte),
+		done:   make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.run()
+	if opts.KeepAlive > 0 {
+		go c.keepAlive()
+	}
+	return c, nil
+}
+
+// DialMQTT connects to the broker at address over TCP
+func DialMQTT(address string, opts MQTTOptions) (*MQTTClient, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultMQTTTimeout
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewMQTTClient(conn, opts)
+}
+
+func (c *MQTTClient) connect() error {
+	flags := byte(mqttCleanSession)
+	body := appendMQTTString(nil, mqttProtocolName)
+	body = append(body, mqttProtocolLevel, 0)
+	body = appendMQTTUint16(body, uint16(c.opts.KeepAlive/time.Second))
+	body = appendMQTTString(body, c.opts.ClientID)
+	if c.opts.Username != "" {
+		flags |= mqttUsernameFlag
+		body = appendMQTTString(body, c.opts.Username)
+		if c.opts.Password != "" {
+			flags |= mqttPasswordFlag
+			body = appendMQTTString(body, c.opts.Password)
+		}
+	}
+	body[len(mqttProtocolName)+3] = flags
+	if err := c.write(&mqttPacket{Type: mqttConnect, Body: body}); err != nil {
+		return err
+	}
+	if conn, ok := c.conn.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		conn.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	pkt, err := readMQTTPacket(c.reader, c.opts.MaxPacketSize)
+	if err != nil {
+		return err
+	}
+	if pkt.Type != mqttConnAck || len(pkt.Body) != 2 {
+		return ErrMQTTProtocol
+	}
+	if code := pkt.Body[1]; code != 0 {
+		return fmt.Errorf("%v: connect return code %d", ErrMQTTRefused, code)
+	}
+	return nil
+}
+
+func (c *MQTTClient) write(pkt *mqttPacket) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(pkt.encode())
+	return err
+}
+
+func (c *MQTTClient) run() {
+	for {
+		pkt, err := readMQTTPacket(c.reader, c.opts.MaxPacketSize)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		switch pkt.Type {
+		case mqttPublish:
+			topic, payload, qos, packetID, err := parseMQTTPublish(pkt)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			if qos == 1 {
+				c.write(newMQTTAck(mqttPubAck, packetID))
+			}
+			c.dispatch(topic, payload)
+		case mqttSubAck:
+			d := &mqttDecoder{buf: pkt.Body}
+			packetID := d.uint16()
+			c.lock.Lock()
+			ack := c.acks[packetID]
+			delete(c.acks, packetID)
+			c.lock.Unlock()
+			if ack != nil {
+				ack <- d.buf
+			}
+		case mqttPingResp:
+		default:
+			LoggerOrDefault(c.opts.Logger).Warn("mqtt packet ignored", "type", pkt.Type)
+		}
+	}
+}
+
+func (c *MQTTClient) dispatch(topic string, payload []byte) {
+	c.lock.Lock()
+	subs := c.subs
+	c.lock.Unlock()
+	for _, sub := range subs {
+		if mqttTopicMatch(sub.filter, topic) {
+			sub.handler(topic, payload)
+		}
+	}
+}
+
+func (c *MQTTClient) keepAlive() {
+	clock := ClockOrSystem(c.opts.Clock)
+	for {
+		select {
+		case <-clock.After(c.opts.KeepAlive):
+			if err := c.write(&mqttPacket{Type: mqttPingReq}); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *MQTTClient) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		c.lock.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// Publish publishes payload to topic
+func (c *MQTTClient) Publish(topic string, payload []byte) error {
+	select {
+	case <-c.done:
+		return ErrMQTTClosed
+	default:
+	}
+	return c.write(newMQTTPublish(topic, payload))
+}
+
+// Subscribe subscribes topics matching filter, handler is invoked from the
+// receiving goroutine and should not block
+func (c *MQTTClient) Subscribe(filter string, handler MQTTHandler) error {
+	ack := make(chan []byte, 1)
+	c.lock.Lock()
+	if c.packetID++; c.packetID == 0 {
+		c.packetID++
+	}
+	packetID := c.packetID
+	c.acks[packetID] = ack
+	// subscribed before sending, messages may arrive right after SUBACK
+	sub := &mqttSubscription{filter: filter, handler: handler}
+	c.subs = append(c.subs[:len(c.subs):len(c.subs)], sub)
+	c.lock.Unlock()
+
+	body := appendMQTTString(appendMQTTUint16(nil, packetID), filter)
+	err := c.write(&mqttPacket{Type: mqttSubscribe, Flags: 0x2, Body: append(body, 0)})
+	if err == nil {
+		select {
+		case codes := <-ack:
+			if len(codes) != 1 || codes[0] == mqttSubscribeFail {
+				err = fmt.Errorf("%v: subscribe %s", ErrMQTTRefused, filter)
+			}
+		case <-c.done:
+			err = ErrMQTTClosed
+		case <-ClockOrSystem(c.opts.Clock).After(c.opts.Timeout):
+			err = ErrRecvTimeout
+		}
+	}
+	if err != nil {
+		c.lock.Lock()
+		delete(c.acks, packetID)
+		c.subs = removeMQTTSubscription(c.subs, sub)
+		c.lock.Unlock()
+	}
+	return err
+}
+
+// removeMQTTSubscription removes only sub, earlier subscriptions with the
+// same filter are kept
+func removeMQTTSubscription(subs []*mqttSubscription, sub *mqttSubscription) []*mqttSubscription {
+	result := make([]*mqttSubscription, 0, len(subs))
+	for _, s := range subs {
+		if s != sub {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Done is closed when the connection is closed
+func (c *MQTTClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection is closed
+func (c *MQTTClient) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close disconnects from the broker
+func (c *MQTTClient) Close() error {
+	c.write(&mqttPacket{Type: mqttDisconnect})
+	c.shutdown(ErrMQTTClosed)
+	return nil
+}
+
+// MQTTBroker is a minimal MQTT 3.1.1 broker delivering messages with QoS 0,
+// retained messages and persistent sessions are not supported. It's meant
+// to be embedded in tests and small setups without an external broker.
+type MQTTBroker struct {
+	// Logger logs client errors, the default Logger is used if nil
+	Logger Logger
+	// MaxPacketSize limits packets from clients, DefaultMQTTMaxPacketSize if 0
+	MaxPacketSize int
+
+	lock      sync.Mutex
+	sessions  map[*mqttSession]struct{}
+	listeners []net.Listener
+	closed    bool
+}
+
+type mqttSession struct {
+	conn    io.ReadWriteCloser
+	out     chan []byte
+	filters []string
+	done    chan struct{}
+}
+
+// NewMQTTBroker creates an MQTTBroker
+func NewMQTTBroker() *MQTTBroker {
+	return &MQTTBroker{sessions: make(map[*mqttSession]struct{})}
+}
+
+// Serve accepts clients from listener until it's closed
+func (b *MQTTBroker) Serve(listener net.Listener) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		listener.Close()
+		return ErrMQTTClosed
+	}
+	b.listeners = append(b.listeners, listener)
+	b.lock.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a client over conn until it disconnects
+func (b *MQTTBroker) ServeConn(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	maxSize := b.MaxPacketSize
+	if maxSize == 0 {
+		maxSize = DefaultMQTTMaxPacketSize
+	}
+	pkt, err := readMQTTPacket(reader, maxSize)
+	if err != nil {
+		return err
+	}
+	if pkt.Type != mqttConnect {
+		return ErrMQTTProtocol
+	}
+	d := &mqttDecoder{buf: pkt.Body}
+	if name, level := d.string(), d.byte(); d.err != nil || name != mqttProtocolName || level != mqttProtocolLevel {
+		conn.Write((&mqttPacket{Type: mqttConnAck, Body: []byte{0, 1}}).encode())
+		return ErrMQTTProtocol
+	}
+	if _, err = conn.Write((&mqttPacket{Type: mqttConnAck, Body: []byte{0, 0}}).encode()); err != nil {
+		return err
+	}
+
+	s := &mqttSession{conn: conn, out: make(chan []byte, mqttOutQueue), done: make(chan struct{})}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return ErrMQTTClosed
+	}
+	b.sessions[s] = struct{}{}
+	b.lock.Unlock()
+	defer b.removeSession(s)
+	go s.writeLoop()
+
+	for {
+		if pkt, err = readMQTTPacket(reader, maxSize); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch pkt.Type {
+		case mqttPublish:
+			topic, payload, qos, packetID, err := parseMQTTPublish(pkt)
+			if err != nil {
+				return err
+			}
+			if qos > 1 {
+				return fmt.Errorf("%v: QoS %d not supported", ErrMQTTProtocol, qos)
+			}
+			if qos == 1 {
+				s.send(newMQTTAck(mqttPubAck, packetID))
+			}
+			b.deliver(topic, payload)
+		case mqttSubscribe, mqttUnsubscribe:
+			d := &mqttDecoder{buf: pkt.Body}
+			packetID := d.uint16()
+			var filters []string
+			for len(d.buf) > 0 && d.err == nil {
+				filters = append(filters, d.string())
+				if pkt.Type == mqttSubscribe {
+					d.byte()
+				}
+			}
+			if d.err != nil {
+				return d.err
+			}
+			b.lock.Lock()
+			if pkt.Type == mqttSubscribe {
+				s.filters = append(s.filters, filters...)
+			} else {
+				s.filters = removeFilters(s.filters, filters)
+			}
+			b.lock.Unlock()
+			if pkt.Type == mqttSubscribe {
+				// all subscriptions are granted with QoS 0
+				ack := newMQTTAck(mqttSubAck, packetID)
+				ack.Body = append(ack.Body, make([]byte, len(filters))...)
+				s.send(ack)
+			} else {
+				s.send(newMQTTAck(mqttUnsubAck, packetID))
+			}
+		case mqttPingReq:
+			s.send(&mqttPacket{Type: mqttPingResp})
+		case mqttDisconnect:
+			return nil
+		default:
+			return fmt.Errorf("%v: unexpected packet type %d", ErrMQTTProtocol, pkt.Type)
+		}
+	}
+}
+
+func removeFilters(filters, removing []string) []string {
+	result := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		keep := true
+		for _, r := range removing {
+			if r == filter {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			result = append(result, filter)
+		}
+	}
+	return result
+}
+
+func (b *MQTTBroker) deliver(topic string, payload []byte) {
+	data := newMQTTPublish(topic, payload).encode()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for s := range b.sessions {
+		for _, filter := range s.filters {
+			if mqttTopicMatch(filter, topic) {
+				if !s.sendData(data) {
+					LoggerOrDefault(b.Logger).Warn("mqtt message dropped", "topic", topic)
+				}
+				break
+			}
+		}
+	}
+}
+
+func (b *MQTTBroker) removeSession(s *mqttSession) {
+	b.lock.Lock()
+	delete(b.sessions, s)
+	b.lock.Unlock()
+	close(s.done)
+}
+
+// Close disconnects all clients and closes listeners
+func (b *MQTTBroker) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	listeners := b.listeners
+	b.listeners = nil
+	var conns []io.Closer
+	for s := range b.sessions {
+		conns = append(conns, s.conn)
+	}
+	b.lock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *mqttSession) send(pkt *mqttPacket) {
+	s.sendData(pkt.encode())
+}
+
+// sendData queues data without blocking, returns false if it's dropped
+func (s *mqttSession) sendData(data []byte) bool {
+	select {
+	case s.out <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *mqttSession) writeLoop() {
+	for {
+		select {
+		case data := <-s.out:
+			if _, err := s.conn.Write(data); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package tbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMQTTPrefix is the first level of topics bridged by MQTTBridge
+	DefaultMQTTPrefix = "robot"
+
+	mqttCommandLevel = "cmd"
+	mqttReplyLevel   = "reply"
+)
+
+// MQTTClassOptions configures how devices of a class are bridged
+type MQTTClassOptions struct {
+	// Events lists channels published as telemetry, nil for all channels
+	Events []string
+	// Methods lists methods accepted from command topics, nil for all methods
+	Methods []string
+}
+
+func (o *MQTTClassOptions) eventAllowed(name string) bool {
+	return o.Events == nil || containsName(o.Events, name)
+}
+
+func (o *MQTTClassOptions) methodAllowed(name string) bool {
+	return o.Methods == nil || containsName(o.Methods, name)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MQTTReply is the payload published to a reply topic
+type MQTTReply struct {
+	Reply json.RawMessage `json:"reply,omitempty"`
+	Error string          `json:"error,omitempty"`
+	Code  string          `json:"code,omitempty"`
+}
+
+// MQTTBridge bridges devices to MQTT topics:
+//
+//	{prefix}/{route}/{Class}/{Channel}                 events in JSON
+//	{prefix}/{route}/{Class}/cmd/{Method}[/{id}]       invokes the method with JSON params
+//	{prefix}/{route}/{Class}/reply/{Method}[/{id}]     MQTTReply of the invocation
+//
+// Route is the device address like 1/2 and is omitted for the root device,
+// a root bus is not bridged. Devices are enumerated once when started.
+type MQTTBridge struct {
+	Master Master
+	Client *MQTTClient
+	// Prefix is the first level of topics, DefaultMQTTPrefix if empty
+	Prefix string
+	// Classes configures bridged classes by name, all classes are bridged
+	// with all channels and methods if nil
+	Classes map[string]*MQTTClassOptions
+	// Timeout overrides the invocation timeout of Master if not 0
+	Timeout time.Duration
+	// Logger logs failures, the default Logger is used if nil
+	Logger Logger
+
+	lock      sync.Mutex
+	subs      []EventSubscription
+	out       chan mqttMessage
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttEventHandler publishes events of a channel to a topic
+type mqttEventHandler struct {
+	bridge  *MQTTBridge
+	topic   string
+	channel *EventDesc
+}
+
+// NewMQTTBridge creates an MQTTBridge
+func NewMQTTBridge(master Master, client *MQTTClient) *MQTTBridge {
+	return &MQTTBridge{
+		Master: master,
+		Client: client,
+		out:    make(chan mqttMessage, mqttOutQueue),
+		closed: make(chan struct{}),
+	}
+}
+
+// Start enumerates devices, subscribes events and command topics
+func (b *MQTTBridge) Start() error {
+	info, err := (&Controller{Master: b.Master}).DeviceInfo()
+	if err == nil {
+		if info.ClassId == BusClassID {
+			err = b.bridgeBus(nil)
+		} else {
+			err = b.bridge(nil, &info)
+		}
+	}
+	if err != nil {
+		b.Close()
+		return err
+	}
+	go b.publishLoop()
+	return nil
+}
+
+func (b *MQTTBridge) bridgeBus(addrs RouteAddr) error {
+	enum, err := NewBusCtl(b.Master).SetAddress(addrs).Enumerate().Wait()
+	if err != nil {
+		return err
+	}
+	for _, info := range enum.Devices {
+		devAddrs := append(append(RouteAddr{}, addrs...), uint8(info.Address))
+		if err = b.bridge(devAddrs, info); err != nil {
+			return err
+		}
+		if info.ClassId == BusClassID {
+			if err = b.bridgeBus(devAddrs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *MQTTBridge) bridge(addrs RouteAddr, info *DeviceInfo) error {
+	class := ClassByID(info.ClassId)
+	if class == nil {
+		LoggerOrDefault(b.Logger).Warn("mqtt bridge skips unknown class",
+			"address", addrs.String(), "class", info.ClassId)
+		return nil
+	}
+	opts := &MQTTClassOptions{}
+	if b.Classes != nil {
+		if opts = b.Classes[class.Name]; opts == nil {
+			return nil
+		}
+	}
+	ctl := NewDynamicCtl(b.Master, addrs, class)
+	base := b.topicBase(addrs, class.Name)
+	for n := range class.Events {
+		channel := &class.Events[n]
+		if !opts.eventAllowed(channel.Name) {
+			continue
+		}
+		handler := &mqttEventHandler{bridge: b, topic: base + "/" + channel.Name, channel: channel}
+		b.lock.Lock()
+		b.subs = append(b.subs, ctl.Subscribe(channel.Index, handler))
+		b.lock.Unlock()
+	}
+	cmdPrefix := base + "/" + mqttCommandLevel + "/"
+	return b.Client.Subscribe(cmdPrefix+"#", func(topic string, payload []byte) {
+		go b.invoke(ctl, opts, base, strings.TrimPrefix(topic, cmdPrefix), payload)
+	})
+}
+
+func (b *MQTTBridge) topicBase(addrs RouteAddr, className string) string {
+	levels := []string{b.Prefix}
+	if b.Prefix == "" {
+		levels[0] = DefaultMQTTPrefix
+	}
+	for _, addr := range addrs {
+		levels = append(levels, strconv.Itoa(int(addr)))
+	}
+	return strings.Join(append(levels, className), "/")
+}
+
+// invoke handles a command, name is the topic after cmd level as Method[/id]
+func (b *MQTTBridge) invoke(ctl *DynamicCtl, opts *MQTTClassOptions, base, name string, payload []byte) {
+	method := name
+	if pos := strings.Index(name, "/"); pos >= 0 {
+		method = name[:pos]
+	}
+	var reply MQTTReply
+	var err error
+	if opts.methodAllowed(method) {
+		invocation := ctl.CallJSON(method, payload)
+		if b.Timeout > 0 {
+			invocation.Timeout(b.Timeout)
+		}
+		reply.Reply, err = invocation.WaitJSON()
+	} else {
+		err = fmt.Errorf("%v %s.%s", ErrUnknownMethod, ctl.Class.Name, method)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		if e, ok := err.(interface {
+			ErrorCode() string
+		}); ok {
+			reply.Code = e.ErrorCode()
+		}
+		LoggerOrDefault(b.Logger).Warn("mqtt command failed", "address", ctl.Address.String(),
+			"method", method, LogKeyError, err)
+	}
+	encoded, err := json.Marshal(&reply)
+	if err != nil {
+		return
+	}
+	select {
+	case b.out <- mqttMessage{topic: base + "/" + mqttReplyLevel + "/" + name, payload: encoded}:
+	case <-b.closed:
+	}
+}
+
+// HandleEvent implements EventHandler
+func (h *mqttEventHandler) HandleEvent(evt Event, _ EventSubscription) {
+	val, err := h.channel.Decode(evt)
+	var encoded []byte
+	if err == nil {
+		encoded, err = MarshalJSON(val)
+	}
+	if err != nil {
+		return
+	}
+	// never block the master
+	select {
+	case h.bridge.out <- mqttMessage{topic: h.topic, payload: encoded}:
+	default:
+		LoggerOrDefault(h.bridge.Logger).Warn("mqtt event dropped", "topic", h.topic)
+	}
+}
+
+func (b *MQTTBridge) publishLoop() {
+	for {
+		select {
+		case msg := <-b.out:
+			if err := b.Client.Publish(msg.topic, msg.payload); err != nil {
+				LoggerOrDefault(b.Logger).Warn("mqtt publish failed", "topic", msg.topic, LogKeyError, err)
+			}
+		case <-b.Client.Done():
+			b.Close()
+			return
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// Done is closed when the bridge is closed
+func (b *MQTTBridge) Done() <-chan struct{} {
+	return b.closed
+}
+
+// Close unsubscribes events and stops publishing, Client is not closed
+func (b *MQTTBridge) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.lock.Lock()
+		subs := b.subs
+		b.subs = nil
+		b.lock.Unlock()
+		for _, sub := range subs {
+			sub.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,220 @@
+package tbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type mqttTestMessage struct {
+	topic   string
+	payload string
+}
+
+// connectMQTT connects a client to the in-process broker
+func connectMQTT(broker *MQTTBroker, clientID string) (*MQTTClient, error) {
+	server, client := net.Pipe()
+	go broker.ServeConn(server)
+	return NewMQTTClient(client, MQTTOptions{ClientID: clientID})
+}
+
+// expectMQTT waits for a message on topic, skipping other messages
+func expectMQTT(msgs chan mqttTestMessage, topic string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.topic == topic {
+				return msg.payload
+			}
+		case <-timeout:
+			return "timeout waiting " + topic
+		}
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	Convey("MQTT", t, func() {
+		Convey("topic match", func() {
+			So(mqttTopicMatch("robot/#", "robot/1/LED/State"), ShouldBeTrue)
+			So(mqttTopicMatch("robot/#", "robot"), ShouldBeTrue)
+			So(mqttTopicMatch("robot/+/LED/+", "robot/1/LED/State"), ShouldBeTrue)
+			So(mqttTopicMatch("robot/+/LED/+", "robot/1/2/LED/State"), ShouldBeFalse)
+			So(mqttTopicMatch("robot/1", "robot/1/LED"), ShouldBeFalse)
+			So(mqttTopicMatch("#", "$SYS/clients"), ShouldBeFalse)
+		})
+
+		broker := NewMQTTBroker()
+		defer broker.Close()
+		observer, err := connectMQTT(broker, "observer")
+		So(err, ShouldBeNil)
+		defer observer.Close()
+		msgs := make(chan mqttTestMessage, 16)
+		So(observer.Subscribe("robot/#", func(topic string, payload []byte) {
+			msgs <- mqttTestMessage{topic: topic, payload: string(payload)}
+		}), ShouldBeNil)
+
+		Convey("pub/sub", func() {
+			So(observer.Publish("robot/hello", []byte("world")), ShouldBeNil)
+			So(expectMQTT(msgs, "robot/hello"), ShouldEqual, "world")
+		})
+
+		Convey("packet size", func() {
+			huge := []byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0x7f}
+			_, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(huge)), DefaultMQTTMaxPacketSize)
+			So(err, ShouldEqual, ErrMQTTPacketTooLarge)
+
+			broker.MaxPacketSize = 64
+			client, err := connectMQTT(broker, "robot")
+			So(err, ShouldBeNil)
+			defer client.Close()
+			So(client.Publish("robot/hello", make([]byte, 128)), ShouldBeNil)
+			select {
+			case <-client.Done():
+			case <-time.After(5 * time.Second):
+				So("client not disconnected", ShouldBeEmpty)
+			}
+		})
+
+		Convey("refused subscription", func() {
+			server, conn := net.Pipe()
+			defer server.Close()
+			publish := make(chan struct{})
+			go func() {
+				reader := bufio.NewReader(server)
+				if _, err := readMQTTPacket(reader, DefaultMQTTMaxPacketSize); err != nil {
+					return
+				}
+				server.Write((&mqttPacket{Type: mqttConnAck, Body: []byte{0, 0}}).encode())
+				for _, code := range []byte{0, mqttSubscribeFail} {
+					pkt, err := readMQTTPacket(reader, DefaultMQTTMaxPacketSize)
+					if err != nil {
+						return
+					}
+					server.Write((&mqttPacket{Type: mqttSubAck, Body: append(pkt.Body[:2:2], code)}).encode())
+				}
+				<-publish
+				server.Write(newMQTTPublish("robot/hello", []byte("world")).encode())
+				io.Copy(ioutil.Discard, reader)
+			}()
+			client, err := NewMQTTClient(conn, MQTTOptions{ClientID: "robot"})
+			So(err, ShouldBeNil)
+			defer client.Close()
+			received := make(chan mqttTestMessage, 4)
+			So(client.Subscribe("robot/#", func(topic string, payload []byte) {
+				received <- mqttTestMessage{topic: topic, payload: string(payload)}
+			}), ShouldBeNil)
+			err = client.Subscribe("robot/#", func(topic string, payload []byte) {
+				received <- mqttTestMessage{topic: "refused"}
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, ErrMQTTRefused.Error())
+			// the earlier subscription of the same filter is kept
+			close(publish)
+			So(expectMQTT(received, "robot/hello"), ShouldEqual, "world")
+			select {
+			case msg := <-received:
+				So(msg.topic, ShouldNotEqual, "refused")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		Convey("clock", func() {
+			server, conn := net.Pipe()
+			defer server.Close()
+			received := make(chan byte, 4)
+			go func() {
+				reader := bufio.NewReader(server)
+				if _, err := readMQTTPacket(reader, DefaultMQTTMaxPacketSize); err != nil {
+					return
+				}
+				server.Write((&mqttPacket{Type: mqttConnAck, Body: []byte{0, 0}}).encode())
+				for {
+					pkt, err := readMQTTPacket(reader, DefaultMQTTMaxPacketSize)
+					if err != nil {
+						return
+					}
+					received <- pkt.Type
+				}
+			}()
+			clock := NewFakeClock(time.Now())
+			client, err := NewMQTTClient(conn, MQTTOptions{ClientID: "robot", Clock: clock})
+			So(err, ShouldBeNil)
+			defer client.Close()
+			clock.BlockUntil(1)
+			clock.Advance(DefaultMQTTKeepAlive)
+			So(<-received, ShouldEqual, mqttPingReq)
+
+			// the broker never acknowledges
+			result := make(chan error, 1)
+			go func() {
+				result <- client.Subscribe("robot/#", func(string, []byte) {})
+			}()
+			So(<-received, ShouldEqual, mqttSubscribe)
+			clock.BlockUntil(2)
+			clock.Advance(DefaultMQTTTimeout)
+			So(<-result, ShouldEqual, ErrRecvTimeout)
+		})
+
+		Convey("bridge", func() {
+			bus := NewLocalBus()
+			led := NewLEDDev(&testLED{})
+			bus.Plug(led)
+			btnLogic := &testButton{}
+			btn := NewButtonDev(btnLogic)
+			bus.Plug(btn)
+			client, err := connectMQTT(broker, "robot")
+			So(err, ShouldBeNil)
+			defer client.Close()
+			bridge := NewMQTTBridge(NewLocalMaster(NewBusDev(bus)), client)
+			defer bridge.Close()
+
+			ledTopic := fmt.Sprintf("robot/%d/LED", DeviceAddress(led)[0])
+			btnTopic := fmt.Sprintf("robot/%d/Button", DeviceAddress(btn)[0])
+
+			Convey("telemetry and commands", func() {
+				So(bridge.Start(), ShouldBeNil)
+				btnLogic.simulatePressed(true)
+				So(expectMQTT(msgs, btnTopic+"/State"), ShouldEqual, `{"pressed":true}`)
+
+				So(observer.Publish(ledTopic+"/cmd/SetPowerState/42", []byte(`{"on":true}`)), ShouldBeNil)
+				So(expectMQTT(msgs, ledTopic+"/reply/SetPowerState/42"), ShouldEqual, `{"reply":null}`)
+
+				So(observer.Publish(btnTopic+"/cmd/GetState", nil), ShouldBeNil)
+				So(expectMQTT(msgs, btnTopic+"/reply/GetState"), ShouldEqual, `{"reply":{"pressed":true}}`)
+
+				So(observer.Publish(ledTopic+"/cmd/Fly", nil), ShouldBeNil)
+				var reply MQTTReply
+				So(json.Unmarshal([]byte(expectMQTT(msgs, ledTopic+"/reply/Fly")), &reply), ShouldBeNil)
+				So(reply.Error, ShouldContainSubstring, "LED.Fly")
+			})
+
+			Convey("class options", func() {
+				bridge.Classes = map[string]*MQTTClassOptions{"LED": {Methods: []string{}}}
+				So(bridge.Start(), ShouldBeNil)
+				So(observer.Publish(ledTopic+"/cmd/SetPowerState", []byte(`{"on":true}`)), ShouldBeNil)
+				var reply MQTTReply
+				So(json.Unmarshal([]byte(expectMQTT(msgs, ledTopic+"/reply/SetPowerState")), &reply), ShouldBeNil)
+				So(reply.Error, ShouldContainSubstring, ErrUnknownMethod.Error())
+
+				// Button is not bridged
+				So(observer.Publish(btnTopic+"/cmd/GetState", nil), ShouldBeNil)
+				So(observer.Publish("robot/done", nil), ShouldBeNil)
+				for msg := range msgs {
+					if msg.topic == "robot/done" {
+						break
+					}
+					So(msg.topic, ShouldNotEqual, btnTopic+"/reply/GetState")
+				}
+			})
+		})
+	})
+}
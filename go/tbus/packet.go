@@ -0,0 +1,492 @@
+package tbus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPacketSize fits a datagram in a typical 1500 bytes MTU
+	DefaultMaxPacketSize = 1400
+	// DefaultRetransmitAttempts is used if Retransmit is enabled without attempts
+	DefaultRetransmitAttempts = 3
+	// DefaultMaxPacketSessions limits the peers of a PacketListener
+	DefaultMaxPacketSessions = 256
+	// DefaultPacketIdleTimeout expires PacketListener sessions without datagrams
+	DefaultPacketIdleTimeout = 5 * time.Minute
+
+	packetQueueSize = 64
+)
+
+// ErrPacketTooLarge indicates a frame exceeds MaxPacketSize
+var ErrPacketTooLarge = fmt.Errorf("frame exceeds max packet size")
+
+// PacketOptions configures packet sessions
+type PacketOptions struct {
+	// MaxPacketSize limits the size of a datagram, DefaultMaxPacketSize if 0
+	MaxPacketSize int
+	// Retransmit resends invocations not replied within the duration,
+	// it should be enabled on the master side, 0 disables retransmission.
+	// Events and replies are never retransmitted. A retransmitted
+	// invocation may be executed more than once.
+	Retransmit         time.Duration
+	RetransmitAttempts int
+	// MaxSessions limits the sessions of a PacketListener, datagrams from
+	// new peers are dropped when reached, DefaultMaxPacketSessions if 0
+	MaxSessions int
+	// IdleTimeout closes a PacketListener session which receives nothing
+	// for the duration, DefaultPacketIdleTimeout if 0
+	IdleTimeout time.Duration
+	Clock       Clock
+}
+
+func (o *PacketOptions) maxPacketSize() int {
+	if o.MaxPacketSize > 0 {
+		return o.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+func (o *PacketOptions) maxSessions() int {
+	if o.MaxSessions > 0 {
+		return o.MaxSessions
+	}
+	return DefaultMaxPacketSessions
+}
+
+func (o *PacketOptions) idleTimeout() time.Duration {
+	if o.IdleTimeout > 0 {
+		return o.IdleTimeout
+	}
+	return DefaultPacketIdleTimeout
+}
+
+// PacketSession exchanges tbus frames with one peer over datagrams, each
+// datagram carries one or several complete frames. It implements
+// io.ReadWriteCloser so it can be used as a stream.
+type PacketSession struct {
+	Options PacketOptions
+
+	conn    net.PacketConn
+	addr    net.Addr
+	inbox   chan []byte
+	reading []byte
+	wbuf    []byte
+	onClose func()
+
+	pending   map[string]*pendingPacket
+	received  time.Time
+	lock      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pendingPacket struct {
+	frame    []byte
+	sent     time.Time
+	attempts int
+}
+
+func newPacketSession(conn net.PacketConn, addr net.Addr, opts PacketOptions) *PacketSession {
+	s := &PacketSession{
+		Options: opts,
+		conn:    conn,
+		addr:    addr,
+		inbox:   make(chan []byte, packetQueueSize),
+		pending: make(map[string]*pendingPacket),
+		closed:  make(chan struct{}),
+	}
+	s.received = s.clock().Now()
+	if opts.Retransmit > 0 {
+		go s.retransmit()
+	}
+	return s
+}
+
+// NewPacketSession creates a session with the peer at addr and receives
+// datagrams from conn, the session owns conn
+func NewPacketSession(conn net.PacketConn, addr net.Addr, opts PacketOptions) *PacketSession {
+	s := newPacketSession(conn, addr, opts)
+	s.onClose = func() { conn.Close() }
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				s.Close()
+				return
+			}
+			if from.String() == addr.String() {
+				s.receive(append([]byte(nil), buf[:n]...))
+			}
+		}
+	}()
+	return s
+}
+
+// RemoteAddr returns the address of peer
+func (s *PacketSession) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// Read implements io.Reader, datagrams are read as a stream
+func (s *PacketSession) Read(p []byte) (int, error) {
+	for len(s.reading) == 0 {
+		select {
+		case data := <-s.inbox:
+			s.reading = data
+		case <-s.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.reading)
+	s.reading = s.reading[n:]
+	return n, nil
+}
+
+// Write implements io.Writer, complete frames are sent in datagrams,
+// an incomplete frame is kept until the rest is written
+func (s *PacketSession) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.wbuf = append(s.wbuf, p...)
+	maxSize := s.Options.maxPacketSize()
+	var packet []byte
+	for {
+		size, head, err := frameSize(s.wbuf)
+		if err != nil {
+			s.wbuf = nil
+			return 0, err
+		}
+		if size == 0 {
+			break
+		}
+		if size > maxSize {
+			s.wbuf = nil
+			return 0, ErrPacketTooLarge
+		}
+		frame := s.wbuf[:size]
+		if s.Options.Retransmit > 0 && len(head.MsgID) > 0 && !head.IsEvent() {
+			s.pending[string(head.MsgID)] = &pendingPacket{
+				frame: append([]byte(nil), frame...),
+				sent:  s.clock().Now(),
+			}
+		}
+		if len(packet)+size > maxSize {
+			if err = s.send(packet); err != nil {
+				return 0, err
+			}
+			packet = nil
+		}
+		packet = append(packet, frame...)
+		s.wbuf = s.wbuf[size:]
+	}
+	if len(s.wbuf) == 0 {
+		s.wbuf = nil
+	}
+	if len(packet) > 0 {
+		if err := s.send(packet); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer
+func (s *PacketSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return nil
+}
+
+func (s *PacketSession) send(packet []byte) error {
+	select {
+	case <-s.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	_, err := s.conn.WriteTo(packet, s.addr)
+	return err
+}
+
+// receive queues the datagram for Read, it returns false if the datagram
+// doesn't consist of complete frames, and it's dropped so the stream
+// decoder on the session isn't broken by it
+func (s *PacketSession) receive(packet []byte) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	var replied []string
+	reader := bytes.NewReader(packet)
+	for reader.Len() > 0 {
+		msg, err := Decode(reader)
+		if err != nil {
+			return false
+		}
+		if len(msg.Head.MsgID) > 0 && !msg.Head.IsEvent() {
+			replied = append(replied, string(msg.Head.MsgID))
+		}
+	}
+	s.lock.Lock()
+	s.received = s.clock().Now()
+	if s.Options.Retransmit > 0 {
+		for _, id := range replied {
+			delete(s.pending, id)
+		}
+	}
+	s.lock.Unlock()
+	select {
+	case s.inbox <- packet:
+	case <-s.closed:
+	default:
+		// lossy like the link when reader falls behind
+	}
+	return true
+}
+
+// idle returns true if nothing is received after the time
+func (s *PacketSession) idle(since time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.received.After(since)
+}
+
+func (s *PacketSession) retransmit() {
+	clock := s.clock()
+	attempts := s.Options.RetransmitAttempts
+	if attempts <= 0 {
+		attempts = DefaultRetransmitAttempts
+	}
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-clock.After(s.Options.Retransmit):
+		}
+		now := clock.Now()
+		var frames [][]byte
+		s.lock.Lock()
+		for id, p := range s.pending {
+			if now.Sub(p.sent) < s.Options.Retransmit {
+				continue
+			}
+			if p.attempts >= attempts {
+				delete(s.pending, id)
+				continue
+			}
+			p.attempts++
+			p.sent = now
+			frames = append(frames, p.frame)
+		}
+		s.lock.Unlock()
+		for _, frame := range frames {
+			s.send(frame)
+		}
+	}
+}
+
+func (s *PacketSession) clock() Clock {
+	return ClockOrSystem(s.Options.Clock)
+}
+
+// frameSize returns the size of the first complete frame in buf,
+// 0 if the frame is incomplete
+func frameSize(buf []byte) (int, MsgHead, error) {
+	if len(buf) == 0 {
+		return 0, MsgHead{}, nil
+	}
+	reader := bytes.NewReader(buf)
+	head, err := DecodeHead(reader)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, head, nil
+	} else if err != nil {
+		return 0, head, err
+	}
+	size := len(buf) - reader.Len() + int(head.BodyBytes)
+	if size > len(buf) {
+		return 0, head, nil
+	}
+	return size, head, nil
+}
+
+// PacketListener accepts a PacketSession for each new peer address,
+// it implements Listener for RemoteDeviceHost
+type PacketListener struct {
+	Options PacketOptions
+
+	conn      net.PacketConn
+	sessions  map[string]*PacketSession
+	acceptCh  chan *PacketSession
+	lock      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPacketListener creates a PacketListener receiving from conn
+func NewPacketListener(conn net.PacketConn, opts PacketOptions) *PacketListener {
+	l := &PacketListener{
+		Options:  opts,
+		conn:     conn,
+		sessions: make(map[string]*PacketSession),
+		acceptCh: make(chan *PacketSession, packetQueueSize),
+		closed:   make(chan struct{}),
+	}
+	go l.run()
+	go l.expire()
+	return l
+}
+
+// ListenPacket listens on the address, e.g. ListenPacket("udp", ":7000", opts)
+func ListenPacket(network, address string, opts PacketOptions) (*PacketListener, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketListener(conn, opts), nil
+}
+
+// Addr returns the local address
+func (l *PacketListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Accept implements Listener
+func (l *PacketListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case s := <-l.acceptCh:
+		return s, nil
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// Close implements Listener, it closes all sessions
+func (l *PacketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+		l.lock.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*PacketSession)
+		l.lock.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return err
+}
+
+func (l *PacketListener) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		l.lock.Lock()
+		s := l.sessions[from.String()]
+		l.lock.Unlock()
+		if s != nil {
+			s.receive(packet)
+		} else {
+			l.accept(from, packet)
+		}
+	}
+}
+
+// accept creates a session for the new peer without blocking the reading,
+// the datagram is dropped if it's malformed, the sessions are full or
+// Accept falls behind
+func (l *PacketListener) accept(from net.Addr, packet []byte) {
+	s := newPacketSession(l.conn, from, l.Options)
+	if !s.receive(packet) {
+		s.Close()
+		return
+	}
+	key := from.String()
+	s.onClose = func() {
+		l.lock.Lock()
+		if l.sessions[key] == s {
+			delete(l.sessions, key)
+		}
+		l.lock.Unlock()
+	}
+	l.lock.Lock()
+	accepted := false
+	select {
+	case <-l.closed:
+	default:
+		if len(l.sessions) < l.Options.maxSessions() {
+			select {
+			case l.acceptCh <- s:
+				l.sessions[key] = s
+				accepted = true
+			default:
+			}
+		}
+	}
+	l.lock.Unlock()
+	if !accepted {
+		s.Close()
+	}
+}
+
+// expire closes sessions idle longer than IdleTimeout
+func (l *PacketListener) expire() {
+	clock := ClockOrSystem(l.Options.Clock)
+	timeout := l.Options.idleTimeout()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-clock.After(timeout / 2):
+		}
+		since := clock.Now().Add(-timeout)
+		var idle []*PacketSession
+		l.lock.Lock()
+		for _, s := range l.sessions {
+			if s.idle(since) {
+				idle = append(idle, s)
+			}
+		}
+		l.lock.Unlock()
+		for _, s := range idle {
+			s.Close()
+		}
+	}
+}
+
+// PacketDialer creates a PacketSession to the address
+type PacketDialer struct {
+	Network string
+	Address string
+	Options PacketOptions
+}
+
+// Dial implements Dialer
+func (d *PacketDialer) Dial() (io.ReadWriteCloser, error) {
+	network := d.Network
+	if network == "" {
+		network = "udp"
+	}
+	addr, err := net.ResolveUDPAddr(network, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketSession(conn, addr, d.Options), nil
+}
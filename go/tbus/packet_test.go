@@ -0,0 +1,243 @@
+package tbus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dropPacketConn drops the first datagrams matched by drop
+type dropPacketConn struct {
+	net.PacketConn
+	drop    func([]byte) bool
+	dropped int
+	lock    sync.Mutex
+}
+
+func (c *dropPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		c.lock.Lock()
+		drop := c.drop(p[:n])
+		if drop {
+			c.dropped++
+		}
+		c.lock.Unlock()
+		if !drop {
+			return n, addr, err
+		}
+	}
+}
+
+// encodeFrame encodes the msg as a datagram
+func encodeFrame(msg *Msg) []byte {
+	var buf bytes.Buffer
+	msg.EncodeTo(&buf)
+	return buf.Bytes()
+}
+
+func TestPacket(t *testing.T) {
+	Convey("Packet", t, func() {
+		Convey("remote device", func() {
+			listener, err := ListenPacket("udp", "127.0.0.1:0", PacketOptions{})
+			So(err, ShouldBeNil)
+			defer listener.Close()
+			host := NewRemoteDeviceHost(listener)
+			go host.Run()
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), &PacketDialer{Address: listener.Addr().String()})
+			go port.Run()
+			dev := <-host.AcceptChan()
+			defer dev.Close(context.Background())
+			master := NewLocalMaster(dev)
+			go dev.Run()
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+		})
+
+		Convey("batch and max size", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			session, err := (&PacketDialer{
+				Address: conn.LocalAddr().String(),
+				Options: PacketOptions{MaxPacketSize: 64},
+			}).Dial()
+			So(err, ShouldBeNil)
+			defer session.Close()
+
+			var frames bytes.Buffer
+			So(BuildMsg().MsgIDVarInt(1).EncodeBody(1, &LEDPowerState{On: true}).Build().EncodeTo(&frames), ShouldBeNil)
+			So(BuildMsg().MsgIDVarInt(2).EncodeBody(1, &LEDPowerState{}).Build().EncodeTo(&frames), ShouldBeNil)
+			data := frames.Bytes()
+			// a partial frame is held until completed
+			_, err = session.Write(data[:3])
+			So(err, ShouldBeNil)
+			_, err = session.Write(data[3:])
+			So(err, ShouldBeNil)
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			So(buf[:n], ShouldResemble, data)
+
+			var large bytes.Buffer
+			So(BuildMsg().Body(1, make([]byte, 100)).Build().EncodeTo(&large), ShouldBeNil)
+			_, err = session.Write(large.Bytes())
+			So(err, ShouldEqual, ErrPacketTooLarge)
+		})
+
+		Convey("retransmit", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			listener := NewPacketListener(conn, PacketOptions{Retransmit: 20 * time.Millisecond})
+			defer listener.Close()
+			host := NewRemoteDeviceHost(listener)
+			go host.Run()
+
+			// the device drops the first invocation it receives
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			dropping := true
+			lossy := &dropPacketConn{PacketConn: pc, drop: func(p []byte) bool {
+				if !dropping {
+					return false
+				}
+				msg, err := Decode(bytes.NewReader(p))
+				if err != nil || len(msg.Head.MsgID) == 0 {
+					return false
+				}
+				dropping = false
+				return true
+			}}
+			session := NewPacketSession(lossy, listener.Addr(), PacketOptions{})
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}), DialerFunc(func() (io.ReadWriteCloser, error) {
+				return session, nil
+			}))
+			go port.Run()
+			dev := <-host.AcceptChan()
+			defer dev.Close(context.Background())
+			master := NewLocalMaster(dev)
+			go dev.Run()
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+			lossy.lock.Lock()
+			So(lossy.dropped, ShouldEqual, 1)
+			lossy.lock.Unlock()
+		})
+
+		Convey("listener", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			clock := NewFakeClock(time.Unix(0, 0))
+			listener := NewPacketListener(conn, PacketOptions{
+				MaxSessions: 2,
+				IdleTimeout: time.Minute,
+				Clock:       clock,
+			})
+			defer listener.Close()
+			sessions := func() int {
+				listener.lock.Lock()
+				defer listener.lock.Unlock()
+				return len(listener.sessions)
+			}
+			peer := func() net.PacketConn {
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				return pc
+			}
+			waitFor := func(cond func() bool) bool {
+				for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+					if cond() {
+						return true
+					}
+					time.Sleep(time.Millisecond)
+				}
+				return false
+			}
+			frame1 := encodeFrame(BuildMsg().MsgIDVarInt(1).EncodeBody(1, &LEDPowerState{On: true}).Build())
+			frame2 := encodeFrame(BuildMsg().MsgIDVarInt(2).EncodeBody(1, &LEDPowerState{}).Build())
+			junk := []byte{0xff, 0x10, 0x01, 0x7f}
+
+			Convey("malformed datagrams", func() {
+				pc := peer()
+				defer pc.Close()
+				_, err := pc.WriteTo(junk, listener.Addr())
+				So(err, ShouldBeNil)
+				pc.WriteTo(frame1, listener.Addr())
+				s, err := listener.Accept()
+				So(err, ShouldBeNil)
+				pc.WriteTo(junk, listener.Addr())
+				pc.WriteTo(frame2[:len(frame2)-1], listener.Addr())
+				pc.WriteTo(frame2, listener.Addr())
+				msg, err := Decode(s)
+				So(err, ShouldBeNil)
+				So(msg.Head.MsgID, ShouldResemble, MsgID{1})
+				msg, err = Decode(s)
+				So(err, ShouldBeNil)
+				So(msg.Head.MsgID, ShouldResemble, MsgID{2})
+				So(sessions(), ShouldEqual, 1)
+			})
+
+			Convey("cap and not blocked by Accept", func() {
+				pc1, pc2, pc3 := peer(), peer(), peer()
+				defer pc1.Close()
+				defer pc2.Close()
+				defer pc3.Close()
+				pc1.WriteTo(frame1, listener.Addr())
+				So(waitFor(func() bool { return sessions() == 1 }), ShouldBeTrue)
+				pc2.WriteTo(frame1, listener.Addr())
+				So(waitFor(func() bool { return sessions() == 2 }), ShouldBeTrue)
+				pc3.WriteTo(frame1, listener.Addr())
+				// datagrams of accepted peers are still received
+				pc1.WriteTo(frame2, listener.Addr())
+				s1, err := listener.Accept()
+				So(err, ShouldBeNil)
+				So(s1.(*PacketSession).RemoteAddr().String(), ShouldEqual, pc1.LocalAddr().String())
+				So(waitFor(func() bool { return len(s1.(*PacketSession).inbox) == 2 }), ShouldBeTrue)
+				s2, err := listener.Accept()
+				So(err, ShouldBeNil)
+				So(s2.(*PacketSession).RemoteAddr().String(), ShouldEqual, pc2.LocalAddr().String())
+				So(sessions(), ShouldEqual, 2)
+
+				// a slot is available when a session is closed
+				s1.Close()
+				So(sessions(), ShouldEqual, 1)
+				pc3.WriteTo(frame1, listener.Addr())
+				s3, err := listener.Accept()
+				So(err, ShouldBeNil)
+				So(s3.(*PacketSession).RemoteAddr().String(), ShouldEqual, pc3.LocalAddr().String())
+			})
+
+			Convey("idle expiry", func() {
+				pc1, pc2 := peer(), peer()
+				defer pc1.Close()
+				defer pc2.Close()
+				pc1.WriteTo(frame1, listener.Addr())
+				s1, err := listener.Accept()
+				So(err, ShouldBeNil)
+				clock.BlockUntil(1)
+				clock.Advance(time.Minute / 2)
+				pc2.WriteTo(frame1, listener.Addr())
+				s2, err := listener.Accept()
+				So(err, ShouldBeNil)
+				clock.BlockUntil(1)
+				clock.Advance(time.Minute / 2)
+				So(waitFor(func() bool { return sessions() == 1 }), ShouldBeTrue)
+				for err == nil {
+					_, err = Decode(s1)
+				}
+				So(err, ShouldEqual, io.EOF)
+				listener.lock.Lock()
+				So(listener.sessions[s2.(*PacketSession).RemoteAddr().String()], ShouldEqual, s2)
+				listener.lock.Unlock()
+			})
+		})
+	})
+}
@@ -55,6 +55,15 @@ func (m *pfxMap) remove(keys []uint8) {
 	}
 }
 
+func (m *pfxMap) each(fn func(interface{})) {
+	if m.value != nil {
+		fn(m.value)
+	}
+	for _, node := range m.nodes {
+		node.each(fn)
+	}
+}
+
 func (m *pfxMap) empty() bool {
 	return len(m.nodes) == 0 && m.value == nil
 }
@@ -0,0 +1,277 @@
+package tbus
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const pipeBacklog = 8
+
+// ErrPipeRefused indicates PipeListener has too many connections not accepted
+var ErrPipeRefused = fmt.Errorf("pipe connection refused")
+
+// PipeOptions configures in-memory connections
+type PipeOptions struct {
+	// Buffer is the number of bytes buffered in each direction, a write
+	// blocks until the data is read if 0, like net.Pipe
+	Buffer int
+	// Latency delays written data before it can be read
+	Latency time.Duration
+	// Clock is used for Latency, the system clock is used if nil
+	Clock Clock
+}
+
+// pipeAddr is the address of in-memory connections
+type pipeAddr string
+
+// Network implements net.Addr
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String implements net.Addr
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipeBuffer carries data in one direction
+type pipeBuffer struct {
+	limit   int
+	latency time.Duration
+	clock   Clock
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	chunks       []pipeChunk
+	size         int
+	written      int64
+	read         int64
+	readerClosed bool
+	writerClosed bool
+}
+
+func newPipeBuffer(opts *PipeOptions) *pipeBuffer {
+	b := &pipeBuffer{limit: opts.Buffer, latency: opts.Latency, clock: ClockOrSystem(opts.Clock)}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *pipeBuffer) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for {
+		if b.readerClosed {
+			return 0, io.ErrClosedPipe
+		}
+		if len(b.chunks) > 0 {
+			chunk := &b.chunks[0]
+			if b.latency > 0 {
+				if wait := chunk.at.Sub(b.clock.Now()); wait > 0 {
+					b.lock.Unlock()
+					b.clock.Sleep(wait)
+					b.lock.Lock()
+					continue
+				}
+			}
+			n := copy(p, chunk.data)
+			if chunk.data = chunk.data[n:]; len(chunk.data) == 0 {
+				b.chunks = b.chunks[1:]
+			}
+			b.size -= n
+			b.read += int64(n)
+			b.cond.Broadcast()
+			return n, nil
+		}
+		if b.writerClosed {
+			return 0, io.EOF
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *pipeBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for n < len(p) {
+		if b.readerClosed || b.writerClosed {
+			return n, io.ErrClosedPipe
+		}
+		size := len(p) - n
+		if b.limit > 0 {
+			if b.size >= b.limit {
+				b.cond.Wait()
+				continue
+			}
+			if avail := b.limit - b.size; size > avail {
+				size = avail
+			}
+		}
+		chunk := pipeChunk{data: append([]byte(nil), p[n:n+size]...)}
+		if b.latency > 0 {
+			chunk.at = b.clock.Now().Add(b.latency)
+		}
+		b.chunks = append(b.chunks, chunk)
+		b.size += size
+		b.written += int64(size)
+		n += size
+		b.cond.Broadcast()
+	}
+	if b.limit == 0 {
+		for b.read < b.written && !b.readerClosed && !b.writerClosed {
+			b.cond.Wait()
+		}
+		if b.read < b.written {
+			return n, io.ErrClosedPipe
+		}
+	}
+	return n, nil
+}
+
+func (b *pipeBuffer) closeReader() {
+	b.lock.Lock()
+	b.readerClosed = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+func (b *pipeBuffer) closeWriter() {
+	b.lock.Lock()
+	b.writerClosed = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// PipeConn is one end of an in-memory connection, data written before the
+// peer closes can still be read, then Read returns io.EOF
+type PipeConn struct {
+	in     *pipeBuffer
+	out    *pipeBuffer
+	local  net.Addr
+	remote net.Addr
+}
+
+// Pipe creates a pair of connected in-memory connections
+func Pipe(opts PipeOptions) (*PipeConn, *PipeConn) {
+	return newPipe(opts, pipeAddr("pipe"), pipeAddr("pipe"))
+}
+
+func newPipe(opts PipeOptions, addr1, addr2 net.Addr) (*PipeConn, *PipeConn) {
+	b1, b2 := newPipeBuffer(&opts), newPipeBuffer(&opts)
+	return &PipeConn{in: b1, out: b2, local: addr1, remote: addr2},
+		&PipeConn{in: b2, out: b1, local: addr2, remote: addr1}
+}
+
+// Read implements io.Reader
+func (c *PipeConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+// Write implements io.Writer
+func (c *PipeConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// Close implements io.Closer
+func (c *PipeConn) Close() error {
+	c.in.closeReader()
+	c.out.closeWriter()
+	return nil
+}
+
+// LocalAddr returns the address of this end
+func (c *PipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the peer
+func (c *PipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// PipeListener is an in-memory Listener, it's also the Dialer connecting
+// to itself, so both ends are wired without networking
+type PipeListener struct {
+	Options PipeOptions
+
+	name     string
+	count    uint64
+	acceptCh chan io.ReadWriteCloser
+	lock     sync.Mutex
+	closed   chan struct{}
+}
+
+// NewPipeListener creates a PipeListener, name is used in the addresses
+// of connections
+func NewPipeListener(name string, opts PipeOptions) *PipeListener {
+	return &PipeListener{
+		Options:  opts,
+		name:     name,
+		acceptCh: make(chan io.ReadWriteCloser, pipeBacklog),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Addr returns the address of the listener
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// Accept implements Listener
+func (l *PipeListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// Dial implements Dialer, it fails if the backlog is full
+func (l *PipeListener) Dial() (io.ReadWriteCloser, error) {
+	client := pipeAddr(l.name + "#" + strconv.FormatUint(atomic.AddUint64(&l.count, 1), 10))
+	server, conn := newPipe(l.Options, pipeAddr(l.name), client)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case l.acceptCh <- server:
+		return conn, nil
+	default:
+		return nil, ErrPipeRefused
+	}
+}
+
+// Close implements Listener, connections not accepted yet are closed
+func (l *PipeListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+	close(l.closed)
+	for {
+		select {
+		case conn := <-l.acceptCh:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tbus
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPipe(t *testing.T) {
+	Convey("Pipe", t, func() {
+		Convey("unbuffered", func() {
+			c1, c2 := Pipe(PipeOptions{})
+			written := make(chan error, 1)
+			go func() {
+				_, err := c1.Write([]byte("hello"))
+				written <- err
+			}()
+			buf := make([]byte, 3)
+			n, err := c2.Read(buf)
+			So(err, ShouldBeNil)
+			So(string(buf[:n]), ShouldEqual, "hel")
+			select {
+			case <-written:
+				So("write returned before read", ShouldBeNil)
+			case <-time.After(10 * time.Millisecond):
+			}
+			n, err = c2.Read(buf)
+			So(err, ShouldBeNil)
+			So(string(buf[:n]), ShouldEqual, "lo")
+			So(<-written, ShouldBeNil)
+
+			c1.Close()
+			_, err = c2.Read(buf)
+			So(err, ShouldEqual, io.EOF)
+			_, err = c1.Read(buf)
+			So(err, ShouldEqual, io.ErrClosedPipe)
+			_, err = c2.Write(buf)
+			So(err, ShouldEqual, io.ErrClosedPipe)
+		})
+
+		Convey("buffered", func() {
+			c1, c2 := Pipe(PipeOptions{Buffer: 4})
+			n, err := c1.Write([]byte("abcd"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 4)
+			written := make(chan error, 1)
+			go func() {
+				_, err := c1.Write([]byte("ef"))
+				written <- err
+			}()
+			select {
+			case <-written:
+				So("write returned with full buffer", ShouldBeNil)
+			case <-time.After(10 * time.Millisecond):
+			}
+			c1.Close()
+			So(<-written, ShouldEqual, io.ErrClosedPipe)
+			// data written before closing is still readable
+			data, err := ioutil.ReadAll(c2)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "abcd")
+		})
+
+		Convey("latency", func() {
+			clock := NewFakeClock(time.Unix(0, 0))
+			c1, c2 := Pipe(PipeOptions{Buffer: 16, Latency: time.Second, Clock: clock})
+			_, err := c1.Write([]byte("late"))
+			So(err, ShouldBeNil)
+			read := make(chan string, 1)
+			go func() {
+				buf := make([]byte, 16)
+				n, _ := c2.Read(buf)
+				read <- string(buf[:n])
+			}()
+			clock.BlockUntil(1)
+			clock.Advance(500 * time.Millisecond)
+			select {
+			case <-read:
+				So("read before latency", ShouldBeNil)
+			case <-time.After(10 * time.Millisecond):
+			}
+			clock.Advance(500 * time.Millisecond)
+			So(<-read, ShouldEqual, "late")
+		})
+
+		Convey("listener", func() {
+			listener := NewPipeListener("test", PipeOptions{})
+			conn, err := listener.Dial()
+			So(err, ShouldBeNil)
+			So(streamName(conn), ShouldEqual, "test")
+			accepted, err := listener.Accept()
+			So(err, ShouldBeNil)
+			So(streamName(accepted), ShouldEqual, "test#1")
+			listener.Close()
+			_, err = listener.Dial()
+			So(err, ShouldEqual, io.ErrClosedPipe)
+			_, err = listener.Accept()
+			So(IsErrClosing(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestHarness(t *testing.T) {
+	Convey("Harness", t, func() {
+		bus := NewLocalBus()
+		btnLogic := &testButton{}
+		bus.Plug(NewButtonDev(btnLogic))
+		sub := NewLocalBus()
+		bus.Plug(NewBusDev(sub))
+
+		h, err := NewRemoteHarness(NewBusDev(bus), PipeOptions{Buffer: 256})
+		So(err, ShouldBeNil)
+		defer h.Close()
+		led, err := h.PlugRemote(sub, NewLEDDev(&testLED{}))
+		So(err, ShouldBeNil)
+
+		enum, err := NewBusCtl(h.Master).Enumerate().Wait()
+		So(err, ShouldBeNil)
+		So(enum.Devices, ShouldHaveLength, 2)
+		subAddr := enum.Devices[1].DeviceAddress()
+		ledAddr := append(subAddr, uint8(led.DeviceInfo().Address))
+		So(NewLEDCtl(h.Master).SetAddress(ledAddr).On().Wait(), ShouldBeNil)
+
+		chn := NewButtonCtl(h.Master).SetAddress(enum.Devices[0].DeviceAddress()).State()
+		go btnLogic.simulatePressed(true)
+		So((<-chn.C).Pressed, ShouldBeTrue)
+
+		So(h.Close(), ShouldBeNil)
+		So(NewLEDCtl(h.Master).SetAddress(ledAddr).On().Wait(), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,262 @@
+// Code generated by protoc-gen-go.
+// source: tbus/pose.proto
+// DO NOT EDIT!
+
+package tbus
+
+import "context"
+import "time"
+import "sync"
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import _ "github.com/golang/protobuf/ptypes/empty"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type Pose2D struct {
+	// position in meters
+	X float64 `protobuf:"fixed64,1,opt,name=x" json:"x,omitempty"`
+	Y float64 `protobuf:"fixed64,2,opt,name=y" json:"y,omitempty"`
+	// heading in radians, counter-clockwise
+	Theta float64 `protobuf:"fixed64,3,opt,name=theta" json:"theta,omitempty"`
+}
+
+func (m *Pose2D) Reset()                    { *m = Pose2D{} }
+func (m *Pose2D) String() string            { return proto.CompactTextString(m) }
+func (*Pose2D) ProtoMessage()               {}
+func (*Pose2D) Descriptor() ([]byte, []int) { return fileDescriptor8, []int{0} }
+
+func init() {
+	proto.RegisterType((*Pose2D)(nil), "tbus.Pose2D")
+}
+
+func init() { proto.RegisterFile("tbus/pose.proto", fileDescriptor8) }
+
+var fileDescriptor8 = []byte{
+	// 199 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2f, 0x49, 0x2a, 0x2d,
+	0xd6, 0x2f, 0xc8, 0x2f, 0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x01, 0x09, 0x48,
+	0x49, 0xa7, 0xe7, 0xe7, 0xa7, 0xe7, 0xa4, 0xea, 0x83, 0xc5, 0x92, 0x4a, 0xd3, 0xf4, 0x53, 0x73,
+	0x0b, 0x4a, 0x2a, 0x21, 0x4a, 0xa4, 0x24, 0xc1, 0x7a, 0x92, 0xf3, 0x73, 0x73, 0xf3, 0xf3, 0xf4,
+	0xf3, 0x0b, 0x4a, 0x32, 0xf3, 0xf3, 0x8a, 0x21, 0x52, 0x4a, 0x56, 0x5c, 0x6c, 0x01, 0xf9, 0xc5,
+	0xa9, 0x46, 0x2e, 0x42, 0x3c, 0x5c, 0x8c, 0x15, 0x12, 0x8c, 0x0a, 0x8c, 0x1a, 0x8c, 0x41, 0x8c,
+	0x15, 0x20, 0x5e, 0xa5, 0x04, 0x13, 0x84, 0x57, 0x29, 0x24, 0xc2, 0xc5, 0x5a, 0x92, 0x91, 0x5a,
+	0x92, 0x28, 0xc1, 0x0c, 0x16, 0x81, 0x70, 0x8c, 0x1a, 0x18, 0xb9, 0xb8, 0x40, 0x9a, 0x83, 0x53,
+	0xf3, 0x8a, 0xf3, 0x8b, 0x84, 0x4c, 0xb9, 0xd8, 0xdd, 0x53, 0x4b, 0x40, 0x02, 0x42, 0x62, 0x7a,
+	0x10, 0xe7, 0xe8, 0xc1, 0x9c, 0xa3, 0xe7, 0x0a, 0x72, 0x8e, 0x14, 0x8f, 0x1e, 0xc8, 0x25, 0x7a,
+	0x10, 0x1b, 0x95, 0x58, 0x1a, 0xb6, 0x4a, 0x30, 0x0a, 0x99, 0x70, 0xb1, 0x90, 0xaa, 0xc7, 0x80,
+	0x51, 0x8a, 0xb5, 0x61, 0xab, 0xc4, 0x04, 0x8e, 0x24, 0x36, 0xb0, 0x62, 0x63, 0xc0, 0x00, 0x44,
+	0x12, 0x1c, 0x4c, 0x16, 0x01, 0x00, 0x00,
+}
+
+//
+// GENERTED FROM tbus/pose.proto, DO NOT EDIT
+//
+
+// PoseSensorClassID is the class ID of PoseSensor
+const PoseSensorClassID uint32 = 0x0410
+
+// PoseSensorClass is the registered descriptor of PoseSensor
+var PoseSensorClass = RegisterClass(&ClassDesc{
+    Name:    "PoseSensor",
+    ClassID: PoseSensorClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "GetPose", ReplyType: "tbus.Pose2D"},
+    },
+    Events: []EventDesc{
+        {Index: 1, Name: "Pose", EventType: "tbus.Pose2D"},
+    },
+})
+
+// PoseSensorLogic defines the logic interface
+type PoseSensorLogic interface {
+    DeviceLogic
+    GetPose() (*Pose2D, error)
+}
+
+// PoseSensorContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type PoseSensorContextLogic interface {
+    GetPoseContext(context.Context) (*Pose2D, error)
+}
+
+// PoseSensorDev is the device
+type PoseSensorDev struct {
+    DeviceBase
+    Logic PoseSensorLogic
+}
+
+// NewPoseSensorDev creates a new device
+func NewPoseSensorDev(logic PoseSensorLogic) *PoseSensorDev {
+    d := &PoseSensorDev{Logic: logic}
+    d.Info.ClassId = PoseSensorClassID
+    logic.SetDevice(d)
+    return d
+}
+
+// DispatchMsg implements Device
+func (d *PoseSensorDev) DispatchMsg(msg *Msg) (err error) {
+    if msg.Head.NeedRoute() {
+        return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
+    }
+    call := &DeviceCall{Device: d, Class: PoseSensorClass, Method: msg.Body.Flag, Msg: msg}
+    switch msg.Body.Flag {
+    case 0:
+    case 1: // GetPose
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
+        }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *PoseSensorDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(PoseSensorContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetPose
+        call.Reply, err = d.Logic.GetPose()
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+func (d *PoseSensorDev) invokeContext(logic PoseSensorContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // GetPose
+        call.Reply, err = logic.GetPoseContext(call.Context)
+    default:
+        err = ErrInvalidMethod
+    }
+    return
+}
+
+// SetDeviceID sets device id
+func (d *PoseSensorDev) SetDeviceID(id uint32) *PoseSensorDev {
+    d.Info.DeviceId = id
+    return d
+}
+
+// PoseSensorCtl is the device controller
+type PoseSensorCtl struct {
+    Controller
+}
+
+// NewPoseSensorCtl creates controller for PoseSensor
+func NewPoseSensorCtl(master Master) *PoseSensorCtl {
+    c := &PoseSensorCtl{}
+    c.Master = master
+    c.Class = PoseSensorClass
+    return c
+}
+
+// SetAddress sets routing address for target device
+func (c *PoseSensorCtl) SetAddress(addrs RouteAddr) *PoseSensorCtl {
+    c.Address = addrs
+    return c
+}
+
+// InvokePoseSensorGetPose represents the invocation of PoseSensor.GetPose
+type InvokePoseSensorGetPose struct {
+	MethodInvocation
+}
+
+// Timeout implements Invocation
+func (i *InvokePoseSensorGetPose) Timeout(dur time.Duration) *InvokePoseSensorGetPose {
+	i.Invocation.Timeout(dur)
+	return i
+}
+
+// Wait waits and retrieves the result
+func (i *InvokePoseSensorGetPose) Wait() (*Pose2D, error) {
+	reply := &Pose2D{}
+	err := i.Result(reply)
+	return reply, err
+}
+
+// GetPose wraps class PoseSensor
+func (c *PoseSensorCtl) GetPose() *InvokePoseSensorGetPose {
+	invoke := &InvokePoseSensorGetPose{}
+	invoke.Invocation = c.Invoke(1, nil)
+	return invoke
+}
+
+// ChnPoseSensorPoseID is the channel index
+const ChnPoseSensorPoseID uint8 = 1
+
+// ChnPoseSensorPose is the subscribed event channel for PoseSensor.Pose
+type ChnPoseSensorPose struct {
+	C chan *Pose2D
+
+	subscription EventSubscription
+	done         chan struct{}
+	closeOnce    sync.Once
+	closed       bool
+	lock         sync.RWMutex
+}
+
+// HandleEvent implements EventHandler
+func (c *ChnPoseSensorPose) HandleEvent(evt Event, _ EventSubscription) {
+	val := &Pose2D{}
+	if evt.Decode(val) != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.C <- val:
+	case <-c.done:
+	}
+}
+
+// HandleClose implements EventCloseHandler
+func (c *ChnPoseSensorPose) HandleClose(EventSubscription) {
+	c.close()
+}
+
+// Close implement EventSubscription, C is closed after events being
+// delivered are dropped
+func (c *ChnPoseSensorPose) Close() error {
+	err := c.subscription.Close()
+	c.close()
+	return err
+}
+
+func (c *ChnPoseSensorPose) close() {
+	// release handlers blocked on sending before waiting for them
+	c.closeOnce.Do(func() { close(c.done) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
+}
+
+// Pose wraps class PoseSensor
+func (c *PoseSensorCtl) Pose() *ChnPoseSensorPose {
+	chn := &ChnPoseSensorPose{C: make(chan *Pose2D), done: make(chan struct{})}
+	chn.subscription = c.Subscribe(1, chn)
+	return chn
+}
+
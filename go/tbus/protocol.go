@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
@@ -21,6 +23,7 @@ const (
 	FormatMask uint8 = 0xf0
 	Format     uint8 = 0x10 // rev 1, protobuf encoded
 	EventMask  uint8 = 0x01
+	TraceMask  uint8 = 0x02 // head contains TraceContext
 
 	BodyError uint8 = 0x80 // body contains error
 )
@@ -38,6 +41,37 @@ func (a RouteAddr) Prefix(addrs ...uint8) RouteAddr {
 	return append(addrs, a...)
 }
 
+// String formats the address as path like /3/1
+func (a RouteAddr) String() string {
+	if len(a) == 0 {
+		return "/"
+	}
+	var buf bytes.Buffer
+	for _, addr := range a {
+		fmt.Fprintf(&buf, "/%d", addr)
+	}
+	return buf.String()
+}
+
+// ParseRouteAddr parses address in path format like /3/1
+func ParseRouteAddr(str string) (RouteAddr, error) {
+	var addrs RouteAddr
+	for _, token := range strings.Split(str, "/") {
+		if token == "" {
+			continue
+		}
+		addr, err := strconv.ParseUint(token, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %v", str, err)
+		}
+		addrs = append(addrs, uint8(addr))
+	}
+	if len(addrs) > RoutingAddrsMax {
+		return nil, fmt.Errorf("invalid address %s: too many addrs", str)
+	}
+	return addrs, nil
+}
+
 // MsgID is message ID
 type MsgID []byte
 
@@ -73,6 +107,8 @@ type MsgHead struct {
 	Flag      uint8
 	BodyBytes uint32
 	MsgID     MsgID
+	// Trace is optional, encoded when valid
+	Trace TraceContext
 }
 
 // NeedRoute indicates the message contains routing addresses
@@ -98,6 +134,11 @@ func (h *MsgHead) EncodeTo(w io.Writer) (err error) {
 			_, err = buf.Write(h.Addrs)
 		}
 	}
+	if h.Trace.IsValid() {
+		h.Flag |= TraceMask
+	} else {
+		h.Flag &^= TraceMask
+	}
 	if err == nil {
 		err = buf.WriteByte(h.Flag)
 	}
@@ -110,6 +151,11 @@ func (h *MsgHead) EncodeTo(w io.Writer) (err error) {
 	if err == nil && len(h.MsgID) > 0 {
 		_, err = buf.Write(h.MsgID)
 	}
+	if err == nil && (h.Flag&TraceMask) != 0 {
+		if _, err = buf.Write(h.Trace.TraceID[:]); err == nil {
+			_, err = buf.Write(h.Trace.SpanID[:])
+		}
+	}
 	if err == nil {
 		err = buf.Flush()
 	}
@@ -146,6 +192,12 @@ func (b *MsgBody) Decode(val proto.Message) error {
 type Msg struct {
 	Head MsgHead
 	Body MsgBody
+
+	// Caller is the identity of the connection the msg is received from,
+	// it's not transmitted
+	Caller *AuthIdentity
+	// Routed is the addresses routed through local buses, it's not transmitted
+	Routed RouteAddr
 }
 
 // EncodeTo encodes the whole message to a writer
@@ -213,6 +265,14 @@ func DecodeHead(reader io.Reader) (head MsgHead, err error) {
 			return
 		}
 	}
+	if (head.Flag & TraceMask) != 0 {
+		if _, err = io.ReadFull(reader, head.Trace.TraceID[:]); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(reader, head.Trace.SpanID[:]); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -275,6 +335,12 @@ func (b *MsgBuilder) MsgIDVarInt(val uint32) *MsgBuilder {
 	return b.MsgID(MsgIDVarInt(val))
 }
 
+// Trace specifies the trace context
+func (b *MsgBuilder) Trace(trace TraceContext) *MsgBuilder {
+	b.msg.Head.Trace = trace
+	return b
+}
+
 // Body specifies the body
 func (b *MsgBuilder) Body(flag uint8, data []byte) *MsgBuilder {
 	b.msg.Body.Flag = flag
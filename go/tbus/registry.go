@@ -0,0 +1,207 @@
+package tbus
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+var (
+	// ErrUnknownClass indicates the class is not registered
+	ErrUnknownClass = fmt.Errorf("unknown class")
+	// ErrUnknownMethod indicates the method is not defined by the class
+	ErrUnknownMethod = fmt.Errorf("unknown method")
+	// ErrUnknownEvent indicates the event channel is not defined by the class
+	ErrUnknownEvent = fmt.Errorf("unknown event channel")
+)
+
+const (
+	// DeviceInfoMethodName is the name of the implicit method 0
+	DeviceInfoMethodName = "DeviceInfo"
+)
+
+// MethodDesc describes a method of a device class
+type MethodDesc struct {
+	Index     uint8
+	Name      string
+	ParamType string
+	ReplyType string
+}
+
+// EventDesc describes an event channel of a device class
+type EventDesc struct {
+	Index     uint8
+	Name      string
+	EventType string
+}
+
+// ClassDesc describes a device class
+type ClassDesc struct {
+	Name    string
+	ClassID uint32
+	Methods []MethodDesc
+	Events  []EventDesc
+}
+
+// deviceInfoMethod is method 0 implicitly supported by all classes
+var deviceInfoMethod = MethodDesc{
+	Name:      DeviceInfoMethodName,
+	ReplyType: "tbus.DeviceInfo",
+}
+
+// MethodByIndex finds method by index
+func (c *ClassDesc) MethodByIndex(index uint8) *MethodDesc {
+	if index == 0 {
+		return &deviceInfoMethod
+	}
+	for n := range c.Methods {
+		if c.Methods[n].Index == index {
+			return &c.Methods[n]
+		}
+	}
+	return nil
+}
+
+// MethodByName finds method by name
+func (c *ClassDesc) MethodByName(name string) *MethodDesc {
+	if name == DeviceInfoMethodName {
+		return &deviceInfoMethod
+	}
+	for n := range c.Methods {
+		if c.Methods[n].Name == name {
+			return &c.Methods[n]
+		}
+	}
+	return nil
+}
+
+// EventByIndex finds event channel by index
+func (c *ClassDesc) EventByIndex(index uint8) *EventDesc {
+	for n := range c.Events {
+		if c.Events[n].Index == index {
+			return &c.Events[n]
+		}
+	}
+	return nil
+}
+
+// EventByName finds event channel by name
+func (c *ClassDesc) EventByName(name string) *EventDesc {
+	for n := range c.Events {
+		if c.Events[n].Name == name {
+			return &c.Events[n]
+		}
+	}
+	return nil
+}
+
+// NewParams creates an empty params message, nil if method accepts no params
+func (m *MethodDesc) NewParams() (proto.Message, error) {
+	return NewMessage(m.ParamType)
+}
+
+// NewReply creates an empty reply message, nil if method replies nothing
+func (m *MethodDesc) NewReply() (proto.Message, error) {
+	return NewMessage(m.ReplyType)
+}
+
+// NewEvent creates an empty event message
+func (e *EventDesc) NewEvent() (proto.Message, error) {
+	return NewMessage(e.EventType)
+}
+
+// Decode decodes the message of a received event
+func (e *EventDesc) Decode(evt Event) (proto.Message, error) {
+	val, err := e.NewEvent()
+	if err == nil && val == nil {
+		err = fmt.Errorf("%v %s", ErrUnknownEvent, e.Name)
+	}
+	if err == nil {
+		err = evt.Decode(val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// NewMessage creates a protobuf message by registered full type name,
+// empty type name results in nil message
+func NewMessage(typeName string) (proto.Message, error) {
+	if typeName == "" {
+		return nil, nil
+	}
+	t := proto.MessageType(typeName)
+	if t == nil {
+		return nil, fmt.Errorf("unknown message type %s", typeName)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface().(proto.Message), nil
+}
+
+var classRegistry = struct {
+	byID   map[uint32]*ClassDesc
+	byName map[string]*ClassDesc
+	lock   sync.RWMutex
+}{
+	byID:   make(map[uint32]*ClassDesc),
+	byName: make(map[string]*ClassDesc),
+}
+
+// RegisterClass registers a class descriptor, the latest registration
+// replaces the existing one with the same class ID
+func RegisterClass(class *ClassDesc) *ClassDesc {
+	classRegistry.lock.Lock()
+	defer classRegistry.lock.Unlock()
+	if exist := classRegistry.byID[class.ClassID]; exist != nil {
+		delete(classRegistry.byName, exist.Name)
+	}
+	classRegistry.byID[class.ClassID] = class
+	classRegistry.byName[class.Name] = class
+	return class
+}
+
+// ClassByID finds registered class by class ID
+func ClassByID(classID uint32) *ClassDesc {
+	classRegistry.lock.RLock()
+	defer classRegistry.lock.RUnlock()
+	return classRegistry.byID[classID]
+}
+
+// ClassByName finds registered class by name
+func ClassByName(name string) *ClassDesc {
+	classRegistry.lock.RLock()
+	defer classRegistry.lock.RUnlock()
+	return classRegistry.byName[name]
+}
+
+// ClassName returns the registered class name or hex class ID if unknown
+func ClassName(classID uint32) string {
+	if class := ClassByID(classID); class != nil {
+		return class.Name
+	}
+	return fmt.Sprintf("0x%04x", classID)
+}
+
+// Classes lists all registered classes ordered by class ID
+func Classes() []*ClassDesc {
+	classRegistry.lock.RLock()
+	classes := make([]*ClassDesc, 0, len(classRegistry.byID))
+	for _, class := range classRegistry.byID {
+		classes = append(classes, class)
+	}
+	classRegistry.lock.RUnlock()
+	sort.Sort(classesByID(classes))
+	return classes
+}
+
+type classesByID []*ClassDesc
+
+func (l classesByID) Len() int           { return len(l) }
+func (l classesByID) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l classesByID) Less(i, j int) bool { return l[i].ClassID < l[j].ClassID }
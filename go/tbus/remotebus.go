@@ -0,0 +1,40 @@
+package tbus
+
+// RemoteBus exposes a LocalBus over one connection, so all devices on the
+// bus share the connection, e.g. a board with several devices over a single
+// serial line. The host plugs it as a single device, and devices on it are
+// reached by routing through the bus like /{bus}/{device}.
+type RemoteBus struct {
+	*RemoteBusPort
+	// Bus hosts the devices
+	Bus *LocalBus
+	// BusDev is the device exposed to the host
+	BusDev *BusDev
+}
+
+// NewRemoteBus creates a RemoteBus with an empty LocalBus
+func NewRemoteBus(dialer Dialer) *RemoteBus {
+	bus := NewLocalBus()
+	dev := NewBusDev(bus)
+	return &RemoteBus{
+		RemoteBusPort: NewRemoteBusPort(dev, dialer),
+		Bus:           bus,
+		BusDev:        dev,
+	}
+}
+
+// Plug plugs devices into the bus, they can be plugged before or after
+// connecting to the host
+func (b *RemoteBus) Plug(devs ...Device) error {
+	for _, dev := range devs {
+		if err := b.Bus.Plug(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unplug removes a device from the bus
+func (b *RemoteBus) Unplug(dev Device) error {
+	return b.Bus.Unplug(dev)
+}
@@ -0,0 +1,70 @@
+package tbus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRemoteBus(t *testing.T) {
+	Convey("RemoteBus", t, func() {
+		listener := NewPipeListener("board", PipeOptions{Buffer: 1024})
+		defer listener.Close()
+		host := NewRemoteDeviceHost(listener)
+		go host.Run()
+
+		remote := NewRemoteBus(listener)
+		btnLogic := &testButton{}
+		btn := NewButtonDev(btnLogic)
+		led := NewLEDDev(&testLED{})
+		So(remote.Plug(led, btn), ShouldBeNil)
+		portDone := make(chan error, 1)
+		go func() {
+			portDone <- remote.Run()
+		}()
+
+		var dev RemoteDevice
+		select {
+		case dev = <-host.AcceptChan():
+		case <-time.After(5 * time.Second):
+		}
+		So(dev, ShouldNotBeNil)
+		So(dev.DeviceInfo().ClassId, ShouldEqual, BusClassID)
+		root := NewLocalBus()
+		So(root.Plug(NewLEDDev(&testLED{})), ShouldBeNil)
+		So(root.Plug(dev), ShouldBeNil)
+		master := NewLocalMaster(NewBusDev(root))
+		devDone := make(chan error, 1)
+		go func() {
+			devDone <- dev.Run()
+		}()
+
+		busAddr := DeviceAddress(dev)
+		So(busAddr, ShouldResemble, RouteAddr{2})
+		enum, err := NewBusCtl(master).SetAddress(busAddr).Enumerate().Wait()
+		So(err, ShouldBeNil)
+		So(enum.Devices, ShouldHaveLength, 2)
+
+		So(NewLEDCtl(master).SetAddress(RouteAddr{2, uint8(led.DeviceInfo().Address)}).On().Wait(), ShouldBeNil)
+
+		chn := NewButtonCtl(master).SetAddress(RouteAddr{2, uint8(btn.DeviceInfo().Address)}).State()
+		go btnLogic.simulatePressed(true)
+		So((<-chn.C).Pressed, ShouldBeTrue)
+
+		// plugged after attached
+		So(remote.Plug(NewButtonDev(&testButton{})), ShouldBeNil)
+		enum, err = NewBusCtl(master).SetAddress(busAddr).Enumerate().Wait()
+		So(err, ShouldBeNil)
+		So(enum.Devices, ShouldHaveLength, 3)
+
+		err = NewLEDCtl(master).SetAddress(RouteAddr{2, 99}).On().Wait()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid address")
+
+		dev.Close(context.Background())
+		So(<-portDone, ShouldBeNil)
+		So(<-devDone, ShouldBeNil)
+	})
+}
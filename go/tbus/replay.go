@@ -0,0 +1,346 @@
+package tbus
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+var (
+	// ErrNoRecordedReply indicates no recorded request matches during replay
+	ErrNoRecordedReply = fmt.Errorf("no recorded reply")
+)
+
+const (
+	// DefaultReplyTimeout is the default timeout waiting for a reply in replay
+	DefaultReplyTimeout = 5 * time.Second
+)
+
+// RecordedCall is a recorded request paired with its reply
+type RecordedCall struct {
+	Request *CaptureRecord
+	Reply   *CaptureRecord
+}
+
+// Session is a recorded bus session
+type Session struct {
+	Records []*CaptureRecord
+	Calls   []*RecordedCall
+	Events  []*CaptureRecord
+	// Info is the device info from attachment if recorded
+	Info *DeviceInfo
+}
+
+// NewSession builds a session from recorded messages
+func NewSession(records []*CaptureRecord) *Session {
+	s := &Session{Records: records}
+	pending := make(map[string]*RecordedCall)
+	for _, rec := range records {
+		msg := &rec.Msg
+		switch {
+		case msg.Head.IsEvent():
+			s.Events = append(s.Events, rec)
+		case len(msg.Head.MsgID) == 0:
+			if rec.Dir == CaptureUp && s.Info == nil {
+				info := &DeviceInfo{}
+				if msg.Body.Decode(info) == nil {
+					s.Info = info
+				}
+			}
+		case rec.Dir == CaptureDown:
+			call := &RecordedCall{Request: rec}
+			s.Calls = append(s.Calls, call)
+			pending[string(msg.Head.MsgID)] = call
+		default:
+			if call := pending[string(msg.Head.MsgID)]; call != nil {
+				call.Reply = rec
+				delete(pending, string(msg.Head.MsgID))
+			}
+		}
+	}
+	return s
+}
+
+// ReadSession reads a session from capture reader
+func ReadSession(r *CaptureReader) (*Session, error) {
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(records), nil
+}
+
+// Start returns the time of the first record
+func (s *Session) Start() time.Time {
+	if len(s.Records) == 0 {
+		return time.Time{}
+	}
+	return s.Records[0].Time
+}
+
+// replayPacer sleeps to reproduce recorded timing
+type replayPacer struct {
+	clock     Clock
+	speed     float64
+	recStart  time.Time
+	realStart time.Time
+}
+
+func newReplayPacer(clock Clock, speed float64, recStart time.Time) *replayPacer {
+	clock = ClockOrSystem(clock)
+	return &replayPacer{clock: clock, speed: speed, recStart: recStart, realStart: clock.Now()}
+}
+
+// wait sleeps until the recorded time, no wait if speed is 0
+func (p *replayPacer) wait(recTime time.Time) {
+	if p.speed <= 0 {
+		return
+	}
+	offset := time.Duration(float64(recTime.Sub(p.recStart)) / p.speed)
+	if delay := offset - p.clock.Now().Sub(p.realStart); delay > 0 {
+		p.clock.Sleep(delay)
+	}
+}
+
+// ReplayMismatch describes a reply different from the recorded one
+type ReplayMismatch struct {
+	Call *RecordedCall
+	// Actual is nil if no reply received
+	Actual *Msg
+	Reason string
+}
+
+// String implements fmt.Stringer
+func (m *ReplayMismatch) String() string {
+	req := &m.Call.Request.Msg
+	return fmt.Sprintf("%s id=%x method %d: %s",
+		req.Head.Addrs, []byte(req.Head.MsgID), req.Body.Flag, m.Reason)
+}
+
+// MasterReplayer replays the master side of a session against a device
+// and compares the replies with recorded ones
+type MasterReplayer struct {
+	Session *Session
+	// Speed is the replay speed relative to recorded timing,
+	// 0 replays as fast as possible
+	Speed float64
+	// ReplyTimeout is the timeout waiting for each reply
+	ReplyTimeout time.Duration
+	// Clock is used for pacing and timeouts, nil uses SystemClock
+	Clock Clock
+
+	replies map[string]chan *Msg
+	lock    sync.Mutex
+}
+
+// NewMasterReplayer creates a MasterReplayer
+func NewMasterReplayer(session *Session) *MasterReplayer {
+	return &MasterReplayer{Session: session, ReplyTimeout: DefaultReplyTimeout}
+}
+
+// Replay sends recorded requests to the device and returns mismatches
+func (r *MasterReplayer) Replay(dev Device) ([]*ReplayMismatch, error) {
+	r.replies = make(map[string]chan *Msg)
+	dev.AttachTo(r, 0)
+	defer dev.AttachTo(nil, 0)
+
+	annotator := NewAnnotator()
+	for _, rec := range r.Session.Records {
+		if len(rec.Msg.Head.MsgID) == 0 && !rec.Msg.Head.IsEvent() {
+			annotator.Annotate(rec)
+		}
+	}
+
+	var mismatches []*ReplayMismatch
+	pacer := newReplayPacer(r.Clock, r.Speed, r.Session.Start())
+	for _, call := range r.Session.Calls {
+		pacer.wait(call.Request.Time)
+		req := call.Request.Msg
+		annotator.Annotate(call.Request)
+		replyCh := make(chan *Msg, 1)
+		r.lock.Lock()
+		r.replies[string(req.Head.MsgID)] = replyCh
+		r.lock.Unlock()
+		if err := dev.DispatchMsg(&req); err != nil {
+			return mismatches, err
+		}
+		var actual *Msg
+		select {
+		case actual = <-replyCh:
+		case <-ClockOrSystem(r.Clock).After(r.ReplyTimeout):
+		}
+		r.lock.Lock()
+		delete(r.replies, string(req.Head.MsgID))
+		r.lock.Unlock()
+
+		var expected *MsgAnnotation
+		if call.Reply != nil {
+			expected = annotator.Annotate(call.Reply)
+		}
+		if reason := compareReply(expected, actual); reason != "" {
+			mismatches = append(mismatches, &ReplayMismatch{Call: call, Actual: actual, Reason: reason})
+		}
+	}
+	return mismatches, nil
+}
+
+// DispatchMsg implements BusPort
+func (r *MasterReplayer) DispatchMsg(msg *Msg) error {
+	if msg.Head.IsEvent() {
+		return nil
+	}
+	r.lock.Lock()
+	replyCh := r.replies[string(msg.Head.MsgID)]
+	r.lock.Unlock()
+	if replyCh != nil {
+		select {
+		case replyCh <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+func compareReply(expected *MsgAnnotation, actual *Msg) string {
+	switch {
+	case expected == nil && actual == nil:
+		return ""
+	case expected == nil:
+		return "unexpected reply"
+	case actual == nil:
+		return "no reply"
+	}
+	exp := &expected.Record.Msg
+	if exp.Body.Flag != actual.Body.Flag {
+		return fmt.Sprintf("reply flag 0x%02x, expect 0x%02x", actual.Body.Flag, exp.Body.Flag)
+	}
+	if bytes.Equal(exp.Body.Data, actual.Body.Data) {
+		return ""
+	}
+	if exp.Body.IsError() {
+		return fmt.Sprintf("error %v, expect %v", actual.Body.Decode(nil), exp.Body.Decode(nil))
+	}
+	// encoding may differ, e.g. map order, compare decoded messages
+	if expected.Body != nil {
+		val := proto.Clone(expected.Body)
+		val.Reset()
+		if actual.Body.Decode(val) == nil && proto.Equal(val, expected.Body) {
+			return ""
+		}
+		return fmt.Sprintf("reply %v, expect %v", val, expected.Body)
+	}
+	return "reply body differs"
+}
+
+// DeviceReplayer replays the device side of a session,
+// it replies recorded results and emits recorded events
+type DeviceReplayer struct {
+	DeviceBase
+	Session *Session
+	// Speed is the replay speed relative to recorded timing,
+	// 0 replays as fast as possible
+	Speed float64
+	// Clock is used for pacing, nil uses SystemClock
+	Clock Clock
+
+	used      []bool
+	unmatched []*Msg
+	lock      sync.Mutex
+}
+
+// NewDeviceReplayer creates a DeviceReplayer
+func NewDeviceReplayer(session *Session) *DeviceReplayer {
+	d := &DeviceReplayer{Session: session, used: make([]bool, len(session.Calls))}
+	if session.Info != nil {
+		d.Info = *session.Info
+	}
+	return d
+}
+
+// DispatchMsg implements Device
+func (d *DeviceReplayer) DispatchMsg(msg *Msg) error {
+	call := d.match(msg)
+	if call == nil {
+		d.lock.Lock()
+		d.unmatched = append(d.unmatched, msg)
+		d.lock.Unlock()
+		return d.Reply(msg.Head.MsgID, nil, ErrNoRecordedReply)
+	}
+	if call.Reply == nil {
+		// no reply recorded, probably timed out
+		return nil
+	}
+	reply := call.Reply.Msg
+	reply.Head.MsgID = msg.Head.MsgID
+	busPort := d.BusPort()
+	if busPort == nil {
+		return ErrInvalidDispatcher
+	}
+	if d.Speed <= 0 {
+		return reply.Dispatch(busPort)
+	}
+	// the caller dispatches synchronously, so the delay is waited out of band
+	delay := time.Duration(float64(call.Reply.Time.Sub(call.Request.Time)) / d.Speed)
+	go func() {
+		ClockOrSystem(d.Clock).Sleep(delay)
+		reply.Dispatch(busPort)
+	}()
+	return nil
+}
+
+// match finds the first unused recorded call with the same route, method
+// and params, or the same route and method if params differ
+func (d *DeviceReplayer) match(msg *Msg) *RecordedCall {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	candidate := -1
+	for n, call := range d.Session.Calls {
+		if d.used[n] {
+			continue
+		}
+		req := &call.Request.Msg
+		if !bytes.Equal(req.Head.Addrs, msg.Head.Addrs) || req.Body.Flag != msg.Body.Flag {
+			continue
+		}
+		if bytes.Equal(req.Body.Data, msg.Body.Data) {
+			candidate = n
+			break
+		}
+		if candidate < 0 {
+			candidate = n
+		}
+	}
+	if candidate < 0 {
+		return nil
+	}
+	d.used[candidate] = true
+	return d.Session.Calls[candidate]
+}
+
+// Run emits recorded events with recorded timing and returns after
+// all events are emitted
+func (d *DeviceReplayer) Run() error {
+	pacer := newReplayPacer(d.Clock, d.Speed, d.Session.Start())
+	for _, rec := range d.Session.Events {
+		pacer.wait(rec.Time)
+		busPort := d.BusPort()
+		if busPort == nil {
+			return ErrInvalidDispatcher
+		}
+		evt := rec.Msg
+		if err := evt.Dispatch(busPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmatched returns requests which have no recorded replies
+func (d *DeviceReplayer) Unmatched() []*Msg {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*Msg(nil), d.unmatched...)
+}
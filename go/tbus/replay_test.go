@@ -0,0 +1,124 @@
+package tbus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func recordSession(bus *LocalBus, fn func(*LocalMaster)) *Session {
+	var recs []*CaptureRecord
+	var lock sync.Mutex
+	tapper := TapperFunc(func(rec *CaptureRecord) {
+		lock.Lock()
+		recs = append(recs, rec)
+		lock.Unlock()
+	})
+	master := NewLocalMaster(NewTapDevice(NewBusDev(bus), tapper))
+	fn(master)
+	lock.Lock()
+	defer lock.Unlock()
+	return NewSession(recs)
+}
+
+func TestReplay(t *testing.T) {
+	Convey("Replay", t, func() {
+		bus := NewLocalBus()
+		led := NewLEDDev(&testLED{})
+		bus.Plug(led)
+		btnLogic := &testButton{}
+		btn := NewButtonDev(btnLogic)
+		bus.Plug(btn)
+
+		session := recordSession(bus, func(master *LocalMaster) {
+			chn := NewButtonCtl(master).SetAddress(DeviceAddress(btn)).State()
+			_, err := NewBusCtl(master).Enumerate().Wait()
+			So(err, ShouldBeNil)
+			ledctl := NewLEDCtl(master).SetAddress(DeviceAddress(led))
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(ledctl.Off().Wait(), ShouldBeNil)
+			go btnLogic.simulatePressed(true)
+			<-chn.C
+		})
+		So(session.Calls, ShouldHaveLength, 3)
+		So(session.Events, ShouldHaveLength, 1)
+
+		Convey("master side", func() {
+			newBus := NewLocalBus()
+			newLED := &testLED{}
+			newBus.Plug(NewLEDDev(newLED))
+			newBus.Plug(NewButtonDev(&testButton{}))
+			replayer := NewMasterReplayer(session)
+			mismatches, err := replayer.Replay(NewBusDev(newBus))
+			So(err, ShouldBeNil)
+			So(mismatches, ShouldBeEmpty)
+			So(newLED.on, ShouldBeFalse)
+
+			badBus := NewLocalBus()
+			badBus.Plug(NewLEDDev(&errorLED{}))
+			badBus.Plug(NewButtonDev(&testButton{}))
+			mismatches, err = replayer.Replay(NewBusDev(badBus))
+			So(err, ShouldBeNil)
+			So(mismatches, ShouldHaveLength, 2)
+			So(mismatches[0].Reason, ShouldContainSubstring, "reply flag")
+		})
+
+		Convey("device side", func() {
+			dev := NewDeviceReplayer(session)
+			master := NewLocalMaster(dev)
+			master.InvocationTimeout = time.Second
+			enum, err := NewBusCtl(master).Enumerate().Wait()
+			So(err, ShouldBeNil)
+			So(enum.Devices, ShouldHaveLength, 2)
+			ledctl := NewLEDCtl(master).SetAddress(DeviceAddress(led))
+			So(ledctl.On().Wait(), ShouldBeNil)
+			So(ledctl.On().Wait(), ShouldBeNil)
+			err = ledctl.On().Wait()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, ErrNoRecordedReply.Error())
+			So(dev.Unmatched(), ShouldHaveLength, 1)
+
+			chn := NewButtonCtl(master).SetAddress(DeviceAddress(btn)).State()
+			go dev.Run()
+			state := <-chn.C
+			So(state.Pressed, ShouldBeTrue)
+		})
+
+		Convey("paced replies", func() {
+			for _, call := range session.Calls {
+				call.Reply.Time = call.Request.Time.Add(time.Hour)
+			}
+			clock := NewFakeClock(time.Now())
+			dev := NewDeviceReplayer(session)
+			dev.Speed = 1
+			dev.Clock = clock
+			master := NewLocalMaster(dev)
+			master.InvocationTimeout = 0
+			enum := NewBusCtl(master).Enumerate()
+			on := NewLEDCtl(master).SetAddress(DeviceAddress(led)).On()
+			// both replies are delayed on the clock without blocking the callers
+			clock.BlockUntil(2)
+			clock.Advance(time.Hour)
+			reply, err := enum.Wait()
+			So(err, ShouldBeNil)
+			So(reply.Devices, ShouldHaveLength, 2)
+			So(on.Wait(), ShouldBeNil)
+		})
+
+		Convey("real speed", func() {
+			start := session.Start()
+			for n, rec := range session.Records {
+				rec.Time = start.Add(time.Duration(n) * 10 * time.Millisecond)
+			}
+			lastCall := session.Calls[len(session.Calls)-1]
+			replayer := NewMasterReplayer(session)
+			replayer.Speed = 2
+			begin := time.Now()
+			_, err := replayer.Replay(NewBusDev(bus))
+			So(err, ShouldBeNil)
+			So(time.Since(begin), ShouldBeGreaterThanOrEqualTo, lastCall.Request.Time.Sub(start)/2)
+		})
+	})
+}
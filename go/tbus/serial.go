@@ -0,0 +1,228 @@
+package tbus
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serial parity modes
+const (
+	ParityNone = 'N'
+	ParityEven = 'E'
+	ParityOdd  = 'O'
+)
+
+// Serial flow control modes
+const (
+	FlowNone     = ""
+	FlowHardware = "rtscts"
+	FlowSoftware = "xonxoff"
+)
+
+// DefaultSerialPoll is the interval to check a serial device reappearing
+const DefaultSerialPoll = time.Second
+
+// ErrSerialNotSupported indicates serial ports are not supported on the platform
+var ErrSerialNotSupported = fmt.Errorf("serial port not supported")
+
+// SerialConfig is the line configuration of a serial port
+type SerialConfig struct {
+	// Baud is the baud rate, 115200 if 0
+	Baud int
+	// DataBits is 5 to 8, 8 if 0
+	DataBits int
+	// Parity is ParityNone, ParityEven or ParityOdd, ParityNone if 0
+	Parity byte
+	// StopBits is 1 or 2, 1 if 0
+	StopBits int
+	// Flow is FlowNone, FlowHardware or FlowSoftware
+	Flow string
+	// Framed wraps messages with prefix and checksum suffix
+	Framed bool
+}
+
+// ParseSerialConfig parses configuration like 115200,8N1,rtscts,framed
+func ParseSerialConfig(str string) (cfg SerialConfig, err error) {
+	for _, item := range strings.Split(str, ",") {
+		switch item = strings.TrimSpace(item); {
+		case item == "":
+		case item == FlowHardware || item == FlowSoftware:
+			cfg.Flow = item
+		case item == "framed":
+			cfg.Framed = true
+		case len(item) == 3 && item[0] >= '5' && item[0] <= '8' &&
+			strings.IndexByte("NEO", item[1]) >= 0 && (item[2] == '1' || item[2] == '2'):
+			cfg.DataBits = int(item[0] - '0')
+			cfg.Parity = item[1]
+			cfg.StopBits = int(item[2] - '0')
+		default:
+			if cfg.Baud, err = strconv.Atoi(item); err != nil || cfg.Baud <= 0 {
+				return cfg, fmt.Errorf("invalid serial config %q", item)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// String returns the configuration like 115200,8N1
+func (c SerialConfig) String() string {
+	c = c.withDefaults()
+	str := fmt.Sprintf("%d,%d%c%d", c.Baud, c.DataBits, c.Parity, c.StopBits)
+	if c.Flow != FlowNone {
+		str += "," + c.Flow
+	}
+	if c.Framed {
+		str += ",framed"
+	}
+	return str
+}
+
+func (c SerialConfig) withDefaults() SerialConfig {
+	if c.Baud == 0 {
+		c.Baud = 115200
+	}
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+	if c.Parity == 0 {
+		c.Parity = ParityNone
+	}
+	if c.StopBits == 0 {
+		c.StopBits = 1
+	}
+	return c
+}
+
+// SerialPort is an opened serial device
+type SerialPort struct {
+	*os.File
+	Config SerialConfig
+	fd     uintptr
+}
+
+// OpenSerialConn opens the serial device and wraps it with framing if
+// configured
+func OpenSerialConn(device string, cfg SerialConfig) (io.ReadWriteCloser, error) {
+	port, err := OpenSerial(device, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Framed {
+		return Framed(port), nil
+	}
+	return port, nil
+}
+
+// SerialDialer opens a serial device
+type SerialDialer struct {
+	Device string
+	Config SerialConfig
+}
+
+// Dial implements Dialer
+func (d *SerialDialer) Dial() (io.ReadWriteCloser, error) {
+	return OpenSerialConn(d.Device, d.Config)
+}
+
+// SerialListener accepts a connection each time the serial device is
+// available, after the previous connection is closed, e.g. when the USB
+// device is unplugged, it waits for the device to reappear
+type SerialListener struct {
+	Device string
+	Config SerialConfig
+	// Poll is the interval to check the device, DefaultSerialPoll if 0
+	Poll  time.Duration
+	Clock Clock
+
+	conn      *serialListenerConn
+	lock      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSerialListener creates a SerialListener
+func NewSerialListener(device string, cfg SerialConfig) *SerialListener {
+	return &SerialListener{Device: device, Config: cfg, closed: make(chan struct{})}
+}
+
+// Accept implements Listener
+func (l *SerialListener) Accept() (io.ReadWriteCloser, error) {
+	clock := ClockOrSystem(l.Clock)
+	poll := l.Poll
+	if poll <= 0 {
+		poll = DefaultSerialPoll
+	}
+	for {
+		l.lock.Lock()
+		var done chan struct{}
+		if l.conn != nil {
+			done = l.conn.done
+		}
+		l.lock.Unlock()
+		if done != nil {
+			select {
+			case <-done:
+			case <-l.closed:
+				return nil, io.ErrClosedPipe
+			}
+		}
+		conn, err := OpenSerialConn(l.Device, l.Config)
+		if err == nil {
+			c := &serialListenerConn{ReadWriteCloser: conn, done: make(chan struct{})}
+			l.lock.Lock()
+			l.conn = c
+			l.lock.Unlock()
+			return c, nil
+		}
+		if err == ErrSerialNotSupported {
+			return nil, err
+		}
+		select {
+		case <-clock.After(poll):
+		case <-l.closed:
+			return nil, io.ErrClosedPipe
+		}
+	}
+}
+
+// Close implements Listener, it closes the current connection
+func (l *SerialListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.lock.Lock()
+		conn := l.conn
+		l.lock.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+type serialListenerConn struct {
+	io.ReadWriteCloser
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *serialListenerConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if err != nil {
+		// the device is gone
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *serialListenerConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.ReadWriteCloser.Close()
+		close(c.done)
+	})
+	return
+}
@@ -0,0 +1,142 @@
+package tbus
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// crtscts is not defined by syscall, it's the same on all Linux architectures
+const crtscts = 0x80000000
+
+var serialBauds = map[int]uint32{
+	1200:    syscall.B1200,
+	2400:    syscall.B2400,
+	4800:    syscall.B4800,
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	500000:  syscall.B500000,
+	576000:  syscall.B576000,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	1500000: syscall.B1500000,
+	2000000: syscall.B2000000,
+	3000000: syscall.B3000000,
+	4000000: syscall.B4000000,
+}
+
+var serialDataBits = map[int]uint32{
+	5: syscall.CS5,
+	6: syscall.CS6,
+	7: syscall.CS7,
+	8: syscall.CS8,
+}
+
+// OpenSerial opens the serial device in raw mode with the line configuration,
+// the framing in configuration is not applied, see OpenSerialConn
+func OpenSerial(device string, cfg SerialConfig) (*SerialPort, error) {
+	termios, err := serialTermios(cfg.withDefaults())
+	if err != nil {
+		return nil, err
+	}
+	fd, err := openNoctty(device)
+	if err != nil {
+		return nil, err
+	}
+	if err = setTermios(fd, termios); err != nil {
+		syscall.Close(int(fd))
+		return nil, fmt.Errorf("%s: %v", device, err)
+	}
+	return &SerialPort{File: os.NewFile(fd, device), Config: cfg, fd: fd}, nil
+}
+
+// Termios returns the current line settings of the port
+func (p *SerialPort) Termios() (*syscall.Termios, error) {
+	return getTermios(p.fd)
+}
+
+// openNoctty opens the terminal device without becoming its controlling
+// terminal, the descriptor is non-blocking if os.File polls it
+func openNoctty(device string) (uintptr, error) {
+	flags := syscall.O_RDWR | syscall.O_NOCTTY | syscall.O_CLOEXEC
+	if filePollable {
+		flags |= syscall.O_NONBLOCK
+	}
+	fd, err := syscall.Open(device, flags, 0)
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: device, Err: err}
+	}
+	return uintptr(fd), nil
+}
+
+func serialTermios(cfg SerialConfig) (*syscall.Termios, error) {
+	baud, ok := serialBauds[cfg.Baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", cfg.Baud)
+	}
+	size, ok := serialDataBits[cfg.DataBits]
+	if !ok {
+		return nil, fmt.Errorf("unsupported data bits %d", cfg.DataBits)
+	}
+	t := &syscall.Termios{
+		Cflag:  syscall.CREAD | syscall.CLOCAL | baud | size,
+		Ispeed: baud,
+		Ospeed: baud,
+	}
+	switch cfg.Parity {
+	case ParityNone:
+	case ParityEven:
+		t.Cflag |= syscall.PARENB
+		t.Iflag |= syscall.INPCK
+	case ParityOdd:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+		t.Iflag |= syscall.INPCK
+	default:
+		return nil, fmt.Errorf("unsupported parity %c", cfg.Parity)
+	}
+	switch cfg.StopBits {
+	case 1:
+	case 2:
+		t.Cflag |= syscall.CSTOPB
+	default:
+		return nil, fmt.Errorf("unsupported stop bits %d", cfg.StopBits)
+	}
+	switch cfg.Flow {
+	case FlowNone:
+	case FlowHardware:
+		t.Cflag |= crtscts
+	case FlowSoftware:
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	default:
+		return nil, fmt.Errorf("unsupported flow control %s", cfg.Flow)
+	}
+	// blocking read returns as soon as a byte is available
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return t, nil
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	t := &syscall.Termios{}
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(t)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(t))
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
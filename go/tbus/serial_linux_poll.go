@@ -0,0 +1,8 @@
+//go:build linux && go1.9
+// +build linux,go1.9
+
+package tbus
+
+// filePollable indicates os.File polls non-blocking descriptors, so closing
+// the file interrupts a pending Read
+const filePollable = true
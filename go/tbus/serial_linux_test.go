@@ -0,0 +1,137 @@
+package tbus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ptyMaster keeps the slave open, otherwise reading master fails
+type ptyMaster struct {
+	*os.File
+	slave *SerialPort
+}
+
+func (m *ptyMaster) Close() error {
+	m.slave.Close()
+	return m.File.Close()
+}
+
+// openPty opens a pseudo terminal pair in raw mode, returns the master and slave path
+func openPty() (*ptyMaster, string, error) {
+	fd, err := openNoctty("/dev/ptmx")
+	if err != nil {
+		return nil, "", err
+	}
+	var unlock, num int32
+	err = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&num))
+	}
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, "", err
+	}
+	master := os.NewFile(fd, "/dev/ptmx")
+	slave := fmt.Sprintf("/dev/pts/%d", num)
+	// put the line into raw mode before anything is sent from master,
+	// like a device which is already configured
+	port, err := OpenSerial(slave, SerialConfig{})
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return &ptyMaster{File: master, slave: port}, slave, nil
+}
+
+func TestSerial(t *testing.T) {
+	master, _, err := openPty()
+	if err != nil {
+		t.Skipf("pty not available: %v", err)
+	}
+	master.Close()
+
+	Convey("Serial", t, func() {
+		Convey("config", func() {
+			cfg, err := ParseSerialConfig("9600,7E2,rtscts,framed")
+			So(err, ShouldBeNil)
+			So(cfg, ShouldResemble, SerialConfig{Baud: 9600, DataBits: 7, Parity: ParityEven, StopBits: 2, Flow: FlowHardware, Framed: true})
+			So(cfg.String(), ShouldEqual, "9600,7E2,rtscts,framed")
+			So(SerialConfig{}.String(), ShouldEqual, "115200,8N1")
+			_, err = ParseSerialConfig("fast")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("termios", func() {
+			master, slave, err := openPty()
+			So(err, ShouldBeNil)
+			defer master.Close()
+			port, err := OpenSerial(slave, SerialConfig{Baud: 9600, DataBits: 7, Parity: ParityOdd, StopBits: 2, Flow: FlowSoftware})
+			So(err, ShouldBeNil)
+			defer port.Close()
+			termios, err := port.Termios()
+			So(err, ShouldBeNil)
+			// pty ignores data bits and parity enabling
+			So(termios.Cflag&syscall.B9600, ShouldEqual, syscall.B9600)
+			So(termios.Cflag&syscall.PARODD, ShouldNotEqual, 0)
+			So(termios.Cflag&syscall.CSTOPB, ShouldNotEqual, 0)
+			So(termios.Iflag&(syscall.IXON|syscall.IXOFF), ShouldEqual, syscall.IXON|syscall.IXOFF)
+			So(termios.Lflag&syscall.ICANON, ShouldEqual, 0)
+
+			_, err = OpenSerial(slave, SerialConfig{Baud: 12345})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("reappear", func() {
+			dir, err := ioutil.TempDir("", "tbus")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			link := filepath.Join(dir, "ttyUSB0")
+			listener := NewSerialListener(link, SerialConfig{Framed: true})
+			listener.Poll = 10 * time.Millisecond
+			defer listener.Close()
+			host := NewRemoteDeviceHost(listener)
+			go host.Run()
+
+			for n := 0; n < 2; n++ {
+				// the device (re)appears
+				ptm, slave, err := openPty()
+				So(err, ShouldBeNil)
+				So(os.Symlink(slave, link), ShouldBeNil)
+				port := NewRemoteBusPort(NewLEDDev(&testLED{}), DialerFunc(func() (io.ReadWriteCloser, error) {
+					return Framed(ptm), nil
+				}))
+				go port.Run()
+				var dev RemoteDevice
+				select {
+				case dev = <-host.AcceptChan():
+				case <-time.After(5 * time.Second):
+				}
+				So(dev, ShouldNotBeNil)
+				master := NewLocalMaster(dev)
+				done := make(chan error, 1)
+				go func() {
+					done <- dev.Run()
+				}()
+				So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+
+				// the device is unplugged
+				So(os.Remove(link), ShouldBeNil)
+				ptm.Close()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					So("device not closed", ShouldBeNil)
+				}
+			}
+		})
+	})
+}
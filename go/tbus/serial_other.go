@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package tbus
+
+// OpenSerial is only supported on Linux
+func OpenSerial(device string, cfg SerialConfig) (*SerialPort, error) {
+	return nil, ErrSerialNotSupported
+}
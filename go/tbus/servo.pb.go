@@ -4,6 +4,7 @@
 
 package tbus
 
+import "context"
 import "time"
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
@@ -53,6 +54,16 @@ var fileDescriptor5 = []byte{
 // ServoClassID is the class ID of Servo
 const ServoClassID uint32 = 0x0024
 
+// ServoClass is the registered descriptor of Servo
+var ServoClass = RegisterClass(&ClassDesc{
+    Name:    "Servo",
+    ClassID: ServoClassID,
+    Methods: []MethodDesc{
+        {Index: 1, Name: "SetPosition", ParamType: "tbus.ServoPosition"},
+        {Index: 2, Name: "Stop"},
+    },
+})
+
 // ServoLogic defines the logic interface
 type ServoLogic interface {
     DeviceLogic
@@ -60,6 +71,13 @@ type ServoLogic interface {
     Stop() error
 }
 
+// ServoContextLogic is optionally implemented by logic to receive
+// the call context which carries the trace of the invocation
+type ServoContextLogic interface {
+    SetPositionContext(context.Context, *ServoPosition) error
+    StopContext(context.Context) error
+}
+
 // ServoDev is the device
 type ServoDev struct {
     DeviceBase
@@ -79,23 +97,55 @@ func (d *ServoDev) DispatchMsg(msg *Msg) (err error) {
     if msg.Head.NeedRoute() {
         return d.Reply(msg.Head.MsgID, nil, ErrRouteNotSupport)
     }
-    var reply proto.Message
+    call := &DeviceCall{Device: d, Class: ServoClass, Method: msg.Body.Flag, Msg: msg}
     switch msg.Body.Flag {
     case 0:
-        devInfo := d.DeviceInfo()
-        reply = &devInfo
     case 1: // SetPosition
-        params := &ServoPosition{}
-        err = msg.Body.Decode(params)
-        if err == nil {
-            err = d.Logic.SetPosition(params)
+        call.Params = &ServoPosition{}
+    case 2: // Stop
+    default:
+        return d.Reply(msg.Head.MsgID, nil, ErrInvalidMethod)
+    }
+    if call.Params != nil {
+        if err = msg.Body.Decode(call.Params); err != nil {
+            return d.Reply(msg.Head.MsgID, nil, err)
         }
+    }
+    err = d.HandleCall(call, d.invoke)
+    return d.Reply(msg.Head.MsgID, call.Reply, err)
+}
+
+func (d *ServoDev) invoke(call *DeviceCall) (err error) {
+    if logic, ok := d.Logic.(ServoContextLogic); ok {
+        return d.invokeContext(logic, call)
+    }
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // SetPosition
+        err = d.Logic.SetPosition(call.Params.(*ServoPosition))
     case 2: // Stop
         err = d.Logic.Stop()
     default:
         err = ErrInvalidMethod
     }
-    return d.Reply(msg.Head.MsgID, reply, err)
+    return
+}
+
+func (d *ServoDev) invokeContext(logic ServoContextLogic, call *DeviceCall) (err error) {
+    switch call.Method {
+    case 0:
+        devInfo := d.DeviceInfo()
+        call.Reply = &devInfo
+    case 1: // SetPosition
+        err = logic.SetPositionContext(call.Context, call.Params.(*ServoPosition))
+    case 2: // Stop
+        err = logic.StopContext(call.Context)
+    default:
+        err = ErrInvalidMethod
+    }
+    return
 }
 
 // SetDeviceID sets device id
@@ -113,6 +163,7 @@ type ServoCtl struct {
 func NewServoCtl(master Master) *ServoCtl {
     c := &ServoCtl{}
     c.Master = master
+    c.Class = ServoClass
     return c
 }
 
@@ -1,15 +1,20 @@
 package tbus
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 // MsgStreamer write msg using stream
 type MsgStreamer struct {
 	Writer io.Writer
+	// Logger logs stream failures, the default Logger is used if nil
+	Logger Logger
 	lock   sync.Mutex
 }
 
@@ -20,21 +25,51 @@ func NewMsgStreamer(writer io.Writer) *MsgStreamer {
 
 // DispatchMsg implements MsgDispatcher
 func (s *MsgStreamer) DispatchMsg(msg *Msg) (err error) {
+	writer := &countingWriter{Writer: s.Writer}
 	s.lock.Lock()
-	err = msg.EncodeTo(s.Writer)
+	err = msg.EncodeTo(writer)
 	s.lock.Unlock()
+	transport := streamTransport(s.Writer)
+	metrics := CurrentMetrics()
+	metrics.Counter(MetricBytes, "transport", transport, "dir", "out").Add(float64(writer.count))
+	if err == nil {
+		metrics.Counter(MetricFrames, "transport", transport, "dir", "out").Add(1)
+	} else if !IsErrClosing(err) {
+		s.logger().Warn("write msg failed", LogKeyPeer, streamName(s.Writer),
+			LogKeyAddr, msg.Head.Addrs.String(), LogKeyMsgID, logMsgID(msg.Head.MsgID), LogKeyError, err)
+	}
 	return
 }
 
+func (s *MsgStreamer) logger() Logger {
+	return LoggerOrDefault(s.Logger)
+}
+
 // DecodeStream decode msgs from stream and pipe to dispatcher
 func DecodeStream(reader io.Reader, dispatcher MsgDispatcher) error {
+	return decodeStream(reader, dispatcher, CurrentLogger())
+}
+
+func decodeStream(reader io.Reader, dispatcher MsgDispatcher, logger Logger) error {
+	conn, transport := streamName(reader), streamTransport(reader)
+	counter := &countingReader{Reader: reader}
 	for {
-		msg, err := Decode(reader)
+		msg, err := Decode(counter)
+		metrics := CurrentMetrics()
+		metrics.Counter(MetricBytes, "transport", transport, "dir", "in").Add(float64(counter.count))
+		counter.count = 0
 		if err == io.EOF {
 			return nil
 		}
 		if err == nil {
-			err = dispatcher.DispatchMsg(&msg)
+			metrics.Counter(MetricFrames, "transport", transport, "dir", "in").Add(1)
+			if err = dispatcher.DispatchMsg(&msg); err != nil && !IsErrClosing(err) {
+				logger.Warn("dispatch msg failed", LogKeyPeer, conn,
+					LogKeyAddr, msg.Head.Addrs.String(), LogKeyMsgID, logMsgID(msg.Head.MsgID), LogKeyError, err)
+			}
+		} else if err != io.ErrClosedPipe && !IsErrClosing(err) {
+			metrics.Counter(MetricDecodeFailures, "transport", transport).Add(1)
+			logger.Warn("decode msg failed", LogKeyPeer, conn, LogKeyError, err)
 		}
 		if err != nil {
 			return IgnoreClosingErr(err)
@@ -51,6 +86,7 @@ type StreamDevice struct {
 	busPort BusPort
 	init    bool
 	initErr error
+	state   runState
 }
 
 // NewStreamDevice creates a stream device
@@ -90,10 +126,35 @@ func (d *StreamDevice) AttachTo(busPort BusPort, addr uint8) {
 
 // Run pipes remote msg to bus port
 func (d *StreamDevice) Run() error {
+	return d.state.run(d.run)
+}
+
+// Start implements Service
+func (d *StreamDevice) Start() error {
+	return d.state.start(d.run)
+}
+
+// Close closes the stream and waits until Run stops or ctx is done
+func (d *StreamDevice) Close(ctx context.Context) error {
+	closeStream(d.Reader, d.Writer)
+	return d.state.wait(ctx)
+}
+
+// Done implements Service
+func (d *StreamDevice) Done() <-chan struct{} {
+	return d.state.stopped()
+}
+
+// Err implements Service
+func (d *StreamDevice) Err() error {
+	return d.state.result()
+}
+
+func (d *StreamDevice) run() error {
 	if d.initErr != nil {
 		return IgnoreClosingErr(d.initErr)
 	}
-	return DecodeStream(d.Reader, d.busPort)
+	return decodeStream(d.Reader, d.busPort, d.logger())
 }
 
 // StreamBusPort exposes a device to remote
@@ -101,6 +162,10 @@ type StreamBusPort struct {
 	MsgStreamer
 	Reader io.Reader
 	Device Device
+	// Caller is set to received msgs to identify the remote master
+	Caller *AuthIdentity
+
+	state runState
 }
 
 // NewStreamBusPort creates a stream bus port
@@ -114,13 +179,46 @@ func NewStreamBusPort(rw io.ReadWriter, dev Device, addr uint8) *StreamBusPort {
 
 // Run pipes remote msg to device
 func (p *StreamBusPort) Run() error {
-	return DecodeStream(p.Reader, p.Device)
+	return p.state.run(p.run)
 }
 
-// RemoteDevice is a remote device communicated over a connection
+// Start implements Service
+func (p *StreamBusPort) Start() error {
+	return p.state.start(p.run)
+}
+
+// Close closes the stream and waits until Run stops or ctx is done
+func (p *StreamBusPort) Close(ctx context.Context) error {
+	closeStream(p.Reader, p.Writer)
+	return p.state.wait(ctx)
+}
+
+// Done implements Service
+func (p *StreamBusPort) Done() <-chan struct{} {
+	return p.state.stopped()
+}
+
+// Err implements Service
+func (p *StreamBusPort) Err() error {
+	return p.state.result()
+}
+
+func (p *StreamBusPort) run() error {
+	var dispatcher MsgDispatcher = p.Device
+	if p.Caller != nil {
+		dispatcher = MsgDispatcherFunc(func(msg *Msg) error {
+			msg.Caller = p.Caller
+			return p.Device.DispatchMsg(msg)
+		})
+	}
+	return decodeStream(p.Reader, dispatcher, p.logger())
+}
+
+// RemoteDevice is a remote device communicated over a connection,
+// Close closes the connection and waits until Run stops
 type RemoteDevice interface {
 	Device
-	io.Closer
+	Service
 	Run() error
 }
 
@@ -163,12 +261,33 @@ func NetListener(listener net.Listener) *NetListenerWrapper {
 	return &NetListenerWrapper{Listener: listener}
 }
 
+// ListenerDialer is a Dialer which accepts a connection from Listener,
+// it allows RemoteBusPort to wait for a remote master to connect
+type ListenerDialer struct {
+	Listener Listener
+}
+
+// Dial implements Dialer
+func (d *ListenerDialer) Dial() (io.ReadWriteCloser, error) {
+	return d.Listener.Accept()
+}
+
 // RemoteBusPort exposes a device over network
 type RemoteBusPort struct {
 	Dialer Dialer
 	Device Device
+	// Logger logs connection failures, the default Logger is used if nil
+	Logger Logger
+	// Credentials authenticates to the host if not nil
+	Credentials Credentials
+	// Caller identifies the remote master for access control, if nil it's
+	// detected from the verified TLS peer certificate
+	Caller *AuthIdentity
 
-	conn io.ReadWriteCloser
+	conn    io.ReadWriteCloser
+	closing bool
+	lock    sync.Mutex
+	state   runState
 }
 
 // NewRemoteBusPort creates a RemoteBusPort
@@ -178,64 +297,152 @@ func NewRemoteBusPort(dev Device, dialer Dialer) *RemoteBusPort {
 
 // Conn returns current connection
 func (p *RemoteBusPort) Conn() io.ReadWriteCloser {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return p.conn
 }
 
-// Close closes the connection
-func (p *RemoteBusPort) Close() error {
+// Close closes the connection and waits until Run stops or ctx is done,
+// a connection being dialed is closed once established
+func (p *RemoteBusPort) Close(ctx context.Context) error {
+	p.lock.Lock()
+	p.closing = true
 	conn := p.conn
+	p.lock.Unlock()
 	if conn != nil {
-		return conn.Close()
+		conn.Close()
 	}
-	return nil
+	return p.state.wait(ctx)
 }
 
 // Run connect to remote and host the device
 func (p *RemoteBusPort) Run() error {
+	return p.state.run(p.run)
+}
+
+// Start implements Service
+func (p *RemoteBusPort) Start() error {
+	return p.state.start(p.run)
+}
+
+// Done implements Service
+func (p *RemoteBusPort) Done() <-chan struct{} {
+	return p.state.stopped()
+}
+
+// Err implements Service
+func (p *RemoteBusPort) Err() error {
+	return p.state.result()
+}
+
+func (p *RemoteBusPort) run() error {
+	p.lock.Lock()
+	p.closing = false
+	p.lock.Unlock()
 	conn, err := p.Dialer.Dial()
-	if err == nil {
-		p.conn = conn
-		err = p.runConn()
-		p.conn = nil
+	if err != nil {
+		p.logger().Error("dial failed", LogKeyError, err)
+		return IgnoreClosingErr(err)
 	}
+	p.lock.Lock()
+	if p.closing {
+		p.lock.Unlock()
+		conn.Close()
+		return nil
+	}
+	p.conn = conn
+	p.lock.Unlock()
+	err = p.runConn(conn)
+	p.lock.Lock()
+	p.conn = nil
+	p.lock.Unlock()
 	return IgnoreClosingErr(err)
 }
 
-func (p *RemoteBusPort) runConn() error {
-	defer p.conn.Close()
+func (p *RemoteBusPort) logger() Logger {
+	return LoggerOrDefault(p.Logger)
+}
+
+func (p *RemoteBusPort) runConn(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	if p.Credentials != nil {
+		if err := Authenticate(conn, p.Credentials); err != nil {
+			p.logger().Warn("authentication failed", LogKeyPeer, streamName(conn), LogKeyError, err)
+			return err
+		}
+	}
 
 	// the first message is sending device info for bus attachment
 	info := p.Device.DeviceInfo()
-	err := BuildMsg().EncodeBody(0, &info).Build().EncodeTo(p.conn)
+	err := BuildMsg().EncodeBody(0, &info).Build().EncodeTo(conn)
 	if err != nil {
 		return err
 	}
 
 	// expect a bus attachment
+	peer := streamName(conn)
 	info = DeviceInfo{}
-	if _, err = DecodeAs(p.conn, &info); err != nil {
+	if _, err = DecodeAs(conn, &info); err != nil {
+		if !IsErrClosing(err) {
+			p.logger().Warn("bus attachment failed", LogKeyPeer, peer, LogKeyError, err)
+		}
 		return err
 	}
 
 	// do a bus attach
-	port := NewStreamBusPort(p.conn, p.Device, uint8(info.Address))
+	p.logger().Info("attached to bus", LogKeyPeer, peer, LogKeyAddr, info.Address)
+	port := NewStreamBusPort(conn, p.Device, uint8(info.Address))
+	port.Logger = p.Logger
+	if port.Caller = p.Caller; port.Caller == nil {
+		if cert, _ := PeerCertificate(conn); cert != nil {
+			port.Caller = &AuthIdentity{Method: AuthMethodTLS, Name: cert.Subject.CommonName, Peer: peer, Certificate: cert}
+		}
+	}
 	err = port.Run()
 	p.Device.AttachTo(nil, 0)
+	p.logger().Info("detached from bus", LogKeyPeer, peer)
 	return err
 }
 
+const (
+	// DefaultHandshakeTimeout specifies the default attachment handshake timeout
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
 // RemoteDeviceHost accepts connections from RemoteBusPort
 // and creates StreamDevice for each connection.
 type RemoteDeviceHost struct {
 	Listener Listener
-	acceptCh chan RemoteDevice
+	// HandshakeTimeout limits the attachment handshake of each connection,
+	// 0 means no limit
+	HandshakeTimeout time.Duration
+	// Clock drives HandshakeTimeout, SystemClock if nil
+	Clock Clock
+	// Logger logs handshake failures, it's also used by accepted devices,
+	// the default Logger is used if nil
+	Logger Logger
+	// Authenticators authenticate devices if not empty
+	Authenticators Authenticators
+	// Authorizer accepts, rejects or relabels devices if not nil
+	Authorizer Authorizer
+
+	acceptCh   chan RemoteDevice
+	devices    map[RemoteDevice]struct{}
+	handshakes map[io.ReadWriteCloser]struct{}
+	pending    sync.WaitGroup
+	closeCh    chan struct{}
+	closed     bool
+	lock       sync.Mutex
+	state      runState
 }
 
 // NewRemoteDeviceHost creates a new remote device host
 func NewRemoteDeviceHost(listener Listener) *RemoteDeviceHost {
 	return &RemoteDeviceHost{
-		Listener: listener,
-		acceptCh: make(chan RemoteDevice),
+		Listener:         listener,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		acceptCh:         make(chan RemoteDevice),
 	}
 }
 
@@ -246,28 +453,239 @@ func (h *RemoteDeviceHost) AcceptChan() <-chan RemoteDevice {
 
 // Run starts accepting device connections
 func (h *RemoteDeviceHost) Run() error {
+	return h.state.run(h.run)
+}
+
+// Start implements Service
+func (h *RemoteDeviceHost) Start() error {
+	return h.state.start(h.run)
+}
+
+// Close closes the listener, connections in handshake and all accepted
+// devices, and waits until Run and the running devices stop or ctx is done
+func (h *RemoteDeviceHost) Close(ctx context.Context) error {
+	h.lock.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.closing())
+	}
+	devices, handshakes := h.devices, h.handshakes
+	h.devices, h.handshakes = nil, nil
+	h.lock.Unlock()
+	if h.Listener != nil {
+		h.Listener.Close()
+	}
+	for conn := range handshakes {
+		conn.Close()
+	}
+	if err := h.state.wait(ctx); err != nil {
+		return err
+	}
+	handshaking := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(handshaking)
+	}()
+	select {
+	case <-handshaking:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for dev := range devices {
+		if err := dev.Close(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done implements Service
+func (h *RemoteDeviceHost) Done() <-chan struct{} {
+	return h.state.stopped()
+}
+
+// Err implements Service
+func (h *RemoteDeviceHost) Err() error {
+	return h.state.result()
+}
+
+func (h *RemoteDeviceHost) run() error {
 	for {
 		conn, err := h.Listener.Accept()
 		if err != nil {
 			return IgnoreClosingErr(err)
 		}
-		info := &DeviceInfo{}
-		if _, err = DecodeAs(conn, info); err != nil {
+		if !h.trackHandshake(conn) {
 			conn.Close()
-		} else {
-			h.acceptCh <- NewRemoteDevice(*info, conn)
+			return nil
 		}
+		h.pending.Add(1)
+		go h.handshake(conn)
+	}
+}
+
+// handshake accepts the device on conn without blocking other connections,
+// the device is queued to AcceptChan only when the handshake succeeds
+func (h *RemoteDeviceHost) handshake(conn io.ReadWriteCloser) {
+	defer h.pending.Done()
+	dev, err := h.Accept(conn)
+	h.lock.Lock()
+	delete(h.handshakes, conn)
+	h.lock.Unlock()
+	if err != nil {
+		return
+	}
+	if !h.track(dev) {
+		// not started yet, so it's closed without waiting
+		dev.Close(context.Background())
+		return
+	}
+	select {
+	case h.acceptCh <- dev:
+	case <-h.closeChan():
+		// the tracked device is closed by Close
 	}
 }
 
+// trackHandshake keeps the connection in handshake so Close is able to
+// abort it, it returns false if the host is closed
+func (h *RemoteDeviceHost) trackHandshake(conn io.ReadWriteCloser) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return false
+	}
+	if h.handshakes == nil {
+		h.handshakes = make(map[io.ReadWriteCloser]struct{})
+	}
+	h.handshakes[conn] = struct{}{}
+	return true
+}
+
+// closing must be called with lock held
+func (h *RemoteDeviceHost) closing() chan struct{} {
+	if h.closeCh == nil {
+		h.closeCh = make(chan struct{})
+	}
+	return h.closeCh
+}
+
+func (h *RemoteDeviceHost) closeChan() <-chan struct{} {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.closing()
+}
+
+// track keeps the accepted device so Close is able to drain it, devices
+// already stopped are dropped, it returns false if the host is closed
+func (h *RemoteDeviceHost) track(dev RemoteDevice) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return false
+	}
+	if h.devices == nil {
+		h.devices = make(map[RemoteDevice]struct{})
+	}
+	for d := range h.devices {
+		select {
+		case <-d.Done():
+			delete(h.devices, d)
+		default:
+		}
+	}
+	h.devices[dev] = struct{}{}
+	return true
+}
+
+// AcceptRemoteDevice performs the host side attachment handshake on the
+// connection, the connection is closed if the handshake fails
+func AcceptRemoteDevice(conn io.ReadWriteCloser) (RemoteDevice, error) {
+	return (&RemoteDeviceHost{}).Accept(conn)
+}
+
+// Accept performs the host side attachment handshake with authentication
+// and authorization, the connection is closed if the handshake fails
+func (h *RemoteDeviceHost) Accept(conn io.ReadWriteCloser) (RemoteDevice, error) {
+	logger := LoggerOrDefault(h.Logger)
+	identity := &AuthIdentity{Peer: streamName(conn)}
+	info := &DeviceInfo{}
+	var handshaked chan struct{}
+	timedOut := make(chan bool, 1)
+	if h.HandshakeTimeout > 0 {
+		handshaked = make(chan struct{})
+		timeout := ClockOrSystem(h.Clock).After(h.HandshakeTimeout)
+		go func() {
+			select {
+			case <-timeout:
+				// closing the connection unblocks the pending read or write
+				conn.Close()
+				timedOut <- true
+			case <-handshaked:
+				timedOut <- false
+			}
+		}()
+	}
+	msg, err := Decode(conn)
+	var cert *x509.Certificate
+	if err == nil {
+		cert, err = PeerCertificate(conn)
+	}
+	if err == nil {
+		identity, msg, err = acceptAuth(conn, msg, h.Authenticators)
+		identity.Certificate = cert
+		if identity.Method == "" && cert != nil {
+			identity.Method, identity.Name = AuthMethodTLS, cert.Subject.CommonName
+		}
+	}
+	if err == nil {
+		err = msg.Body.Decode(info)
+	}
+	if err == nil && h.Authorizer != nil {
+		if err = h.Authorizer(identity, info); err != nil {
+			rejectAuth(conn, err)
+		}
+	}
+	if handshaked != nil {
+		close(handshaked)
+		if <-timedOut {
+			err = ErrHandshakeTimeout
+		}
+	}
+	if err != nil {
+		logger.Warn("device handshake failed", LogKeyPeer, identity.Peer,
+			"identity", identity.Name, LogKeyError, err)
+		conn.Close()
+		return nil, err
+	}
+	logger.Info("device connected", LogKeyPeer, identity.Peer, "identity", identity.Name,
+		LogKeyClass, ClassName(info.ClassId), "device_id", info.DeviceId)
+	d := newRemoteStreamDevice(*info, conn)
+	d.Logger = h.Logger
+	return d, nil
+}
+
+// DialRemoteDevice connects to a RemoteBusPort waiting on ListenerDialer
+// and creates the remote device
+func DialRemoteDevice(dialer Dialer) (RemoteDevice, error) {
+	conn, err := dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return AcceptRemoteDevice(conn)
+}
+
 type remoteStreamDevice struct {
 	StreamDevice
-	conn io.ReadWriteCloser
 }
 
 // NewRemoteDevice creates a connection backed remote device
 func NewRemoteDevice(info DeviceInfo, conn io.ReadWriteCloser) RemoteDevice {
-	d := &remoteStreamDevice{conn: conn}
+	return newRemoteStreamDevice(info, conn)
+}
+
+func newRemoteStreamDevice(info DeviceInfo, conn io.ReadWriteCloser) *remoteStreamDevice {
+	d := &remoteStreamDevice{}
 	d.Reader = conn
 	d.Writer = conn
 	d.Info = info
@@ -275,16 +693,14 @@ func NewRemoteDevice(info DeviceInfo, conn io.ReadWriteCloser) RemoteDevice {
 	return d
 }
 
-// Close implements RemoteDevice
-func (d *remoteStreamDevice) Close() error {
-	return d.conn.Close()
-}
-
 // IsErrClosing determines if the error is caused due to stream closing
 func IsErrClosing(err error) bool {
 	if err == nil {
 		return false
 	}
+	if err == io.ErrClosedPipe {
+		return true
+	}
 	if strings.Contains(err.Error(), "use of closed network connection") {
 		return true
 	}
@@ -304,3 +720,46 @@ func IgnoreClosingErr(err error) error {
 	}
 	return err
 }
+
+// streamName returns the remote address of a stream if available
+func streamName(stream interface{}) string {
+	if conn, ok := stream.(interface {
+		RemoteAddr() net.Addr
+	}); ok && conn.RemoteAddr() != nil {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// streamTransport returns the network of a stream as a metrics label,
+// unlike the remote address it doesn't grow with connections
+func streamTransport(stream interface{}) string {
+	if conn, ok := stream.(interface {
+		RemoteAddr() net.Addr
+	}); ok && conn.RemoteAddr() != nil {
+		return conn.RemoteAddr().Network()
+	}
+	return "stream"
+}
+
+type countingWriter struct {
+	io.Writer
+	count int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += n
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	count int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += n
+	return n, err
+}
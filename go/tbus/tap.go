@@ -0,0 +1,188 @@
+package tbus
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// TapDispatcher taps messages passing to a dispatcher
+type TapDispatcher struct {
+	Dispatcher MsgDispatcher
+	Dir        CaptureDir
+	Tapper     Tapper
+}
+
+// NewTapDispatcher creates a TapDispatcher
+func NewTapDispatcher(dispatcher MsgDispatcher, dir CaptureDir, tapper Tapper) *TapDispatcher {
+	return &TapDispatcher{Dispatcher: dispatcher, Dir: dir, Tapper: tapper}
+}
+
+// DispatchMsg implements MsgDispatcher
+func (d *TapDispatcher) DispatchMsg(msg *Msg) error {
+	rec := &CaptureRecord{Time: time.Now(), Dir: d.Dir, Msg: *msg}
+	rec.Msg.Head.Addrs = append(RouteAddr(nil), msg.Head.Addrs...)
+	d.Tapper.Tap(rec)
+	return d.Dispatcher.DispatchMsg(msg)
+}
+
+// TapDevice wraps a device and taps messages to and from it,
+// it's used to record at master boundary, e.g.
+//
+//	NewLocalMaster(NewTapDevice(dev, tapper))
+type TapDevice struct {
+	Device
+	Tapper Tapper
+
+	busPort BusPort
+}
+
+// NewTapDevice creates a TapDevice
+func NewTapDevice(dev Device, tapper Tapper) *TapDevice {
+	return &TapDevice{Device: dev, Tapper: tapper}
+}
+
+// DispatchMsg implements Device
+func (d *TapDevice) DispatchMsg(msg *Msg) error {
+	return NewTapDispatcher(d.Device, CaptureDown, d.Tapper).DispatchMsg(msg)
+}
+
+// AttachTo implements Device
+func (d *TapDevice) AttachTo(busPort BusPort, addr uint8) {
+	d.busPort = busPort
+	if busPort != nil {
+		busPort = NewTapDispatcher(busPort, CaptureUp, d.Tapper)
+	}
+	d.Device.AttachTo(busPort, addr)
+}
+
+// BusPort implements Device
+func (d *TapDevice) BusPort() BusPort {
+	return d.busPort
+}
+
+// TapConn wraps a connection and taps messages in both directions
+type TapConn struct {
+	Conn io.ReadWriteCloser
+
+	readTap  *streamTap
+	writeTap *streamTap
+}
+
+// NewTapConn creates a TapConn, readDir is the direction of messages
+// read from the connection, e.g. CaptureUp on master side
+func NewTapConn(conn io.ReadWriteCloser, readDir CaptureDir, tapper Tapper) *TapConn {
+	return &TapConn{
+		Conn:     conn,
+		readTap:  newStreamTap(readDir, tapper),
+		writeTap: newStreamTap(readDir.Reverse(), tapper),
+	}
+}
+
+// Read implements io.Reader
+func (c *TapConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.readTap.feed(p[:n])
+	}
+	return
+}
+
+// Write implements io.Writer
+func (c *TapConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	if n > 0 {
+		c.writeTap.feed(p[:n])
+	}
+	return
+}
+
+// Close implements io.Closer
+func (c *TapConn) Close() error {
+	c.readTap.close()
+	c.writeTap.close()
+	return c.Conn.Close()
+}
+
+// TapDialer taps connections from a Dialer
+type TapDialer struct {
+	Dialer  Dialer
+	ReadDir CaptureDir
+	Tapper  Tapper
+}
+
+// Dial implements Dialer
+func (d *TapDialer) Dial() (io.ReadWriteCloser, error) {
+	conn, err := d.Dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewTapConn(conn, d.ReadDir, d.Tapper), nil
+}
+
+// TapListener taps connections from a Listener
+type TapListener struct {
+	Listener Listener
+	ReadDir  CaptureDir
+	Tapper   Tapper
+}
+
+// Accept implements Listener
+func (l *TapListener) Accept() (io.ReadWriteCloser, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewTapConn(conn, l.ReadDir, l.Tapper), nil
+}
+
+// Close implements Listener
+func (l *TapListener) Close() error {
+	return l.Listener.Close()
+}
+
+// streamTap decodes messages from a byte stream
+type streamTap struct {
+	dir    CaptureDir
+	tapper Tapper
+	buf    []byte
+	broken bool
+	lock   sync.Mutex
+}
+
+func newStreamTap(dir CaptureDir, tapper Tapper) *streamTap {
+	return &streamTap{dir: dir, tapper: tapper}
+}
+
+func (t *streamTap) feed(data []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.broken {
+		return
+	}
+	t.buf = append(t.buf, data...)
+	for len(t.buf) > 0 {
+		reader := bytes.NewReader(t.buf)
+		msg, err := Decode(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// wait for more data
+			return
+		}
+		if err != nil {
+			// unable to resync, stop tapping
+			t.broken = true
+			t.buf = nil
+			return
+		}
+		t.buf = t.buf[len(t.buf)-reader.Len():]
+		t.tapper.Tap(&CaptureRecord{Time: time.Now(), Dir: t.dir, Msg: msg})
+	}
+}
+
+func (t *streamTap) close() {
+	t.lock.Lock()
+	t.broken = true
+	t.buf = nil
+	t.lock.Unlock()
+}
@@ -27,6 +27,12 @@ var (
 	ErrNoAssocDevice = fmt.Errorf("logic not associated with device")
 	// ErrInvalidDispatcher indicates dispatcher is unavailable
 	ErrInvalidDispatcher = fmt.Errorf("dispatcher not available")
+	// ErrMasterClosed indicates the invocation failed as the master is closed
+	ErrMasterClosed = fmt.Errorf("master closed")
+	// ErrAlreadyRunning indicates a component is started while running
+	ErrAlreadyRunning = fmt.Errorf("already running")
+	// ErrHandshakeTimeout indicates the attachment handshake timed out
+	ErrHandshakeTimeout = fmt.Errorf("handshake timed out")
 )
 
 // MsgReceiver provides a message chan for read
@@ -39,6 +45,14 @@ type MsgDispatcher interface {
 	DispatchMsg(*Msg) error
 }
 
+// MsgDispatcherFunc is func form of MsgDispatcher
+type MsgDispatcherFunc func(*Msg) error
+
+// DispatchMsg implements MsgDispatcher
+func (f MsgDispatcherFunc) DispatchMsg(msg *Msg) error {
+	return f(msg)
+}
+
 // MsgRouter is able to route a message
 type MsgRouter interface {
 	RouteMsg(*Msg) error
@@ -99,3 +113,9 @@ type Event interface {
 type EventHandler interface {
 	HandleEvent(Event, EventSubscription)
 }
+
+// EventCloseHandler is optionally implemented by EventHandler to be notified
+// when the subscription is closed by the Master, e.g. the Master is closed
+type EventCloseHandler interface {
+	HandleClose(EventSubscription)
+}
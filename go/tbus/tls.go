@@ -0,0 +1,100 @@
+package tbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// AuthMethodTLS is the method of AuthIdentity verified by client certificate
+const AuthMethodTLS = "tls"
+
+// TLSListener wraps listener to accept TLS connections
+func TLSListener(listener net.Listener, config *tls.Config) *NetListenerWrapper {
+	return NetListener(tls.NewListener(listener, config))
+}
+
+// ListenTLS listens on the address and accepts TLS connections
+func ListenTLS(network, address string, config *tls.Config) (*NetListenerWrapper, error) {
+	listener, err := tls.Listen(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NetListener(listener), nil
+}
+
+// TLSDialer creates a Dialer connecting with TLS, the handshake is
+// completed in Dial
+func TLSDialer(network, address string, config *tls.Config) Dialer {
+	return DialerFunc(func() (io.ReadWriteCloser, error) {
+		conn, err := tls.Dial(network, address, config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// ServerTLSConfig creates a server side config, client certificates are
+// required and verified against clientCAs if it's not nil (mutual TLS)
+func ServerTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// ClientTLSConfig creates a client side config verifying server against
+// rootCAs (system roots if nil), cert is presented for mutual TLS if not nil
+func ClientTLSConfig(cert *tls.Certificate, rootCAs *x509.CertPool, serverName string) *tls.Config {
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
+
+// LoadCertPool loads PEM encoded certificates from a file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// PeerCertificate returns the verified certificate of the peer if the
+// connection is TLS, it performs the handshake if not done yet
+func PeerCertificate(conn interface{}) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(interface {
+		Handshake() error
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	return state.VerifiedChains[0][0], nil
+}
@@ -0,0 +1,124 @@
+package tbus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA() *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+func (ca *testCA) issue(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	return cert, key
+}
+
+func (ca *testCA) leaf(cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	cert, key := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func TestTLS(t *testing.T) {
+	Convey("TLS", t, func() {
+		ca := newTestCA()
+		serverCert := ca.leaf("bus", x509.ExtKeyUsageServerAuth)
+		clientCert := ca.leaf("arm", x509.ExtKeyUsageClientAuth)
+
+		listener, err := ListenTLS("tcp", "127.0.0.1:0", ServerTLSConfig(serverCert, ca.pool()))
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		addr := listener.Listener.Addr().String()
+		host := NewRemoteDeviceHost(listener)
+		var identity AuthIdentity
+		host.Authorizer = func(id *AuthIdentity, info *DeviceInfo) error {
+			identity = *id
+			info.AddLabel("identity", id.Name)
+			return nil
+		}
+		go host.Run()
+
+		Convey("mutual", func() {
+			port := NewRemoteBusPort(NewLEDDev(&testLED{}),
+				TLSDialer("tcp", addr, ClientTLSConfig(&clientCert, ca.pool(), "")))
+			defer port.Close(context.Background())
+			go port.Run()
+			dev := <-host.AcceptChan()
+			defer dev.Close(context.Background())
+			So(identity.Method, ShouldEqual, AuthMethodTLS)
+			So(identity.Name, ShouldEqual, "arm")
+			So(identity.Certificate, ShouldNotBeNil)
+			So(dev.DeviceInfo().Labels["identity"], ShouldEqual, "arm")
+
+			bus := NewLocalBus()
+			So(bus.Plug(dev), ShouldBeNil)
+			go dev.Run()
+			master := NewLocalMaster(NewBusDev(bus))
+			So(NewLEDCtl(master).SetAddress(DeviceAddress(dev)).On().Wait(), ShouldBeNil)
+		})
+
+		Convey("client certificate required", func() {
+			dialer := TLSDialer("tcp", addr, ClientTLSConfig(nil, ca.pool(), ""))
+			conn, err := dialer.Dial()
+			if err == nil {
+				// TLS 1.3 reports client certificate failure on first read
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("untrusted server", func() {
+			_, err := TLSDialer("tcp", addr, ClientTLSConfig(&clientCert, newTestCA().pool(), "")).Dial()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
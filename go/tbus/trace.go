@@ -0,0 +1,271 @@
+package tbus
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceIDSize is the size of TraceID in bytes
+	TraceIDSize = 16
+	// SpanIDSize is the size of SpanID in bytes
+	SpanIDSize = 8
+	// TraceContextSize is the size of encoded TraceContext in message head
+	TraceContextSize = TraceIDSize + SpanIDSize
+)
+
+// TraceID identifies a trace across buses
+type TraceID [TraceIDSize]byte
+
+// IsValid indicates the ID is not all zero
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// String formats the ID in hex
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span in a trace
+type SpanID [SpanIDSize]byte
+
+// IsValid indicates the ID is not all zero
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// String formats the ID in hex
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// TraceContext is carried in message head to correlate a message
+// with the span which sent it
+type TraceContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid indicates both trace ID and span ID are present
+func (c TraceContext) IsValid() bool {
+	return c.TraceID.IsValid() && c.SpanID.IsValid()
+}
+
+// String formats the context as TRACEID-SPANID
+func (c TraceContext) String() string {
+	return c.TraceID.String() + "-" + c.SpanID.String()
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a context carrying the trace context
+func ContextWithTrace(ctx context.Context, trace TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, trace)
+}
+
+// TraceFromContext extracts the trace context, ok is false if absent
+func TraceFromContext(ctx context.Context) (trace TraceContext, ok bool) {
+	if ctx != nil {
+		trace, ok = ctx.Value(traceContextKey{}).(TraceContext)
+	}
+	return
+}
+
+// Span is a timed operation in a trace
+type Span struct {
+	Name   string
+	Trace  TraceContext
+	Parent SpanID
+	Start  time.Time
+	End    time.Time
+	// Labels are name/value pairs
+	Labels []string
+	Err    error
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+// SetLabel appends a label to the span
+func (s *Span) SetLabel(name, value string) *Span {
+	s.Labels = append(s.Labels, name, value)
+	return s
+}
+
+// Finish ends the span and exports it, only the first call takes effect
+func (s *Span) Finish(err error) {
+	s.once.Do(func() {
+		s.End = s.tracer.clock().Now()
+		s.Err = err
+		if s.tracer.Exporter != nil {
+			s.tracer.Exporter.ExportSpan(s)
+		}
+	})
+}
+
+// Duration returns the duration of a finished span
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// String formats the span in a single line
+func (s *Span) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "trace=%s span=%s", s.Trace.TraceID, s.Trace.SpanID)
+	if s.Parent.IsValid() {
+		fmt.Fprintf(&buf, " parent=%s", s.Parent)
+	}
+	fmt.Fprintf(&buf, " name=%s duration=%s", s.Name, s.Duration())
+	for n := 0; n+1 < len(s.Labels); n += 2 {
+		fmt.Fprintf(&buf, " %s=%q", s.Labels[n], s.Labels[n+1])
+	}
+	if s.Err != nil {
+		fmt.Fprintf(&buf, " error=%q", s.Err.Error())
+	}
+	return buf.String()
+}
+
+// SpanExporter receives finished spans
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+// SpanExporterFunc is func implementation of SpanExporter
+type SpanExporterFunc func(*Span)
+
+// ExportSpan implements SpanExporter
+func (f SpanExporterFunc) ExportSpan(span *Span) {
+	f(span)
+}
+
+// MemoryExporter keeps finished spans in memory
+type MemoryExporter struct {
+	spans []*Span
+	lock  sync.Mutex
+}
+
+// ExportSpan implements SpanExporter
+func (e *MemoryExporter) ExportSpan(span *Span) {
+	e.lock.Lock()
+	e.spans = append(e.spans, span)
+	e.lock.Unlock()
+}
+
+// Spans returns exported spans in the order of finishing
+func (e *MemoryExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset removes all exported spans
+func (e *MemoryExporter) Reset() {
+	e.lock.Lock()
+	e.spans = nil
+	e.lock.Unlock()
+}
+
+// WriterExporter writes each finished span as a line
+type WriterExporter struct {
+	Writer io.Writer
+	lock   sync.Mutex
+}
+
+// NewWriterExporter creates a WriterExporter, e.g. on os.Stdout
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{Writer: w}
+}
+
+// ExportSpan implements SpanExporter
+func (e *WriterExporter) ExportSpan(span *Span) {
+	e.lock.Lock()
+	fmt.Fprintln(e.Writer, span.String())
+	e.lock.Unlock()
+}
+
+// Tracer creates spans and exports them when finished
+type Tracer struct {
+	Exporter SpanExporter
+	Clock    Clock
+}
+
+// NewTracer creates a Tracer
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter, Clock: SystemClock}
+}
+
+// StartSpan starts a span, it's a child span if parent is valid,
+// otherwise it starts a new trace
+func (t *Tracer) StartSpan(name string, parent TraceContext, labels ...string) *Span {
+	span := &Span{Name: name, Labels: labels, tracer: t}
+	if parent.IsValid() {
+		span.Trace.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+	} else {
+		randomID(span.Trace.TraceID[:])
+	}
+	randomID(span.Trace.SpanID[:])
+	span.Start = t.clock().Now()
+	return span
+}
+
+func (t *Tracer) clock() Clock {
+	return ClockOrSystem(t.Clock)
+}
+
+func randomID(id []byte) {
+	for {
+		if _, err := rand.Read(id); err != nil {
+			panic(err)
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
+
+var (
+	tracer     *Tracer
+	tracerLock sync.RWMutex
+)
+
+// SetTracer sets the Tracer used by master and devices, nil disables tracing
+func SetTracer(t *Tracer) {
+	tracerLock.Lock()
+	tracer = t
+	tracerLock.Unlock()
+}
+
+// CurrentTracer returns the Tracer in use, nil if tracing is disabled
+func CurrentTracer() *Tracer {
+	tracerLock.RLock()
+	defer tracerLock.RUnlock()
+	return tracer
+}
+
+// startCallSpan starts the span of a device call if the message is traced
+// and returns the context for device logic
+func startCallSpan(call *DeviceCall) (context.Context, *Span) {
+	ctx := context.Background()
+	if call.Msg == nil || !call.Msg.Head.Trace.IsValid() {
+		return ctx, nil
+	}
+	trace := call.Msg.Head.Trace
+	var span *Span
+	if t := CurrentTracer(); t != nil {
+		span = t.StartSpan(call.MethodName(), trace, "side", "device",
+			"address", strconv.Itoa(int(call.Device.DeviceInfo().Address)))
+		trace = span.Trace
+	}
+	return ContextWithTrace(ctx, trace), span
+}
@@ -0,0 +1,117 @@
+package tbus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type tracedLED struct {
+	testLED
+	traces chan TraceContext
+}
+
+func (d *tracedLED) SetPowerStateContext(ctx context.Context, param *LEDPowerState) error {
+	trace, _ := TraceFromContext(ctx)
+	d.traces <- trace
+	return d.SetPowerState(param)
+}
+
+func TestTrace(t *testing.T) {
+	Convey("Trace", t, func() {
+		Convey("encode in head", func() {
+			trace := TraceContext{TraceID: TraceID{1, 2, 3}, SpanID: SpanID{4, 5}}
+			var buf bytes.Buffer
+			msg := BuildMsg().RouteTo(RouteWith(1, 2)).MsgIDVarInt(3).Trace(trace).
+				EncodeBody(1, &LEDPowerState{On: true}).Build()
+			So(msg.EncodeTo(&buf), ShouldBeNil)
+			So(msg.Head.Flag&TraceMask, ShouldEqual, TraceMask)
+			decoded, err := Decode(&buf)
+			So(err, ShouldBeNil)
+			So(decoded.Head.Trace, ShouldResemble, trace)
+			So(decoded.Head.Addrs, ShouldResemble, RouteWith(1, 2))
+			state := &LEDPowerState{}
+			So(decoded.Body.Decode(state), ShouldBeNil)
+			So(state.On, ShouldBeTrue)
+
+			buf.Reset()
+			msg = BuildMsg().MsgIDVarInt(3).EncodeBody(1, nil).Build()
+			So(msg.EncodeTo(&buf), ShouldBeNil)
+			So(buf.Bytes()[0]&TraceMask, ShouldEqual, 0)
+			decoded, err = Decode(&buf)
+			So(err, ShouldBeNil)
+			So(decoded.Head.Trace.IsValid(), ShouldBeFalse)
+		})
+
+		Convey("span", func() {
+			exporter := &MemoryExporter{}
+			tracer := NewTracer(exporter)
+			root := tracer.StartSpan("root", TraceContext{})
+			So(root.Trace.IsValid(), ShouldBeTrue)
+			So(root.Parent.IsValid(), ShouldBeFalse)
+			child := tracer.StartSpan("child", root.Trace, "k", "v")
+			So(child.Trace.TraceID, ShouldEqual, root.Trace.TraceID)
+			So(child.Parent, ShouldEqual, root.Trace.SpanID)
+			So(child.Trace.SpanID, ShouldNotEqual, root.Trace.SpanID)
+			child.Finish(ErrInvalidMethod)
+			child.Finish(nil)
+			So(exporter.Spans(), ShouldHaveLength, 1)
+			So(exporter.Spans()[0].Err, ShouldEqual, ErrInvalidMethod)
+
+			var out bytes.Buffer
+			tracer.Exporter = NewWriterExporter(&out)
+			root.Finish(nil)
+			So(out.String(), ShouldStartWith, "trace="+root.Trace.TraceID.String()+" span="+root.Trace.SpanID.String()+" name=root")
+			So(out.String(), ShouldEndWith, "\n")
+		})
+
+		Convey("propagate across buses", func() {
+			exporter := &MemoryExporter{}
+			SetTracer(NewTracer(exporter))
+			defer SetTracer(nil)
+
+			remoteBus := NewLocalBus()
+			logic := &tracedLED{traces: make(chan TraceContext, 1)}
+			led := NewLEDDev(logic)
+			remoteBus.Plug(led)
+			hostConn, portConn := net.Pipe()
+			port := NewRemoteBusPort(NewBusDev(remoteBus), DialerFunc(func() (io.ReadWriteCloser, error) {
+				return portConn, nil
+			}))
+			go port.Run()
+			remote, err := AcceptRemoteDevice(hostConn)
+			So(err, ShouldBeNil)
+			bus := NewLocalBus()
+			So(bus.Plug(remote), ShouldBeNil)
+			go remote.Run()
+			defer remote.Close(context.Background())
+			master := NewLocalMaster(NewBusDev(bus))
+			addrs := DeviceAddress(remote, led)
+			So(NewLEDCtl(master).SetAddress(addrs).On().Wait(), ShouldBeNil)
+			So(logic.on, ShouldBeTrue)
+			trace := <-logic.traces
+
+			spans := exporter.Spans()
+			So(spans, ShouldHaveLength, 2)
+			devSpan, masterSpan := spans[0], spans[1]
+			So(masterSpan.Name, ShouldEqual, "LED.SetPowerState")
+			So(masterSpan.Parent.IsValid(), ShouldBeFalse)
+			So(devSpan.Name, ShouldEqual, "LED.SetPowerState")
+			So(devSpan.Trace.TraceID, ShouldEqual, masterSpan.Trace.TraceID)
+			So(devSpan.Parent, ShouldEqual, masterSpan.Trace.SpanID)
+			So(trace, ShouldResemble, devSpan.Trace)
+		})
+
+		Convey("disabled", func() {
+			logic := &tracedLED{traces: make(chan TraceContext, 1)}
+			master := NewLocalMaster(NewLEDDev(logic))
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+			trace := <-logic.traces
+			So(trace.IsValid(), ShouldBeFalse)
+		})
+	})
+}
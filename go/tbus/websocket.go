@@ -0,0 +1,494 @@
+package tbus
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WSSubprotocol is the WebSocket subprotocol negotiated if requested
+const WSSubprotocol = "tbus"
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsFinBit  = 0x80
+	wsMaskBit = 0x80
+
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+)
+
+var (
+	// ErrWSHandshake indicates the WebSocket upgrade failed
+	ErrWSHandshake = fmt.Errorf("websocket handshake failed")
+	// ErrWSProtocol indicates a malformed or unexpected frame
+	ErrWSProtocol = fmt.Errorf("websocket protocol error")
+)
+
+// WSKeepalive configures ping/pong keepalive, the connection is closed if
+// nothing is received within Interval + Timeout after a ping
+type WSKeepalive struct {
+	// Interval between pings, zero disables keepalive
+	Interval time.Duration
+	Timeout  time.Duration
+	// Clock drives pings and the timeout, SystemClock if nil
+	Clock Clock
+}
+
+// WSConn is a WebSocket connection carrying tbus messages in binary frames,
+// each Write is sent as one frame and frames are read as a byte stream
+type WSConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool
+
+	keepalive WSKeepalive
+	received  time.Time
+	recvLock  sync.Mutex
+
+	// current data frame being read
+	remain  uint64
+	mask    [4]byte
+	masked  bool
+	maskPos int
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader, client bool, keepalive WSKeepalive) *WSConn {
+	c := &WSConn{
+		conn:   conn,
+		reader: reader,
+		client: client,
+		closed: make(chan struct{}),
+	}
+	if keepalive.Interval > 0 {
+		c.keepalive = keepalive
+		c.received = ClockOrSystem(keepalive.Clock).Now()
+		go c.ping()
+	}
+	return c
+}
+
+// RemoteAddr returns the remote address of underlying connection
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Read implements io.Reader, control frames are handled internally
+func (c *WSConn) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.reader.Read(p)
+	c.unmask(p[:n])
+	c.remain -= uint64(n)
+	return n, err
+}
+
+// Write implements io.Writer, p is sent in a single binary frame
+func (c *WSConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the connection
+func (c *WSConn) Close() error {
+	return c.close(wsCloseNormal)
+}
+
+func (c *WSConn) close(code uint16) (err error) {
+	err = io.ErrClosedPipe
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, code)
+		c.writeFrame(wsOpClose, payload)
+		err = c.conn.Close()
+	})
+	return
+}
+
+// ping sends pings every Interval and closes the connection if nothing is
+// received within Interval + Timeout
+func (c *WSConn) ping() {
+	clock := ClockOrSystem(c.keepalive.Clock)
+	limit := c.keepalive.Interval + c.keepalive.Timeout
+	nextPing := clock.Now().Add(c.keepalive.Interval)
+	for {
+		now := clock.Now()
+		wait := nextPing.Sub(now)
+		if expire := c.lastReceived().Add(limit).Sub(now); expire < wait {
+			wait = expire
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-clock.After(wait):
+		}
+		now = clock.Now()
+		if !now.Before(c.lastReceived().Add(limit)) {
+			c.close(wsCloseNormal)
+			return
+		}
+		if !now.Before(nextPing) {
+			if c.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+			nextPing = now.Add(c.keepalive.Interval)
+		}
+	}
+}
+
+func (c *WSConn) lastReceived() time.Time {
+	c.recvLock.Lock()
+	defer c.recvLock.Unlock()
+	return c.received
+}
+
+// nextFrame reads frame headers until a data frame with payload
+func (c *WSConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return c.readErr(err)
+	}
+	if c.keepalive.Interval > 0 {
+		c.recvLock.Lock()
+		c.received = ClockOrSystem(c.keepalive.Clock).Now()
+		c.recvLock.Unlock()
+	}
+	opcode := head[0] & 0x0f
+	masked := (head[1] & wsMaskBit) != 0
+	if masked == c.client {
+		// client must mask and server must not
+		c.close(wsCloseProtocol)
+		return ErrWSProtocol
+	}
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return c.readErr(err)
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return c.readErr(err)
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	c.masked, c.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return c.readErr(err)
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		c.remain = size
+		return nil
+	case wsOpPing, wsOpPong, wsOpClose:
+		if size > 125 || (head[0]&wsFinBit) == 0 {
+			c.close(wsCloseProtocol)
+			return ErrWSProtocol
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return c.readErr(err)
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.close(wsCloseNormal)
+			return io.EOF
+		}
+		return nil
+	}
+	c.close(wsCloseProtocol)
+	return ErrWSProtocol
+}
+
+func (c *WSConn) readErr(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *WSConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for n := range p {
+		p[n] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *WSConn) writeFrame(opcode uint8, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, wsFinBit|opcode)
+	maskBit := uint8(0)
+	if c.client {
+		maskBit = wsMaskBit
+	}
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskBit|uint8(size))
+	case size <= 0xffff:
+		frame = append(frame, maskBit|126, uint8(size>>8), uint8(size))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for n, b := range payload {
+			frame = append(frame, b^mask[n&3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, val := range h[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WSListener is an http.Handler accepting WebSocket connections,
+// it implements Listener for RemoteDeviceHost or ListenerDialer
+type WSListener struct {
+	// CheckOrigin accepts or rejects the request by Origin header,
+	// if nil, requests without Origin or of the same host are accepted
+	CheckOrigin func(r *http.Request) bool
+	Keepalive   WSKeepalive
+
+	acceptCh  chan *WSConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWSListener creates a WSListener
+func NewWSListener() *WSListener {
+	return &WSListener{
+		acceptCh: make(chan *WSConn),
+		closed:   make(chan struct{}),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (l *WSListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	checkOrigin := l.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", WSSubprotocol) {
+		resp += "Sec-WebSocket-Protocol: " + WSSubprotocol + "\r\n"
+	}
+	if _, err = io.WriteString(conn, resp+"\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	// the http server no longer manages deadlines of hijacked conn
+	conn.SetDeadline(time.Time{})
+	wsConn := newWSConn(conn, rw.Reader, false, l.Keepalive)
+	select {
+	case l.acceptCh <- wsConn:
+	case <-l.closed:
+		wsConn.Close()
+	}
+}
+
+// Accept implements Listener
+func (l *WSListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// Close implements Listener, it doesn't close accepted connections
+func (l *WSListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// SameOrigin accepts requests without Origin header or from the same host
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// WSDialer connects to a WSListener, URL is ws://host:port/path
+// or wss://host:port/path
+type WSDialer struct {
+	URL       string
+	Origin    string
+	Header    http.Header
+	TLSConfig *tls.Config
+	Keepalive WSKeepalive
+}
+
+// Dial implements Dialer
+func (d *WSDialer) Dial() (io.ReadWriteCloser, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", hostWithPort(u.Host, "80"))
+	case "wss":
+		conn, err = tls.Dial("tcp", hostWithPort(u.Host, "443"), d.TLSConfig)
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wsConn, err := d.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+// hostWithPort appends the default port if host doesn't specify one
+func hostWithPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+func (d *WSDialer) handshake(conn net.Conn, u *url.URL) (*WSConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, vals := range d.Header {
+		req.Header[name] = vals
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", WSSubprotocol)
+	if d.Origin != "" {
+		req.Header.Set("Origin", d.Origin)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %s", ErrWSHandshake, resp.Status)
+	}
+	return newWSConn(conn, reader, true, d.Keepalive), nil
+}
@@ -0,0 +1,152 @@
+package tbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebSocket(t *testing.T) {
+	Convey("WebSocket", t, func() {
+		listener := NewWSListener()
+		server := httptest.NewServer(listener)
+		defer server.Close()
+		defer listener.Close()
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		Convey("remote device", func() {
+			host := NewRemoteDeviceHost(listener)
+			go host.Run()
+			logic := &testLED{}
+			port := NewRemoteBusPort(NewLEDDev(logic), &WSDialer{URL: wsURL})
+			go port.Run()
+			dev := <-host.AcceptChan()
+			defer dev.Close(context.Background())
+			master := NewLocalMaster(dev)
+			go dev.Run()
+			So(NewLEDCtl(master).On().Wait(), ShouldBeNil)
+			So(logic.on, ShouldBeTrue)
+		})
+
+		Convey("large frames", func() {
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					io.Copy(conn, conn)
+				}
+			}()
+			conn, err := (&WSDialer{URL: wsURL}).Dial()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			for _, size := range []int{1, 125, 126, 70000} {
+				data := bytes.Repeat([]byte{byte(size)}, size)
+				_, err = conn.Write(data)
+				So(err, ShouldBeNil)
+				echo := make([]byte, size)
+				_, err = io.ReadFull(conn, echo)
+				So(err, ShouldBeNil)
+				So(echo, ShouldResemble, data)
+			}
+		})
+
+		Convey("default port", func() {
+			So(hostWithPort("example.com", "80"), ShouldEqual, "example.com:80")
+			So(hostWithPort("example.com:8080", "80"), ShouldEqual, "example.com:8080")
+			So(hostWithPort("[::1]", "443"), ShouldEqual, "[::1]:443")
+			So(hostWithPort("[::1]:9000", "443"), ShouldEqual, "[::1]:9000")
+		})
+
+		Convey("origin", func() {
+			_, err := (&WSDialer{URL: wsURL, Origin: "http://evil.example"}).Dial()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "403")
+
+			listener.CheckOrigin = func(r *http.Request) bool {
+				return r.Header.Get("Origin") == "http://app.example"
+			}
+			go listener.Accept()
+			conn, err := (&WSDialer{URL: wsURL, Origin: "http://app.example"}).Dial()
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Convey("not upgrade", func() {
+			resp, err := http.Get(server.URL)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("keepalive", func() {
+			listener.Keepalive = WSKeepalive{Interval: 20 * time.Millisecond, Timeout: 30 * time.Millisecond}
+			accepted := make(chan io.ReadWriteCloser, 1)
+			go func() {
+				conn, _ := listener.Accept()
+				accepted <- conn
+			}()
+
+			// client keeps reading, so pings are answered
+			alive, err := (&WSDialer{URL: wsURL}).Dial()
+			So(err, ShouldBeNil)
+			go io.Copy(ioutil.Discard, alive)
+			serverConn := <-accepted
+			readErr := make(chan error, 1)
+			go func() {
+				_, err := serverConn.Read(make([]byte, 1))
+				readErr <- err
+			}()
+			select {
+			case err = <-readErr:
+			case <-time.After(200 * time.Millisecond):
+				err = nil
+			}
+			So(err, ShouldBeNil)
+			alive.Close()
+			So(<-readErr, ShouldNotBeNil)
+
+			// client never reads, so pings are not answered
+			go func() {
+				conn, _ := listener.Accept()
+				accepted <- conn
+			}()
+			dead, err := (&WSDialer{URL: wsURL}).Dial()
+			So(err, ShouldBeNil)
+			defer dead.Close()
+			serverConn = <-accepted
+			start := time.Now()
+			_, err = serverConn.Read(make([]byte, 1))
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("keepalive clock", func() {
+			clock := NewFakeClock(time.Now())
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := newWSConn(local, bufio.NewReader(local), false,
+				WSKeepalive{Interval: time.Second, Timeout: time.Second, Clock: clock})
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+			head := make([]byte, 2)
+			_, err := io.ReadFull(remote, head)
+			So(err, ShouldBeNil)
+			So(head[0]&0x0f, ShouldEqual, wsOpPing)
+			// the ping is not answered, so the connection is closed after Timeout
+			go io.Copy(ioutil.Discard, remote)
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+			_, err = conn.Read(make([]byte, 1))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
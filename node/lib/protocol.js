@@ -11,6 +11,10 @@ var PFX_ROUTING_MASK = 0xe0,
 var FORMAT_MASK = 0xf0,
     FORMAT = 0x10;      // rev 1, protobuf encoded
 
+var HF_TRACE = 0x02,    // head contains trace context
+    TRACE_ID_BYTES = 16,
+    SPAN_ID_BYTES = 8;
+
 var BF_ERROR = 0x80;    // body contains error
 
 var EVT_ROUTE = 'route',
@@ -189,6 +193,7 @@ var Decoder = Class(StreamDecoder, {
         delete this._msgIdBytes;
         delete this._bodyBytes;
         delete this._msgId;
+        delete this._trace;
         delete this._body;
         this._headBytes = 0;
         this._head = this._prefix.slice(0);
@@ -233,12 +238,7 @@ var Decoder = Class(StreamDecoder, {
             if (this._msgIdBytes > 0) {
                 this.transit('MsgId');
             } else {
-                this._report(EVT_HEAD);
-                if (this._bodyBytes > 0) {
-                    this.transit('Body');
-                } else {
-                    this.reset();
-                }
+                this._headDone();
             }
         }
     },
@@ -251,12 +251,35 @@ var Decoder = Class(StreamDecoder, {
         if (this.recvBytes()) {
             this._msgId = Array.from(this._recv);
             this._head = this._head.concat(this._msgId);
-            this._report(EVT_HEAD);
-            if (this._bodyBytes > 0) {
-                this.transit('Body');
-            } else {
-                this.reset();
-            }
+            this._headDone();
+        }
+    },
+
+    _enterTrace: function () {
+        this.startRecv(TRACE_ID_BYTES + SPAN_ID_BYTES);
+    },
+
+    _parseTrace: function () {
+        if (this.recvBytes()) {
+            this._trace = {
+                traceId: this._recv.slice(0, TRACE_ID_BYTES),
+                spanId: this._recv.slice(TRACE_ID_BYTES)
+            };
+            this._head = this._head.concat(Array.from(this._recv));
+            this._headDone();
+        }
+    },
+
+    _headDone: function () {
+        if ((this._flag & HF_TRACE) != 0 && this._trace == null) {
+            this.transit('Trace');
+            return;
+        }
+        this._report(EVT_HEAD);
+        if (this._bodyBytes > 0) {
+            this.transit('Body');
+        } else {
+            this.reset();
         }
     },
 
@@ -282,6 +305,9 @@ var Decoder = Class(StreamDecoder, {
             },
             body: {}
         };
+        if (this._trace != null) {
+            msg.head.trace = this._trace;
+        }
         if (this._prefix.length > 0) {
             msg.head.prefix = this._prefix[0];
             msg.head.addrs = this._prefix.slice(1);
@@ -400,6 +426,22 @@ var Encoder = Class({
         return this.body(buf);
     },
 
+    trace: function (traceId, spanId) {
+        if (traceId != null && spanId != null) {
+            traceId = new Buffer(traceId);
+            spanId = new Buffer(spanId);
+            if (traceId.length != TRACE_ID_BYTES || spanId.length != SPAN_ID_BYTES) {
+                throw new Error("invalid trace context");
+            }
+            this._trace = {traceId: traceId, spanId: spanId};
+            this._flag |= HF_TRACE;
+        } else {
+            delete(this._trace);
+            this._flag &= ~HF_TRACE;
+        }
+        return this;
+    },
+
     route: function (addrs) {
         if (Array.isArray(addrs) && addrs.length > 0) {
             this._addrs = addrs;
@@ -433,6 +475,10 @@ var Encoder = Class({
         encode7Bit(head, msg.head.bodyBytes);
         headBytes += head.length;
         headBytes += msgIdBytes;
+        if (this._trace) {
+            msg.head.trace = this._trace;
+            headBytes += TRACE_ID_BYTES + SPAN_ID_BYTES;
+        }
 
         msg.head.raw = new Buffer(headBytes);
         var off = 0;
@@ -450,6 +496,10 @@ var Encoder = Class({
                 msg.head.raw.writeUInt8(msg.head.msgId[i], off++);
             }
         }
+        if (msg.head.trace) {
+            off += msg.head.trace.traceId.copy(msg.head.raw, off);
+            off += msg.head.trace.spanId.copy(msg.head.raw, off);
+        }
         if (msg.head.addrs) {
             msg.head.rawPrefix = msg.head.raw.slice(0, msg.head.addrs.length + 1);
             msg.head.rawHead = msg.head.raw.slice(msg.head.addrs.length + 1);
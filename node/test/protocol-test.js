@@ -96,4 +96,51 @@ describe('Protocol', function () {
             done(err);
         });
     });
+
+    it('decode stream with trace', function (done) {
+        var traceId = [], spanId = [];
+        for (var i = 0; i < 16; i ++) {
+            traceId.push(i + 1);
+        }
+        for (var i = 0; i < 8; i ++) {
+            spanId.push(0xa0 + i);
+        }
+        var encoded = new protocol.Encoder()
+            .messageId(1)
+            .encodeBody(20, Uint8Array.from([1, 2]))
+            .trace(traceId, spanId)
+            .buildMsg();
+        expect(encoded.head.flag).to.equal(0x12);
+        expect(encoded.head.raw).to.have.lengthOf(28);
+        expect(encoded.head.raw[4]).to.eql(1);
+        expect(encoded.head.raw[27]).to.eql(0xa7);
+        var buf = Buffer.concat([encoded.head.raw, encoded.body.raw]);
+
+        var s = new protocol.DecodeStream();
+        var collected = []
+        s.on(protocol.EVT_MSG, function (msg) {
+            collected.push(msg);
+        });
+        // feed byte by byte to cross state boundaries
+        var writeFrom = function (off) {
+            if (off < buf.length) {
+                s.write(buf.slice(off, off + 1), null, function () {
+                    writeFrom(off + 1);
+                });
+                return;
+            }
+            setImmediate(function () {
+                expect(collected).to.have.lengthOf(1);
+                var msg = collected[0];
+                expect(msg.head.flag).to.equal(0x12);
+                expect(msg.head.msgId).to.eql([1]);
+                expect(Array.from(msg.head.trace.traceId)).to.eql(traceId);
+                expect(Array.from(msg.head.trace.spanId)).to.eql(spanId);
+                expect(msg.head.raw).to.eql(encoded.head.raw);
+                expect(Array.from(msg.body.data)).to.eql([1, 2]);
+                done();
+            });
+        };
+        writeFrom(0);
+    });
 });